@@ -2,19 +2,42 @@ package main
 
 import (
 	"context"
+	"flag"
 	"fmt"
+	"net"
+	"net/http"
 	"os"
+	"os/signal"
+	"syscall"
+	"time"
 
-	"github.com/aws/aws-sdk-go-v2/config"
+	awsconfig "github.com/aws/aws-sdk-go-v2/config"
 	"github.com/aws/aws-sdk-go-v2/service/ec2"
 	"go.uber.org/zap"
+	"google.golang.org/grpc"
 
 	"github.com/ansg191/remote-worker/api/proto"
+	"github.com/ansg191/remote-worker/internal/autoscale"
+	"github.com/ansg191/remote-worker/internal/budget"
 	"github.com/ansg191/remote-worker/internal/compute"
+	"github.com/ansg191/remote-worker/internal/config"
+	"github.com/ansg191/remote-worker/internal/cost"
+	"github.com/ansg191/remote-worker/internal/dashboard"
+	"github.com/ansg191/remote-worker/internal/manager"
+	"github.com/ansg191/remote-worker/internal/metrics"
+	"github.com/ansg191/remote-worker/internal/tracing"
+	"github.com/ansg191/remote-worker/internal/webhook"
 	"github.com/ansg191/remote-worker/internal/worker/aws"
 )
 
 func run() error {
+	configPath := flag.String("config", "", "path to the YAML configuration file")
+	flag.Parse()
+
+	conf, err := config.Load(*configPath)
+	if err != nil {
+		return err
+	}
 	logger, err := zap.NewDevelopment()
 	if err != nil {
 		return err
@@ -23,39 +46,185 @@ func run() error {
 		_ = logger.Sync()
 	}(logger)
 
-	cfg, err := config.LoadDefaultConfig(context.Background())
+	shutdownTracing, err := tracing.Setup(context.Background(), "remote-worker-manager", conf.Manager.TraceExporter)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err := shutdownTracing(context.Background()); err != nil {
+			logger.Error("error flushing traces", zap.Error(err))
+		}
+	}()
+
+	var awsOpts []func(*awsconfig.LoadOptions) error
+	if conf.Region != "" {
+		awsOpts = append(awsOpts, awsconfig.WithRegion(conf.Region))
+	}
+	cfg, err := awsconfig.LoadDefaultConfig(context.Background(), awsOpts...)
+	if err != nil {
+		return err
+	}
+
+	mx := metrics.New()
+	dash := dashboard.New(logger)
+	accountant := cost.New(logger, conf.Prices())
+	poolOpts := append(conf.PoolOptions(),
+		compute.WithPoolEventHandler(mx.HandlePoolEvent),
+		compute.WithPoolEventHandler(dash.HandlePoolEvent),
+		compute.WithPoolEventHandler(accountant.HandlePoolEvent))
+	managerOpts := []manager.OptionsFunc{
+		manager.WithAccountant(accountant),
+		manager.WithQueueOptions(conf.QueueOptions()...),
+		manager.WithQueueOptions(
+			compute.WithQueueEventHandler(mx.HandleQueueEvent),
+			compute.WithQueueEventHandler(dash.HandleQueueEvent)),
+	}
+	if conf.Manager.DataDir != "" {
+		journal, err := compute.OpenFileJournal(conf.Manager.DataDir)
+		if err != nil {
+			return err
+		}
+		defer func(journal compute.Journal) {
+			_ = journal.Close()
+		}(journal)
+
+		poolOpts = append(poolOpts, compute.WithPoolJournal(journal))
+		managerOpts = append(managerOpts, manager.WithJournal(journal))
+	}
+
+	var notifier *webhook.Notifier
+	if len(conf.Webhooks.Endpoints) > 0 {
+		hookOpts := conf.WebhookOptions()
+		if conf.Webhooks.DeadLetterFile != "" {
+			deadLetters, err := os.OpenFile(conf.Webhooks.DeadLetterFile, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o600)
+			if err != nil {
+				return err
+			}
+			defer func(f *os.File) {
+				_ = f.Close()
+			}(deadLetters)
+			hookOpts = append(hookOpts, webhook.WithDeadLetterLog(deadLetters))
+		}
+
+		notifier = webhook.New(logger, conf.WebhookEndpoints(), hookOpts...)
+		managerOpts = append(managerOpts, manager.WithJobEventHandler(notifier.HandleJobEvent))
+	}
+
+	var scaler *autoscale.Controller
+	if autoscaler := conf.Autoscaler(); autoscaler != nil {
+		scaler = autoscale.New(logger, autoscaler, conf.AutoscaleOptions()...)
+		poolOpts = append(poolOpts, compute.WithPoolEventHandler(scaler.HandlePoolEvent))
+		managerOpts = append(managerOpts, manager.WithQueueOptions(compute.WithQueueEventHandler(scaler.HandleQueueEvent)))
+	}
+
+	var guard *budget.Guard
+	if limits := conf.BudgetLimits(); len(limits) > 0 {
+		guard = budget.New(logger, accountant, limits, conf.BudgetOptions()...)
+		defer func(guard *budget.Guard) {
+			_ = guard.Close()
+		}(guard)
+
+		managerOpts = append(managerOpts, manager.WithGuard(guard))
+	}
+
+	ec2Client := ec2.NewFromConfig(cfg)
+	factories, err := conf.NamedFactories(logger, func(params *ec2.RunInstancesInput) compute.WorkerFactory {
+		var factory compute.WorkerFactory = aws.NewWorkerFactory(logger, ec2Client, params, conf.Worker.Port)
+		if guard != nil {
+			factory = guard.Factory(factory)
+		}
+		return factory
+	})
 	if err != nil {
 		return err
 	}
 
-	pool := compute.NewPool(logger, aws.NewWorkerFactory(logger, ec2.NewFromConfig(cfg), aws.DefaultInstanceParams, 443))
-	defer func(pool compute.Pool) {
-		_ = pool.Close()
-	}(pool)
+	// Shutting down the manager closes the pool, terminating all instances
+	pool := compute.NewMultiPool(logger, factories, poolOpts...)
+	mgr := manager.New(logger, pool, conf.Queue.MaxSize, managerOpts...)
+	mx.Observe(pool, mgr.Queue())
+	if scaler != nil {
+		scaler.Start(pool, mgr.Queue())
+	}
 
-	queue := compute.NewQueue(logger, pool, 2)
+	if conf.Manager.MetricsAddr != "" {
+		mux := http.NewServeMux()
+		mux.Handle("/metrics", mx.Handler())
+		defer serveHTTP(logger, "metrics", conf.Manager.MetricsAddr, mux)()
+	}
+	if conf.Manager.DashboardAddr != "" {
+		defer serveHTTP(logger, "dashboard", conf.Manager.DashboardAddr, dash.Handler(mgr))()
+	}
 
-	info := compute.NewWorkInfo(
-		context.Background(),
-		nil,
-		func(ctx context.Context, logger *zap.Logger, req any, worker compute.Worker) (string, error) {
-			res, err := worker.Worker().Status(ctx, &proto.WorkerStatusRequest{})
-			return res.Msg, err
-		},
-	)
+	lis, err := net.Listen("tcp", conf.Manager.Addr)
+	if err != nil {
+		return err
+	}
 
-	queue.Add(info)
+	grpcServer := grpc.NewServer(tracing.ServerOptions()...)
+	proto.RegisterManagerServiceServer(grpcServer, mgr)
 
-	queue.Wait()
+	serveErr := make(chan error, 1)
+	go func() {
+		serveErr <- grpcServer.Serve(lis)
+	}()
+	logger.Info("Manager running", zap.String("addr", conf.Manager.Addr))
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
 
 	select {
-	case result := <-info.Result:
-		fmt.Println(result)
-	case err = <-info.Err:
-		fmt.Println(err)
+	case <-ctx.Done():
+		logger.Info("Signal received, draining jobs")
+	case err = <-serveErr:
+		logger.Error("grpc server failure", zap.Error(err))
+	}
+	// A second signal kills the manager immediately
+	stop()
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), time.Duration(conf.Manager.ShutdownTimeout))
+	defer cancel()
+
+	// The drained queue is not scaled anymore
+	if scaler != nil {
+		_ = scaler.Close()
+	}
+
+	// Running jobs are drained while the API keeps serving, so they can still
+	// be watched. Jobs still running at the timeout are aborted.
+	if err := mgr.Shutdown(shutdownCtx, compute.ShutdownDrain); err != nil {
+		logger.Error("error shutting down manager", zap.Error(err))
+	}
+	grpcServer.Stop()
+
+	if notifier != nil {
+		// Events of the drained jobs are delivered for at most one more
+		// delivery timeout
+		hookCtx, cancel := context.WithTimeout(context.Background(), time.Duration(conf.Webhooks.Timeout))
+		defer cancel()
+		if err := notifier.Close(hookCtx); err != nil {
+			logger.Error("error delivering webhooks", zap.Error(err))
+		}
 	}
 
-	return nil
+	return err
+}
+
+// serveHTTP serves handler on addr in the background and returns a function
+// closing the server
+func serveHTTP(logger *zap.Logger, name, addr string, handler http.Handler) func() {
+	srv := &http.Server{Addr: addr, Handler: handler, ReadHeaderTimeout: 10 * time.Second}
+
+	go func() {
+		if err := srv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			logger.Error("error serving "+name, zap.Error(err))
+		}
+	}()
+	logger.Info("Serving "+name, zap.String("addr", addr))
+
+	return func() {
+		_ = srv.Close()
+	}
 }
 
 func main() {
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"time"
+
+	"github.com/ansg191/remote-worker/api/proto"
+)
+
+func budgets(ctx context.Context, client proto.ManagerServiceClient, out *printer, args []string) error {
+	fs := flag.NewFlagSet("budgets", flag.ExitOnError)
+	_ = fs.Parse(args)
+
+	res, err := client.ListBudgets(ctx, &proto.ListBudgetsRequest{})
+	if err != nil {
+		return err
+	}
+	return out.budgets(res.Budgets)
+}
+
+func override(ctx context.Context, client proto.ManagerServiceClient, out *printer, args []string) error {
+	fs := flag.NewFlagSet("override", flag.ExitOnError)
+	duration := fs.Duration("for", time.Hour, "how long to ignore the hard limit. 0 ends the override")
+	_ = fs.Parse(args)
+	if fs.NArg() != 1 {
+		return errors.New("usage: override [-for duration] <budget>")
+	}
+
+	res, err := client.OverrideBudget(ctx, &proto.OverrideBudgetRequest{
+		Name:    fs.Arg(0),
+		Seconds: int64(duration.Seconds()),
+	})
+	if err != nil {
+		return err
+	}
+	return out.budgets([]*proto.Budget{res})
+}
+
+func reset(ctx context.Context, client proto.ManagerServiceClient, out *printer, args []string) error {
+	fs := flag.NewFlagSet("reset", flag.ExitOnError)
+	_ = fs.Parse(args)
+	if fs.NArg() != 1 {
+		return errors.New("usage: reset <batch budget>")
+	}
+
+	res, err := client.ResetBudget(ctx, &proto.ResetBudgetRequest{Name: fs.Arg(0)})
+	if err != nil {
+		return err
+	}
+	return out.budgets([]*proto.Budget{res})
+}
@@ -0,0 +1,20 @@
+package main
+
+import (
+	"context"
+	"flag"
+
+	"github.com/ansg191/remote-worker/api/proto"
+)
+
+func costs(ctx context.Context, client proto.ManagerServiceClient, out *printer, args []string) error {
+	fs := flag.NewFlagSet("costs", flag.ExitOnError)
+	tenant := fs.String("tenant", "", "only show the costs of tenant")
+	_ = fs.Parse(args)
+
+	res, err := client.GetCosts(ctx, &proto.GetCostsRequest{Tenant: *tenant})
+	if err != nil {
+		return err
+	}
+	return out.costs(res)
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"strings"
+
+	"github.com/ansg191/remote-worker/api/proto"
+)
+
+func get(ctx context.Context, client proto.ManagerServiceClient, out *printer, args []string) error {
+	fs := flag.NewFlagSet("get", flag.ExitOnError)
+	_ = fs.Parse(args)
+	if fs.NArg() == 0 {
+		return errors.New("usage: get <job id>...")
+	}
+
+	var jobs []*proto.JobInfo
+	for _, id := range fs.Args() {
+		job, err := client.GetJob(ctx, &proto.GetJobRequest{Id: id})
+		if err != nil {
+			return err
+		}
+		jobs = append(jobs, job)
+	}
+	return out.jobs(jobs)
+}
+
+func list(ctx context.Context, client proto.ManagerServiceClient, out *printer, args []string) error {
+	fs := flag.NewFlagSet("list", flag.ExitOnError)
+	states := fs.String("state", "", "comma separated states to list, e.g. queued,running")
+	tenant := fs.String("tenant", "", "only list jobs of tenant")
+	_ = fs.Parse(args)
+
+	req := &proto.ListJobsRequest{Tenant: *tenant}
+	if *states != "" {
+		for _, name := range strings.Split(*states, ",") {
+			state, ok := proto.JobInfo_State_value[strings.ToUpper(strings.TrimSpace(name))]
+			if !ok {
+				return fmt.Errorf("unknown state %q", name)
+			}
+			req.States = append(req.States, proto.JobInfo_State(state))
+		}
+	}
+
+	res, err := client.ListJobs(ctx, req)
+	if err != nil {
+		return err
+	}
+	return out.jobs(res.Jobs)
+}
+
+func cancel(ctx context.Context, client proto.ManagerServiceClient, out *printer, args []string) error {
+	fs := flag.NewFlagSet("cancel", flag.ExitOnError)
+	_ = fs.Parse(args)
+	if fs.NArg() == 0 {
+		return errors.New("usage: cancel <job id>...")
+	}
+
+	var canceled []string
+	for _, id := range fs.Args() {
+		if _, err := client.CancelJob(ctx, &proto.CancelJobRequest{Id: id}); err != nil {
+			_ = out.ids(canceled)
+			return fmt.Errorf("job %s: %w", id, err)
+		}
+		canceled = append(canceled, id)
+	}
+	return out.ids(canceled)
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"sort"
+	"syscall"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+
+	"github.com/ansg191/remote-worker/api/proto"
+)
+
+// command runs a subcommand with its arguments
+type command struct {
+	summary string
+	run     func(ctx context.Context, client proto.ManagerServiceClient, out *printer, args []string) error
+}
+
+var commands = map[string]command{
+	"submit":   {"Submit jobs from flags or a manifest", submit},
+	"get":      {"Show jobs", get},
+	"list":     {"List jobs", list},
+	"watch":    {"Watch the progress of a job", watch},
+	"cancel":   {"Cancel jobs", cancel},
+	"costs":    {"Show the costs of tenants", costs},
+	"budgets":  {"Show spend budgets", budgets},
+	"override": {"Ignore the hard limit of a budget for a while", override},
+	"reset":    {"Start a new window of a batch budget", reset},
+}
+
+func usage() {
+	out := flag.CommandLine.Output()
+	_, _ = fmt.Fprintf(out, "Usage: %s [flags] <command> [command flags]\n\nCommands:\n", os.Args[0])
+
+	names := make([]string, 0, len(commands))
+	for name := range commands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		_, _ = fmt.Fprintf(out, "  %-8s %s\n", name, commands[name].summary)
+	}
+
+	_, _ = fmt.Fprintf(out, "\nFlags:\n")
+	flag.PrintDefaults()
+}
+
+func run() error {
+	addr := flag.String("addr", envOr("RWCTL_ADDR", "localhost:8080"), "address of the manager. Defaults to $RWCTL_ADDR")
+	format := flag.String("o", formatTable, "output format: table or json")
+	flag.Usage = usage
+	flag.Parse()
+
+	if flag.NArg() < 1 {
+		usage()
+		os.Exit(2)
+	}
+	cmd, ok := commands[flag.Arg(0)]
+	if !ok {
+		return fmt.Errorf("unknown command %q", flag.Arg(0))
+	}
+
+	out, err := newPrinter(os.Stdout, *format)
+	if err != nil {
+		return err
+	}
+
+	conn, err := grpc.Dial(*addr, grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		return err
+	}
+	defer func(conn *grpc.ClientConn) {
+		_ = conn.Close()
+	}(conn)
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	return cmd.run(ctx, proto.NewManagerServiceClient(conn), out, flag.Args()[1:])
+}
+
+func envOr(key, fallback string) string {
+	if v, ok := os.LookupEnv(key); ok {
+		return v
+	}
+	return fallback
+}
+
+func main() {
+	if err := run(); err != nil {
+		_, _ = fmt.Fprintf(os.Stderr, "err: %v\n", err)
+		os.Exit(1)
+	}
+}
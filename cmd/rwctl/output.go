@@ -0,0 +1,233 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"google.golang.org/protobuf/encoding/protojson"
+	protobuf "google.golang.org/protobuf/proto"
+
+	"github.com/ansg191/remote-worker/api/proto"
+)
+
+// Output formats
+const (
+	formatTable = "table"
+	formatJSON  = "json"
+)
+
+// printer writes command output as a table or JSON
+type printer struct {
+	w    io.Writer
+	json bool
+}
+
+func newPrinter(w io.Writer, format string) (*printer, error) {
+	switch format {
+	case formatTable:
+		return &printer{w: w}, nil
+	case formatJSON:
+		return &printer{w: w, json: true}, nil
+	default:
+		return nil, fmt.Errorf("unknown output format %q", format)
+	}
+}
+
+// jobs prints a list of jobs
+func (p *printer) jobs(jobs []*proto.JobInfo) error {
+	if p.json {
+		messages := make([]protobuf.Message, len(jobs))
+		for i, job := range jobs {
+			messages[i] = job
+		}
+		return p.messages(messages)
+	}
+
+	tw := tabwriter.NewWriter(p.w, 0, 4, 2, ' ', 0)
+	_, _ = fmt.Fprintln(tw, "ID\tSTATE\tPROGRESS\tSPEED\tTENANT\tSOURCE\tDEST\tAGE\tCOST\tERROR")
+	for _, job := range jobs {
+		_, _ = fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\n",
+			job.Id,
+			strings.ToLower(job.State.String()),
+			progress(job),
+			speed(job.Status),
+			dash(job.Tenant),
+			job.Job.GetSourcePath(),
+			job.Job.GetDestPath(),
+			age(job),
+			jobCost(job.Cost),
+			dash(job.Error),
+		)
+	}
+	return tw.Flush()
+}
+
+// costs prints the costs of tenants
+func (p *printer) costs(costs *proto.GetCostsResponse) error {
+	if p.json {
+		return p.messages([]protobuf.Message{costs})
+	}
+
+	tw := tabwriter.NewWriter(p.w, 0, 4, 2, ' ', 0)
+	_, _ = fmt.Fprintln(tw, "TENANT\tJOBS\tCOST")
+	for _, tenant := range costs.Tenants {
+		_, _ = fmt.Fprintf(tw, "%s\t%d\t%s\n", dash(tenant.Tenant), tenant.Jobs, usd(tenant.Cost))
+	}
+	_, _ = fmt.Fprintf(tw, "(unattributed)\t-\t%s\n", usd(costs.Unattributed))
+	if err := tw.Flush(); err != nil {
+		return err
+	}
+
+	_, err := fmt.Fprintf(p.w, "\nTotal of terminated workers: %s\n", usd(costs.Total))
+	return err
+}
+
+// budgets prints the state of budgets
+func (p *printer) budgets(budgets []*proto.Budget) error {
+	if p.json {
+		messages := make([]protobuf.Message, len(budgets))
+		for i, budget := range budgets {
+			messages[i] = budget
+		}
+		return p.messages(messages)
+	}
+
+	tw := tabwriter.NewWriter(p.w, 0, 4, 2, ' ', 0)
+	_, _ = fmt.Fprintln(tw, "NAME\tPERIOD\tSINCE\tSPEND\tSOFT\tHARD\tSTATE")
+	for _, budget := range budgets {
+		_, _ = fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%s\t%s\n",
+			budget.Name,
+			budget.Period,
+			budget.Since.AsTime().Local().Format(time.RFC3339),
+			usd(budget.Spend),
+			limit(budget.Soft),
+			limit(budget.Hard),
+			budgetState(budget),
+		)
+	}
+	return tw.Flush()
+}
+
+// ids prints the IDs of submitted jobs
+func (p *printer) ids(ids []string) error {
+	if p.json {
+		return p.encode(map[string][]string{"ids": ids})
+	}
+
+	for _, id := range ids {
+		_, _ = fmt.Fprintln(p.w, id)
+	}
+	return nil
+}
+
+// status prints a status of a watched job on its own line. Tables are
+// rendered as a progress bar by watch instead.
+func (p *printer) status(status *proto.JobStatus) error {
+	data, err := protojson.Marshal(status)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintln(p.w, string(data))
+	return err
+}
+
+func (p *printer) messages(messages []protobuf.Message) error {
+	raw := make([]json.RawMessage, len(messages))
+	for i, message := range messages {
+		data, err := protojson.Marshal(message)
+		if err != nil {
+			return err
+		}
+		raw[i] = data
+	}
+	return p.encode(raw)
+}
+
+func (p *printer) encode(v any) error {
+	enc := json.NewEncoder(p.w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(v)
+}
+
+// progress describes how far a job got
+func progress(job *proto.JobInfo) string {
+	switch job.State {
+	case proto.JobInfo_SUCCEEDED:
+		return "100%"
+	case proto.JobInfo_RUNNING:
+	default:
+		return "-"
+	}
+
+	status := job.Status
+	switch {
+	case status == nil:
+		return "starting"
+	case status.Status == proto.JobStatus_ENCODING && status.EncodeStatus != nil:
+		return fmt.Sprintf("%.1f%%", status.EncodeStatus.Progress)
+	default:
+		return strings.ToLower(status.Status.String())
+	}
+}
+
+func speed(status *proto.JobStatus) string {
+	if status.GetEncodeStatus() == nil {
+		return "-"
+	}
+	return fmt.Sprintf("%.2fx", status.EncodeStatus.Speed)
+}
+
+// age is the time since the job was submitted, up to when it finished
+func age(job *proto.JobInfo) string {
+	if job.Submitted == nil {
+		return "-"
+	}
+
+	end := time.Now()
+	if job.Finished != nil {
+		end = job.Finished.AsTime()
+	}
+	return end.Sub(job.Submitted.AsTime()).Round(time.Second).String()
+}
+
+// jobCost is the cost of a job so far. The idle share of a worker is only
+// added once the worker is terminated.
+func jobCost(c *proto.JobCost) string {
+	if c == nil {
+		return "-"
+	}
+	return usd(c.Total)
+}
+
+func limit(v float64) string {
+	if v == 0 {
+		return "-"
+	}
+	return usd(v)
+}
+
+func budgetState(budget *proto.Budget) string {
+	switch {
+	case budget.Exceeded:
+		return "exceeded"
+	case budget.OverrideUntil != nil:
+		return "overridden until " + budget.OverrideUntil.AsTime().Local().Format(time.RFC3339)
+	default:
+		return "ok"
+	}
+}
+
+func usd(v float64) string {
+	return fmt.Sprintf("$%.4f", v)
+}
+
+func dash(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
@@ -0,0 +1,210 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+
+	"gopkg.in/yaml.v2"
+
+	"github.com/ansg191/remote-worker/api/proto"
+)
+
+// manifest lists jobs to submit at once. Fields left empty in a job default to
+// the submit flags.
+//
+//	jobs:
+//	  - source: s3://media/in/title.mkv
+//	    dest: s3://media/out/title.mp4
+//	    codec: hevc_nvenc
+//	    bitrate: 8M
+//	    priority: 1
+//	    tenant: studio
+//	    gpu_vendor: nvidia
+//	    min_scratch_gib: 100
+//	    labels:
+//	      region: eu
+type manifest struct {
+	Jobs []manifestJob `yaml:"jobs"`
+}
+
+type manifestJob struct {
+	Source   string `yaml:"source"`
+	Dest     string `yaml:"dest"`
+	Codec    string `yaml:"codec"`
+	Bitrate  string `yaml:"bitrate"`
+	Priority int32  `yaml:"priority"`
+	Tenant   string `yaml:"tenant"`
+
+	// Requirements of the worker running the job
+	GPU        bool              `yaml:"gpu"`
+	GPUVendor  string            `yaml:"gpu_vendor"`
+	MinScratch uint64            `yaml:"min_scratch_gib"`
+	MinThreads uint32            `yaml:"min_threads"`
+	Labels     map[string]string `yaml:"labels"`
+}
+
+// labelsFlag collects key=value flags
+type labelsFlag map[string]string
+
+func (f labelsFlag) String() string {
+	pairs := make([]string, 0, len(f))
+	for key, value := range f {
+		pairs = append(pairs, key+"="+value)
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, ",")
+}
+
+func (f labelsFlag) Set(s string) error {
+	key, value, ok := strings.Cut(s, "=")
+	if !ok || key == "" {
+		return fmt.Errorf("label %q must be key=value", s)
+	}
+	f[key] = value
+	return nil
+}
+
+func readManifest(path string) (*manifest, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var m manifest
+	if err = yaml.UnmarshalStrict(data, &m); err != nil {
+		return nil, fmt.Errorf("invalid manifest %s: %w", path, err)
+	}
+	if len(m.Jobs) == 0 {
+		return nil, fmt.Errorf("manifest %s has no jobs", path)
+	}
+	return &m, nil
+}
+
+func submit(ctx context.Context, client proto.ManagerServiceClient, out *printer, args []string) error {
+	fs := flag.NewFlagSet("submit", flag.ExitOnError)
+	manifestPath := fs.String("f", "", "manifest of jobs to submit")
+	defaults := manifestJob{}
+	fs.StringVar(&defaults.Source, "source", "", "source path, local to the worker or s3://")
+	fs.StringVar(&defaults.Dest, "dest", "", "destination path, local to the worker or s3://")
+	fs.StringVar(&defaults.Codec, "codec", "", "video codec")
+	fs.StringVar(&defaults.Bitrate, "bitrate", "", "video bitrate")
+	var priority int
+	fs.IntVar(&priority, "priority", 0, "priority of the jobs")
+	fs.StringVar(&defaults.Tenant, "tenant", "", "tenant owning the jobs")
+	fs.BoolVar(&defaults.GPU, "gpu", false, "require a worker with a GPU")
+	fs.StringVar(&defaults.GPUVendor, "gpu-vendor", "", "require a worker with a GPU of the vendor, e.g. nvidia")
+	var minScratch, minThreads uint
+	fs.UintVar(&minScratch, "min-scratch", 0, "require a worker with at least this much scratch storage in GiB")
+	fs.UintVar(&minThreads, "min-threads", 0, "require a worker with at least this many hardware threads")
+	labels := labelsFlag{}
+	fs.Var(labels, "label", "require a worker advertising the key=value label, may be repeated")
+	doWatch := fs.Bool("watch", false, "watch the job after submitting it")
+	_ = fs.Parse(args)
+	defaults.Priority = int32(priority)
+	defaults.MinScratch = uint64(minScratch)
+	defaults.MinThreads = uint32(minThreads)
+	if len(labels) > 0 {
+		defaults.Labels = labels
+	}
+
+	jobs := []manifestJob{defaults}
+	if *manifestPath != "" {
+		m, err := readManifest(*manifestPath)
+		if err != nil {
+			return err
+		}
+		jobs = m.Jobs
+		for i := range jobs {
+			jobs[i].withDefaults(defaults)
+		}
+	}
+	if *doWatch && len(jobs) != 1 {
+		return errors.New("-watch requires a single job")
+	}
+
+	var ids []string
+	for i, job := range jobs {
+		if job.Source == "" || job.Dest == "" {
+			return fmt.Errorf("job %d: source and dest are required", i+1)
+		}
+
+		res, err := client.SubmitJob(ctx, &proto.SubmitJobRequest{
+			Job: &proto.Job{
+				SourcePath: job.Source,
+				DestPath:   job.Dest,
+				Codec:      job.Codec,
+				Bitrate:    job.Bitrate,
+			},
+			Priority:     job.Priority,
+			Tenant:       job.Tenant,
+			Requirements: job.requirements(),
+		})
+		if err != nil {
+			// Report what was submitted before failing
+			_ = out.ids(ids)
+			return fmt.Errorf("job %d: %w", i+1, err)
+		}
+		ids = append(ids, res.Id)
+	}
+
+	if *doWatch {
+		return watchJob(ctx, client, out, ids[0])
+	}
+	return out.ids(ids)
+}
+
+func (j *manifestJob) withDefaults(defaults manifestJob) {
+	if j.Source == "" {
+		j.Source = defaults.Source
+	}
+	if j.Dest == "" {
+		j.Dest = defaults.Dest
+	}
+	if j.Codec == "" {
+		j.Codec = defaults.Codec
+	}
+	if j.Bitrate == "" {
+		j.Bitrate = defaults.Bitrate
+	}
+	if j.Priority == 0 {
+		j.Priority = defaults.Priority
+	}
+	if j.Tenant == "" {
+		j.Tenant = defaults.Tenant
+	}
+	if !j.GPU {
+		j.GPU = defaults.GPU
+	}
+	if j.GPUVendor == "" {
+		j.GPUVendor = defaults.GPUVendor
+	}
+	if j.MinScratch == 0 {
+		j.MinScratch = defaults.MinScratch
+	}
+	if j.MinThreads == 0 {
+		j.MinThreads = defaults.MinThreads
+	}
+	if j.Labels == nil {
+		j.Labels = defaults.Labels
+	}
+}
+
+// requirements returns the requirements of the job, nil if it runs on any
+// worker
+func (j *manifestJob) requirements() *proto.Requirements {
+	if !j.GPU && j.GPUVendor == "" && j.MinScratch == 0 && j.MinThreads == 0 && len(j.Labels) == 0 {
+		return nil
+	}
+	return &proto.Requirements{
+		Gpu:           j.GPU,
+		GpuVendor:     j.GPUVendor,
+		MinScratchGib: j.MinScratch,
+		MinThreads:    j.MinThreads,
+		Labels:        j.Labels,
+	}
+}
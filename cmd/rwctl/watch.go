@@ -0,0 +1,116 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/ansg191/remote-worker/api/proto"
+)
+
+// barWidth is the number of characters of the progress bar
+const barWidth = 40
+
+func watch(ctx context.Context, client proto.ManagerServiceClient, out *printer, args []string) error {
+	fs := flag.NewFlagSet("watch", flag.ExitOnError)
+	_ = fs.Parse(args)
+	if fs.NArg() != 1 {
+		return errors.New("usage: watch <job id>")
+	}
+
+	return watchJob(ctx, client, out, fs.Arg(0))
+}
+
+// watchJob follows a job until it finished, rendering its progress as a bar
+// or printing every status as JSON. It fails if the job didn't succeed.
+func watchJob(ctx context.Context, client proto.ManagerServiceClient, out *printer, id string) error {
+	stream, err := client.WatchJob(ctx, &proto.WatchJobRequest{Id: id})
+	if err != nil {
+		return err
+	}
+
+	rendered := false
+	for {
+		status, err := stream.Recv()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+
+		if out.json {
+			if err = out.status(status); err != nil {
+				return err
+			}
+			continue
+		}
+		_, _ = fmt.Fprintf(out.w, "\r%s", bar(status))
+		rendered = true
+	}
+	if rendered {
+		_, _ = fmt.Fprintln(out.w)
+	}
+
+	job, err := client.GetJob(ctx, &proto.GetJobRequest{Id: id})
+	if err != nil {
+		return err
+	}
+	if !out.json {
+		_, _ = fmt.Fprintf(out.w, "Job %s %s\n", id, strings.ToLower(job.State.String()))
+	}
+
+	switch job.State {
+	case proto.JobInfo_SUCCEEDED:
+		return nil
+	case proto.JobInfo_FAILED:
+		return fmt.Errorf("job failed: %s", job.Error)
+	default:
+		return fmt.Errorf("job %s", strings.ToLower(job.State.String()))
+	}
+}
+
+// bar renders a status as a fixed width progress line, e.g.
+//
+//	[=================>                      ]  45.0%  1.52x  00:12:31.20
+func bar(status *proto.JobStatus) string {
+	var line string
+	switch status.Status {
+	case proto.JobStatus_ENCODING:
+		encode := status.GetEncodeStatus()
+		percent := encode.GetProgress()
+		if percent < 0 {
+			percent = 0
+		} else if percent > 100 {
+			percent = 100
+		}
+
+		filled := int(percent / 100 * barWidth)
+		head := ""
+		if filled < barWidth {
+			head = ">"
+		}
+		line = fmt.Sprintf("[%s%s%s] %5.1f%%  %.2fx  %s",
+			strings.Repeat("=", filled),
+			head,
+			strings.Repeat(" ", barWidth-filled-len(head)),
+			percent,
+			encode.GetSpeed(),
+			encode.GetCurrTime(),
+		)
+	case proto.JobStatus_ERROR:
+		line = "error: " + status.Error
+	default:
+		line = strings.ToLower(status.Status.String()) + "..."
+	}
+
+	// Pad to overwrite longer previous lines
+	const lineWidth = barWidth + 40
+	if len(line) < lineWidth {
+		line += strings.Repeat(" ", lineWidth-len(line))
+	}
+	return line
+}
@@ -5,6 +5,7 @@ import (
 	"sync"
 
 	"github.com/aws/aws-sdk-go-v2/aws"
+	"go.opentelemetry.io/otel/trace"
 	"go.uber.org/zap"
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/status"
@@ -22,9 +23,10 @@ type JobServer struct {
 
 	mtx sync.Mutex
 	job encoder.EncodeJob
+	id  string // ID of job
 }
 
-func (s *JobServer) Start(_ context.Context, request *proto.JobStartRequest) (*proto.JobStartResponse, error) {
+func (s *JobServer) Start(ctx context.Context, request *proto.JobStartRequest) (*proto.JobStartResponse, error) {
 	job := request.Job
 	if job == nil {
 		return nil, status.Error(codes.InvalidArgument, "job not provided")
@@ -37,28 +39,40 @@ func (s *JobServer) Start(_ context.Context, request *proto.JobStartRequest) (*p
 	}
 
 	s.job = encoder.NewEncodeJob(s.logger, s.cfg, s.tempPath)
+	s.id = request.Id
 	s.job.SetSourcePath(job.SourcePath).
 		SetDestPath(job.DestPath).
 		SetBitrate(job.Bitrate).
 		SetCodec(job.Codec)
 
-	go s.job.Start()
+	// The job outlives the RPC, so only its trace is carried over
+	jobCtx := trace.ContextWithSpanContext(context.Background(), trace.SpanContextFromContext(ctx))
+	go s.job.Start(jobCtx)
 
-	go func() {
-		s.job.Wait()
-		s.job = nil
-	}()
+	go func(job encoder.EncodeJob) {
+		job.Wait()
+
+		s.mtx.Lock()
+		defer s.mtx.Unlock()
+		// The job may have been canceled and replaced meanwhile
+		if s.job == job {
+			s.job = nil
+		}
+	}(s.job)
 
 	return &proto.JobStartResponse{}, nil
 }
 
-func (s *JobServer) Cancel(context.Context, *proto.JobCancelRequest) (*proto.JobCancelResponse, error) {
+func (s *JobServer) Cancel(_ context.Context, request *proto.JobCancelRequest) (*proto.JobCancelResponse, error) {
 	s.mtx.Lock()
 	defer s.mtx.Unlock()
 
 	if s.job == nil {
 		return nil, status.Errorf(codes.NotFound, "no current job found")
 	}
+	if request.Id != "" && request.Id != s.id {
+		return nil, status.Errorf(codes.NotFound, "job %q not running", request.Id)
+	}
 
 	s.job.Cancel()
 	s.job = nil
@@ -5,20 +5,49 @@ import (
 	"flag"
 	"fmt"
 	"net"
+	"sort"
+	"strconv"
+	"strings"
 
 	"github.com/aws/aws-sdk-go-v2/config"
 	"go.uber.org/zap"
 	"google.golang.org/grpc"
 
 	"github.com/ansg191/remote-worker/api/proto"
+	"github.com/ansg191/remote-worker/internal/tracing"
 )
 
 var (
+	host     = flag.String("host", "0.0.0.0", "Address to listen on")
 	port     = flag.Int("p", 8000, "Port to listen on")
 	tempPath = flag.String("tmp", "/tmp", "Temporary File Path")
+	exporter = flag.String("trace-exporter", tracing.ExporterNone, "Trace exporter: stdout or otlp. Disabled if empty")
+	labels   = labelsFlag{}
 )
 
+// labelsFlag collects key=value flags
+type labelsFlag map[string]string
+
+func (f labelsFlag) String() string {
+	pairs := make([]string, 0, len(f))
+	for key, value := range f {
+		pairs = append(pairs, key+"="+value)
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, ",")
+}
+
+func (f labelsFlag) Set(s string) error {
+	key, value, ok := strings.Cut(s, "=")
+	if !ok || key == "" {
+		return fmt.Errorf("label %q must be key=value", s)
+	}
+	f[key] = value
+	return nil
+}
+
 func main() {
+	flag.Var(labels, "label", "Label advertised to the manager as key=value, may be repeated")
 	flag.Parse()
 
 	logger, err := zap.NewProduction()
@@ -31,18 +60,31 @@ func main() {
 
 	logger.Debug("Configuration Info",
 		zap.Stringp("tempPath", tempPath),
+		zap.Stringer("labels", labels),
 	)
 
-	lis, err := net.Listen("tcp", fmt.Sprintf("0.0.0.0:%d", *port))
+	lis, err := net.Listen("tcp", net.JoinHostPort(*host, strconv.Itoa(*port)))
 	if err != nil {
 		logger.Fatal("listener error", zap.Error(err))
 	}
 
 	logger.Debug("Listener running", zap.Intp("port", port))
 
-	grpcServer := grpc.NewServer()
+	shutdownTracing, err := tracing.Setup(context.Background(), "remote-worker-worker", *exporter)
+	if err != nil {
+		logger.Fatal("tracing error", zap.Error(err))
+	}
+	defer func() {
+		_ = shutdownTracing(context.Background())
+	}()
+
+	grpcServer := grpc.NewServer(tracing.ServerOptions()...)
 
-	workerServer := &WorkerServer{logger: logger}
+	workerServer := &WorkerServer{
+		logger:   logger,
+		labels:   labels,
+		tempPath: *tempPath,
+	}
 	proto.RegisterWorkerServiceServer(grpcServer, workerServer)
 
 	cfg, err := config.LoadDefaultConfig(context.Background())
@@ -3,6 +3,7 @@ package main
 import (
 	"context"
 	"runtime"
+	"strings"
 
 	"github.com/aws/aws-sdk-go-v2/aws"
 	"github.com/jaypipes/ghw"
@@ -15,7 +16,9 @@ import (
 
 type WorkerServer struct {
 	proto.UnimplementedWorkerServiceServer
-	logger *zap.Logger
+	logger   *zap.Logger
+	labels   map[string]string
+	tempPath string // Scratch directory of jobs
 }
 
 func (w *WorkerServer) Status(context.Context, *proto.WorkerStatusRequest) (*proto.WorkerStatusResponse, error) {
@@ -24,7 +27,7 @@ func (w *WorkerServer) Status(context.Context, *proto.WorkerStatusRequest) (*pro
 
 //goland:noinspection GoBoolExpressions
 func (w *WorkerServer) Info(_ context.Context, req *proto.WorkerInfoRequest) (*proto.WorkerInfoResponse, error) {
-	res := &proto.WorkerInfoResponse{}
+	res := &proto.WorkerInfoResponse{Labels: w.labels}
 
 	// Memory
 	if runtime.GOOS == "linux" || runtime.GOOS == "windows" {
@@ -156,6 +159,7 @@ func (w *WorkerServer) Info(_ context.Context, req *proto.WorkerInfoRequest) (*p
 		}
 
 		res.Storage = info
+		res.ScratchBytes = scratchBytes(block, w.tempPath)
 	}
 
 	// Topology
@@ -343,3 +347,24 @@ func pciPIToProto(pi *pcidb.ProgrammingInterface) *proto.PCIInfo_Class_Programmi
 		Name: pi.Name,
 	}
 }
+
+// scratchBytes returns the size of the partition mounted at or above path, 0
+// if none is found
+func scratchBytes(block *ghw.BlockInfo, path string) uint64 {
+	var mount string
+	var size uint64
+	for _, disk := range block.Disks {
+		for _, part := range disk.Partitions {
+			mp := part.MountPoint
+			if mp == "" || (path != mp && !strings.HasPrefix(path, strings.TrimSuffix(mp, "/")+"/")) {
+				continue
+			}
+			// The deepest mount point holds path
+			if len(mp) > len(mount) {
+				mount = mp
+				size = part.SizeBytes
+			}
+		}
+	}
+	return size
+}
@@ -0,0 +1,199 @@
+package autoscale
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/benbjohnson/clock"
+	"go.uber.org/zap"
+
+	"github.com/ansg191/remote-worker/internal/compute"
+)
+
+// smoothing is the weight of a new sample in the moving averages of job
+// durations and provisioning latencies
+const smoothing = 0.2
+
+// Autoscaler decides the capacity of a queue and its pool from their state
+type Autoscaler interface {
+	// Scale returns the capacity for state. It is called periodically by a
+	// Controller, never concurrently.
+	Scale(state State) Decision
+}
+
+// State is the observed state of a queue and its pool
+type State struct {
+	// Time of the observation
+	Time time.Time
+	// Queued is the work waiting for a slot, including work waiting for a
+	// retry or for its schedule
+	Queued int
+	// Running is the work holding a slot, including work waiting for a
+	// worker
+	Running int
+	// MaxSize is the current maximum number of concurrent workers of the
+	// queue
+	MaxSize int
+	// AvgDuration is the moving average of how long work ran. Zero until
+	// work finished.
+	AvgDuration time.Duration
+	// AvgProvisioning is the moving average of how long WorkerFactory.Create
+	// took. Zero until a worker was created.
+	AvgProvisioning time.Duration
+	// Pool is the current number of workers in the pool
+	Pool compute.PoolStats
+}
+
+// Decision is the capacity decided by an Autoscaler
+type Decision struct {
+	// MaxSize is the maximum number of concurrent workers of the queue
+	MaxSize int
+	// MinWarm is the number of live workers the pool provisions ahead of
+	// work. When lowered, idle workers above it are closed right away.
+	MinWarm int
+}
+
+// Controller periodically applies the decisions of an Autoscaler to a queue
+// and its pool. It must be fed the events of both with HandlePoolEvent and
+// HandleQueueEvent, and is started with Start once they are created.
+type Controller struct {
+	logger     *zap.Logger
+	autoscaler Autoscaler
+	options    Options
+
+	mtx             sync.Mutex // Mutex for below fields
+	avgDuration     time.Duration
+	avgProvisioning time.Duration
+
+	// Only used by the run routine
+	pool    compute.Pool
+	queue   compute.WorkQueue
+	minWarm int // MinWarm last applied to the pool, -1 if none
+
+	ctx    context.Context // Context for background routine, canceled on Close
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+}
+
+func New(logger *zap.Logger, autoscaler Autoscaler, opts ...OptionsFunc) *Controller {
+	options := Options{
+		Interval: 30 * time.Second,
+		Clock:    clock.New(),
+	}
+
+	for _, opt := range opts {
+		opt(&options)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	return &Controller{
+		logger:     logger,
+		autoscaler: autoscaler,
+		options:    options,
+		minWarm:    -1,
+		ctx:        ctx,
+		cancel:     cancel,
+	}
+}
+
+func (c *Controller) HandlePoolEvent(event compute.PoolEvent) {
+	if event.Type != compute.WorkerCreated {
+		return
+	}
+
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	c.avgProvisioning = average(c.avgProvisioning, event.Duration)
+}
+
+func (c *Controller) HandleQueueEvent(event compute.QueueEvent) {
+	// Work that never ran took no slot time
+	if event.Type != compute.WorkFinished || event.Duration <= 0 {
+		return
+	}
+
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	c.avgDuration = average(c.avgDuration, event.Duration)
+}
+
+// average adds sample to the moving average avg
+func average(avg, sample time.Duration) time.Duration {
+	if avg == 0 {
+		return sample
+	}
+	return avg + time.Duration(smoothing*float64(sample-avg))
+}
+
+// Start scales pool and queue every Interval until the controller is closed
+func (c *Controller) Start(pool compute.Pool, queue compute.WorkQueue) {
+	c.pool = pool
+	c.queue = queue
+
+	// The ticker is created before the goroutine starts so that no tick is
+	// missed by a clock that is advanced right after Start returns.
+	ticker := c.options.Clock.Ticker(c.options.Interval)
+	c.wg.Add(1)
+	go c.run(ticker)
+}
+
+func (c *Controller) run(ticker *clock.Ticker) {
+	defer c.wg.Done()
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-c.ctx.Done():
+			return
+		case <-ticker.C:
+			c.scale()
+		}
+	}
+}
+
+// scale observes the queue and pool and applies the decision of the
+// Autoscaler
+func (c *Controller) scale() {
+	state := State{
+		Time:    c.options.Clock.Now(),
+		MaxSize: c.queue.GetMaxSize(),
+		Pool:    c.pool.Stats(),
+	}
+	c.mtx.Lock()
+	state.AvgDuration = c.avgDuration
+	state.AvgProvisioning = c.avgProvisioning
+	c.mtx.Unlock()
+
+	for _, stats := range c.queue.TenantStats() {
+		state.Queued += stats.Queued
+		state.Running += stats.Running
+	}
+
+	decision := c.autoscaler.Scale(state)
+
+	if decision.MaxSize != state.MaxSize {
+		c.logger.Info("Scaling queue",
+			zap.Int("from", state.MaxSize),
+			zap.Int("to", decision.MaxSize),
+			zap.Int("queued", state.Queued),
+			zap.Int("running", state.Running))
+		c.queue.SetMaxSize(decision.MaxSize)
+	}
+
+	if decision.MinWarm != c.minWarm {
+		c.logger.Info("Scaling warm workers", zap.Int("from", c.minWarm), zap.Int("to", decision.MinWarm))
+		c.pool.SetMinWarm(decision.MinWarm)
+		if c.minWarm >= 0 && decision.MinWarm < c.minWarm && state.Queued == 0 {
+			c.pool.Shrink(state.Pool.Available)
+		}
+		c.minWarm = decision.MinWarm
+	}
+}
+
+// Close stops scaling
+func (c *Controller) Close() error {
+	c.cancel()
+	c.wg.Wait()
+	return nil
+}
@@ -0,0 +1,118 @@
+package autoscale
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/benbjohnson/clock"
+	"github.com/golang/mock/gomock"
+	m "github.com/launchdarkly/go-test-helpers/v2/matchers"
+	"go.uber.org/zap/zaptest"
+
+	"github.com/ansg191/remote-worker/internal/compute"
+)
+
+// testQueue reports fixed stats. Its other methods are never called.
+type testQueue struct {
+	compute.WorkQueue
+
+	mtx     sync.Mutex
+	stats   map[string]compute.TenantStats
+	maxSize int
+}
+
+func (q *testQueue) TenantStats() map[string]compute.TenantStats {
+	q.mtx.Lock()
+	defer q.mtx.Unlock()
+	return q.stats
+}
+
+func (q *testQueue) GetMaxSize() int {
+	q.mtx.Lock()
+	defer q.mtx.Unlock()
+	return q.maxSize
+}
+
+func (q *testQueue) SetMaxSize(size int) {
+	q.mtx.Lock()
+	defer q.mtx.Unlock()
+	q.maxSize = size
+}
+
+// scalerFunc is an Autoscaler calling a function
+type scalerFunc func(state State) Decision
+
+func (f scalerFunc) Scale(state State) Decision {
+	return f(state)
+}
+
+func TestController(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	t.Cleanup(func() {
+		ctrl.Finish()
+	})
+
+	states := make(chan State, 1)
+	decisions := []Decision{{MaxSize: 4, MinWarm: 2}, {MaxSize: 4, MinWarm: 0}}
+	scaler := scalerFunc(func(state State) Decision {
+		decision := decisions[0]
+		decisions = decisions[1:]
+		states <- state
+		return decision
+	})
+
+	clk := clock.NewMock()
+	c := New(zaptest.NewLogger(t), scaler, WithInterval(time.Minute), WithClock(clk))
+
+	c.HandlePoolEvent(compute.PoolEvent{Type: compute.WorkerCreated, Duration: 2 * time.Minute})
+	c.HandleQueueEvent(compute.QueueEvent{Type: compute.WorkFinished, Duration: 10 * time.Minute})
+	c.HandleQueueEvent(compute.QueueEvent{Type: compute.WorkFinished, Duration: 20 * time.Minute})
+	// Work that never ran is not averaged
+	c.HandleQueueEvent(compute.QueueEvent{Type: compute.WorkFinished})
+
+	queue := &testQueue{maxSize: 1, stats: map[string]compute.TenantStats{
+		"a": {Queued: 2, Running: 1},
+		"b": {Queued: 1},
+	}}
+	stats := compute.PoolStats{Live: 3, Available: 2}
+	applied := make(chan struct{})
+	pool := compute.NewMockPool(ctrl)
+	pool.EXPECT().Stats().Return(stats).Times(2)
+	gomock.InOrder(
+		pool.EXPECT().SetMinWarm(2),
+		pool.EXPECT().SetMinWarm(0),
+		pool.EXPECT().Shrink(2).DoAndReturn(func(n int) int {
+			close(applied)
+			return n
+		}),
+	)
+
+	c.Start(pool, queue)
+	t.Cleanup(func() {
+		_ = c.Close()
+	})
+
+	clk.Add(time.Minute)
+	state := <-states
+	m.For(t, "queued").Assert(state.Queued, m.Equal(3))
+	m.For(t, "running").Assert(state.Running, m.Equal(1))
+	m.For(t, "max size").Assert(state.MaxSize, m.Equal(1))
+	m.For(t, "avg duration").Assert(state.AvgDuration, m.Equal(12*time.Minute))
+	m.For(t, "avg provisioning").Assert(state.AvgProvisioning, m.Equal(2*time.Minute))
+	m.For(t, "pool").Assert(state.Pool, m.Equal(stats))
+
+	// Lowering warm workers without queued work closes idle workers
+	queue.mtx.Lock()
+	queue.stats = map[string]compute.TenantStats{"a": {Running: 1}}
+	queue.mtx.Unlock()
+	clk.Add(time.Minute)
+	<-states
+
+	select {
+	case <-applied:
+	case <-time.After(time.Second):
+		t.Fatal("idle workers not closed")
+	}
+	m.For(t, "scaled queue").Assert(queue.GetMaxSize(), m.Equal(4))
+}
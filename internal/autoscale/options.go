@@ -0,0 +1,68 @@
+package autoscale
+
+import (
+	"time"
+
+	"github.com/benbjohnson/clock"
+)
+
+type Options struct {
+	// Interval is how often the Autoscaler is evaluated. Defaults to 30
+	// seconds.
+	Interval time.Duration
+	// Clock is the time source of the controller.
+	Clock clock.Clock
+}
+
+type OptionsFunc func(options *Options)
+
+func WithInterval(interval time.Duration) OptionsFunc {
+	return func(opts *Options) {
+		opts.Interval = interval
+	}
+}
+
+func WithClock(clock clock.Clock) OptionsFunc {
+	return func(opts *Options) {
+		opts.Clock = clock
+	}
+}
+
+type TargetOptions struct {
+	// MinSize is the lowest maximum size of the queue. Defaults to 1, so that
+	// work is dispatched without waiting for an evaluation.
+	MinSize int
+	// MaxSize is the highest maximum size of the queue. Zero means
+	// unlimited.
+	MaxSize int
+	// MinWarm is the lowest number of warm workers
+	MinWarm int
+	// ScaleUpCooldown is how long after scaling up the size is raised again.
+	// Defaults to 1 minute.
+	ScaleUpCooldown time.Duration
+	// ScaleDownCooldown is how long after scaling in either direction the
+	// size or warm workers are lowered. Defaults to 5 minutes.
+	ScaleDownCooldown time.Duration
+}
+
+type TargetOptionsFunc func(options *TargetOptions)
+
+func WithSizeRange(min, max int) TargetOptionsFunc {
+	return func(opts *TargetOptions) {
+		opts.MinSize = min
+		opts.MaxSize = max
+	}
+}
+
+func WithMinWarm(n int) TargetOptionsFunc {
+	return func(opts *TargetOptions) {
+		opts.MinWarm = n
+	}
+}
+
+func WithCooldowns(up, down time.Duration) TargetOptionsFunc {
+	return func(opts *TargetOptions) {
+		opts.ScaleUpCooldown = up
+		opts.ScaleDownCooldown = down
+	}
+}
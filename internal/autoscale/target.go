@@ -0,0 +1,103 @@
+package autoscale
+
+import (
+	"math"
+	"time"
+)
+
+// TargetTracking is an Autoscaler keeping the expected wait of queued work
+// under a target.
+//
+// Every slot of the queue finishes a job per average job duration. A new slot
+// first waits for a worker to be provisioned, so within the target wait it
+// finishes (target - provisioning latency) / duration jobs. The size is the
+// running work plus the slots needed to start all queued work within the
+// target, but never more than the work. Without a known job duration, or if
+// provisioning alone takes longer than the target, every job gets a slot.
+//
+// Warm workers follow the size while there is work, so that workers of
+// finished work are kept for the next work until the scale down cooldown
+// passes.
+type TargetTracking struct {
+	target  time.Duration
+	options TargetOptions
+
+	warm     int       // Last decided warm workers
+	lastUp   time.Time // Last time the size was raised
+	lastDown time.Time // Last time the size or warm workers were lowered
+}
+
+// NewTargetTracking creates a TargetTracking keeping the expected wait under
+// target
+func NewTargetTracking(target time.Duration, opts ...TargetOptionsFunc) *TargetTracking {
+	options := TargetOptions{
+		MinSize:           1,
+		ScaleUpCooldown:   time.Minute,
+		ScaleDownCooldown: 5 * time.Minute,
+	}
+
+	for _, opt := range opts {
+		opt(&options)
+	}
+
+	return &TargetTracking{
+		target:  target,
+		options: options,
+		warm:    options.MinWarm,
+	}
+}
+
+func (t *TargetTracking) Scale(state State) Decision {
+	desired := t.desired(state)
+	canScaleDown := state.Time.Sub(t.lastUp) >= t.options.ScaleDownCooldown &&
+		state.Time.Sub(t.lastDown) >= t.options.ScaleDownCooldown
+
+	size := state.MaxSize
+	switch {
+	case desired > size && state.Time.Sub(t.lastUp) >= t.options.ScaleUpCooldown:
+		size = desired
+		t.lastUp = state.Time
+	case desired < size && canScaleDown:
+		size = desired
+		t.lastDown = state.Time
+	}
+
+	warm := t.options.MinWarm
+	if work := state.Queued + state.Running; work > 0 && size > warm {
+		warm = size
+		if work < warm {
+			warm = work
+		}
+	}
+	switch {
+	case warm > t.warm:
+		t.warm = warm
+	case warm < t.warm && canScaleDown:
+		t.warm = warm
+		t.lastDown = state.Time
+	}
+
+	return Decision{MaxSize: size, MinWarm: t.warm}
+}
+
+// desired returns the size keeping the expected wait of state under the
+// target
+func (t *TargetTracking) desired(state State) int {
+	work := state.Queued + state.Running
+
+	desired := work
+	if budget := t.target - state.AvgProvisioning; state.AvgDuration > 0 && budget > 0 {
+		slots := math.Ceil(float64(state.Queued) * float64(state.AvgDuration) / float64(budget))
+		if size := state.Running + int(slots); size < desired {
+			desired = size
+		}
+	}
+
+	if desired < t.options.MinSize {
+		desired = t.options.MinSize
+	}
+	if t.options.MaxSize > 0 && desired > t.options.MaxSize {
+		desired = t.options.MaxSize
+	}
+	return desired
+}
@@ -0,0 +1,89 @@
+package autoscale
+
+import (
+	"testing"
+	"time"
+
+	m "github.com/launchdarkly/go-test-helpers/v2/matchers"
+)
+
+func TestTargetTracking(t *testing.T) {
+	tt := NewTargetTracking(10*time.Minute,
+		WithSizeRange(1, 8),
+		WithCooldowns(time.Minute, 5*time.Minute))
+
+	steps := []struct {
+		name   string
+		at     time.Duration
+		state  State
+		expect Decision
+	}{
+		{
+			name:   "unknown duration",
+			state:  State{Queued: 3, MaxSize: 1},
+			expect: Decision{MaxSize: 3, MinWarm: 3},
+		},
+		{
+			name:   "scale up cooldown",
+			at:     30 * time.Second,
+			state:  State{Queued: 4, Running: 3, MaxSize: 3, AvgDuration: 5 * time.Minute},
+			expect: Decision{MaxSize: 3, MinWarm: 3},
+		},
+		{
+			// 2 more slots finish 4 jobs in 10m
+			name:   "target",
+			at:     time.Minute,
+			state:  State{Queued: 4, Running: 3, MaxSize: 3, AvgDuration: 5 * time.Minute},
+			expect: Decision{MaxSize: 5, MinWarm: 5},
+		},
+		{
+			// Provisioning takes half of the target
+			name:   "max size",
+			at:     2 * time.Minute,
+			state:  State{Queued: 4, Running: 5, MaxSize: 5, AvgDuration: 5 * time.Minute, AvgProvisioning: 5 * time.Minute},
+			expect: Decision{MaxSize: 8, MinWarm: 8},
+		},
+		{
+			name:   "scale down cooldown",
+			at:     3 * time.Minute,
+			state:  State{Running: 2, MaxSize: 8, AvgDuration: 5 * time.Minute},
+			expect: Decision{MaxSize: 8, MinWarm: 8},
+		},
+		{
+			name:   "scale down",
+			at:     7 * time.Minute,
+			state:  State{Running: 2, MaxSize: 8, AvgDuration: 5 * time.Minute},
+			expect: Decision{MaxSize: 2, MinWarm: 2},
+		},
+		{
+			name:   "idle cooldown",
+			at:     8 * time.Minute,
+			state:  State{MaxSize: 2, AvgDuration: 5 * time.Minute},
+			expect: Decision{MaxSize: 2, MinWarm: 2},
+		},
+		{
+			name:   "idle",
+			at:     12 * time.Minute,
+			state:  State{MaxSize: 2, AvgDuration: 5 * time.Minute},
+			expect: Decision{MaxSize: 1, MinWarm: 0},
+		},
+	}
+
+	t0 := time.Date(2022, 9, 1, 12, 0, 0, 0, time.UTC)
+	for _, step := range steps {
+		step.state.Time = t0.Add(step.at)
+		decision := tt.Scale(step.state)
+		m.For(t, step.name).Assert(decision, m.Equal(step.expect))
+	}
+}
+
+func TestTargetTracking_minWarm(t *testing.T) {
+	tt := NewTargetTracking(10*time.Minute, WithMinWarm(2), WithCooldowns(0, 0))
+	now := time.Date(2022, 9, 1, 12, 0, 0, 0, time.UTC)
+
+	decision := tt.Scale(State{Time: now, MaxSize: 4})
+	m.For(t, "idle").Assert(decision, m.Equal(Decision{MaxSize: 1, MinWarm: 2}))
+
+	decision = tt.Scale(State{Time: now, Queued: 1, MaxSize: 1})
+	m.For(t, "less work than warm").Assert(decision, m.Equal(Decision{MaxSize: 1, MinWarm: 2}))
+}
@@ -0,0 +1,345 @@
+package budget
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/benbjohnson/clock"
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
+
+	"github.com/ansg191/remote-worker/internal/compute"
+)
+
+var (
+	ErrUnknownBudget = errors.New("unknown budget")
+	ErrNotBatch      = errors.New("not a batch budget")
+)
+
+// Period is the window a Budget limits spend over
+type Period string
+
+const (
+	// Daily budgets limit the spend of every calendar day
+	Daily Period = "daily"
+	// Monthly budgets limit the spend of every calendar month
+	Monthly Period = "monthly"
+	// Batch budgets limit the spend since the guard was created or the budget
+	// was last reset, e.g. of a backfill.
+	Batch Period = "batch"
+)
+
+// Budget limits the spend of workers over a Period. A zero limit is disabled.
+type Budget struct {
+	Name   string
+	Period Period
+	// Soft is the spend in USD at which a SoftLimitReached event is emitted
+	Soft float64
+	// Hard is the spend in USD at which new workers are refused and queued
+	// work is held
+	Hard float64
+}
+
+// Spender reports the spend of workers. It is implemented by
+// cost.Accountant.
+type Spender interface {
+	// Spend returns the cost of workers between since and until
+	Spend(since, until time.Time) float64
+}
+
+// ExceededError is returned for workers refused by a hard limit. It wraps
+// compute.ErrBudgetExceeded.
+type ExceededError struct {
+	Budget Budget
+	Spend  float64
+}
+
+func (e *ExceededError) Error() string {
+	return fmt.Sprintf("%s budget %q exceeded: spent $%.2f of $%.2f",
+		e.Budget.Period, e.Budget.Name, e.Spend, e.Budget.Hard)
+}
+
+func (e *ExceededError) Unwrap() error {
+	return compute.ErrBudgetExceeded
+}
+
+// Status is the state of a budget in its current window
+type Status struct {
+	Budget Budget
+	// Since is the start of the current window
+	Since time.Time
+	Spend float64
+	// Exceeded is set if the hard limit is reached and not overridden
+	Exceeded bool
+	// Override is when the override of the hard limit ends, if any
+	Override time.Time
+}
+
+// Guard enforces budgets on the spend reported by a Spender. Factories
+// wrapped with Factory refuse to create workers while a hard limit is
+// exceeded, and a watched WorkQueue holds its queued work until every hard
+// limit is respected again: because a new window started, the budget was
+// reset, or an operator overrode it.
+type Guard struct {
+	logger  *zap.Logger
+	spender Spender
+	options Options
+
+	mtx     sync.Mutex // Mutex for below fields
+	budgets []*state
+	queue   compute.WorkQueue // Queue held while a hard limit is exceeded
+
+	ctx    context.Context // Context for background routine, canceled on Close
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+}
+
+type state struct {
+	budget   Budget
+	reset    time.Time // Start of the window of Batch budgets
+	override time.Time // Hard limit is ignored until override
+
+	since    time.Time // Start of the current window
+	spend    float64   // Spend of the current window at the last check
+	soft     bool      // SoftLimitReached was emitted in the window
+	hard     bool      // HardLimitReached was emitted in the window
+	exceeded bool      // Hard limit is reached and not overridden
+}
+
+func New(logger *zap.Logger, spender Spender, budgets []Budget, opts ...OptionsFunc) *Guard {
+	options := Options{
+		CheckInterval: time.Minute,
+		Location:      time.UTC,
+		Clock:         clock.New(),
+	}
+
+	for _, opt := range opts {
+		opt(&options)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	g := &Guard{
+		logger:  logger,
+		spender: spender,
+		options: options,
+		ctx:     ctx,
+		cancel:  cancel,
+	}
+
+	now := options.Clock.Now()
+	for _, budget := range budgets {
+		g.budgets = append(g.budgets, &state{budget: budget, reset: now})
+	}
+
+	ticker := options.Clock.Ticker(options.CheckInterval)
+	g.wg.Add(1)
+	go g.run(ticker)
+
+	return g
+}
+
+// run checks the budgets on every tick until the guard is closed
+func (g *Guard) run(ticker *clock.Ticker) {
+	defer g.wg.Done()
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-g.ctx.Done():
+			return
+		case <-ticker.C:
+			_ = g.Check()
+		}
+	}
+}
+
+// Watch holds the queued work of queue while a hard limit is exceeded
+func (g *Guard) Watch(queue compute.WorkQueue) {
+	g.mtx.Lock()
+	defer g.mtx.Unlock()
+
+	g.queue = queue
+	g.check()
+}
+
+// Check evaluates the budgets, emitting events for limits reached, and holds
+// or resumes the watched queue. It returns an *ExceededError if a hard limit
+// is exceeded.
+func (g *Guard) Check() error {
+	g.mtx.Lock()
+	defer g.mtx.Unlock()
+
+	if err := g.check(); err != nil {
+		return err
+	}
+	return nil
+}
+
+// check implements Check.
+// g.mtx must be held.
+func (g *Guard) check() *ExceededError {
+	now := g.options.Clock.Now()
+
+	var exceeded *ExceededError
+	for _, st := range g.budgets {
+		b := st.budget
+		if since := g.since(st, now); !since.Equal(st.since) {
+			st.since = since
+			st.soft = false
+			st.hard = false
+		}
+		st.spend = g.spender.Spend(st.since, now)
+
+		if b.Soft > 0 && st.spend >= b.Soft && !st.soft {
+			st.soft = true
+			g.logger.Warn("Budget soft limit reached",
+				zap.String("budget", b.Name),
+				zap.Float64("spend", st.spend),
+				zap.Float64("limit", b.Soft))
+			g.emit(Event{Type: SoftLimitReached, Budget: b, Spend: st.spend, Time: now})
+		}
+
+		st.exceeded = false
+		if b.Hard <= 0 || st.spend < b.Hard {
+			continue
+		}
+		if !st.hard {
+			st.hard = true
+			g.logger.Warn("Budget hard limit reached, refusing new workers",
+				zap.String("budget", b.Name),
+				zap.Float64("spend", st.spend),
+				zap.Float64("limit", b.Hard))
+			g.emit(Event{Type: HardLimitReached, Budget: b, Spend: st.spend, Time: now})
+		}
+		if now.Before(st.override) {
+			continue
+		}
+
+		st.exceeded = true
+		if exceeded == nil {
+			exceeded = &ExceededError{Budget: b, Spend: st.spend}
+		}
+	}
+
+	g.hold(exceeded != nil, now)
+	return exceeded
+}
+
+// hold holds or resumes the queued work of the watched queue. Pauses of
+// operators are left alone.
+// g.mtx must be held.
+func (g *Guard) hold(held bool, now time.Time) {
+	switch {
+	case g.queue == nil:
+	case held:
+		g.queue.SetHeld(true)
+	case g.queue.Held():
+		// The queue also holds its work itself when a worker is refused
+		g.logger.Info("Budgets respected, resuming queued work")
+		g.queue.SetHeld(false)
+		g.emit(Event{Type: WorkResumed, Time: now})
+	}
+}
+
+// since returns the start of the window of st at now
+func (g *Guard) since(st *state, now time.Time) time.Time {
+	now = now.In(g.options.Location)
+	year, month, day := now.Date()
+
+	switch st.budget.Period {
+	case Daily:
+		return time.Date(year, month, day, 0, 0, 0, 0, g.options.Location)
+	case Monthly:
+		return time.Date(year, month, 1, 0, 0, 0, 0, g.options.Location)
+	default:
+		return st.reset
+	}
+}
+
+func (g *Guard) emit(event Event) {
+	for _, handler := range g.options.EventHandlers {
+		handler(event)
+	}
+}
+
+// find returns the state of the budget called name.
+// g.mtx must be held.
+func (g *Guard) find(name string) (*state, error) {
+	for _, st := range g.budgets {
+		if st.budget.Name == name {
+			return st, nil
+		}
+	}
+	return nil, errors.Wrap(ErrUnknownBudget, name)
+}
+
+// Override ignores the hard limit of the budget called name for d, and resumes
+// held work if no other hard limit is exceeded. A d of zero ends the override.
+func (g *Guard) Override(name string, d time.Duration) error {
+	g.mtx.Lock()
+	defer g.mtx.Unlock()
+
+	st, err := g.find(name)
+	if err != nil {
+		return err
+	}
+
+	st.override = time.Time{}
+	if d > 0 {
+		st.override = g.options.Clock.Now().Add(d)
+	}
+	g.logger.Info("Budget overridden", zap.String("budget", name), zap.Duration("duration", d))
+	g.check()
+	return nil
+}
+
+// Reset starts a new window of the Batch budget called name
+func (g *Guard) Reset(name string) error {
+	g.mtx.Lock()
+	defer g.mtx.Unlock()
+
+	st, err := g.find(name)
+	if err != nil {
+		return err
+	}
+	if st.budget.Period != Batch {
+		return errors.Wrap(ErrNotBatch, name)
+	}
+
+	st.reset = g.options.Clock.Now()
+	g.logger.Info("Budget reset", zap.String("budget", name))
+	g.check()
+	return nil
+}
+
+// Status checks the budgets and returns their state in configuration order
+func (g *Guard) Status() []Status {
+	g.mtx.Lock()
+	defer g.mtx.Unlock()
+
+	g.check()
+
+	now := g.options.Clock.Now()
+	statuses := make([]Status, len(g.budgets))
+	for i, st := range g.budgets {
+		statuses[i] = Status{
+			Budget:   st.budget,
+			Since:    st.since,
+			Spend:    st.spend,
+			Exceeded: st.exceeded,
+		}
+		if now.Before(st.override) {
+			statuses[i].Override = st.override
+		}
+	}
+	return statuses
+}
+
+// Close stops checking budgets in the background
+func (g *Guard) Close() error {
+	g.cancel()
+	g.wg.Wait()
+	return nil
+}
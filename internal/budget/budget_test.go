@@ -0,0 +1,232 @@
+package budget
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/benbjohnson/clock"
+	"github.com/golang/mock/gomock"
+	m "github.com/launchdarkly/go-test-helpers/v2/matchers"
+	"github.com/pkg/errors"
+	"go.uber.org/zap/zaptest"
+
+	"github.com/ansg191/remote-worker/internal/compute"
+)
+
+// testSpender reports a fixed spend for any window
+type testSpender struct {
+	mtx   sync.Mutex
+	spend float64
+	since time.Time // Start of the last window reported
+}
+
+func (s *testSpender) Spend(since, _ time.Time) float64 {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	s.since = since
+	return s.spend
+}
+
+func (s *testSpender) set(spend float64) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	s.spend = spend
+}
+
+// testQueue records whether it is held. Its other methods, including Pause and
+// Resume, are never called.
+type testQueue struct {
+	compute.WorkQueue
+
+	mtx  sync.Mutex
+	held bool
+}
+
+func (q *testQueue) SetHeld(held bool) {
+	q.mtx.Lock()
+	defer q.mtx.Unlock()
+	q.held = held
+}
+
+func (q *testQueue) Held() bool {
+	q.mtx.Lock()
+	defer q.mtx.Unlock()
+	return q.held
+}
+
+// events collects the events of a guard
+type events struct {
+	mtx    sync.Mutex
+	events []Event
+}
+
+func (e *events) handle(event Event) {
+	e.mtx.Lock()
+	defer e.mtx.Unlock()
+	e.events = append(e.events, event)
+}
+
+func (e *events) types() []EventType {
+	e.mtx.Lock()
+	defer e.mtx.Unlock()
+
+	types := make([]EventType, len(e.events))
+	for i, event := range e.events {
+		types[i] = event.Type
+	}
+	return types
+}
+
+var t0 = time.Date(2022, 9, 3, 8, 0, 0, 0, time.UTC)
+
+func newGuard(t *testing.T, spender Spender, budgets ...Budget) (*Guard, *clock.Mock, *events) {
+	clk := clock.NewMock()
+	clk.Set(t0)
+	ev := &events{}
+
+	g := New(zaptest.NewLogger(t), spender, budgets,
+		WithClock(clk),
+		WithCheckInterval(time.Minute),
+		WithEventHandler(ev.handle))
+	t.Cleanup(func() {
+		_ = g.Close()
+	})
+	return g, clk, ev
+}
+
+func TestGuard_Check(t *testing.T) {
+	spender := &testSpender{spend: 5}
+	queue := &testQueue{}
+	g, clk, ev := newGuard(t, spender, Budget{Name: "daily", Period: Daily, Soft: 10, Hard: 20})
+	g.Watch(queue)
+
+	m.For(t, "under limits").Assert(g.Check(), m.BeNil())
+	m.For(t, "window").Assert(spender.since, m.Equal(time.Date(2022, 9, 3, 0, 0, 0, 0, time.UTC)))
+
+	spender.set(15)
+	m.For(t, "soft err").Assert(g.Check(), m.BeNil())
+	m.For(t, "soft err again").Assert(g.Check(), m.BeNil())
+	m.For(t, "soft event once").Assert(ev.types(), m.Equal([]EventType{SoftLimitReached}))
+
+	spender.set(25)
+	err := g.Check()
+	var exceeded *ExceededError
+	m.For(t, "error type").Require(errors.As(err, &exceeded), m.Equal(true))
+	m.For(t, "typed error").Assert(errors.Is(err, compute.ErrBudgetExceeded), m.Equal(true))
+	m.For(t, "exceeded budget").Assert(exceeded.Budget.Name, m.Equal("daily"))
+	m.For(t, "exceeded spend").Assert(exceeded.Spend, m.Equal(25.0))
+	m.For(t, "held").Assert(queue.Held(), m.Equal(true))
+	m.For(t, "hard event").Assert(ev.types(), m.Equal([]EventType{SoftLimitReached, HardLimitReached}))
+
+	// The next day starts a new window, resumed by the background check
+	spender.set(0)
+	clk.Add(16 * time.Hour)
+	deadline := time.Now().Add(time.Second)
+	for queue.Held() {
+		if time.Now().After(deadline) {
+			t.Fatal("held work not resumed")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	m.For(t, "resumed event").Assert(ev.types(), m.Equal([]EventType{SoftLimitReached, HardLimitReached, WorkResumed}))
+
+	statuses := g.Status()
+	m.For(t, "statuses").Require(statuses, m.Length().Should(m.Equal(1)))
+	m.For(t, "new window").Assert(statuses[0].Since, m.Equal(time.Date(2022, 9, 4, 0, 0, 0, 0, time.UTC)))
+	m.For(t, "not exceeded").Assert(statuses[0].Exceeded, m.Equal(false))
+
+	// Limits reached again in the new window are reported again
+	spender.set(15)
+	m.For(t, "new window err").Assert(g.Check(), m.BeNil())
+	m.For(t, "new window event").Assert(ev.types(), m.Length().Should(m.Equal(4)))
+}
+
+func TestGuard_Override(t *testing.T) {
+	spender := &testSpender{spend: 150}
+	queue := &testQueue{}
+	g, clk, _ := newGuard(t, spender,
+		Budget{Name: "monthly", Period: Monthly, Hard: 100},
+		Budget{Name: "daily", Period: Daily, Hard: 200})
+	g.Watch(queue)
+
+	m.For(t, "held").Assert(queue.Held(), m.Equal(true))
+
+	err := g.Override("monthly", time.Hour)
+	m.For(t, "override err").Require(err, m.BeNil())
+	m.For(t, "resumed").Assert(queue.Held(), m.Equal(false))
+	m.For(t, "overridden err").Assert(g.Check(), m.BeNil())
+
+	statuses := g.Status()
+	m.For(t, "override").Assert(statuses[0].Override, m.Equal(t0.Add(time.Hour)))
+	m.For(t, "month").Assert(statuses[0].Since, m.Equal(time.Date(2022, 9, 1, 0, 0, 0, 0, time.UTC)))
+
+	// Other hard limits are still enforced
+	spender.set(250)
+	err = g.Check()
+	var exceeded *ExceededError
+	m.For(t, "daily exceeded").Require(errors.As(err, &exceeded), m.Equal(true))
+	m.For(t, "daily budget").Assert(exceeded.Budget.Name, m.Equal("daily"))
+
+	// The override ends
+	spender.set(150)
+	clk.Add(2 * time.Hour)
+	err = g.Check()
+	m.For(t, "override ended").Require(errors.As(err, &exceeded), m.Equal(true))
+	m.For(t, "monthly budget").Assert(exceeded.Budget.Name, m.Equal("monthly"))
+	m.For(t, "held again").Assert(queue.Held(), m.Equal(true))
+
+	err = g.Override("weekly", 0)
+	m.For(t, "unknown").Assert(errors.Is(err, ErrUnknownBudget), m.Equal(true))
+}
+
+func TestGuard_Reset(t *testing.T) {
+	spender := &testSpender{}
+	g, clk, _ := newGuard(t, spender,
+		Budget{Name: "backfill", Period: Batch, Hard: 100},
+		Budget{Name: "daily", Period: Daily, Hard: 100})
+
+	_ = g.Check()
+	m.For(t, "batch start").Assert(g.Status()[0].Since, m.Equal(t0))
+
+	clk.Add(time.Hour)
+	err := g.Reset("backfill")
+	m.For(t, "reset err").Require(err, m.BeNil())
+	m.For(t, "reset start").Assert(g.Status()[0].Since, m.Equal(t0.Add(time.Hour)))
+
+	err = g.Reset("daily")
+	m.For(t, "not batch").Assert(errors.Is(err, ErrNotBatch), m.Equal(true))
+	err = g.Reset("weekly")
+	m.For(t, "unknown").Assert(errors.Is(err, ErrUnknownBudget), m.Equal(true))
+}
+
+func TestGuard_Factory(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	t.Cleanup(func() {
+		ctrl.Finish()
+	})
+
+	spender := &testSpender{}
+	g, _, _ := newGuard(t, spender, Budget{Name: "daily", Period: Daily, Hard: 100})
+
+	worker := compute.NewMockWorker(ctrl)
+	mFactory := compute.NewMockWorkerFactory(ctrl)
+	mFactory.EXPECT().Create(gomock.Any()).Return(worker, nil)
+
+	factory := g.Factory(mFactory)
+
+	created, err := factory.Create(context.Background())
+	m.For(t, "create err").Require(err, m.BeNil())
+	m.For(t, "worker").Assert(created, m.Equal(worker))
+
+	spender.set(100)
+	_, err = factory.Create(context.Background())
+	m.For(t, "refused").Assert(errors.Is(err, compute.ErrBudgetExceeded), m.Equal(true))
+
+	// Pools find the optional interfaces of the wrapped factory, e.g. to
+	// attach existing instances regardless of budgets
+	wrapper, ok := factory.(compute.FactoryWrapper)
+	m.For(t, "wrapper").Require(ok, m.Equal(true))
+	m.For(t, "unwrap").Assert(wrapper.Unwrap(), m.Equal(compute.WorkerFactory(mFactory)))
+}
@@ -0,0 +1,46 @@
+package budget
+
+import "time"
+
+type EventType int
+
+const (
+	// SoftLimitReached is emitted once per window when the spend of a budget
+	// reaches its soft limit
+	SoftLimitReached EventType = iota
+	// HardLimitReached is emitted once per window when the spend of a budget
+	// reaches its hard limit. New workers are refused and queued work is held
+	// unless the budget is overridden.
+	HardLimitReached
+	// WorkResumed is emitted when held work is resumed because every hard
+	// limit is respected again
+	WorkResumed
+)
+
+func (t EventType) String() string {
+	switch t {
+	case SoftLimitReached:
+		return "soft_limit_reached"
+	case HardLimitReached:
+		return "hard_limit_reached"
+	case WorkResumed:
+		return "work_resumed"
+	default:
+		return "unknown"
+	}
+}
+
+type Event struct {
+	Type EventType
+	Time time.Time
+
+	// Budget is the budget whose limit was reached. Unset for WorkResumed
+	// events.
+	Budget Budget
+	// Spend is the spend of the budget in its current window
+	Spend float64
+}
+
+// EventHandler receives the events of all budgets. Handlers are called with
+// the guard locked, so they must not block or call the guard.
+type EventHandler func(event Event)
@@ -0,0 +1,31 @@
+package budget
+
+import (
+	"context"
+
+	"github.com/ansg191/remote-worker/internal/compute"
+)
+
+// Factory wraps factory to refuse to create workers with an *ExceededError
+// while a hard limit of g is exceeded. Pools find the optional interfaces of
+// factory, e.g. compute.CapableFactory, through compute.FactoryWrapper, so
+// attaching to and terminating existing instances is never refused.
+func (g *Guard) Factory(factory compute.WorkerFactory) compute.WorkerFactory {
+	return &guardedFactory{guard: g, factory: factory}
+}
+
+type guardedFactory struct {
+	guard   *Guard
+	factory compute.WorkerFactory
+}
+
+func (f *guardedFactory) Create(ctx context.Context) (compute.Worker, error) {
+	if err := f.guard.Check(); err != nil {
+		return nil, err
+	}
+	return f.factory.Create(ctx)
+}
+
+func (f *guardedFactory) Unwrap() compute.WorkerFactory {
+	return f.factory
+}
@@ -0,0 +1,47 @@
+package budget
+
+import (
+	"time"
+
+	"github.com/benbjohnson/clock"
+)
+
+type Options struct {
+	// CheckInterval is how often budgets are evaluated in the background, to
+	// emit events and resume held work once a new window starts. Defaults to
+	// 1 minute.
+	CheckInterval time.Duration
+	// Location is the time zone of the days and months of Daily and Monthly
+	// budgets. Defaults to UTC.
+	Location *time.Location
+	// EventHandlers are called with every Event.
+	EventHandlers []EventHandler
+	// Clock is the time source of the guard.
+	Clock clock.Clock
+}
+
+type OptionsFunc func(options *Options)
+
+func WithCheckInterval(interval time.Duration) OptionsFunc {
+	return func(opts *Options) {
+		opts.CheckInterval = interval
+	}
+}
+
+func WithLocation(loc *time.Location) OptionsFunc {
+	return func(opts *Options) {
+		opts.Location = loc
+	}
+}
+
+func WithEventHandler(handler EventHandler) OptionsFunc {
+	return func(opts *Options) {
+		opts.EventHandlers = append(opts.EventHandlers, handler)
+	}
+}
+
+func WithClock(clock clock.Clock) OptionsFunc {
+	return func(opts *Options) {
+		opts.Clock = clock
+	}
+}
@@ -0,0 +1,151 @@
+package compute
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/pkg/errors"
+
+	"github.com/ansg191/remote-worker/api/proto"
+)
+
+// GiB is the number of bytes in a gibibyte
+const GiB = 1 << 30
+
+// ErrNoMatchingWorker is returned by Pool.GetWorkerFor when no worker
+// satisfying the requirements exists or can be provisioned
+var ErrNoMatchingWorker = errors.New("no worker matches the requirements")
+
+// Requirements are the capabilities a worker needs to run work. The zero value
+// is satisfied by any worker.
+type Requirements struct {
+	// GPU requires a GPU
+	GPU bool `json:"gpu,omitempty"`
+	// GPUVendor requires a GPU of the vendor, e.g. NVIDIA. It is matched
+	// case-insensitively against the PCI vendor name and implies GPU.
+	GPUVendor string `json:"gpuVendor,omitempty"`
+	// MinScratch is the minimum scratch storage in bytes
+	MinScratch uint64 `json:"minScratch,omitempty"`
+	// MinThreads is the minimum number of hardware threads
+	MinThreads uint32 `json:"minThreads,omitempty"`
+	// Labels must all be advertised by the worker with the same value
+	Labels map[string]string `json:"labels,omitempty"`
+}
+
+// IsZero reports whether r is satisfied by any worker
+func (r Requirements) IsZero() bool {
+	return !r.GPU && r.GPUVendor == "" && r.MinScratch == 0 && r.MinThreads == 0 && len(r.Labels) == 0
+}
+
+func (r Requirements) String() string {
+	var parts []string
+	switch {
+	case r.GPUVendor != "":
+		parts = append(parts, "gpu="+r.GPUVendor)
+	case r.GPU:
+		parts = append(parts, "gpu")
+	}
+	if r.MinScratch > 0 {
+		parts = append(parts, fmt.Sprintf("scratch>=%dGiB", (r.MinScratch+GiB-1)/GiB))
+	}
+	if r.MinThreads > 0 {
+		parts = append(parts, fmt.Sprintf("threads>=%d", r.MinThreads))
+	}
+	keys := make([]string, 0, len(r.Labels))
+	for key := range r.Labels {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		parts = append(parts, key+"="+r.Labels[key])
+	}
+	return strings.Join(parts, ", ")
+}
+
+// includes reports whether r requires at least what match requires
+func (r Requirements) includes(match Requirements) bool {
+	if match.GPU && !r.GPU && r.GPUVendor == "" {
+		return false
+	}
+	if match.GPUVendor != "" && !strings.EqualFold(r.GPUVendor, match.GPUVendor) {
+		return false
+	}
+	if r.MinScratch < match.MinScratch || r.MinThreads < match.MinThreads {
+		return false
+	}
+	for key, value := range match.Labels {
+		if v, ok := r.Labels[key]; !ok || v != value {
+			return false
+		}
+	}
+	return true
+}
+
+// Capabilities are the resources and labels a worker offers
+type Capabilities struct {
+	// GPUs holds the PCI vendor name of every GPU of the worker
+	GPUs []string
+	// Scratch is the storage in bytes available to work
+	Scratch uint64
+	// Threads is the number of hardware threads
+	Threads uint32
+	// Labels are the labels advertised by the worker
+	Labels map[string]string
+}
+
+// CapabilitiesFromInfo returns the capabilities reported by
+// WorkerService.Info
+func CapabilitiesFromInfo(info *proto.WorkerInfoResponse) Capabilities {
+	c := Capabilities{
+		Scratch: info.GetScratchBytes(),
+		Threads: info.GetCpu().GetThreads(),
+		Labels:  info.GetLabels(),
+	}
+	if c.Scratch == 0 {
+		// Workers that can't locate their scratch filesystem report their
+		// total storage
+		c.Scratch = info.GetStorage().GetTotalBytes()
+	}
+	for _, card := range info.GetGpu().GetCard() {
+		c.GPUs = append(c.GPUs, card.GetDevice().GetVendor().GetName())
+	}
+	return c
+}
+
+// Satisfies reports whether a worker with capabilities c can run work
+// requiring r
+func (c Capabilities) Satisfies(r Requirements) bool {
+	if (r.GPU || r.GPUVendor != "") && !c.hasGPU(r.GPUVendor) {
+		return false
+	}
+	if c.Scratch < r.MinScratch || c.Threads < r.MinThreads {
+		return false
+	}
+	for key, value := range r.Labels {
+		if v, ok := c.Labels[key]; !ok || v != value {
+			return false
+		}
+	}
+	return true
+}
+
+// hasGPU reports whether c has a GPU of vendor, or any GPU if vendor is empty
+func (c Capabilities) hasGPU(vendor string) bool {
+	vendor = strings.ToLower(vendor)
+	for _, name := range c.GPUs {
+		if strings.Contains(strings.ToLower(name), vendor) {
+			return true
+		}
+	}
+	return false
+}
+
+// CapableFactory is implemented by factories that know the capabilities of
+// the workers they create before creating them. Pools only create workers
+// from them for work they satisfy, and trust them without waiting for the
+// worker to be connected. Workers of other factories are checked once
+// connected.
+type CapableFactory interface {
+	Capabilities() Capabilities
+}
@@ -0,0 +1,58 @@
+package compute
+
+import (
+	"testing"
+
+	m "github.com/launchdarkly/go-test-helpers/v2/matchers"
+
+	"github.com/ansg191/remote-worker/api/proto"
+)
+
+func TestCapabilities_Satisfies(t *testing.T) {
+	caps := CapabilitiesFromInfo(&proto.WorkerInfoResponse{
+		Cpu:     &proto.CPUInfo{Threads: 16},
+		Storage: &proto.StorageInfo{TotalBytes: 200 * GiB},
+		Gpu: &proto.GPUInfo{Card: []*proto.GPUInfo_Card{{
+			Device: &proto.PCIInfo_Device{Vendor: &proto.PCIInfo_Vendor{Name: "NVIDIA Corporation"}},
+		}}},
+		Labels: map[string]string{"region": "eu", "tier": "fast"},
+	})
+	m.For(t, "scratch from storage").Assert(caps.Scratch, m.Equal(uint64(200*GiB)))
+
+	tests := []struct {
+		name string
+		req  Requirements
+		want bool
+	}{
+		{"none", Requirements{}, true},
+		{"gpu", Requirements{GPU: true}, true},
+		{"gpu vendor", Requirements{GPUVendor: "nvidia"}, true},
+		{"other gpu vendor", Requirements{GPUVendor: "AMD"}, false},
+		{"threads", Requirements{MinThreads: 16}, true},
+		{"too many threads", Requirements{MinThreads: 32}, false},
+		{"scratch", Requirements{MinScratch: 100 * GiB}, true},
+		{"too much scratch", Requirements{MinScratch: 300 * GiB}, false},
+		{"labels", Requirements{Labels: map[string]string{"region": "eu"}}, true},
+		{"label value", Requirements{Labels: map[string]string{"region": "us"}}, false},
+		{"missing label", Requirements{Labels: map[string]string{"zone": "a"}}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m.For(t, "satisfies").Assert(caps.Satisfies(tt.req), m.Equal(tt.want))
+		})
+	}
+
+	m.For(t, "no gpu").Assert(Capabilities{}.Satisfies(Requirements{GPU: true}), m.Equal(false))
+}
+
+func TestRequirements_String(t *testing.T) {
+	req := Requirements{
+		GPU:        true,
+		MinScratch: 100 * GiB,
+		MinThreads: 16,
+		Labels:     map[string]string{"tier": "fast", "region": "eu"},
+	}
+	m.For(t, "string").Assert(req.String(), m.Equal("gpu, scratch>=100GiB, threads>=16, region=eu, tier=fast"))
+	m.For(t, "zero").Assert(Requirements{}.IsZero(), m.Equal(true))
+	m.For(t, "not zero").Assert(req.IsZero(), m.Equal(false))
+}
@@ -0,0 +1,99 @@
+package compute
+
+import "time"
+
+type PoolEventType int
+
+const (
+	// WorkerCreated is emitted after WorkerFactory.Create returns a new worker
+	WorkerCreated PoolEventType = iota
+	// WorkerRemoved is emitted after a worker has been removed from the pool
+	WorkerRemoved
+)
+
+func (t PoolEventType) String() string {
+	switch t {
+	case WorkerCreated:
+		return "created"
+	case WorkerRemoved:
+		return "removed"
+	default:
+		return "unknown"
+	}
+}
+
+// RemovalReason describes why a worker was removed from a pool
+type RemovalReason string
+
+const (
+	ReasonIdle       RemovalReason = "idle"        // Idle longer than IdleTimeout
+	ReasonUnhealthy  RemovalReason = "unhealthy"   // Failed consecutive health checks
+	ReasonClosed     RemovalReason = "closed"      // Worker was found already closed
+	ReasonFailed     RemovalReason = "failed"      // Worker was removed after failing work
+	ReasonPoolClosed RemovalReason = "pool_closed" // Pool was closed
+	ReasonScaledDown RemovalReason = "scaled_down" // Closed by Pool.Shrink
+	ReasonReplaced   RemovalReason = "replaced"    // Closed for a worker matching the requirements of work
+)
+
+type PoolEvent struct {
+	Type   PoolEventType
+	Worker Worker
+	Time   time.Time
+
+	// Duration is how long WorkerFactory.Create took for WorkerCreated events
+	Duration time.Duration
+	// Warm is set for WorkerCreated events of workers provisioned to keep
+	// MinWarm workers in the pool
+	Warm bool
+	// Factory is the name of the factory that created the worker for
+	// WorkerCreated events
+	Factory string
+
+	// Reason is set for WorkerRemoved events
+	Reason RemovalReason
+	// Err is the last error that caused the removal, if any
+	Err error
+}
+
+type PoolEventHandler func(event PoolEvent)
+
+type QueueEventType int
+
+const (
+	// WorkStarted is emitted when an attempt of work starts running after its
+	// worker is ready and connected
+	WorkStarted QueueEventType = iota
+	// WorkFinished is emitted once work succeeded or finally failed
+	WorkFinished
+)
+
+func (t QueueEventType) String() string {
+	switch t {
+	case WorkStarted:
+		return "started"
+	case WorkFinished:
+		return "finished"
+	default:
+		return "unknown"
+	}
+}
+
+type QueueEvent struct {
+	Type   QueueEventType
+	WorkID WorkID
+	Tenant string
+	Time   time.Time
+
+	// Worker running the work, set for WorkStarted events
+	Worker Worker
+	// Wait is how long the work was queued before it started, set for
+	// WorkStarted events
+	Wait time.Duration
+	// Duration is how long the last attempt ran, set for WorkFinished events
+	// of work that ran
+	Duration time.Duration
+	// Err is the final error of failed work, set for WorkFinished events
+	Err error
+}
+
+type QueueEventHandler func(event QueueEvent)
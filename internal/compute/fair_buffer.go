@@ -0,0 +1,151 @@
+package compute
+
+// fairBuffer shares dispatching between tenants with deficit round-robin.
+// Every tenant with waiting work gets its weight in dispatches per round, so a
+// tenant with a large backlog can't block other tenants. Within a tenant, work
+// is ordered by the buffer created by newBuffer.
+//
+// Tenants at their concurrency limit are skipped until done is called for one
+// of their dispatched items.
+type fairBuffer struct {
+	newBuffer func() workBuffer
+	weight    func(tenant string) int
+	limit     func(tenant string) int
+
+	tenants map[string]*tenantQueue // Tenants with buffered or dispatched work
+	ring    []*tenantQueue          // Tenants with buffered work in round-robin order
+	cursor  int                     // Index in ring of the tenant whose turn it is
+	size    int
+}
+
+type tenantQueue struct {
+	name    string
+	buffer  workBuffer
+	deficit int // Dispatches left in the current turn
+	running int // Dispatched work not yet done
+}
+
+func newFairBuffer(newBuffer func() workBuffer, weight, limit func(tenant string) int) *fairBuffer {
+	return &fairBuffer{
+		newBuffer: newBuffer,
+		weight:    weight,
+		limit:     limit,
+		tenants:   make(map[string]*tenantQueue),
+	}
+}
+
+func (b *fairBuffer) push(item *workItem) {
+	name := item.info.getTenant()
+
+	t, ok := b.tenants[name]
+	if !ok {
+		t = &tenantQueue{name: name, buffer: b.newBuffer()}
+		b.tenants[name] = t
+	}
+	if t.buffer.len() == 0 {
+		// Join the end of the round
+		b.ring = append(b.ring, t)
+	}
+
+	t.buffer.push(item)
+	b.size++
+}
+
+func (b *fairBuffer) pop() (*workItem, bool) {
+	for i := 0; i < len(b.ring); i++ {
+		t := b.ring[b.cursor]
+
+		if limit := b.limit(t.name); limit > 0 && t.running >= limit {
+			// Skip the tenant's turn without saving it
+			t.deficit = 0
+			b.advance()
+			continue
+		}
+
+		if t.deficit <= 0 {
+			t.deficit = b.weight(t.name)
+			if t.deficit <= 0 {
+				t.deficit = 1
+			}
+		}
+
+		item, _ := t.buffer.pop()
+		t.deficit--
+		t.running++
+		b.size--
+
+		if t.buffer.len() == 0 {
+			t.deficit = 0
+			b.leave(b.cursor)
+		} else if t.deficit <= 0 {
+			b.advance()
+		}
+
+		return item, true
+	}
+
+	return nil, false
+}
+
+func (b *fairBuffer) remove(item *workItem) bool {
+	t, ok := b.tenants[item.info.getTenant()]
+	if !ok || !t.buffer.remove(item) {
+		return false
+	}
+	b.size--
+
+	if t.buffer.len() == 0 {
+		t.deficit = 0
+		for i, other := range b.ring {
+			if other == t {
+				b.leave(i)
+				break
+			}
+		}
+		b.forget(t)
+	}
+	return true
+}
+
+func (b *fairBuffer) len() int {
+	return b.size
+}
+
+// done reports that dispatched item no longer counts against its tenant's
+// concurrency limit
+func (b *fairBuffer) done(item *workItem) {
+	t, ok := b.tenants[item.info.getTenant()]
+	if !ok {
+		return
+	}
+
+	t.running--
+	b.forget(t)
+}
+
+// advance passes the turn to the next tenant
+func (b *fairBuffer) advance() {
+	b.cursor++
+	if b.cursor >= len(b.ring) {
+		b.cursor = 0
+	}
+}
+
+// leave removes the tenant at index i from the round. The turn passes to the
+// tenant after it.
+func (b *fairBuffer) leave(i int) {
+	b.ring = remove(b.ring, i)
+	if i < b.cursor {
+		b.cursor--
+	}
+	if b.cursor >= len(b.ring) {
+		b.cursor = 0
+	}
+}
+
+// forget drops a tenant without buffered or dispatched work
+func (b *fairBuffer) forget(t *tenantQueue) {
+	if t.running <= 0 && t.buffer.len() == 0 {
+		delete(b.tenants, t.name)
+	}
+}
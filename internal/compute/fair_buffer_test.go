@@ -0,0 +1,99 @@
+package compute
+
+import (
+	"context"
+	"testing"
+
+	m "github.com/launchdarkly/go-test-helpers/v2/matchers"
+)
+
+func newTenantWork(req, tenant string) *workItem {
+	work := NewWorkInfo[string, any](context.Background(), req, nil)
+	work.Tenant = tenant
+	return &workItem{info: work}
+}
+
+func newTestFairBuffer(weights, limits map[string]int) *fairBuffer {
+	opts := &QueueOptions{TenantWeights: weights, TenantLimits: limits}
+	return newFairBuffer(func() workBuffer { return newFIFOBuffer() }, opts.tenantWeight, opts.tenantLimit)
+}
+
+func TestFairBuffer(t *testing.T) {
+	t.Run("round-robin", func(t *testing.T) {
+		b := newTestFairBuffer(nil, nil)
+		for _, req := range []string{"a1", "a2", "a3", "a4"} {
+			b.push(newTenantWork(req, "a"))
+		}
+		b.push(newTenantWork("b1", "b"))
+		b.push(newTenantWork("b2", "b"))
+		b.push(newTenantWork("c1", "c"))
+
+		m.For(t, "len").Assert(b.len(), m.Equal(7))
+		m.For(t, "order").Assert(popAll(t, b), m.Items(
+			m.Equal("a1"), m.Equal("b1"), m.Equal("c1"),
+			m.Equal("a2"), m.Equal("b2"),
+			m.Equal("a3"),
+			m.Equal("a4"),
+		))
+		m.For(t, "len").Assert(b.len(), m.Equal(0))
+	})
+
+	t.Run("weights", func(t *testing.T) {
+		b := newTestFairBuffer(map[string]int{"a": 3}, nil)
+		for _, req := range []string{"a1", "a2", "a3", "a4", "a5"} {
+			b.push(newTenantWork(req, "a"))
+		}
+		b.push(newTenantWork("b1", "b"))
+		b.push(newTenantWork("b2", "b"))
+
+		m.For(t, "order").Assert(popAll(t, b), m.Items(
+			m.Equal("a1"), m.Equal("a2"), m.Equal("a3"), m.Equal("b1"),
+			m.Equal("a4"), m.Equal("a5"), m.Equal("b2"),
+		))
+	})
+
+	t.Run("late tenant joins round", func(t *testing.T) {
+		b := newTestFairBuffer(nil, nil)
+		b.push(newTenantWork("a1", "a"))
+		b.push(newTenantWork("a2", "a"))
+		b.push(newTenantWork("a3", "a"))
+
+		item, _ := b.pop()
+		m.For(t, "first").Assert(item.info.getReq(), m.Equal("a1"))
+
+		b.push(newTenantWork("b1", "b"))
+		m.For(t, "order").Assert(popAll(t, b), m.Items(
+			m.Equal("a2"), m.Equal("b1"), m.Equal("a3"),
+		))
+	})
+
+	t.Run("limits", func(t *testing.T) {
+		b := newTestFairBuffer(nil, map[string]int{"a": 1})
+		a1 := newTenantWork("a1", "a")
+		b.push(a1)
+		b.push(newTenantWork("a2", "a"))
+		b.push(newTenantWork("b1", "b"))
+		b.push(newTenantWork("b2", "b"))
+
+		m.For(t, "order").Assert(popAll(t, b), m.Items(
+			m.Equal("a1"), m.Equal("b1"), m.Equal("b2"),
+		))
+		m.For(t, "held back").Assert(b.len(), m.Equal(1))
+
+		b.done(a1)
+		m.For(t, "after done").Assert(popAll(t, b), m.Items(m.Equal("a2")))
+	})
+
+	t.Run("remove", func(t *testing.T) {
+		b := newTestFairBuffer(nil, nil)
+		a1 := newTenantWork("a1", "a")
+		b.push(a1)
+		b.push(newTenantWork("b1", "b"))
+
+		m.For(t, "removed").Assert(b.remove(a1), m.Equal(true))
+		m.For(t, "removed twice").Assert(b.remove(a1), m.Equal(false))
+		m.For(t, "len").Assert(b.len(), m.Equal(1))
+		m.For(t, "tenants").Assert(b.tenants, m.Length().Should(m.Equal(1)))
+		m.For(t, "order").Assert(popAll(t, b), m.Items(m.Equal("b1")))
+	})
+}
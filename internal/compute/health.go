@@ -0,0 +1,123 @@
+package compute
+
+import (
+	"context"
+	"sync"
+
+	"github.com/benbjohnson/clock"
+	"go.uber.org/zap"
+
+	"github.com/ansg191/remote-worker/api/proto"
+)
+
+// healthCheck periodically checks idle workers with WorkerService.Status and
+// evicts those that fail HealthCheckThreshold consecutive checks. Workers that
+// were never connected, e.g. warm workers, are checked with Worker.IsReady
+// first. Workers are taken from the available workers while they are checked,
+// so that they aren't handed out during the check. It runs until the pool is
+// closed.
+func (p *DefaultPool) healthCheck(ticker *clock.Ticker) {
+	defer p.wg.Done()
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-p.ctx.Done():
+			return
+		case <-ticker.C:
+			p.checkIdle()
+		}
+	}
+}
+
+func (p *DefaultPool) checkIdle() {
+	p.mtx.Lock()
+	idle := make([]Worker, len(p.availableInstances))
+	copy(idle, p.availableInstances)
+	p.mtx.Unlock()
+
+	var wg sync.WaitGroup
+	for _, worker := range idle {
+		wg.Add(1)
+		go func(worker Worker) {
+			defer wg.Done()
+			p.checkWorker(worker)
+		}(worker)
+	}
+	wg.Wait()
+}
+
+func (p *DefaultPool) checkWorker(worker Worker) {
+	p.mtx.Lock()
+	i := find(p.availableInstances, worker)
+	if i < 0 {
+		// Taken since checkIdle listed it
+		p.mtx.Unlock()
+		return
+	}
+	p.availableInstances = remove(p.availableInstances, i)
+	idle := p.idleSince[worker]
+	p.mtx.Unlock()
+
+	checked, err := p.status(worker)
+
+	p.mtx.Lock()
+	var failures int
+	switch {
+	case !checked || p.ctx.Err() != nil:
+		// Worker still booting, or pool closed during the check
+	case err == nil:
+		delete(p.healthFailures, worker)
+	default:
+		p.healthFailures[worker]++
+		failures = p.healthFailures[worker]
+
+		p.logger.Warn("Worker health check failed",
+			zap.Int("failures", failures),
+			zap.Int("threshold", p.options.HealthCheckThreshold),
+			zap.Error(err))
+	}
+
+	if failures < p.options.HealthCheckThreshold {
+		p.mtx.Unlock()
+		p.putBack(worker, idle)
+		return
+	}
+
+	p.forget(worker)
+	p.signal()
+	p.mtx.Unlock()
+
+	p.logger.Error("Evicting unhealthy worker",
+		zap.Int("failures", failures),
+		zap.Error(err))
+
+	if closeErr := worker.Close(); closeErr != nil && closeErr != ErrClosed {
+		p.logger.Error("error closing unhealthy worker", zap.Error(closeErr))
+	}
+	p.emit(PoolEvent{Type: WorkerRemoved, Worker: worker, Reason: ReasonUnhealthy, Err: err})
+}
+
+// status checks worker with WorkerService.Status, connecting it first if
+// needed. It returns false if the worker is not ready yet, e.g. still
+// booting, so that there is nothing to check.
+func (p *DefaultPool) status(worker Worker) (bool, error) {
+	ctx, cancel := context.WithTimeout(p.ctx, p.options.HealthCheckTimeout)
+	defer cancel()
+
+	client := worker.Worker()
+	if client == nil {
+		// Errors of IsReady, e.g. of reclaimed instances, fail the check
+		ready, err := worker.IsReady(ctx, WithConnTimeout(p.options.HealthCheckTimeout))
+		if err != nil {
+			return true, err
+		}
+		if !ready {
+			return false, nil
+		}
+		client = worker.Worker()
+	}
+
+	_, err := client.Status(ctx, &proto.WorkerStatusRequest{})
+	return true, err
+}
@@ -0,0 +1,328 @@
+package compute
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/benbjohnson/clock"
+	"github.com/golang/mock/gomock"
+	m "github.com/launchdarkly/go-test-helpers/v2/matchers"
+	"go.uber.org/zap/zaptest"
+	"google.golang.org/grpc"
+
+	"github.com/ansg191/remote-worker/api/proto"
+)
+
+type statusClient struct {
+	proto.WorkerServiceClient
+	err    error
+	called chan struct{}
+}
+
+func (c *statusClient) Status(context.Context, *proto.WorkerStatusRequest, ...grpc.CallOption) (*proto.WorkerStatusResponse, error) {
+	defer func() { c.called <- struct{}{} }()
+	if c.err != nil {
+		return nil, c.err
+	}
+	return &proto.WorkerStatusResponse{Msg: "OK"}, nil
+}
+
+// blockingStatusClient signals checking and blocks until release is closed
+// when WorkerService.Status is called
+type blockingStatusClient struct {
+	proto.WorkerServiceClient
+	checking chan struct{}
+	release  chan struct{}
+}
+
+func (c *blockingStatusClient) Status(context.Context, *proto.WorkerStatusRequest, ...grpc.CallOption) (*proto.WorkerStatusResponse, error) {
+	c.checking <- struct{}{}
+	<-c.release
+	return &proto.WorkerStatusResponse{Msg: "OK"}, nil
+}
+
+// waitAvailable waits for pool to have n available workers
+func waitAvailable(t *testing.T, pool Pool, n int) {
+	t.Helper()
+
+	deadline := time.Now().Add(time.Second)
+	for pool.Stats().Available != n {
+		if time.Now().After(deadline) {
+			t.Fatalf("%d workers not available", n)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestDefaultPool_healthCheck(t *testing.T) {
+	logger := zaptest.NewLogger(t)
+
+	ctrl := gomock.NewController(t)
+	t.Cleanup(func() {
+		ctrl.Finish()
+	})
+
+	t.Run("unhealthy worker evicted", func(t *testing.T) {
+		expectedErr := errors.New("connection refused")
+		client := &statusClient{err: expectedErr, called: make(chan struct{}, 1)}
+
+		mWorker := NewMockWorker(ctrl)
+		mWorker.EXPECT().
+			Equals(gomock.Any()).
+			Return(true).
+			AnyTimes()
+		mWorker.EXPECT().
+			Worker().
+			Return(client).
+			Times(2)
+		mWorker.EXPECT().
+			Close().
+			Return(nil)
+
+		mWorkerFactory := NewMockWorkerFactory(ctrl)
+		mWorkerFactory.EXPECT().
+			Create(gomock.Any()).
+			Return(mWorker, nil)
+
+		events := make(chan PoolEvent, 4)
+		mClock := clock.NewMock()
+		pool := NewPool(logger, mWorkerFactory,
+			WithHealthCheckInterval(time.Minute),
+			WithHealthCheckThreshold(2),
+			WithPoolEventHandler(func(event PoolEvent) {
+				events <- event
+			}),
+			WithPoolClock(mClock),
+		)
+		dp := pool.(*DefaultPool)
+
+		worker, err := pool.GetWorker(context.Background())
+		m.For(t, "err").Require(err, m.BeNil())
+		m.For(t, "created event").Assert((<-events).Type, m.Equal(WorkerCreated))
+		pool.ReturnWorker(worker)
+
+		for i := 0; i < 2; i++ {
+			mClock.Add(time.Minute)
+			select {
+			case <-client.called:
+			case <-time.After(time.Second):
+				t.Fatal("health check not run")
+			}
+		}
+
+		select {
+		case event := <-events:
+			m.For(t, "event").For("type").Assert(event.Type, m.Equal(WorkerRemoved))
+			m.For(t, "event").For("reason").Assert(event.Reason, m.Equal(ReasonUnhealthy))
+			m.For(t, "event").For("err").Assert(event.Err, m.Equal(expectedErr))
+		case <-time.After(time.Second):
+			t.Fatal("unhealthy worker not evicted")
+		}
+
+		dp.mtx.Lock()
+		m.For(t, "allWorkers").Assert(dp.allInstances, m.Length().Should(m.Equal(0)))
+		m.For(t, "availableWorkers").Assert(dp.availableInstances, m.Length().Should(m.Equal(0)))
+		dp.mtx.Unlock()
+
+		err = pool.Close()
+		m.For(t, "close err").Assert(err, m.BeNil())
+	})
+
+	t.Run("unconnected worker checked", func(t *testing.T) {
+		terminated := errors.New("instance terminated")
+		checked := make(chan struct{}, 1)
+		results := []error{nil, terminated, terminated}
+
+		mWorker := NewMockWorker(ctrl)
+		mWorker.EXPECT().
+			Equals(gomock.Any()).
+			Return(true).
+			AnyTimes()
+		mWorker.EXPECT().
+			Worker().
+			Return(nil).
+			Times(3)
+		// Not ready while booting, then reclaimed
+		mWorker.EXPECT().
+			IsReady(gomock.Any(), gomock.Any()).
+			DoAndReturn(func(ctx context.Context, opts ...ReadyOptionsFunc) (bool, error) {
+				defer func() { checked <- struct{}{} }()
+				err := results[0]
+				results = results[1:]
+				return false, err
+			}).
+			Times(3)
+		mWorker.EXPECT().
+			Close().
+			Return(nil)
+
+		mWorkerFactory := NewMockWorkerFactory(ctrl)
+		gomock.InOrder(
+			mWorkerFactory.EXPECT().
+				Create(gomock.Any()).
+				Return(mWorker, nil),
+			// The evicted warm worker is not replaced
+			mWorkerFactory.EXPECT().
+				Create(gomock.Any()).
+				Return(nil, errors.New("no capacity")).
+				AnyTimes(),
+		)
+
+		events := make(chan PoolEvent, 4)
+		mClock := clock.NewMock()
+		pool := NewPool(logger, mWorkerFactory,
+			WithMinWarm(1),
+			WithHealthCheckInterval(time.Minute),
+			WithHealthCheckThreshold(2),
+			WithPoolEventHandler(func(event PoolEvent) {
+				events <- event
+			}),
+			WithPoolClock(mClock),
+		)
+		dp := pool.(*DefaultPool)
+
+		m.For(t, "created event").Assert((<-events).Type, m.Equal(WorkerCreated))
+		deadline := time.Now().Add(time.Second)
+		for pool.Stats().Available != 1 {
+			if time.Now().After(deadline) {
+				t.Fatal("warm worker not available")
+			}
+			time.Sleep(time.Millisecond)
+		}
+
+		for i := 0; i < 3; i++ {
+			mClock.Add(time.Minute)
+			select {
+			case <-checked:
+			case <-time.After(time.Second):
+				t.Fatal("health check not run")
+			}
+		}
+
+		select {
+		case event := <-events:
+			m.For(t, "event").For("type").Assert(event.Type, m.Equal(WorkerRemoved))
+			m.For(t, "event").For("reason").Assert(event.Reason, m.Equal(ReasonUnhealthy))
+			m.For(t, "event").For("err").Assert(event.Err, m.Equal(terminated))
+		case <-time.After(time.Second):
+			t.Fatal("reclaimed worker not evicted")
+		}
+
+		dp.mtx.Lock()
+		m.For(t, "availableWorkers").Assert(dp.availableInstances, m.Length().Should(m.Equal(0)))
+		dp.mtx.Unlock()
+
+		err := pool.Close()
+		m.For(t, "close err").Assert(err, m.BeNil())
+	})
+
+	t.Run("healthy worker kept", func(t *testing.T) {
+		client := &statusClient{called: make(chan struct{}, 1)}
+
+		mWorker := NewMockWorker(ctrl)
+		mWorker.EXPECT().
+			Equals(gomock.Any()).
+			Return(true).
+			AnyTimes()
+		mWorker.EXPECT().
+			Worker().
+			Return(client).
+			Times(3)
+		mWorker.EXPECT().
+			Close().
+			Return(nil)
+
+		mWorkerFactory := NewMockWorkerFactory(ctrl)
+		mWorkerFactory.EXPECT().
+			Create(gomock.Any()).
+			Return(mWorker, nil)
+
+		mClock := clock.NewMock()
+		pool := NewPool(logger, mWorkerFactory,
+			WithHealthCheckInterval(time.Minute),
+			WithHealthCheckThreshold(1),
+			WithPoolClock(mClock),
+		)
+		dp := pool.(*DefaultPool)
+
+		worker, err := pool.GetWorker(context.Background())
+		m.For(t, "err").Require(err, m.BeNil())
+		pool.ReturnWorker(worker)
+
+		for i := 0; i < 3; i++ {
+			mClock.Add(time.Minute)
+			select {
+			case <-client.called:
+			case <-time.After(time.Second):
+				t.Fatal("health check not run")
+			}
+			waitAvailable(t, pool, 1)
+		}
+
+		dp.mtx.Lock()
+		m.For(t, "allWorkers").Assert(dp.allInstances, m.Items(m.Equal(mWorker)))
+		m.For(t, "availableWorkers").Assert(dp.availableInstances, m.Items(m.Equal(mWorker)))
+		dp.mtx.Unlock()
+
+		err = pool.Close()
+		m.For(t, "close err").Assert(err, m.BeNil())
+	})
+
+	t.Run("worker not handed out while checked", func(t *testing.T) {
+		client := &blockingStatusClient{checking: make(chan struct{}, 1), release: make(chan struct{})}
+
+		mWorker := NewMockWorker(ctrl)
+		mWorker.EXPECT().
+			Equals(gomock.Any()).
+			Return(true).
+			AnyTimes()
+		mWorker.EXPECT().
+			Worker().
+			Return(client)
+		mWorker.EXPECT().
+			IsReady(gomock.Any()).
+			Return(true, nil)
+		mWorker.EXPECT().
+			Close().
+			Return(nil)
+
+		mWorkerFactory := NewMockWorkerFactory(ctrl)
+		mWorkerFactory.EXPECT().
+			Create(gomock.Any()).
+			Return(mWorker, nil)
+
+		mClock := clock.NewMock()
+		pool := NewPool(logger, mWorkerFactory,
+			WithMaxWorkers(1),
+			WithFailWhenExhausted(),
+			WithHealthCheckInterval(time.Minute),
+			WithPoolClock(mClock),
+		)
+
+		worker, err := pool.GetWorker(context.Background())
+		m.For(t, "err").Require(err, m.BeNil())
+		pool.ReturnWorker(worker)
+
+		mClock.Add(time.Minute)
+		select {
+		case <-client.checking:
+		case <-time.After(time.Second):
+			t.Fatal("health check not run")
+		}
+
+		_, err = pool.GetWorker(context.Background())
+		m.For(t, "checked err").Assert(errors.Is(err, ErrPoolExhausted), m.Equal(true))
+
+		close(client.release)
+		waitAvailable(t, pool, 1)
+
+		worker, err = pool.GetWorker(context.Background())
+		m.For(t, "err after check").Require(err, m.BeNil())
+		m.For(t, "worker after check").Assert(worker, m.Equal(mWorker))
+
+		err = pool.Close()
+		m.For(t, "close err").Assert(err, m.BeNil())
+	})
+}
@@ -0,0 +1,265 @@
+package compute
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// journalFile is the name of the journal file inside the data directory
+const journalFile = "journal.jsonl"
+
+type JournalEntryType string
+
+const (
+	JournalWorkSubmitted   JournalEntryType = "submitted"
+	JournalWorkStarted     JournalEntryType = "started"
+	JournalWorkFinished    JournalEntryType = "finished"
+	JournalInstanceCreated JournalEntryType = "instance_created"
+	JournalInstanceRemoved JournalEntryType = "instance_removed"
+)
+
+type JournalEntry struct {
+	Type JournalEntryType `json:"type"`
+	Time time.Time        `json:"time"`
+
+	WorkID    WorkID    `json:"workId,omitempty"`
+	Kind      string    `json:"kind,omitempty"`      // Registered work type of submitted work
+	Payload   []byte    `json:"payload,omitempty"`   // Serialized request of submitted work
+	Priority  int       `json:"priority,omitempty"`  // Priority of submitted work
+	Tenant    string    `json:"tenant,omitempty"`    // Tenant of submitted work
+	NotBefore time.Time `json:"notBefore,omitempty"` // Not-before time of submitted work
+	Window    *Window   `json:"window,omitempty"`    // Window of submitted work
+	Error     string    `json:"error,omitempty"`     // Error of finished work
+
+	Requirements *Requirements `json:"requirements,omitempty"` // Requirements of submitted work
+
+	InstanceID string `json:"instanceId,omitempty"` // Instance work started on, or instance created/removed
+	Factory    string `json:"factory,omitempty"`    // Factory of a created instance
+}
+
+// JournalState is the state recovered from a journal
+type JournalState struct {
+	// Pending holds the submitted entries of unfinished work in submission order
+	Pending []JournalEntry
+	// Running maps unfinished, started work to the instance it was running on
+	Running map[WorkID]string
+	// Instances holds the IDs of instances that were never removed
+	Instances []string
+	// Factories maps Instances to the name of the factory that created them,
+	// if it was recorded
+	Factories map[string]string
+}
+
+// Journal durably records submitted, started and finished work and the
+// instances it ran on, so that a restarted manager can recover.
+type Journal interface {
+	io.Closer
+
+	// Record appends entry to the journal
+	Record(entry JournalEntry) error
+	// State returns the state recovered when the journal was opened
+	State() *JournalState
+}
+
+// FileJournal is a Journal stored as a single append-only JSON lines file.
+// The file is compacted to the unfinished state every time it is opened.
+type FileJournal struct {
+	mtx   sync.Mutex
+	file  *os.File
+	state *JournalState
+}
+
+// OpenFileJournal opens or creates the journal in dir
+func OpenFileJournal(dir string) (*FileJournal, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+
+	path := filepath.Join(dir, journalFile)
+
+	entries, err := readJournal(path)
+	if err != nil {
+		return nil, err
+	}
+
+	state, live := replayJournal(entries)
+
+	// Compact by rewriting only entries still relevant, then atomically
+	// replace the old journal.
+	tmpPath := path + ".tmp"
+	tmp, err := os.OpenFile(tmpPath, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0o644)
+	if err != nil {
+		return nil, err
+	}
+	w := bufio.NewWriter(tmp)
+	enc := json.NewEncoder(w)
+	for _, entry := range live {
+		if err = enc.Encode(entry); err != nil {
+			break
+		}
+	}
+	if err == nil {
+		err = w.Flush()
+	}
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		_ = os.Remove(tmpPath)
+		return nil, err
+	}
+	if err = os.Rename(tmpPath, path); err != nil {
+		return nil, err
+	}
+
+	file, err := os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0o644)
+	if err != nil {
+		return nil, err
+	}
+
+	return &FileJournal{
+		file:  file,
+		state: state,
+	}, nil
+}
+
+func readJournal(path string) ([]JournalEntry, error) {
+	file, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer func(file *os.File) {
+		_ = file.Close()
+	}(file)
+
+	var entries []JournalEntry
+
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for scanner.Scan() {
+		var entry JournalEntry
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			// A torn final write from a crash; everything before it is intact
+			break
+		}
+		entries = append(entries, entry)
+	}
+
+	return entries, scanner.Err()
+}
+
+// replayJournal computes the unfinished state of entries and returns the
+// entries needed to reproduce it.
+func replayJournal(entries []JournalEntry) (*JournalState, []JournalEntry) {
+	submitted := make(map[WorkID]JournalEntry)
+	started := make(map[WorkID]JournalEntry)
+	instances := make(map[string]JournalEntry)
+	var order []WorkID
+	var instanceOrder []string
+
+	for _, entry := range entries {
+		switch entry.Type {
+		case JournalWorkSubmitted:
+			submitted[entry.WorkID] = entry
+			order = append(order, entry.WorkID)
+		case JournalWorkStarted:
+			started[entry.WorkID] = entry
+		case JournalWorkFinished:
+			delete(submitted, entry.WorkID)
+			delete(started, entry.WorkID)
+		case JournalInstanceCreated:
+			instances[entry.InstanceID] = entry
+			instanceOrder = append(instanceOrder, entry.InstanceID)
+		case JournalInstanceRemoved:
+			delete(instances, entry.InstanceID)
+		}
+	}
+
+	state := &JournalState{
+		Running:   make(map[WorkID]string),
+		Factories: make(map[string]string),
+	}
+	var live []JournalEntry
+
+	for _, id := range instanceOrder {
+		if entry, ok := instances[id]; ok {
+			state.Instances = append(state.Instances, id)
+			if entry.Factory != "" {
+				state.Factories[id] = entry.Factory
+			}
+			live = append(live, entry)
+			delete(instances, id)
+		}
+	}
+
+	for _, id := range order {
+		entry, ok := submitted[id]
+		if !ok {
+			continue
+		}
+		state.Pending = append(state.Pending, entry)
+		live = append(live, entry)
+		delete(submitted, id)
+
+		if s, ok := started[id]; ok {
+			state.Running[id] = s.InstanceID
+			live = append(live, s)
+		}
+	}
+
+	return state, live
+}
+
+func (j *FileJournal) Record(entry JournalEntry) error {
+	if entry.Time.IsZero() {
+		entry.Time = time.Now()
+	}
+
+	b, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	b = append(b, '\n')
+
+	j.mtx.Lock()
+	defer j.mtx.Unlock()
+
+	if j.file == nil {
+		return errors.New("journal closed")
+	}
+
+	if _, err := j.file.Write(b); err != nil {
+		return err
+	}
+	return j.file.Sync()
+}
+
+func (j *FileJournal) State() *JournalState {
+	return j.state
+}
+
+func (j *FileJournal) Close() error {
+	j.mtx.Lock()
+	defer j.mtx.Unlock()
+
+	if j.file == nil {
+		return nil
+	}
+
+	err := j.file.Close()
+	j.file = nil
+	return err
+}
@@ -0,0 +1,291 @@
+package compute
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/golang/mock/gomock"
+	m "github.com/launchdarkly/go-test-helpers/v2/matchers"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zaptest"
+)
+
+// memJournal is an in-memory Journal
+type memJournal struct {
+	mtx     sync.Mutex
+	state   *JournalState
+	entries []JournalEntry
+}
+
+func (j *memJournal) Record(entry JournalEntry) error {
+	j.mtx.Lock()
+	defer j.mtx.Unlock()
+	j.entries = append(j.entries, entry)
+	return nil
+}
+
+func (j *memJournal) State() *JournalState {
+	return j.state
+}
+
+func (j *memJournal) Close() error {
+	return nil
+}
+
+func (j *memJournal) types() []any {
+	j.mtx.Lock()
+	defer j.mtx.Unlock()
+
+	var types []any
+	for _, entry := range j.entries {
+		types = append(types, entry.Type)
+	}
+	return types
+}
+
+func TestFileJournal(t *testing.T) {
+	dir := t.TempDir()
+
+	journal, err := OpenFileJournal(dir)
+	m.For(t, "open err").Require(err, m.BeNil())
+	m.For(t, "empty pending").Assert(journal.State().Pending, m.Length().Should(m.Equal(0)))
+
+	entries := []JournalEntry{
+		{Type: JournalInstanceCreated, InstanceID: "i-1"},
+		{Type: JournalInstanceCreated, InstanceID: "i-2", Factory: "gpu"},
+		{Type: JournalWorkSubmitted, WorkID: "a", Kind: "test", Payload: []byte(`"a"`)},
+		{Type: JournalWorkSubmitted, WorkID: "b", Kind: "test", Payload: []byte(`"b"`), Priority: 3},
+		{Type: JournalWorkSubmitted, WorkID: "c", Kind: "test", Payload: []byte(`"c"`), Requirements: &Requirements{GPU: true}},
+		{Type: JournalWorkStarted, WorkID: "a", InstanceID: "i-1"},
+		{Type: JournalWorkStarted, WorkID: "b", InstanceID: "i-2"},
+		{Type: JournalWorkFinished, WorkID: "a"},
+		{Type: JournalInstanceRemoved, InstanceID: "i-1"},
+	}
+	for _, entry := range entries {
+		err = journal.Record(entry)
+		m.For(t, "record err").Require(err, m.BeNil())
+	}
+	m.For(t, "close err").Require(journal.Close(), m.BeNil())
+
+	// Simulate a write torn by a crash
+	file, err := os.OpenFile(filepath.Join(dir, journalFile), os.O_APPEND|os.O_WRONLY, 0o644)
+	m.For(t, "open file err").Require(err, m.BeNil())
+	_, err = file.WriteString(`{"type":"finished","wor`)
+	m.For(t, "write err").Require(err, m.BeNil())
+	m.For(t, "close file err").Require(file.Close(), m.BeNil())
+
+	journal, err = OpenFileJournal(dir)
+	m.For(t, "reopen err").Require(err, m.BeNil())
+
+	state := journal.State()
+	var pending []any
+	for _, entry := range state.Pending {
+		pending = append(pending, entry.WorkID)
+	}
+	m.For(t, "pending").Assert(pending, m.Items(m.Equal(WorkID("b")), m.Equal(WorkID("c"))))
+	m.For(t, "priority").Assert(state.Pending[0].Priority, m.Equal(3))
+	m.For(t, "payload").Assert(string(state.Pending[0].Payload), m.Equal(`"b"`))
+	m.For(t, "requirements").Assert(state.Pending[1].Requirements, m.Equal(&Requirements{GPU: true}))
+	m.For(t, "running").Assert(state.Running, m.Equal(map[WorkID]string{"b": "i-2"}))
+	m.For(t, "instances").Assert(state.Instances, m.Equal([]string{"i-2"}))
+	m.For(t, "factories").Assert(state.Factories, m.Equal(map[string]string{"i-2": "gpu"}))
+
+	err = journal.Record(JournalEntry{Type: JournalWorkFinished, WorkID: "b"})
+	m.For(t, "record err").Require(err, m.BeNil())
+	m.For(t, "close err").Require(journal.Close(), m.BeNil())
+
+	// Compaction drops finished work
+	journal, err = OpenFileJournal(dir)
+	m.For(t, "reopen err").Require(err, m.BeNil())
+	t.Cleanup(func() {
+		_ = journal.Close()
+	})
+
+	state = journal.State()
+	m.For(t, "pending").Assert(state.Pending, m.Length().Should(m.Equal(1)))
+	m.For(t, "pending id").Assert(state.Pending[0].WorkID, m.Equal(WorkID("c")))
+	m.For(t, "running").Assert(state.Running, m.Length().Should(m.Equal(0)))
+}
+
+var (
+	replayRan      = make(chan string, 1)
+	replayWorkType = RegisterWorkType("replay-test",
+		func(ctx context.Context, logger *zap.Logger, req string, worker Worker) (string, error) {
+			replayRan <- req
+			return req, nil
+		}, nil)
+)
+
+func TestDefaultWorkQueue_replay(t *testing.T) {
+	logger := zaptest.NewLogger(t)
+
+	ctrl := gomock.NewController(t)
+	t.Cleanup(func() {
+		ctrl.Finish()
+	})
+
+	mWorker := NewMockWorker(ctrl)
+	mPool := NewMockPool(ctrl)
+
+	mPool.EXPECT().
+		GetWorker(gomock.Any()).
+		Return(mWorker, nil).
+		AnyTimes()
+	mPool.EXPECT().
+		ReturnWorker(gomock.Eq(mWorker)).
+		AnyTimes()
+	mWorker.EXPECT().
+		IsReadyChan(gomock.Any(), gomock.Any()).
+		DoAndReturn(func(ctx context.Context, opts ...func(options *ReadyOptions)) <-chan error {
+			ch := make(chan error, 1)
+			ch <- nil
+			return ch
+		}).
+		AnyTimes()
+	mWorker.EXPECT().
+		Connect(gomock.Any()).
+		Return(nil).
+		AnyTimes()
+	mWorker.EXPECT().
+		Equals(gomock.Eq(mWorker)).
+		Return(true).
+		AnyTimes()
+
+	workType := replayWorkType
+	ran := replayRan
+
+	journal := &memJournal{
+		state: &JournalState{
+			Pending: []JournalEntry{
+				{Type: JournalWorkSubmitted, WorkID: "a", Kind: workType.Name(), Payload: []byte(`"hello"`)},
+				{Type: JournalWorkSubmitted, WorkID: "b", Kind: "unregistered"},
+			},
+		},
+	}
+
+	q := NewQueue(logger, mPool, 1, WithJournal(journal))
+	q.Wait()
+
+	m.For(t, "replayed request").Assert(<-ran, m.Equal("hello"))
+	m.For(t, "entries").Assert(journal.types(), m.ItemsInAnyOrder(
+		m.Equal(JournalWorkFinished), m.Equal(JournalWorkStarted), m.Equal(JournalWorkFinished),
+	))
+
+	// Newly submitted work of a registered type is journaled
+	work := workType.NewWorkInfo(context.Background(), "world")
+	id := q.Add(work)
+	q.Wait()
+
+	m.For(t, "request").Assert(<-ran, m.Equal("world"))
+
+	journal.mtx.Lock()
+	submitted := journal.entries[3]
+	journal.mtx.Unlock()
+	m.For(t, "submitted type").Assert(submitted.Type, m.Equal(JournalWorkSubmitted))
+	m.For(t, "submitted id").Assert(submitted.WorkID, m.Equal(id))
+	m.For(t, "submitted payload").Assert(string(submitted.Payload), m.Equal(`"world"`))
+}
+
+// attachFactory is a WorkerFactory that can reattach instances
+type attachFactory struct {
+	*MockWorkerFactory
+	*MockWorkerAttacher
+}
+
+func TestDefaultPool_recoverInstances(t *testing.T) {
+	logger := zaptest.NewLogger(t)
+
+	ctrl := gomock.NewController(t)
+	t.Cleanup(func() {
+		ctrl.Finish()
+	})
+
+	idle := NewMockWorker(ctrl)
+	idle.EXPECT().
+		Equals(gomock.Any()).
+		DoAndReturn(func(other Worker) bool { return other == idle }).
+		AnyTimes()
+	idle.EXPECT().
+		Close().
+		Return(nil)
+
+	busy := NewMockWorker(ctrl)
+	busy.EXPECT().
+		Close().
+		Return(nil)
+
+	factory := attachFactory{
+		MockWorkerFactory:  NewMockWorkerFactory(ctrl),
+		MockWorkerAttacher: NewMockWorkerAttacher(ctrl),
+	}
+	factory.MockWorkerAttacher.EXPECT().
+		Attach(gomock.Any(), gomock.Eq("i-idle")).
+		Return(idle, nil)
+	factory.MockWorkerAttacher.EXPECT().
+		Attach(gomock.Any(), gomock.Eq("i-busy")).
+		Return(busy, nil)
+	// Instances that can't be reattached are terminated
+	factory.MockWorkerAttacher.EXPECT().
+		Attach(gomock.Any(), gomock.Eq("i-stopped")).
+		Return(nil, errors.New("instance stopped"))
+	factory.MockWorkerAttacher.EXPECT().
+		Terminate(gomock.Any(), gomock.Eq("i-stopped")).
+		Return(nil)
+	// Instances whose termination fails stay in the journal
+	factory.MockWorkerAttacher.EXPECT().
+		Attach(gomock.Any(), gomock.Eq("i-stuck")).
+		Return(nil, errors.New("instance stopped"))
+	factory.MockWorkerAttacher.EXPECT().
+		Terminate(gomock.Any(), gomock.Eq("i-stuck")).
+		Return(errors.New("request limit exceeded"))
+	// Instances of factories that are gone are terminated
+	factory.MockWorkerAttacher.EXPECT().
+		Terminate(gomock.Any(), gomock.Eq("i-orphan")).
+		Return(nil)
+
+	journal := &memJournal{
+		state: &JournalState{
+			Running:   map[WorkID]string{"a": "i-busy"},
+			Instances: []string{"i-idle", "i-busy", "i-stopped", "i-stuck", "i-orphan"},
+			Factories: map[string]string{"i-orphan": "removed"},
+		},
+	}
+
+	// Wrapped factories reattach instances too
+	pool := NewPool(logger, wrapFactory{factory}, WithPoolJournal(journal))
+	dp := pool.(*DefaultPool)
+
+	deadline := time.Now().Add(time.Second)
+	for {
+		journal.mtx.Lock()
+		recorded := len(journal.entries)
+		journal.mtx.Unlock()
+		if recorded == 3 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("instances not terminated")
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	dp.mtx.Lock()
+	available := dp.availableInstances
+	dp.mtx.Unlock()
+	m.For(t, "available").Assert(available, m.Items(m.Equal(idle)))
+	journal.mtx.Lock()
+	var removed []string
+	for _, entry := range journal.entries {
+		removed = append(removed, entry.InstanceID)
+	}
+	journal.mtx.Unlock()
+	m.For(t, "removed").Assert(removed, m.Equal([]string{"i-busy", "i-stopped", "i-orphan"}))
+
+	err := pool.Close()
+	m.For(t, "close err").Assert(err, m.BeNil())
+}
@@ -1,6 +1,12 @@
 package compute
 
-import "time"
+import (
+	"context"
+	"time"
+
+	"github.com/benbjohnson/clock"
+	"go.opentelemetry.io/otel/trace"
+)
 
 type ReadyOptions struct {
 	TickerInterval time.Duration
@@ -20,3 +26,250 @@ func WithConnTimeout(timeout time.Duration) ReadyOptionsFunc {
 		opts.ConnTimeout = timeout
 	}
 }
+
+type PoolOptions struct {
+	// IdleTimeout is how long a returned worker may sit unused before it is
+	// closed and removed from the pool. Zero disables idle reaping.
+	IdleTimeout time.Duration
+	// ReapInterval is how often the pool checks for idle workers.
+	// Defaults to half of IdleTimeout.
+	ReapInterval time.Duration
+	// MaxWorkers caps the number of live workers, including those still being
+	// created. Zero means unlimited.
+	MaxWorkers int
+	// MinWarm is the number of live workers the pool provisions up front and
+	// maintains in the background. Idle reaping never goes below it. It can
+	// be changed with Pool.SetMinWarm.
+	MinWarm int
+	// FailWhenExhausted makes GetWorker return a PoolExhaustedError instead of
+	// waiting for a worker when MaxWorkers is reached.
+	FailWhenExhausted bool
+	// HealthCheckInterval is how often idle workers are checked with
+	// WorkerService.Status. Zero disables health checking.
+	HealthCheckInterval time.Duration
+	// HealthCheckTimeout bounds a single health check. Defaults to 10 seconds.
+	HealthCheckTimeout time.Duration
+	// HealthCheckThreshold is the number of consecutive failed health checks
+	// after which a worker is evicted. Defaults to 3.
+	HealthCheckThreshold int
+	// EventHandlers are called with every PoolEvent.
+	EventHandlers []PoolEventHandler
+	// Journal records created and removed instances. Instances left over in
+	// the journal are reattached or terminated when the pool is created.
+	Journal Journal
+	// Clock is the time source used by the pool's background routines.
+	Clock clock.Clock
+	// TracerProvider creates the spans of the pool. Defaults to the global
+	// TracerProvider.
+	TracerProvider trace.TracerProvider
+	// Router chooses the factories of pools created with NewMultiPool. All
+	// factories may create any worker if nil.
+	Router Router
+}
+
+type PoolOptionsFunc func(options *PoolOptions)
+
+func WithIdleTimeout(timeout time.Duration) PoolOptionsFunc {
+	return func(opts *PoolOptions) {
+		opts.IdleTimeout = timeout
+	}
+}
+
+func WithReapInterval(interval time.Duration) PoolOptionsFunc {
+	return func(opts *PoolOptions) {
+		opts.ReapInterval = interval
+	}
+}
+
+func WithMaxWorkers(max int) PoolOptionsFunc {
+	return func(opts *PoolOptions) {
+		opts.MaxWorkers = max
+	}
+}
+
+func WithMinWarm(min int) PoolOptionsFunc {
+	return func(opts *PoolOptions) {
+		opts.MinWarm = min
+	}
+}
+
+func WithFailWhenExhausted() PoolOptionsFunc {
+	return func(opts *PoolOptions) {
+		opts.FailWhenExhausted = true
+	}
+}
+
+func WithHealthCheckInterval(interval time.Duration) PoolOptionsFunc {
+	return func(opts *PoolOptions) {
+		opts.HealthCheckInterval = interval
+	}
+}
+
+func WithHealthCheckTimeout(timeout time.Duration) PoolOptionsFunc {
+	return func(opts *PoolOptions) {
+		opts.HealthCheckTimeout = timeout
+	}
+}
+
+func WithHealthCheckThreshold(threshold int) PoolOptionsFunc {
+	return func(opts *PoolOptions) {
+		opts.HealthCheckThreshold = threshold
+	}
+}
+
+func WithPoolEventHandler(handler PoolEventHandler) PoolOptionsFunc {
+	return func(opts *PoolOptions) {
+		opts.EventHandlers = append(opts.EventHandlers, handler)
+	}
+}
+
+func WithPoolJournal(journal Journal) PoolOptionsFunc {
+	return func(opts *PoolOptions) {
+		opts.Journal = journal
+	}
+}
+
+func WithRouter(router Router) PoolOptionsFunc {
+	return func(opts *PoolOptions) {
+		opts.Router = router
+	}
+}
+
+func WithPoolClock(c clock.Clock) PoolOptionsFunc {
+	return func(opts *PoolOptions) {
+		opts.Clock = c
+	}
+}
+
+func WithPoolTracerProvider(tp trace.TracerProvider) PoolOptionsFunc {
+	return func(opts *PoolOptions) {
+		opts.TracerProvider = tp
+	}
+}
+
+type QueueOptions struct {
+	// PriorityScheduling dispatches work with the highest priority first
+	// instead of in FIFO order.
+	PriorityScheduling bool
+	// AgingInterval is how long queued work waits before gaining one priority
+	// level when PriorityScheduling is enabled. Zero disables aging.
+	AgingInterval time.Duration
+	// FairShare dispatches work round-robin across tenants instead of in
+	// one queue. Within a tenant, work is ordered by priority or FIFO.
+	FairShare bool
+	// TenantWeights sets the number of dispatches a tenant gets per round
+	// when FairShare is enabled. Tenants default to a weight of 1.
+	TenantWeights map[string]int
+	// TenantLimits caps the running work of a tenant on top of the queue's
+	// maxSize when FairShare is enabled.
+	TenantLimits map[string]int
+	// DefaultTenantLimit caps the running work of tenants not in
+	// TenantLimits. Zero means no cap.
+	DefaultTenantLimit int
+	// Retry is the policy for retrying failed work. Retries are disabled by
+	// default.
+	Retry RetryPolicy
+	// Journal records submitted, started and finished work. Unfinished work
+	// in the journal is replayed when the queue is created.
+	Journal Journal
+	// ReplayContext returns the context of work replayed from the Journal,
+	// e.g. to attach the values the context of the submitted work carried.
+	// Defaults to context.Background.
+	ReplayContext func(entry JournalEntry) context.Context
+	// EventHandlers are called with every QueueEvent.
+	EventHandlers []QueueEventHandler
+	// Clock is the time source used by the queue.
+	Clock clock.Clock
+	// TracerProvider creates the spans of the queue. Defaults to the global
+	// TracerProvider.
+	TracerProvider trace.TracerProvider
+}
+
+type QueueOptionsFunc func(options *QueueOptions)
+
+func WithPriorityScheduling(agingInterval time.Duration) QueueOptionsFunc {
+	return func(opts *QueueOptions) {
+		opts.PriorityScheduling = true
+		opts.AgingInterval = agingInterval
+	}
+}
+
+// WithFairShare enables fair-share scheduling across tenants with the given
+// weights. Tenants missing from weights have a weight of 1.
+func WithFairShare(weights map[string]int) QueueOptionsFunc {
+	return func(opts *QueueOptions) {
+		opts.FairShare = true
+		opts.TenantWeights = weights
+	}
+}
+
+// WithTenantLimit caps the running work of tenant. Implies fair-share
+// scheduling.
+func WithTenantLimit(tenant string, limit int) QueueOptionsFunc {
+	return func(opts *QueueOptions) {
+		opts.FairShare = true
+		if opts.TenantLimits == nil {
+			opts.TenantLimits = make(map[string]int)
+		}
+		opts.TenantLimits[tenant] = limit
+	}
+}
+
+// WithDefaultTenantLimit caps the running work of every tenant without its
+// own limit. Implies fair-share scheduling.
+func WithDefaultTenantLimit(limit int) QueueOptionsFunc {
+	return func(opts *QueueOptions) {
+		opts.FairShare = true
+		opts.DefaultTenantLimit = limit
+	}
+}
+
+func (opts *QueueOptions) tenantWeight(tenant string) int {
+	if weight, ok := opts.TenantWeights[tenant]; ok {
+		return weight
+	}
+	return 1
+}
+
+func (opts *QueueOptions) tenantLimit(tenant string) int {
+	if limit, ok := opts.TenantLimits[tenant]; ok {
+		return limit
+	}
+	return opts.DefaultTenantLimit
+}
+
+func WithRetryPolicy(policy RetryPolicy) QueueOptionsFunc {
+	return func(opts *QueueOptions) {
+		opts.Retry = policy
+	}
+}
+
+func WithJournal(journal Journal) QueueOptionsFunc {
+	return func(opts *QueueOptions) {
+		opts.Journal = journal
+	}
+}
+
+func WithReplayContext(replayContext func(entry JournalEntry) context.Context) QueueOptionsFunc {
+	return func(opts *QueueOptions) {
+		opts.ReplayContext = replayContext
+	}
+}
+
+func WithQueueEventHandler(handler QueueEventHandler) QueueOptionsFunc {
+	return func(opts *QueueOptions) {
+		opts.EventHandlers = append(opts.EventHandlers, handler)
+	}
+}
+
+func WithQueueClock(c clock.Clock) QueueOptionsFunc {
+	return func(opts *QueueOptions) {
+		opts.Clock = c
+	}
+}
+
+func WithQueueTracerProvider(tp trace.TracerProvider) QueueOptionsFunc {
+	return func(opts *QueueOptions) {
+		opts.TracerProvider = tp
+	}
+}
@@ -52,3 +52,149 @@ func TestWithConnTimeout(t *testing.T) {
 		})
 	}
 }
+
+func TestWithIdleTimeout(t *testing.T) {
+	tests := []struct {
+		name    string
+		timeout time.Duration
+	}{
+		{"0", time.Duration(0)},
+		{"seconds", 1 * time.Second},
+		{"minutes", 15 * time.Minute},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			f := WithIdleTimeout(test.timeout)
+
+			opt := new(PoolOptions)
+
+			f(opt)
+
+			m.For(t, "val").Assert(opt.IdleTimeout, m.Equal(test.timeout))
+		})
+	}
+}
+
+func TestWithReapInterval(t *testing.T) {
+	tests := []struct {
+		name     string
+		interval time.Duration
+	}{
+		{"0", time.Duration(0)},
+		{"seconds", 1 * time.Second},
+		{"minutes", 1 * time.Minute},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			f := WithReapInterval(test.interval)
+
+			opt := new(PoolOptions)
+
+			f(opt)
+
+			m.For(t, "val").Assert(opt.ReapInterval, m.Equal(test.interval))
+		})
+	}
+}
+
+func TestWithMaxWorkers(t *testing.T) {
+	tests := []struct {
+		name string
+		max  int
+	}{
+		{"0", 0},
+		{"1", 1},
+		{"100", 100},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			f := WithMaxWorkers(test.max)
+
+			opt := new(PoolOptions)
+
+			f(opt)
+
+			m.For(t, "val").Assert(opt.MaxWorkers, m.Equal(test.max))
+		})
+	}
+}
+
+func TestWithMinWarm(t *testing.T) {
+	tests := []struct {
+		name string
+		min  int
+	}{
+		{"0", 0},
+		{"1", 1},
+		{"100", 100},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			f := WithMinWarm(test.min)
+
+			opt := new(PoolOptions)
+
+			f(opt)
+
+			m.For(t, "val").Assert(opt.MinWarm, m.Equal(test.min))
+		})
+	}
+}
+
+func TestWithHealthCheckInterval(t *testing.T) {
+	tests := []struct {
+		name     string
+		interval time.Duration
+	}{
+		{"0", time.Duration(0)},
+		{"seconds", 30 * time.Second},
+		{"minutes", 5 * time.Minute},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			f := WithHealthCheckInterval(test.interval)
+
+			opt := new(PoolOptions)
+
+			f(opt)
+
+			m.For(t, "val").Assert(opt.HealthCheckInterval, m.Equal(test.interval))
+		})
+	}
+}
+
+func TestWithHealthCheckThreshold(t *testing.T) {
+	tests := []struct {
+		name      string
+		threshold int
+	}{
+		{"0", 0},
+		{"1", 1},
+		{"5", 5},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			f := WithHealthCheckThreshold(test.threshold)
+
+			opt := new(PoolOptions)
+
+			f(opt)
+
+			m.For(t, "val").Assert(opt.HealthCheckThreshold, m.Equal(test.threshold))
+		})
+	}
+}
+
+func TestWithTenantLimit(t *testing.T) {
+	opt := new(QueueOptions)
+
+	WithTenantLimit("a", 2)(opt)
+	WithTenantLimit("b", 5)(opt)
+	WithDefaultTenantLimit(1)(opt)
+
+	m.For(t, "fair share").Assert(opt.FairShare, m.Equal(true))
+	m.For(t, "a").Assert(opt.tenantLimit("a"), m.Equal(2))
+	m.For(t, "b").Assert(opt.tenantLimit("b"), m.Equal(5))
+	m.For(t, "default").Assert(opt.tenantLimit("c"), m.Equal(1))
+	m.For(t, "weight").Assert(opt.tenantWeight("a"), m.Equal(1))
+}
@@ -2,84 +2,629 @@ package compute
 
 import (
 	"context"
+	"fmt"
 	"io"
+	"sort"
 	"sync"
+	"time"
 
+	"github.com/benbjohnson/clock"
+	"github.com/pkg/errors"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 	"go.uber.org/zap"
+
+	"github.com/ansg191/remote-worker/api/proto"
+	"github.com/ansg191/remote-worker/internal/tracing"
+)
+
+var (
+	// ErrPoolExhausted is matched by the PoolExhaustedError of pools at
+	// maximum capacity
+	ErrPoolExhausted = errors.New("pool at maximum capacity")
+	ErrPoolClosed    = errors.New("pool closed")
 )
 
+// PoolExhaustedError is returned by GetWorker of pools failing when
+// exhausted, once MaxWorkers is reached. It is ErrPoolExhausted.
+type PoolExhaustedError struct {
+	MaxWorkers int
+}
+
+func (e *PoolExhaustedError) Error() string {
+	return fmt.Sprintf("%v: %d workers", ErrPoolExhausted, e.MaxWorkers)
+}
+
+func (e *PoolExhaustedError) Is(target error) bool {
+	return target == ErrPoolExhausted
+}
+
+// warmRetryInterval is how long the pool waits before retrying to provision
+// warm workers after WorkerFactory.Create failed.
+const warmRetryInterval = 30 * time.Second
+
+// tracerName is the name of the tracer of pools and queues
+const tracerName = "github.com/ansg191/remote-worker/internal/compute"
+
 type Pool interface {
 	io.Closer
 
 	GetWorker(ctx context.Context) (Worker, error)
+	// GetWorkerFor gets a worker satisfying req. Idle workers are matched on
+	// their capabilities, reported by WorkerService.Info once they are
+	// connected. If none matches, a worker is provisioned, replacing an idle
+	// worker that doesn't match if the pool is full. ErrNoMatchingWorker is
+	// returned if no worker can satisfy req.
+	GetWorkerFor(ctx context.Context, req Requirements) (Worker, error)
 	ReturnWorker(worker Worker)
+	// RemoveWorker closes a worker taken from the pool instead of returning
+	// it, e.g. because it is suspected to be broken.
+	RemoveWorker(worker Worker)
+	// Stats returns the current number of workers in the pool
+	Stats() PoolStats
+	// SetMinWarm sets the number of live workers the pool provisions and
+	// maintains in the background
+	SetMinWarm(n int)
+	// Shrink closes up to n available workers now, regardless of how long
+	// they were idle, but keeps at least MinWarm live workers. It returns the
+	// number of workers closed.
+	Shrink(n int) int
+}
+
+type PoolStats struct {
+	// Live is the number of workers in the pool, available or in use
+	Live int
+	// Available is the number of idle workers in the pool
+	Available int
+	// Pending is the number of workers being created
+	Pending int
+}
+
+// DefaultFactoryName is the name of the factory of pools created with NewPool
+const DefaultFactoryName = "default"
+
+// NamedFactory is a WorkerFactory of a pool created with NewMultiPool
+type NamedFactory struct {
+	Name    string
+	Factory WorkerFactory
+	// MaxWorkers limits the live and pending workers of the factory.
+	// Unlimited if zero.
+	MaxWorkers int
+	// Priority orders the factories, lowest first, e.g. by the cost of their
+	// workers. Factories of equal priority keep their order.
+	Priority int
+	// Capabilities declares the capabilities of the workers of the factory.
+	// If nil, those of a CapableFactory are used.
+	Capabilities *Capabilities
+}
+
+// Router returns the names of the factories that may create a worker for work
+// requiring req. They are tried in priority order, falling back to the next
+// one when a factory is full or lacks capacity. All factories may be used if
+// no names are returned.
+type Router func(req Requirements) []string
+
+// RouteRule routes work whose requirements include Match to Factories
+type RouteRule struct {
+	Match     Requirements
+	Factories []string
+}
+
+// RouteRules returns a Router applying the first rule matching the
+// requirements of work. Work matching no rule may use any factory.
+func RouteRules(rules ...RouteRule) Router {
+	return func(req Requirements) []string {
+		for _, rule := range rules {
+			if req.includes(rule.Match) {
+				return rule.Factories
+			}
+		}
+		return nil
+	}
+}
+
+// poolFactory is a factory of a pool
+type poolFactory struct {
+	NamedFactory
+	workers int // Live and pending workers of the factory
+}
+
+// capabilities returns the capabilities of the workers of f, if known
+// before they are created
+func (f *poolFactory) capabilities() (Capabilities, bool) {
+	if f.Capabilities != nil {
+		return *f.Capabilities, true
+	}
+	if capable, ok := factoryAs[CapableFactory](f.Factory); ok {
+		return capable.Capabilities(), true
+	}
+	return Capabilities{}, false
+}
+
+// attacher returns the WorkerAttacher of f, if it can reattach instances
+func (f *poolFactory) attacher() (WorkerAttacher, bool) {
+	return factoryAs[WorkerAttacher](f.Factory)
+}
+
+// hasCapacity reports whether f may create another worker.
+// DefaultPool.mtx must be held.
+func (f *poolFactory) hasCapacity() bool {
+	return f.MaxWorkers <= 0 || f.workers < f.MaxWorkers
 }
 
 type DefaultPool struct {
 	logger *zap.Logger
 
-	factory WorkerFactory
+	factories []*poolFactory // Factories in priority order
+	tracer    trace.Tracer
+	options   PoolOptions
+
+	mtx                sync.Mutex              // Mutex for below fields
+	allInstances       []Worker                // All Workers active in pool
+	availableInstances []Worker                // All Workers available in pool
+	idleSince          map[Worker]time.Time    // Time each available Worker was returned
+	pending            int                     // Workers currently being created
+	healthFailures     map[Worker]int          // Consecutive failed health checks per Worker
+	capabilities       map[Worker]Capabilities // Capabilities of Workers, cached once connected
+	owners             map[Worker]*poolFactory // Factory that created each Worker
+	changed            chan struct{}           // Closed and replaced whenever capacity is freed
+	closed             bool
+
+	ctx       context.Context // Context for background routines, canceled on Close
+	cancel    context.CancelFunc
+	closeOnce sync.Once
+	wg        sync.WaitGroup // WaitGroup for background routines
+}
 
-	mtx                sync.Mutex // Mutex for below slices
-	allInstances       []Worker   // All Workers active in pool
-	availableInstances []Worker   // All Workers available in pool
+func NewPool(logger *zap.Logger, factory WorkerFactory, opts ...PoolOptionsFunc) Pool {
+	return NewMultiPool(logger, []NamedFactory{{Name: DefaultFactoryName, Factory: factory}}, opts...)
 }
 
-func NewPool(logger *zap.Logger, factory WorkerFactory) Pool {
+// NewMultiPool creates a pool provisioning workers from several factories. The
+// factories serving a work item are chosen by the Router of the pool and the
+// capabilities of their workers.
+func NewMultiPool(logger *zap.Logger, factories []NamedFactory, opts ...PoolOptionsFunc) Pool {
+	options := PoolOptions{
+		Clock:          clock.New(),
+		TracerProvider: otel.GetTracerProvider(),
+	}
+
+	for _, opt := range opts {
+		opt(&options)
+	}
+
+	if options.ReapInterval <= 0 {
+		options.ReapInterval = options.IdleTimeout / 2
+	}
+	if options.HealthCheckTimeout <= 0 {
+		options.HealthCheckTimeout = 10 * time.Second
+	}
+	if options.HealthCheckThreshold <= 0 {
+		options.HealthCheckThreshold = 3
+	}
+	if options.MaxWorkers > 0 && options.MinWarm > options.MaxWorkers {
+		options.MinWarm = options.MaxWorkers
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+
+	ordered := make([]*poolFactory, len(factories))
+	for i, factory := range factories {
+		ordered[i] = &poolFactory{NamedFactory: factory}
+	}
+	sort.SliceStable(ordered, func(i, j int) bool {
+		return ordered[i].Priority < ordered[j].Priority
+	})
+
 	pool := &DefaultPool{
-		logger:  logger,
-		factory: factory,
+		logger:         logger,
+		factories:      ordered,
+		tracer:         options.TracerProvider.Tracer(tracerName),
+		options:        options,
+		idleSince:      make(map[Worker]time.Time),
+		healthFailures: make(map[Worker]int),
+		capabilities:   make(map[Worker]Capabilities),
+		owners:         make(map[Worker]*poolFactory),
+		changed:        make(chan struct{}),
+		ctx:            ctx,
+		cancel:         cancel,
+	}
+
+	if options.IdleTimeout > 0 {
+		// The ticker is created before the goroutine starts so that no tick
+		// is missed by a clock that is advanced right after NewPool returns.
+		ticker := options.Clock.Ticker(options.ReapInterval)
+		pool.wg.Add(1)
+		go pool.reap(ticker)
 	}
 
+	if options.HealthCheckInterval > 0 {
+		ticker := options.Clock.Ticker(options.HealthCheckInterval)
+		pool.wg.Add(1)
+		go pool.healthCheck(ticker)
+	}
+
+	pool.wg.Add(1)
+	go func() {
+		defer pool.wg.Done()
+
+		// Recover instances first so warming doesn't provision workers
+		// that are about to be reattached.
+		if options.Journal != nil {
+			pool.recoverInstances(options.Journal.State())
+		}
+		// MinWarm may be raised later with SetMinWarm
+		pool.warm()
+	}()
+
 	return pool
 }
 
 func (p *DefaultPool) Close() (err error) {
+	p.closeOnce.Do(func() {
+		p.mtx.Lock()
+		p.closed = true
+		p.signal()
+		p.mtx.Unlock()
+		p.cancel()
+	})
+	p.wg.Wait()
+
 	p.mtx.Lock()
-	defer p.mtx.Unlock()
-	p.logger.Info("Pool closing", zap.Int("openWorkers", len(p.allInstances)))
-	for _, instance := range p.allInstances {
-		err = instance.Close()
-		if err != nil {
-			p.logger.Error("error closing worker", zap.Error(err))
+	instances := p.allInstances
+	p.allInstances = nil
+	p.availableInstances = nil
+	p.mtx.Unlock()
+
+	p.logger.Info("Pool closing", zap.Int("openWorkers", len(instances)))
+	for _, instance := range instances {
+		closeErr := instance.Close()
+		if closeErr != nil {
+			p.logger.Error("error closing worker", zap.Error(closeErr))
+			err = closeErr
 		}
+		p.emit(PoolEvent{Type: WorkerRemoved, Worker: instance, Reason: ReasonPoolClosed, Err: closeErr})
 	}
 	p.logger.Info("Pool closed")
 	return
 }
 
 func (p *DefaultPool) GetWorker(ctx context.Context) (Worker, error) {
-	p.mtx.Lock()
-	//defer p.mtx.Unlock()
+	return p.GetWorkerFor(ctx, Requirements{})
+}
 
-	if len(p.availableInstances) == 0 {
-		p.logger.Debug("No worker available in pool. Creating new...")
-		worker, err := p.factory.Create(ctx)
-		if err != nil {
+func (p *DefaultPool) GetWorkerFor(ctx context.Context, req Requirements) (Worker, error) {
+	// Workers whose capabilities couldn't be read are skipped by this call
+	skip := make(map[Worker]bool)
+	// Factories that created a worker not satisfying req aren't used again by
+	// this call
+	mismatched := make(map[*poolFactory]bool)
+
+	for {
+		p.mtx.Lock()
+
+		if p.closed {
 			p.mtx.Unlock()
-			return nil, err
+			return nil, ErrPoolClosed
 		}
 
-		p.allInstances = append(p.allInstances, worker)
+		if worker, probe := p.takeAvailable(req, skip); worker != nil {
+			idle := p.idleSince[worker]
+			delete(p.idleSince, worker)
+			p.mtx.Unlock()
 
-		p.logger.Debug("Worker created")
-		p.mtx.Unlock()
+			if _, err := worker.IsReady(ctx); err == ErrClosed {
+				// Worker is already closed. Remove from pool
+				p.mtx.Lock()
+				p.forget(worker)
+				p.signal()
+				p.mtx.Unlock()
+				p.emit(PoolEvent{Type: WorkerRemoved, Worker: worker, Reason: ReasonClosed, Err: err})
+				continue
+			}
 
-		return worker, err
-	} else {
-		worker := p.availableInstances[0]
-		p.availableInstances = p.availableInstances[1:]
-		if _, err := worker.IsReady(ctx); err == ErrClosed {
-			// Worker is already closed. Remove from pool
-			p.allInstances = removeItem(p.allInstances, worker)
+			if probe {
+				caps, err := p.probe(ctx, worker)
+				if err != nil {
+					p.logger.Warn("error reading worker capabilities", zap.Error(err))
+					skip[worker] = true
+				}
+				if err != nil || !caps.Satisfies(req) {
+					p.putBack(worker, idle)
+					continue
+				}
+			}
+
+			p.logger.Debug("Pool returning existing worker")
+			return worker, nil
+		}
+
+		if routes := exclude(p.routes(req), mismatched); len(routes) > 0 {
+			f := p.pick(routes, nil)
+
+			// A worker that doesn't match is replaced if the pool or the
+			// factories of the work are full
+			var replaced Worker
+			if !req.IsZero() && (f == nil || !p.hasCapacity()) {
+				var from []*poolFactory
+				if f == nil {
+					from = routes
+				}
+				if replaced = p.takeMismatched(req, from); replaced != nil {
+					f = p.pick(routes, nil)
+				}
+			}
+
+			if f != nil && p.hasCapacity() {
+				p.logger.Debug("No worker available in pool. Creating new...", zap.String("factory", f.Name))
+				p.reserve(f)
+				p.mtx.Unlock()
+
+				if replaced != nil {
+					p.closeReplaced(replaced, req)
+				}
+				worker, err := p.createFor(ctx, f, req, mismatched)
+				if worker == nil && err == nil {
+					// The created worker doesn't match, try the next factory
+					continue
+				}
+				return worker, err
+			}
+		} else if !p.mayMatch(req, skip) {
 			p.mtx.Unlock()
-			return p.GetWorker(ctx)
+			return nil, errors.Wrap(ErrNoMatchingWorker, req.String())
 		}
 
-		p.logger.Debug("Pool returning existing worker")
+		if p.options.FailWhenExhausted {
+			p.mtx.Unlock()
+			return nil, &PoolExhaustedError{MaxWorkers: p.options.MaxWorkers}
+		}
+
+		p.logger.Debug("Pool at maximum capacity. Waiting for worker...",
+			zap.Int("maxWorkers", p.options.MaxWorkers))
+		changed := p.changed
 		p.mtx.Unlock()
+
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-changed:
+		}
+	}
+}
+
+// takeAvailable removes an available worker that may satisfy req, preferring
+// the longest idle worker known to satisfy it. probe is set if the
+// capabilities of the worker are unknown.
+// p.mtx must be held.
+func (p *DefaultPool) takeAvailable(req Requirements, skip map[Worker]bool) (worker Worker, probe bool) {
+	unknown := -1
+	for i, w := range p.availableInstances {
+		if skip[w] {
+			continue
+		}
+		caps, known := p.capabilities[w]
+		if req.IsZero() || (known && caps.Satisfies(req)) {
+			p.availableInstances = remove(p.availableInstances, i)
+			return w, false
+		}
+		if !known && unknown < 0 {
+			unknown = i
+		}
+	}
+
+	if unknown < 0 {
+		return nil, false
+	}
+	worker = p.availableInstances[unknown]
+	p.availableInstances = remove(p.availableInstances, unknown)
+	return worker, true
+}
+
+// takeMismatched removes the longest idle worker known not to satisfy req
+// from the pool, to make room for one that does. If from is not nil, only
+// workers of those factories are removed.
+// p.mtx must be held.
+func (p *DefaultPool) takeMismatched(req Requirements, from []*poolFactory) Worker {
+	for i, worker := range p.availableInstances {
+		if caps, known := p.capabilities[worker]; !known || caps.Satisfies(req) {
+			continue
+		}
+		if from != nil && !containsFactory(from, p.owners[worker]) {
+			continue
+		}
+
+		p.availableInstances = remove(p.availableInstances, i)
+		p.forget(worker)
+		return worker
+	}
+	return nil
+}
+
+func containsFactory(factories []*poolFactory, f *poolFactory) bool {
+	for _, factory := range factories {
+		if factory == f {
+			return true
+		}
+	}
+	return false
+}
+
+// forget removes worker from the pool, except from the available workers.
+// p.mtx must be held.
+func (p *DefaultPool) forget(worker Worker) {
+	p.allInstances = removeItem(p.allInstances, worker)
+	delete(p.idleSince, worker)
+	delete(p.healthFailures, worker)
+	delete(p.capabilities, worker)
+	if f, ok := p.owners[worker]; ok {
+		f.workers--
+		delete(p.owners, worker)
+	}
+}
+
+// closeReplaced closes a worker removed by takeMismatched
+func (p *DefaultPool) closeReplaced(worker Worker, req Requirements) {
+	p.logger.Info("Closing idle worker for a worker matching requirements", zap.Stringer("requirements", req))
+	err := worker.Close()
+	if err != nil && err != ErrClosed {
+		p.logger.Error("error closing worker", zap.Error(err))
+	}
+	p.emit(PoolEvent{Type: WorkerRemoved, Worker: worker, Reason: ReasonReplaced, Err: err})
+}
+
+// putBack returns a worker taken by takeAvailable to the available workers,
+// keeping its idle time
+func (p *DefaultPool) putBack(worker Worker, idle time.Time) {
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+
+	if find(p.allInstances, worker) < 0 {
+		// Removed while it was probed
+		return
+	}
+
+	// Available workers are kept ordered from the longest idle
+	i := 0
+	for i < len(p.availableInstances) && !p.idleSince[p.availableInstances[i]].After(idle) {
+		i++
+	}
+	p.availableInstances = append(p.availableInstances[:i], append([]Worker{worker}, p.availableInstances[i:]...)...)
+	p.idleSince[worker] = idle
+	p.signal()
+}
+
+// routes returns the factories that may create a worker satisfying req, in
+// priority order. Factories that don't declare their capabilities may.
+func (p *DefaultPool) routes(req Requirements) []*poolFactory {
+	var names []string
+	if p.options.Router != nil {
+		names = p.options.Router(req)
+	}
+
+	var routes []*poolFactory
+	for _, f := range p.factories {
+		if len(names) > 0 && !containsString(names, f.Name) {
+			continue
+		}
+		if caps, known := f.capabilities(); known && !req.IsZero() && !caps.Satisfies(req) {
+			continue
+		}
+		routes = append(routes, f)
+	}
+	return routes
+}
+
+// exclude returns routes without the factories in excluded
+func exclude(routes []*poolFactory, excluded map[*poolFactory]bool) []*poolFactory {
+	if len(excluded) == 0 {
+		return routes
+	}
+
+	var res []*poolFactory
+	for _, f := range routes {
+		if !excluded[f] {
+			res = append(res, f)
+		}
+	}
+	return res
+}
+
+func containsString(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+// pick returns the first of routes not in tried with capacity left, or nil.
+// p.mtx must be held.
+func (p *DefaultPool) pick(routes []*poolFactory, tried map[*poolFactory]bool) *poolFactory {
+	for _, f := range routes {
+		if !tried[f] && f.hasCapacity() {
+			return f
+		}
+	}
+	return nil
+}
+
+// reserve reserves a slot for a worker of f.
+// p.mtx must be held.
+func (p *DefaultPool) reserve(f *poolFactory) {
+	p.pending++
+	f.workers++
+}
+
+// mayMatch reports whether a live worker may satisfy req once it is returned.
+// p.mtx must be held.
+func (p *DefaultPool) mayMatch(req Requirements, skip map[Worker]bool) bool {
+	for _, worker := range p.allInstances {
+		caps, known := p.capabilities[worker]
+		if !skip[worker] && (!known || caps.Satisfies(req)) {
+			return true
+		}
+	}
+	return false
+}
+
+// probe connects to worker and caches its capabilities, reported by
+// WorkerService.Info
+func (p *DefaultPool) probe(ctx context.Context, worker Worker) (Capabilities, error) {
+	if err := worker.Connect(ctx); err != nil {
+		return Capabilities{}, err
+	}
+	info, err := worker.Worker().Info(ctx, &proto.WorkerInfoRequest{})
+	if err != nil {
+		return Capabilities{}, err
+	}
+
+	caps := CapabilitiesFromInfo(info)
+	p.mtx.Lock()
+	if find(p.allInstances, worker) >= 0 {
+		p.capabilities[worker] = caps
+	}
+	p.mtx.Unlock()
+	return caps, nil
+}
+
+// createFor creates a worker satisfying req for a slot of f already reserved
+// with reserve. Workers of factories not declaring their capabilities are
+// checked once connected, and kept in the pool for other work if they don't
+// match. Their factory is then added to mismatched, and a nil worker and error
+// are returned.
+func (p *DefaultPool) createFor(ctx context.Context, f *poolFactory, req Requirements, mismatched map[*poolFactory]bool) (Worker, error) {
+	worker, f, err := p.create(ctx, f, req, false)
+	if err != nil || req.IsZero() {
+		return worker, err
+	}
+	if _, known := f.capabilities(); known {
 		return worker, nil
 	}
+
+	err = <-worker.IsReadyChan(ctx)
+	var caps Capabilities
+	if err == nil {
+		caps, err = p.probe(ctx, worker)
+	}
+	switch {
+	case err != nil && ctx.Err() == nil:
+		p.RemoveWorker(worker)
+		return nil, err
+	case err != nil:
+		p.ReturnWorker(worker)
+		return nil, err
+	case !caps.Satisfies(req):
+		p.logger.Info("Created worker doesn't match requirements",
+			zap.String("factory", f.Name),
+			zap.Stringer("requirements", req))
+		mismatched[f] = true
+		p.ReturnWorker(worker)
+		return nil, nil
+	}
+	return worker, nil
 }
 
 func (p *DefaultPool) ReturnWorker(worker Worker) {
@@ -92,4 +637,284 @@ func (p *DefaultPool) ReturnWorker(worker Worker) {
 	}
 
 	p.availableInstances = append(p.availableInstances, worker)
+	p.idleSince[worker] = p.options.Clock.Now()
+	p.signal()
+}
+
+func (p *DefaultPool) RemoveWorker(worker Worker) {
+	p.mtx.Lock()
+	if find(p.allInstances, worker) < 0 {
+		// Worker not from this pool, return silently
+		p.mtx.Unlock()
+		return
+	}
+
+	if i := find(p.availableInstances, worker); i >= 0 {
+		p.availableInstances = remove(p.availableInstances, i)
+	}
+	p.forget(worker)
+	p.signal()
+	p.mtx.Unlock()
+
+	p.logger.Info("Removing failed worker from pool")
+	err := worker.Close()
+	if err != nil && err != ErrClosed {
+		p.logger.Error("error closing worker", zap.Error(err))
+	}
+	p.emit(PoolEvent{Type: WorkerRemoved, Worker: worker, Reason: ReasonFailed, Err: err})
+}
+
+// create provisions a new worker from f for a slot already reserved with
+// reserve. If f lacks capacity, the slot moves to the next factory routed for
+// req. It returns the factory that created the worker.
+// The pool lock must not be held, as WorkerFactory.Create can take minutes.
+func (p *DefaultPool) create(ctx context.Context, f *poolFactory, req Requirements, warm bool) (Worker, *poolFactory, error) {
+	tried := make(map[*poolFactory]bool)
+	for {
+		createCtx, span := p.tracer.Start(ctx, "WorkerFactory.Create", trace.WithAttributes(
+			attribute.Bool("worker.warm", warm),
+			attribute.String("worker.factory", f.Name),
+		))
+		start := p.options.Clock.Now()
+		worker, err := f.Factory.Create(createCtx)
+		duration := p.options.Clock.Since(start)
+		tracing.End(span, err)
+
+		p.mtx.Lock()
+		if err != nil {
+			f.workers--
+			tried[f] = true
+
+			var next *poolFactory
+			if errors.Is(err, ErrInsufficientCapacity) && !p.closed {
+				next = p.pick(p.routes(req), tried)
+			}
+			if next == nil {
+				p.pending--
+				p.signal()
+				p.mtx.Unlock()
+				return nil, nil, err
+			}
+			next.workers++
+			p.mtx.Unlock()
+
+			p.logger.Warn("Factory out of capacity, falling back to next factory",
+				zap.String("factory", f.Name),
+				zap.String("next", next.Name),
+				zap.Error(err))
+			f = next
+			continue
+		}
+
+		p.pending--
+		closed := p.closed
+		if closed {
+			f.workers--
+			p.signal()
+		} else {
+			p.allInstances = append(p.allInstances, worker)
+			p.owners[worker] = f
+		}
+		p.mtx.Unlock()
+
+		p.logger.Debug("Worker created", zap.String("factory", f.Name))
+		p.emit(PoolEvent{Type: WorkerCreated, Worker: worker, Duration: duration, Warm: warm, Factory: f.Name})
+
+		if closed {
+			// Pool was closed while the worker was being created
+			closeErr := worker.Close()
+			if closeErr != nil {
+				p.logger.Error("error closing worker", zap.Error(closeErr))
+			}
+			p.emit(PoolEvent{Type: WorkerRemoved, Worker: worker, Reason: ReasonPoolClosed, Err: closeErr})
+			return nil, nil, ErrPoolClosed
+		}
+
+		return worker, f, nil
+	}
+}
+
+func (p *DefaultPool) Stats() PoolStats {
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+
+	return PoolStats{
+		Live:      len(p.allInstances),
+		Available: len(p.availableInstances),
+		Pending:   p.pending,
+	}
+}
+
+func (p *DefaultPool) SetMinWarm(n int) {
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+
+	if p.options.MaxWorkers > 0 && n > p.options.MaxWorkers {
+		n = p.options.MaxWorkers
+	}
+	p.options.MinWarm = n
+	p.signal()
+}
+
+func (p *DefaultPool) Shrink(n int) int {
+	// Like reapIdle, workers are removed while holding the lock
+	p.mtx.Lock()
+	var closed []Worker
+	for len(closed) < n && len(p.availableInstances) > 0 && len(p.allInstances) > p.options.MinWarm {
+		// The longest idle worker is first
+		worker := p.availableInstances[0]
+		p.availableInstances = p.availableInstances[1:]
+		p.forget(worker)
+		closed = append(closed, worker)
+	}
+	if len(closed) > 0 {
+		p.signal()
+	}
+	p.mtx.Unlock()
+
+	for _, worker := range closed {
+		p.logger.Info("Closing worker to scale down")
+		err := worker.Close()
+		if err != nil && err != ErrClosed {
+			p.logger.Error("error closing worker", zap.Error(err))
+		}
+		p.emit(PoolEvent{Type: WorkerRemoved, Worker: worker, Reason: ReasonScaledDown, Err: err})
+	}
+	return len(closed)
+}
+
+// emit sends event to the configured PoolEventHandler.
+// p.mtx must not be held.
+func (p *DefaultPool) emit(event PoolEvent) {
+	if event.Time.IsZero() {
+		event.Time = p.options.Clock.Now()
+	}
+
+	p.record(event)
+
+	for _, handler := range p.options.EventHandlers {
+		handler(event)
+	}
+}
+
+// hasCapacity reports whether another worker may be created.
+// p.mtx must be held.
+func (p *DefaultPool) hasCapacity() bool {
+	return p.options.MaxWorkers <= 0 || len(p.allInstances)+p.pending < p.options.MaxWorkers
+}
+
+// signal wakes all routines waiting for the pool to change.
+// p.mtx must be held.
+func (p *DefaultPool) signal() {
+	close(p.changed)
+	p.changed = make(chan struct{})
+}
+
+// warm provisions workers until the pool holds at least MinWarm live workers,
+// and keeps topping it up as workers are removed. It runs until the pool is
+// closed.
+func (p *DefaultPool) warm() {
+	for {
+		p.mtx.Lock()
+		var reserved []*poolFactory
+		for i := len(p.allInstances) + p.pending; i < p.options.MinWarm && p.hasCapacity(); i++ {
+			f := p.pick(p.routes(Requirements{}), nil)
+			if f == nil {
+				break
+			}
+			p.reserve(f)
+			reserved = append(reserved, f)
+		}
+		missing := len(reserved)
+		changed := p.changed
+		p.mtx.Unlock()
+
+		failed := false
+		if missing > 0 {
+			p.logger.Info("Provisioning warm workers", zap.Int("count", missing))
+
+			var wg sync.WaitGroup
+			var failMtx sync.Mutex
+			for _, f := range reserved {
+				wg.Add(1)
+				go func(f *poolFactory) {
+					defer wg.Done()
+					worker, _, err := p.create(p.ctx, f, Requirements{}, true)
+					if err != nil {
+						if err != ErrPoolClosed && p.ctx.Err() == nil {
+							p.logger.Error("error provisioning warm worker", zap.Error(err))
+						}
+						failMtx.Lock()
+						failed = true
+						failMtx.Unlock()
+						return
+					}
+					p.ReturnWorker(worker)
+				}(f)
+			}
+			wg.Wait()
+		}
+
+		if failed {
+			select {
+			case <-p.ctx.Done():
+				return
+			case <-p.options.Clock.After(warmRetryInterval):
+			}
+		} else if missing <= 0 {
+			select {
+			case <-p.ctx.Done():
+				return
+			case <-changed:
+			}
+		}
+	}
+}
+
+// reap periodically closes workers that have been idle longer than the
+// configured IdleTimeout. It runs until the pool is closed.
+func (p *DefaultPool) reap(ticker *clock.Ticker) {
+	defer p.wg.Done()
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-p.ctx.Done():
+			return
+		case <-ticker.C:
+			p.reapIdle()
+		}
+	}
+}
+
+func (p *DefaultPool) reapIdle() {
+	now := p.options.Clock.Now()
+
+	// Expired workers are removed while holding the lock so that a concurrent
+	// GetWorker can never hand out a worker that is about to be closed.
+	p.mtx.Lock()
+	var expired []Worker
+	available := make([]Worker, 0, len(p.availableInstances))
+	for _, worker := range p.availableInstances {
+		if len(p.allInstances) > p.options.MinWarm && now.Sub(p.idleSince[worker]) >= p.options.IdleTimeout {
+			expired = append(expired, worker)
+			p.forget(worker)
+		} else {
+			available = append(available, worker)
+		}
+	}
+	p.availableInstances = available
+	if len(expired) > 0 {
+		p.signal()
+	}
+	p.mtx.Unlock()
+
+	for _, worker := range expired {
+		p.logger.Info("Closing idle worker", zap.Duration("idleTimeout", p.options.IdleTimeout))
+		err := worker.Close()
+		if err != nil && err != ErrClosed {
+			p.logger.Error("error closing idle worker", zap.Error(err))
+		}
+		p.emit(PoolEvent{Type: WorkerRemoved, Worker: worker, Reason: ReasonIdle, Err: err})
+	}
 }
@@ -3,11 +3,18 @@ package compute
 import (
 	"context"
 	"errors"
+	"fmt"
+	"sync"
 	"testing"
+	"time"
 
+	"github.com/benbjohnson/clock"
 	"github.com/golang/mock/gomock"
 	m "github.com/launchdarkly/go-test-helpers/v2/matchers"
 	"go.uber.org/zap/zaptest"
+	"google.golang.org/grpc"
+
+	"github.com/ansg191/remote-worker/api/proto"
 )
 
 func TestNewPool(t *testing.T) {
@@ -348,3 +355,551 @@ func TestDefaultPool_ReturnWorker(t *testing.T) {
 		m.For(t, "availableWorkers").Assert(dp.availableInstances, m.Length().Should(m.Equal(0)))
 	})
 }
+
+func TestDefaultPool_reap(t *testing.T) {
+	logger := zaptest.NewLogger(t)
+
+	ctrl := gomock.NewController(t)
+	t.Cleanup(func() {
+		ctrl.Finish()
+	})
+
+	t.Run("idle worker closed", func(t *testing.T) {
+		closed := make(chan struct{})
+
+		mWorker := NewMockWorker(ctrl)
+		mWorker.EXPECT().
+			Equals(gomock.Any()).
+			Return(true).
+			AnyTimes()
+		mWorker.EXPECT().
+			Close().
+			DoAndReturn(func() error {
+				close(closed)
+				return nil
+			})
+
+		mWorkerFactory := NewMockWorkerFactory(ctrl)
+		mWorkerFactory.EXPECT().
+			Create(gomock.Any()).
+			Return(mWorker, nil)
+
+		mClock := clock.NewMock()
+		pool := NewPool(logger, mWorkerFactory,
+			WithIdleTimeout(5*time.Minute),
+			WithReapInterval(time.Minute),
+			WithPoolClock(mClock),
+		)
+		dp := pool.(*DefaultPool)
+
+		worker, err := pool.GetWorker(context.Background())
+		m.For(t, "err").Require(err, m.BeNil())
+		pool.ReturnWorker(worker)
+
+		mClock.Add(6 * time.Minute)
+
+		select {
+		case <-closed:
+		case <-time.After(time.Second):
+			t.Fatal("idle worker not closed")
+		}
+
+		dp.mtx.Lock()
+		m.For(t, "allWorkers").Assert(dp.allInstances, m.Length().Should(m.Equal(0)))
+		m.For(t, "availableWorkers").Assert(dp.availableInstances, m.Length().Should(m.Equal(0)))
+		dp.mtx.Unlock()
+
+		err = pool.Close()
+		m.For(t, "close err").Assert(err, m.BeNil())
+	})
+
+	t.Run("recently used worker kept", func(t *testing.T) {
+		mWorker := NewMockWorker(ctrl)
+		mWorker.EXPECT().
+			Equals(gomock.Any()).
+			Return(true).
+			AnyTimes()
+		mWorker.EXPECT().
+			IsReady(gomock.Any()).
+			Return(true, nil)
+		mWorker.EXPECT().
+			Close().
+			Return(nil)
+
+		mWorkerFactory := NewMockWorkerFactory(ctrl)
+		mWorkerFactory.EXPECT().
+			Create(gomock.Any()).
+			Return(mWorker, nil)
+
+		mClock := clock.NewMock()
+		pool := NewPool(logger, mWorkerFactory,
+			WithIdleTimeout(5*time.Minute),
+			WithReapInterval(time.Minute),
+			WithPoolClock(mClock),
+		)
+		dp := pool.(*DefaultPool)
+
+		worker, err := pool.GetWorker(context.Background())
+		m.For(t, "err").Require(err, m.BeNil())
+		pool.ReturnWorker(worker)
+
+		mClock.Add(3 * time.Minute)
+
+		// Taking the worker resets its idle time
+		worker, err = pool.GetWorker(context.Background())
+		m.For(t, "err").Require(err, m.BeNil())
+		m.For(t, "worker").Assert(worker, m.Equal(mWorker))
+
+		mClock.Add(10 * time.Minute)
+		pool.ReturnWorker(worker)
+		mClock.Add(3 * time.Minute)
+
+		dp.mtx.Lock()
+		m.For(t, "allWorkers").Assert(dp.allInstances, m.Items(m.Equal(mWorker)))
+		m.For(t, "availableWorkers").Assert(dp.availableInstances, m.Items(m.Equal(mWorker)))
+		dp.mtx.Unlock()
+
+		// Pool.Close closes the still pooled worker
+		err = pool.Close()
+		m.For(t, "close err").Assert(err, m.BeNil())
+	})
+}
+
+func TestDefaultPool_MaxWorkers(t *testing.T) {
+	logger := zaptest.NewLogger(t)
+
+	ctrl := gomock.NewController(t)
+	t.Cleanup(func() {
+		ctrl.Finish()
+	})
+
+	t.Run("fail when exhausted", func(t *testing.T) {
+		mWorker := NewMockWorker(ctrl)
+
+		mWorkerFactory := NewMockWorkerFactory(ctrl)
+		mWorkerFactory.EXPECT().
+			Create(gomock.Any()).
+			Return(mWorker, nil).
+			Times(1)
+
+		pool := NewPool(logger, mWorkerFactory, WithMaxWorkers(1), WithFailWhenExhausted())
+
+		worker, err := pool.GetWorker(context.Background())
+		m.For(t, "err").Require(err, m.BeNil())
+		m.For(t, "worker").Assert(worker, m.Equal(mWorker))
+
+		worker, err = pool.GetWorker(context.Background())
+		m.For(t, "err").Assert(errors.Is(err, ErrPoolExhausted), m.Equal(true))
+		var exhausted *PoolExhaustedError
+		m.For(t, "exhausted err").Require(errors.As(err, &exhausted), m.Equal(true))
+		m.For(t, "max workers").Assert(exhausted.MaxWorkers, m.Equal(1))
+		m.For(t, "worker").Assert(worker, m.BeNil())
+	})
+
+	t.Run("wait honours ctx", func(t *testing.T) {
+		mWorker := NewMockWorker(ctrl)
+
+		mWorkerFactory := NewMockWorkerFactory(ctrl)
+		mWorkerFactory.EXPECT().
+			Create(gomock.Any()).
+			Return(mWorker, nil).
+			Times(1)
+
+		pool := NewPool(logger, mWorkerFactory, WithMaxWorkers(1))
+
+		_, err := pool.GetWorker(context.Background())
+		m.For(t, "err").Require(err, m.BeNil())
+
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+		defer cancel()
+
+		worker, err := pool.GetWorker(ctx)
+		m.For(t, "err").Assert(err, m.Equal(context.DeadlineExceeded))
+		m.For(t, "worker").Assert(worker, m.BeNil())
+	})
+
+	t.Run("wait for returned worker", func(t *testing.T) {
+		mWorker := NewMockWorker(ctrl)
+		mWorker.EXPECT().
+			Equals(gomock.Any()).
+			Return(true).
+			AnyTimes()
+		mWorker.EXPECT().
+			IsReady(gomock.Any()).
+			Return(true, nil)
+
+		mWorkerFactory := NewMockWorkerFactory(ctrl)
+		mWorkerFactory.EXPECT().
+			Create(gomock.Any()).
+			Return(mWorker, nil).
+			Times(1)
+
+		pool := NewPool(logger, mWorkerFactory, WithMaxWorkers(1))
+
+		worker, err := pool.GetWorker(context.Background())
+		m.For(t, "err").Require(err, m.BeNil())
+
+		result := make(chan Worker)
+		go func() {
+			w, err := pool.GetWorker(context.Background())
+			m.For(t, "err").Assert(err, m.BeNil())
+			result <- w
+		}()
+
+		time.Sleep(10 * time.Millisecond)
+		pool.ReturnWorker(worker)
+
+		select {
+		case w := <-result:
+			m.For(t, "worker").Assert(w, m.Equal(mWorker))
+		case <-time.After(time.Second):
+			t.Fatal("GetWorker did not return after worker was returned")
+		}
+	})
+}
+
+func TestDefaultPool_MinWarm(t *testing.T) {
+	logger := zaptest.NewLogger(t)
+
+	ctrl := gomock.NewController(t)
+	t.Cleanup(func() {
+		ctrl.Finish()
+	})
+
+	mWorker := NewMockWorker(ctrl)
+	mWorker.EXPECT().
+		Equals(gomock.Any()).
+		DoAndReturn(func(other Worker) bool { return other == mWorker }).
+		AnyTimes()
+	mWorker.EXPECT().
+		Close().
+		Return(nil)
+	mWorker2 := NewMockWorker(ctrl)
+	mWorker2.EXPECT().
+		Equals(gomock.Any()).
+		DoAndReturn(func(other Worker) bool { return other == mWorker2 }).
+		AnyTimes()
+	mWorker2.EXPECT().
+		Close().
+		Return(nil)
+
+	created := make(chan struct{}, 2)
+	mWorkerFactory := NewMockWorkerFactory(ctrl)
+	gomock.InOrder(
+		mWorkerFactory.EXPECT().
+			Create(gomock.Any()).
+			DoAndReturn(func(context.Context) (Worker, error) {
+				created <- struct{}{}
+				return mWorker, nil
+			}),
+		mWorkerFactory.EXPECT().
+			Create(gomock.Any()).
+			DoAndReturn(func(context.Context) (Worker, error) {
+				created <- struct{}{}
+				return mWorker2, nil
+			}),
+	)
+
+	pool := NewPool(logger, mWorkerFactory, WithMinWarm(2), WithMaxWorkers(4))
+	dp := pool.(*DefaultPool)
+
+	for i := 0; i < 2; i++ {
+		select {
+		case <-created:
+		case <-time.After(time.Second):
+			t.Fatal("warm workers not provisioned")
+		}
+	}
+
+	// Wait for the warmer to return both workers to the pool
+	deadline := time.Now().Add(time.Second)
+	for {
+		dp.mtx.Lock()
+		available := len(dp.availableInstances)
+		dp.mtx.Unlock()
+		if available == 2 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("warm workers not made available")
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	err := pool.Close()
+	m.For(t, "close err").Assert(err, m.BeNil())
+}
+
+func TestDefaultPool_SetMinWarm(t *testing.T) {
+	logger := zaptest.NewLogger(t)
+
+	ctrl := gomock.NewController(t)
+	t.Cleanup(func() {
+		ctrl.Finish()
+	})
+
+	workers := make([]*MockWorker, 3)
+	closed := make(chan struct{}, len(workers))
+	for i := range workers {
+		worker := NewMockWorker(ctrl)
+		workers[i] = worker
+		worker.EXPECT().
+			Equals(gomock.Any()).
+			DoAndReturn(func(other Worker) bool { return other == worker }).
+			AnyTimes()
+		worker.EXPECT().
+			Close().
+			DoAndReturn(func() error {
+				closed <- struct{}{}
+				return nil
+			})
+	}
+
+	var removed []RemovalReason
+	var removedMtx sync.Mutex
+	mWorkerFactory := NewMockWorkerFactory(ctrl)
+	gomock.InOrder(
+		mWorkerFactory.EXPECT().Create(gomock.Any()).Return(workers[0], nil),
+		mWorkerFactory.EXPECT().Create(gomock.Any()).Return(workers[1], nil),
+		mWorkerFactory.EXPECT().Create(gomock.Any()).Return(workers[2], nil),
+	)
+
+	pool := NewPool(logger, mWorkerFactory, WithMaxWorkers(4),
+		WithPoolEventHandler(func(event PoolEvent) {
+			if event.Type == WorkerRemoved {
+				removedMtx.Lock()
+				removed = append(removed, event.Reason)
+				removedMtx.Unlock()
+			}
+		}))
+
+	// Raising MinWarm provisions workers in the background
+	pool.SetMinWarm(3)
+	deadline := time.Now().Add(time.Second)
+	for pool.Stats().Available != 3 {
+		if time.Now().After(deadline) {
+			t.Fatal("warm workers not provisioned")
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	// Shrinking keeps MinWarm workers
+	m.For(t, "shrink at MinWarm").Assert(pool.Shrink(3), m.Equal(0))
+	pool.SetMinWarm(1)
+	m.For(t, "shrink").Assert(pool.Shrink(3), m.Equal(2))
+	m.For(t, "stats").Assert(pool.Stats(), m.Equal(PoolStats{Live: 1, Available: 1}))
+
+	removedMtx.Lock()
+	m.For(t, "reasons").Assert(removed, m.Equal([]RemovalReason{ReasonScaledDown, ReasonScaledDown}))
+	removedMtx.Unlock()
+
+	err := pool.Close()
+	m.For(t, "close err").Assert(err, m.BeNil())
+	m.For(t, "closed").Assert(len(closed), m.Equal(3))
+}
+
+// infoClient reports fixed worker info
+type infoClient struct {
+	proto.WorkerServiceClient
+	info *proto.WorkerInfoResponse
+}
+
+func (c *infoClient) Info(context.Context, *proto.WorkerInfoRequest, ...grpc.CallOption) (*proto.WorkerInfoResponse, error) {
+	return c.info, nil
+}
+
+// capableFactory declares the capabilities of its workers
+type capableFactory struct {
+	WorkerFactory
+	caps Capabilities
+}
+
+func (f capableFactory) Capabilities() Capabilities {
+	return f.caps
+}
+
+// wrapFactory wraps a factory, hiding its optional interfaces
+type wrapFactory struct {
+	WorkerFactory
+}
+
+func (f wrapFactory) Unwrap() WorkerFactory {
+	return f.WorkerFactory
+}
+
+func TestDefaultPool_GetWorkerFor(t *testing.T) {
+	logger := zaptest.NewLogger(t)
+
+	ctrl := gomock.NewController(t)
+	t.Cleanup(func() {
+		ctrl.Finish()
+	})
+
+	ready := make(chan error)
+	close(ready)
+	newWorker := func(info *proto.WorkerInfoResponse) *MockWorker {
+		worker := NewMockWorker(ctrl)
+		worker.EXPECT().
+			Equals(gomock.Any()).
+			DoAndReturn(func(other Worker) bool { return other == worker }).
+			AnyTimes()
+		worker.EXPECT().IsReady(gomock.Any()).Return(true, nil).AnyTimes()
+		worker.EXPECT().IsReadyChan(gomock.Any()).Return((<-chan error)(ready)).AnyTimes()
+		// Info is read once per worker
+		worker.EXPECT().Connect(gomock.Any()).Return(nil)
+		worker.EXPECT().Worker().Return(&infoClient{info: info})
+		return worker
+	}
+
+	cpu := newWorker(&proto.WorkerInfoResponse{Cpu: &proto.CPUInfo{Threads: 8}})
+	gpu := newWorker(&proto.WorkerInfoResponse{
+		Cpu: &proto.CPUInfo{Threads: 8},
+		Gpu: &proto.GPUInfo{Card: []*proto.GPUInfo_Card{{
+			Device: &proto.PCIInfo_Device{Vendor: &proto.PCIInfo_Vendor{Name: "NVIDIA Corporation"}},
+		}}},
+	})
+	big := newWorker(&proto.WorkerInfoResponse{Cpu: &proto.CPUInfo{Threads: 64}, ScratchBytes: 500 * GiB})
+	cpu.EXPECT().Close().Return(nil)
+	gpu.EXPECT().Close().Return(nil)
+	big.EXPECT().Close().Return(nil)
+
+	mWorkerFactory := NewMockWorkerFactory(ctrl)
+	gomock.InOrder(
+		mWorkerFactory.EXPECT().Create(gomock.Any()).Return(cpu, nil),
+		mWorkerFactory.EXPECT().Create(gomock.Any()).Return(gpu, nil),
+		mWorkerFactory.EXPECT().Create(gomock.Any()).Return(big, nil),
+	)
+
+	var removed []RemovalReason
+	pool := NewPool(logger, mWorkerFactory, WithMaxWorkers(2),
+		WithPoolEventHandler(func(event PoolEvent) {
+			if event.Type == WorkerRemoved {
+				removed = append(removed, event.Reason)
+			}
+		}))
+
+	worker, err := pool.GetWorker(context.Background())
+	m.For(t, "get err").Require(err, m.BeNil())
+	pool.ReturnWorker(worker)
+
+	// The idle worker is checked, then a matching worker is provisioned
+	nvidia := Requirements{GPUVendor: "nvidia"}
+	worker, err = pool.GetWorkerFor(context.Background(), nvidia)
+	m.For(t, "gpu err").Require(err, m.BeNil())
+	m.For(t, "gpu worker").Assert(worker, m.Equal(gpu))
+	pool.ReturnWorker(worker)
+
+	// Capabilities are cached
+	worker, err = pool.GetWorkerFor(context.Background(), nvidia)
+	m.For(t, "cached err").Require(err, m.BeNil())
+	m.For(t, "cached worker").Assert(worker, m.Equal(gpu))
+
+	// The full pool replaces its idle worker that doesn't match
+	worker, err = pool.GetWorkerFor(context.Background(), Requirements{MinThreads: 16, MinScratch: 100 * GiB})
+	m.For(t, "big err").Require(err, m.BeNil())
+	m.For(t, "big worker").Assert(worker, m.Equal(big))
+	m.For(t, "replaced").Assert(removed, m.Equal([]RemovalReason{ReasonReplaced}))
+
+	err = pool.Close()
+	m.For(t, "close err").Assert(err, m.BeNil())
+
+	// Factories declaring capabilities aren't used for work they can't run,
+	// even wrapped
+	mWorkerFactory = NewMockWorkerFactory(ctrl)
+	pool = NewPool(logger, wrapFactory{capableFactory{WorkerFactory: mWorkerFactory, caps: Capabilities{Threads: 4}}})
+	_, err = pool.GetWorkerFor(context.Background(), Requirements{GPU: true})
+	m.For(t, "no match").Assert(errors.Is(err, ErrNoMatchingWorker), m.Equal(true))
+	m.For(t, "no match close err").Assert(pool.Close(), m.BeNil())
+
+	// Created workers that don't match are kept and the next factory is used
+	cpu = newWorker(&proto.WorkerInfoResponse{Cpu: &proto.CPUInfo{Threads: 8}})
+	gpu = newWorker(&proto.WorkerInfoResponse{Gpu: &proto.GPUInfo{Card: []*proto.GPUInfo_Card{{
+		Device: &proto.PCIInfo_Device{Vendor: &proto.PCIInfo_Vendor{Name: "NVIDIA Corporation"}},
+	}}}})
+	cpu.EXPECT().Close().Return(nil)
+	gpu.EXPECT().Close().Return(nil)
+
+	spare := NewMockWorkerFactory(ctrl)
+	spare.EXPECT().Create(gomock.Any()).Return(cpu, nil)
+	spot := NewMockWorkerFactory(ctrl)
+	spot.EXPECT().Create(gomock.Any()).Return(gpu, nil)
+	pool = NewMultiPool(logger, []NamedFactory{
+		{Name: "spare", Factory: spare},
+		{Name: "spot", Factory: spot, Priority: 1},
+	})
+
+	worker, err = pool.GetWorkerFor(context.Background(), nvidia)
+	m.For(t, "fallback err").Require(err, m.BeNil())
+	m.For(t, "fallback worker").Assert(worker, m.Equal(gpu))
+	m.For(t, "fallback stats").Assert(pool.Stats(), m.Equal(PoolStats{Live: 2, Available: 1}))
+
+	// The worker that didn't match is used for other work
+	worker, err = pool.GetWorker(context.Background())
+	m.For(t, "kept err").Require(err, m.BeNil())
+	m.For(t, "kept worker").Assert(worker, m.Equal(cpu))
+	m.For(t, "fallback close err").Assert(pool.Close(), m.BeNil())
+}
+
+func TestNewMultiPool(t *testing.T) {
+	logger := zaptest.NewLogger(t)
+
+	ctrl := gomock.NewController(t)
+	t.Cleanup(func() {
+		ctrl.Finish()
+	})
+
+	workers := make([]*MockWorker, 3)
+	for i := range workers {
+		worker := NewMockWorker(ctrl)
+		workers[i] = worker
+		worker.EXPECT().
+			Equals(gomock.Any()).
+			DoAndReturn(func(other Worker) bool { return other == worker }).
+			AnyTimes()
+		worker.EXPECT().Close().Return(nil)
+	}
+
+	cpu := NewMockWorkerFactory(ctrl)
+	cpu.EXPECT().Create(gomock.Any()).Return(workers[0], nil)
+	spare := NewMockWorkerFactory(ctrl)
+	spare.EXPECT().Create(gomock.Any()).Return(workers[1], nil)
+	spot := NewMockWorkerFactory(ctrl)
+	spot.EXPECT().Create(gomock.Any()).Return(nil, fmt.Errorf("no spot capacity: %w", ErrInsufficientCapacity))
+	onDemand := NewMockWorkerFactory(ctrl)
+	onDemand.EXPECT().Create(gomock.Any()).Return(workers[2], nil)
+
+	gpu := &Capabilities{GPUs: []string{"NVIDIA Corporation"}}
+	var created []string
+	pool := NewMultiPool(logger, []NamedFactory{
+		{Name: "gpu-on-demand", Factory: onDemand, Priority: 3, Capabilities: gpu},
+		{Name: "spare", Factory: spare, Priority: 2},
+		{Name: "gpu-spot", Factory: spot, Priority: 1, Capabilities: gpu},
+		{Name: "cpu", Factory: cpu, Priority: 0, MaxWorkers: 1},
+	},
+		WithRouter(RouteRules(
+			RouteRule{Match: Requirements{GPU: true}, Factories: []string{"gpu-spot", "gpu-on-demand"}},
+			RouteRule{Factories: []string{"cpu", "spare"}},
+		)),
+		WithPoolEventHandler(func(event PoolEvent) {
+			if event.Type == WorkerCreated {
+				created = append(created, event.Factory)
+			}
+		}))
+
+	// The cheapest factory is used until it is full
+	worker, err := pool.GetWorker(context.Background())
+	m.For(t, "cpu err").Require(err, m.BeNil())
+	m.For(t, "cpu worker").Assert(worker, m.Equal(workers[0]))
+	worker, err = pool.GetWorker(context.Background())
+	m.For(t, "spare err").Require(err, m.BeNil())
+	m.For(t, "spare worker").Assert(worker, m.Equal(workers[1]))
+
+	// Factories out of capacity fall back to the next routed factory
+	worker, err = pool.GetWorkerFor(context.Background(), Requirements{GPUVendor: "nvidia"})
+	m.For(t, "gpu err").Require(err, m.BeNil())
+	m.For(t, "gpu worker").Assert(worker, m.Equal(workers[2]))
+	m.For(t, "created").Assert(created, m.Equal([]string{"cpu", "spare", "gpu-on-demand"}))
+
+	err = pool.Close()
+	m.For(t, "close err").Assert(err, m.BeNil())
+}
@@ -0,0 +1,121 @@
+package compute
+
+import (
+	"container/heap"
+	"time"
+
+	"github.com/benbjohnson/clock"
+)
+
+// priorityBuffer dispatches work with the highest priority first. Work with
+// equal priority is dispatched in the order it was added.
+//
+// If agingInterval is set, waiting work gains one priority level for every
+// agingInterval it spends in the buffer, so low priority work cannot be starved
+// forever. Because all buffered work ages at the same rate, this is equivalent
+// to ordering by a virtual enqueue time of enqueued - priority*agingInterval.
+type priorityBuffer struct {
+	clock         clock.Clock
+	agingInterval time.Duration
+
+	seq   uint64
+	items priorityItems
+	index map[*workItem]*priorityItem
+}
+
+func newPriorityBuffer(c clock.Clock, agingInterval time.Duration) *priorityBuffer {
+	return &priorityBuffer{
+		clock:         c,
+		agingInterval: agingInterval,
+		index:         make(map[*workItem]*priorityItem),
+	}
+}
+
+func (b *priorityBuffer) push(work *workItem) {
+	item := &priorityItem{
+		work:     work,
+		priority: work.info.getPriority(),
+		seq:      b.seq,
+	}
+	b.seq++
+
+	if b.agingInterval > 0 {
+		item.aging = true
+		item.virtual = b.clock.Now().Add(-time.Duration(item.priority) * b.agingInterval)
+	}
+
+	heap.Push(&b.items, item)
+	b.index[work] = item
+}
+
+func (b *priorityBuffer) pop() (*workItem, bool) {
+	if len(b.items) == 0 {
+		return nil, false
+	}
+
+	item := heap.Pop(&b.items).(*priorityItem)
+	delete(b.index, item.work)
+	return item.work, true
+}
+
+func (b *priorityBuffer) remove(work *workItem) bool {
+	item, ok := b.index[work]
+	if !ok {
+		return false
+	}
+
+	heap.Remove(&b.items, item.index)
+	delete(b.index, work)
+	return true
+}
+
+func (b *priorityBuffer) len() int {
+	return len(b.items)
+}
+
+type priorityItem struct {
+	work     *workItem
+	priority int
+	seq      uint64 // Insertion order, for stable FIFO within a priority
+	index    int    // Index in the heap
+
+	aging   bool
+	virtual time.Time // Enqueue time shifted back by the priority
+}
+
+// priorityItems implements heap.Interface
+type priorityItems []*priorityItem
+
+func (p priorityItems) Len() int { return len(p) }
+
+func (p priorityItems) Less(i, j int) bool {
+	a, b := p[i], p[j]
+	if a.aging && !a.virtual.Equal(b.virtual) {
+		return a.virtual.Before(b.virtual)
+	}
+	if !a.aging && a.priority != b.priority {
+		return a.priority > b.priority
+	}
+	return a.seq < b.seq
+}
+
+func (p priorityItems) Swap(i, j int) {
+	p[i], p[j] = p[j], p[i]
+	p[i].index = i
+	p[j].index = j
+}
+
+func (p *priorityItems) Push(x any) {
+	item := x.(*priorityItem)
+	item.index = len(*p)
+	*p = append(*p, item)
+}
+
+func (p *priorityItems) Pop() any {
+	old := *p
+	n := len(old)
+	item := old[n-1]
+	old[n-1] = nil
+	*p = old[:n-1]
+	return item
+}
@@ -0,0 +1,109 @@
+package compute
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/benbjohnson/clock"
+	m "github.com/launchdarkly/go-test-helpers/v2/matchers"
+)
+
+func newPriorityWork(req string, priority int) *workItem {
+	work := NewWorkInfo[string, any](context.Background(), req, nil)
+	work.Priority = priority
+	return &workItem{info: work}
+}
+
+func popAll(t *testing.T, b workBuffer) []any {
+	t.Helper()
+
+	var reqs []any
+	for {
+		item, ok := b.pop()
+		if !ok {
+			return reqs
+		}
+		reqs = append(reqs, item.info.getReq())
+	}
+}
+
+func TestPriorityBuffer(t *testing.T) {
+	t.Run("highest priority first", func(t *testing.T) {
+		b := newPriorityBuffer(clock.NewMock(), 0)
+		b.push(newPriorityWork("low", 0))
+		b.push(newPriorityWork("high", 10))
+		b.push(newPriorityWork("mid", 5))
+
+		m.For(t, "len").Assert(b.len(), m.Equal(3))
+		m.For(t, "order").Assert(popAll(t, b), m.Items(
+			m.Equal("high"), m.Equal("mid"), m.Equal("low"),
+		))
+	})
+
+	t.Run("fifo within priority", func(t *testing.T) {
+		b := newPriorityBuffer(clock.NewMock(), 0)
+		b.push(newPriorityWork("a0", 0))
+		b.push(newPriorityWork("a5", 5))
+		b.push(newPriorityWork("b0", 0))
+		b.push(newPriorityWork("b5", 5))
+		b.push(newPriorityWork("c0", 0))
+
+		m.For(t, "order").Assert(popAll(t, b), m.Items(
+			m.Equal("a5"), m.Equal("b5"), m.Equal("a0"), m.Equal("b0"), m.Equal("c0"),
+		))
+	})
+
+	t.Run("aging", func(t *testing.T) {
+		mClock := clock.NewMock()
+		b := newPriorityBuffer(mClock, time.Minute)
+
+		b.push(newPriorityWork("old low", 0))
+		mClock.Add(10 * time.Minute)
+		// Waited 10 minutes, so ranks above fresh priority 5 work
+		b.push(newPriorityWork("new high", 5))
+		// But not above fresh priority 15 work
+		b.push(newPriorityWork("new urgent", 15))
+		// Equal effective priority keeps insertion order
+		b.push(newPriorityWork("new equal", 10))
+
+		m.For(t, "order").Assert(popAll(t, b), m.Items(
+			m.Equal("new urgent"), m.Equal("old low"), m.Equal("new equal"), m.Equal("new high"),
+		))
+	})
+
+	t.Run("remove", func(t *testing.T) {
+		b := newPriorityBuffer(clock.NewMock(), 0)
+		low := newPriorityWork("low", 0)
+		mid := newPriorityWork("mid", 5)
+		b.push(low)
+		b.push(newPriorityWork("high", 10))
+		b.push(mid)
+
+		m.For(t, "removed").Assert(b.remove(mid), m.Equal(true))
+		m.For(t, "removed twice").Assert(b.remove(mid), m.Equal(false))
+		m.For(t, "order").Assert(popAll(t, b), m.Items(m.Equal("high"), m.Equal("low")))
+		m.For(t, "removed popped").Assert(b.remove(low), m.Equal(false))
+	})
+
+	t.Run("empty", func(t *testing.T) {
+		b := newPriorityBuffer(clock.NewMock(), 0)
+
+		work, ok := b.pop()
+		m.For(t, "ok").Assert(ok, m.Equal(false))
+		m.For(t, "work").Assert(work, m.BeNil())
+	})
+}
+
+func TestFIFOBuffer(t *testing.T) {
+	b := newFIFOBuffer()
+	b.push(newPriorityWork("a", 0))
+	b.push(newPriorityWork("b", 10))
+	b.push(newPriorityWork("c", 5))
+
+	m.For(t, "len").Assert(b.len(), m.Equal(3))
+	m.For(t, "order").Assert(popAll(t, b), m.Items(
+		m.Equal("a"), m.Equal("b"), m.Equal("c"),
+	))
+	m.For(t, "len").Assert(b.len(), m.Equal(0))
+}
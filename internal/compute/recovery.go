@@ -0,0 +1,235 @@
+package compute
+
+import (
+	"context"
+
+	"go.uber.org/zap"
+)
+
+// record journals instance lifecycle events
+func (p *DefaultPool) record(event PoolEvent) {
+	if p.options.Journal == nil {
+		return
+	}
+
+	identifier, ok := event.Worker.(Identifier)
+	if !ok {
+		return
+	}
+
+	entry := JournalEntry{
+		Time:       event.Time,
+		InstanceID: identifier.ID(),
+	}
+	switch event.Type {
+	case WorkerCreated:
+		entry.Type = JournalInstanceCreated
+		entry.Factory = event.Factory
+	case WorkerRemoved:
+		entry.Type = JournalInstanceRemoved
+	default:
+		return
+	}
+
+	if err := p.options.Journal.Record(entry); err != nil {
+		p.logger.Error("error recording instance in journal", zap.Error(err))
+	}
+}
+
+// recoverInstances reattaches instances left over from a previous run as idle
+// workers. Instances that were running work or can't be reattached are
+// terminated, as that work is replayed from the start by the WorkQueue.
+// Instances stay in the journal until they are terminated, so that the next
+// run terminates them if this one can't.
+func (p *DefaultPool) recoverInstances(state *JournalState) {
+	if state == nil || len(state.Instances) == 0 {
+		return
+	}
+
+	busy := make(map[string]bool)
+	for _, id := range state.Running {
+		busy[id] = true
+	}
+
+	for _, id := range state.Instances {
+		f := p.attacher(state.Factories[id])
+		if f == nil {
+			// The factory of the instance is gone, e.g. after a configuration
+			// change
+			if f = p.attacher(""); f != nil {
+				p.terminate(f, id)
+				continue
+			}
+			p.logger.Error("No worker factory can terminate instance. Leaving it running",
+				zap.String("instance", id),
+				zap.String("factory", state.Factories[id]))
+			continue
+		}
+
+		attacher, _ := f.attacher()
+		worker, err := attacher.Attach(p.ctx, id)
+		if err != nil {
+			if p.ctx.Err() != nil {
+				return
+			}
+			p.logger.Warn("Could not reattach instance", zap.String("instance", id), zap.Error(err))
+			p.terminate(f, id)
+			continue
+		}
+
+		p.mtx.Lock()
+		adopt := !busy[id] && !p.closed && p.hasCapacity() && f.hasCapacity()
+		if adopt {
+			p.allInstances = append(p.allInstances, worker)
+			p.availableInstances = append(p.availableInstances, worker)
+			p.idleSince[worker] = p.options.Clock.Now()
+			p.owners[worker] = f
+			f.workers++
+			p.signal()
+		}
+		p.mtx.Unlock()
+
+		if adopt {
+			p.logger.Info("Reattached instance", zap.String("instance", id), zap.String("factory", f.Name))
+			continue
+		}
+
+		p.logger.Info("Terminating recovered instance", zap.String("instance", id))
+		if err := worker.Close(); err != nil {
+			p.logger.Error("error terminating recovered instance", zap.String("instance", id), zap.Error(err))
+			continue
+		}
+		p.recordRemoved(id)
+	}
+}
+
+// terminate terminates instance id with the WorkerAttacher f and removes it
+// from the journal
+func (p *DefaultPool) terminate(f *poolFactory, id string) {
+	p.logger.Info("Terminating recovered instance", zap.String("instance", id), zap.String("factory", f.Name))
+	attacher, _ := f.attacher()
+	if err := attacher.Terminate(p.ctx, id); err != nil {
+		p.logger.Error("error terminating recovered instance", zap.String("instance", id), zap.Error(err))
+		return
+	}
+	p.recordRemoved(id)
+}
+
+// attacher returns the factory called name if it can reattach instances.
+// Instances journaled without a factory are reattached by the first factory
+// that can.
+func (p *DefaultPool) attacher(name string) *poolFactory {
+	for _, f := range p.factories {
+		if _, ok := f.attacher(); ok && (name == "" || f.Name == name) {
+			return f
+		}
+	}
+	return nil
+}
+
+func (p *DefaultPool) recordRemoved(id string) {
+	err := p.options.Journal.Record(JournalEntry{
+		Type:       JournalInstanceRemoved,
+		Time:       p.options.Clock.Now(),
+		InstanceID: id,
+	})
+	if err != nil {
+		p.logger.Error("error recording instance in journal", zap.Error(err))
+	}
+}
+
+// replay re-adds unfinished work from the journal, keeping its WorkID
+func (q *DefaultWorkQueue) replay(state *JournalState) {
+	if state == nil {
+		return
+	}
+
+	for _, entry := range state.Pending {
+		restorer, ok := lookupWorkType(entry.Kind)
+		if !ok {
+			q.logger.Error("Cannot replay work of unregistered type",
+				zap.String("id", string(entry.WorkID)),
+				zap.String("kind", entry.Kind))
+			q.recordFinished(entry.WorkID, ErrUnknownWorkType)
+			continue
+		}
+
+		ctx := context.Background()
+		if q.options.ReplayContext != nil {
+			ctx = q.options.ReplayContext(entry)
+		}
+
+		info, err := restorer.restore(ctx, entry)
+		if err != nil {
+			q.logger.Error("Cannot restore journaled work",
+				zap.String("id", string(entry.WorkID)),
+				zap.Error(err))
+			q.recordFinished(entry.WorkID, err)
+			continue
+		}
+
+		q.logger.Info("Replaying work from journal", zap.String("id", string(entry.WorkID)))
+		q.add(entry.WorkID, info, true)
+	}
+}
+
+func (q *DefaultWorkQueue) recordSubmitted(item *workItem) {
+	kind, payload, err := item.info.marshal()
+	if err != nil {
+		q.logger.Error("error serializing work for journal", zap.Error(err))
+		return
+	}
+	if kind == "" {
+		// Work not created from a registered WorkType can't be replayed
+		return
+	}
+
+	item.journaled = true
+	entry := JournalEntry{
+		Type:      JournalWorkSubmitted,
+		WorkID:    item.id,
+		Kind:      kind,
+		Payload:   payload,
+		Priority:  item.info.getPriority(),
+		Tenant:    item.info.getTenant(),
+		NotBefore: item.info.getNotBefore(),
+		Window:    item.info.getWindow(),
+	}
+	if req := item.info.getRequirements(); !req.IsZero() {
+		entry.Requirements = &req
+	}
+	q.record(entry)
+}
+
+func (q *DefaultWorkQueue) recordStarted(item *workItem, worker Worker) {
+	entry := JournalEntry{
+		Type:   JournalWorkStarted,
+		WorkID: item.id,
+	}
+	if identifier, ok := worker.(Identifier); ok {
+		entry.InstanceID = identifier.ID()
+	}
+	q.record(entry)
+}
+
+func (q *DefaultWorkQueue) recordFinished(id WorkID, err error) {
+	entry := JournalEntry{
+		Type:   JournalWorkFinished,
+		WorkID: id,
+	}
+	if err != nil {
+		entry.Error = err.Error()
+	}
+	q.record(entry)
+}
+
+func (q *DefaultWorkQueue) record(entry JournalEntry) {
+	if q.options.Journal == nil {
+		return
+	}
+
+	entry.Time = q.options.Clock.Now()
+	if err := q.options.Journal.Record(entry); err != nil {
+		q.logger.Error("error recording work in journal", zap.Error(err))
+	}
+}
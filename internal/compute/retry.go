@@ -0,0 +1,120 @@
+package compute
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"math/rand"
+	"time"
+
+	"github.com/pkg/errors"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// RetryClassifier reports whether work that failed with err may be retried on
+// a fresh worker.
+type RetryClassifier func(err error) bool
+
+type RetryPolicy struct {
+	// MaxAttempts is the total number of attempts, including the first.
+	// Values below 2 disable retries.
+	MaxAttempts int
+	// InitialBackoff is the delay before the first retry.
+	InitialBackoff time.Duration
+	// MaxBackoff caps the delay between attempts. Zero means uncapped.
+	MaxBackoff time.Duration
+	// Multiplier is applied to the delay after every attempt. Defaults to 2.
+	Multiplier float64
+	// Jitter randomly shortens each delay by up to this fraction (0 to 1).
+	Jitter float64
+	// Retryable classifies errors. Defaults to DefaultRetryable.
+	Retryable RetryClassifier
+}
+
+// backoff returns the delay before the given retry (1 for the first retry)
+func (p RetryPolicy) backoff(retry int) time.Duration {
+	multiplier := p.Multiplier
+	if multiplier <= 0 {
+		multiplier = 2
+	}
+
+	delay := float64(p.InitialBackoff) * math.Pow(multiplier, float64(retry-1))
+	if p.MaxBackoff > 0 && delay > float64(p.MaxBackoff) {
+		delay = float64(p.MaxBackoff)
+	}
+
+	if p.Jitter > 0 {
+		delay -= delay * p.Jitter * rand.Float64()
+	}
+
+	return time.Duration(delay)
+}
+
+func (p RetryPolicy) retryable(err error) bool {
+	if p.Retryable != nil {
+		return p.Retryable(err)
+	}
+	return DefaultRetryable(err)
+}
+
+// retries reports whether the given attempt, which failed with err, is
+// retried
+func (p RetryPolicy) retries(attempt int, err error) bool {
+	return attempt < p.MaxAttempts && p.retryable(err)
+}
+
+// DefaultRetryable treats worker failures and transient gRPC errors as
+// retryable. Canceled work, work no worker can run and all other errors are
+// permanent.
+func DefaultRetryable(err error) bool {
+	if err == nil || errors.Is(err, context.Canceled) || errors.Is(err, ErrPoolClosed) || errors.Is(err, ErrNoMatchingWorker) {
+		return false
+	}
+
+	var workerErr *WorkerError
+	if errors.As(err, &workerErr) || errors.Is(err, ErrClosed) {
+		return true
+	}
+
+	if s, ok := status.FromError(err); ok {
+		switch s.Code() {
+		case codes.Unavailable, codes.ResourceExhausted, codes.Aborted, codes.Internal:
+			return true
+		}
+	}
+
+	return false
+}
+
+// WorkerError wraps errors from getting a worker ready for work, as opposed to
+// errors returned by the work itself.
+type WorkerError struct {
+	Err error
+}
+
+func (e *WorkerError) Error() string {
+	return fmt.Sprintf("worker error: %v", e.Err)
+}
+
+func (e *WorkerError) Unwrap() error {
+	return e.Err
+}
+
+// RetryError is returned for work that failed after more than one attempt.
+type RetryError struct {
+	// Attempts holds the error of every attempt in order
+	Attempts []error
+}
+
+func (e *RetryError) Error() string {
+	return fmt.Sprintf("work failed after %d attempts: %v", len(e.Attempts), e.Unwrap())
+}
+
+// Unwrap returns the error of the last attempt
+func (e *RetryError) Unwrap() error {
+	if len(e.Attempts) == 0 {
+		return nil
+	}
+	return e.Attempts[len(e.Attempts)-1]
+}
@@ -0,0 +1,228 @@
+package compute
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/golang/mock/gomock"
+	m "github.com/launchdarkly/go-test-helpers/v2/matchers"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zaptest"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestDefaultRetryable(t *testing.T) {
+	tests := []struct {
+		name   string
+		err    error
+		expect bool
+	}{
+		{"nil", nil, false},
+		{"plain", errors.New("err"), false},
+		{"canceled", context.Canceled, false},
+		{"worker error", &WorkerError{Err: errors.New("connect failed")}, true},
+		{"worker canceled", &WorkerError{Err: context.Canceled}, false},
+		{"pool closed", &WorkerError{Err: ErrPoolClosed}, false},
+		{"closed", ErrClosed, true},
+		{"unavailable", status.Error(codes.Unavailable, "unavailable"), true},
+		{"resource exhausted", status.Error(codes.ResourceExhausted, "exhausted"), true},
+		{"invalid argument", status.Error(codes.InvalidArgument, "invalid"), false},
+		{"not found", status.Error(codes.NotFound, "not found"), false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			m.For(t, "retryable").Assert(DefaultRetryable(test.err), m.Equal(test.expect))
+		})
+	}
+}
+
+func TestRetryPolicy_backoff(t *testing.T) {
+	tests := []struct {
+		name   string
+		policy RetryPolicy
+		retry  int
+		expect time.Duration
+	}{
+		{"first", RetryPolicy{InitialBackoff: time.Second}, 1, time.Second},
+		{"second", RetryPolicy{InitialBackoff: time.Second}, 2, 2 * time.Second},
+		{"third", RetryPolicy{InitialBackoff: time.Second}, 3, 4 * time.Second},
+		{"multiplier", RetryPolicy{InitialBackoff: time.Second, Multiplier: 3}, 3, 9 * time.Second},
+		{"capped", RetryPolicy{InitialBackoff: time.Second, MaxBackoff: 3 * time.Second}, 5, 3 * time.Second},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			m.For(t, "backoff").Assert(test.policy.backoff(test.retry), m.Equal(test.expect))
+		})
+	}
+
+	t.Run("jitter", func(t *testing.T) {
+		policy := RetryPolicy{InitialBackoff: time.Second, Jitter: 0.5}
+		for i := 0; i < 100; i++ {
+			d := policy.backoff(1)
+			if d < 500*time.Millisecond || d > time.Second {
+				t.Fatalf("backoff %v out of jitter range", d)
+			}
+		}
+	})
+}
+
+func TestDefaultWorkQueue_Retry(t *testing.T) {
+	logger := zaptest.NewLogger(t)
+
+	ctrl := gomock.NewController(t)
+	t.Cleanup(func() {
+		ctrl.Finish()
+	})
+
+	newWorker := func() *MockWorker {
+		mWorker := NewMockWorker(ctrl)
+		mWorker.EXPECT().
+			IsReadyChan(gomock.Any(), gomock.Any()).
+			DoAndReturn(func(ctx context.Context, opts ...func(options *ReadyOptions)) <-chan error {
+				ch := make(chan error, 1)
+				ch <- nil
+				return ch
+			}).
+			AnyTimes()
+		mWorker.EXPECT().
+			Connect(gomock.Any()).
+			Return(nil).
+			AnyTimes()
+		mWorker.EXPECT().
+			Equals(gomock.Any()).
+			DoAndReturn(func(other Worker) bool { return other == mWorker }).
+			AnyTimes()
+		return mWorker
+	}
+
+	policy := RetryPolicy{
+		MaxAttempts:    3,
+		InitialBackoff: time.Millisecond,
+	}
+	unavailable := status.Error(codes.Unavailable, "worker gone")
+
+	t.Run("retry on fresh worker", func(t *testing.T) {
+		mWorker := newWorker()
+		mWorker2 := newWorker()
+
+		mPool := NewMockPool(ctrl)
+		gomock.InOrder(
+			mPool.EXPECT().GetWorker(gomock.Any()).Return(mWorker, nil),
+			mPool.EXPECT().RemoveWorker(gomock.Eq(mWorker)),
+			mPool.EXPECT().GetWorker(gomock.Any()).Return(mWorker2, nil),
+			mPool.EXPECT().ReturnWorker(gomock.Eq(mWorker2)),
+		)
+
+		work := NewWorkInfo(context.Background(), "req",
+			func(ctx context.Context, logger *zap.Logger, req string, worker Worker) (string, error) {
+				if worker == mWorker {
+					return "", unavailable
+				}
+				return "done", nil
+			})
+
+		q := NewQueue(logger, mPool, 1, WithRetryPolicy(policy))
+		q.Add(work)
+		q.Wait()
+
+		select {
+		case res := <-work.Result:
+			m.For(t, "result").Assert(res, m.Equal("done"))
+		case err := <-work.Err:
+			t.Fatalf("unexpected error: %v", err)
+		}
+	})
+
+	t.Run("permanent error", func(t *testing.T) {
+		mWorker := newWorker()
+		invalid := status.Error(codes.InvalidArgument, "bad codec")
+
+		mPool := NewMockPool(ctrl)
+		mPool.EXPECT().GetWorker(gomock.Any()).Return(mWorker, nil)
+		mPool.EXPECT().ReturnWorker(gomock.Eq(mWorker))
+
+		work := NewWorkInfo(context.Background(), "req",
+			func(ctx context.Context, logger *zap.Logger, req string, worker Worker) (string, error) {
+				return "", invalid
+			})
+
+		q := NewQueue(logger, mPool, 1, WithRetryPolicy(policy))
+		q.Add(work)
+		q.Wait()
+
+		m.For(t, "err").Assert(<-work.Err, m.Equal(invalid))
+	})
+
+	t.Run("attempts exhausted", func(t *testing.T) {
+		mWorker := newWorker()
+
+		mPool := NewMockPool(ctrl)
+		mPool.EXPECT().GetWorker(gomock.Any()).Return(mWorker, nil).Times(3)
+		mPool.EXPECT().RemoveWorker(gomock.Eq(mWorker)).Times(2)
+		// The worker of the last attempt is not replaced, as nothing is retried
+		mPool.EXPECT().ReturnWorker(gomock.Eq(mWorker))
+
+		work := NewWorkInfo(context.Background(), "req",
+			func(ctx context.Context, logger *zap.Logger, req string, worker Worker) (string, error) {
+				return "", unavailable
+			})
+
+		q := NewQueue(logger, mPool, 1, WithRetryPolicy(policy))
+		q.Add(work)
+		q.Wait()
+
+		err := <-work.Err
+		var retryErr *RetryError
+		m.For(t, "is RetryError").Require(errors.As(err, &retryErr), m.Equal(true))
+		m.For(t, "attempts").Assert(retryErr.Attempts, m.Items(
+			m.Equal(unavailable), m.Equal(unavailable), m.Equal(unavailable),
+		))
+		m.For(t, "unwrap").Assert(errors.Unwrap(err), m.Equal(unavailable))
+	})
+
+	t.Run("default policy", func(t *testing.T) {
+		mWorker := newWorker()
+
+		// Retries are disabled, so the worker is kept
+		mPool := NewMockPool(ctrl)
+		mPool.EXPECT().GetWorker(gomock.Any()).Return(mWorker, nil)
+		mPool.EXPECT().ReturnWorker(gomock.Eq(mWorker))
+
+		work := NewWorkInfo(context.Background(), "req",
+			func(ctx context.Context, logger *zap.Logger, req string, worker Worker) (string, error) {
+				return "", unavailable
+			})
+
+		q := NewQueue(logger, mPool, 1)
+		q.Add(work)
+		q.Wait()
+
+		m.For(t, "err").Assert(<-work.Err, m.Equal(unavailable))
+	})
+
+	t.Run("get worker error", func(t *testing.T) {
+		mWorker := newWorker()
+		createErr := errors.New("insufficient capacity")
+
+		mPool := NewMockPool(ctrl)
+		gomock.InOrder(
+			mPool.EXPECT().GetWorker(gomock.Any()).Return(nil, createErr),
+			mPool.EXPECT().GetWorker(gomock.Any()).Return(mWorker, nil),
+			mPool.EXPECT().ReturnWorker(gomock.Eq(mWorker)),
+		)
+
+		work := NewWorkInfo(context.Background(), "req",
+			func(ctx context.Context, logger *zap.Logger, req string, worker Worker) (string, error) {
+				return "done", nil
+			})
+
+		q := NewQueue(logger, mPool, 1, WithRetryPolicy(policy))
+		q.Add(work)
+		q.Wait()
+
+		m.For(t, "result").Assert(<-work.Result, m.Equal("done"))
+	})
+}
@@ -0,0 +1,173 @@
+package compute
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/benbjohnson/clock"
+	"go.uber.org/zap"
+)
+
+// Window is a daily recurring time window, e.g. 22:00 to 06:00. A window
+// whose end is before its start spans midnight. A window whose start equals
+// its end is always open.
+type Window struct {
+	// Start is the time of day the window opens, as an offset from midnight
+	Start time.Duration
+	// End is the time of day the window closes, as an offset from midnight
+	End time.Duration
+	// Location of the times of day. Defaults to time.Local.
+	Location *time.Location
+}
+
+// NewWindow creates a window from start and end times of day in 15:04 format
+func NewWindow(start, end string, loc *time.Location) (*Window, error) {
+	startOffset, err := parseTimeOfDay(start)
+	if err != nil {
+		return nil, err
+	}
+	endOffset, err := parseTimeOfDay(end)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Window{
+		Start:    startOffset,
+		End:      endOffset,
+		Location: loc,
+	}, nil
+}
+
+func parseTimeOfDay(s string) (time.Duration, error) {
+	t, err := time.Parse("15:04", s)
+	if err != nil {
+		return 0, fmt.Errorf("invalid time of day %q: %w", s, err)
+	}
+	return time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute, nil
+}
+
+func (w *Window) location() *time.Location {
+	if w.Location == nil {
+		return time.Local
+	}
+	return w.Location
+}
+
+// timeOfDay returns the time of day of t in the window's location, as an
+// offset from midnight. It is read from the clock, so that days on which the
+// clocks change don't shift the window.
+func (w *Window) timeOfDay(t time.Time) time.Duration {
+	hour, minute, sec := t.In(w.location()).Clock()
+	return time.Duration(hour)*time.Hour + time.Duration(minute)*time.Minute + time.Duration(sec)*time.Second
+}
+
+// at returns the time of day offset, days after the day of t in the window's
+// location
+func (w *Window) at(t time.Time, days int, offset time.Duration) time.Time {
+	t = t.In(w.location())
+	return time.Date(t.Year(), t.Month(), t.Day()+days, 0, 0, 0, int(offset), t.Location())
+}
+
+// Contains reports whether the window is open at t
+func (w *Window) Contains(t time.Time) bool {
+	if w.Start == w.End {
+		return true
+	}
+
+	offset := w.timeOfDay(t)
+	if w.Start < w.End {
+		return offset >= w.Start && offset < w.End
+	}
+	return offset >= w.Start || offset < w.End
+}
+
+// Next returns t if the window is open at t, otherwise the next time the
+// window opens.
+func (w *Window) Next(t time.Time) time.Time {
+	if w.Contains(t) {
+		return t
+	}
+
+	opening := w.at(t, 0, w.Start)
+	if !opening.After(t) {
+		opening = w.at(t, 1, w.Start)
+	}
+	return opening
+}
+
+type windowJSON struct {
+	Start    time.Duration `json:"start"`
+	End      time.Duration `json:"end"`
+	Location string        `json:"location,omitempty"`
+}
+
+func (w *Window) MarshalJSON() ([]byte, error) {
+	return json.Marshal(windowJSON{
+		Start:    w.Start,
+		End:      w.End,
+		Location: w.location().String(),
+	})
+}
+
+func (w *Window) UnmarshalJSON(data []byte) error {
+	var v windowJSON
+	if err := json.Unmarshal(data, &v); err != nil {
+		return err
+	}
+
+	loc, err := time.LoadLocation(v.Location)
+	if err != nil {
+		return err
+	}
+
+	*w = Window{Start: v.Start, End: v.End, Location: loc}
+	return nil
+}
+
+// readyAt returns the earliest time at or after now that work may be
+// dispatched according to its not-before time and window.
+func readyAt(info WorkInfo, now time.Time) time.Time {
+	at := now
+	if notBefore := info.getNotBefore(); notBefore.After(at) {
+		at = notBefore
+	}
+	if window := info.getWindow(); window != nil {
+		at = window.Next(at)
+	}
+	return at
+}
+
+// hold keeps item out of the buffer until it may be dispatched at at.
+// q.bufMtx must be held.
+func (q *DefaultWorkQueue) hold(item *workItem, at time.Time) {
+	q.logger.Debug("Deferring work", zap.String("id", string(item.id)), zap.Time("until", at))
+
+	var timer *clock.Timer
+	timer = q.options.Clock.AfterFunc(at.Sub(q.options.Clock.Now()), func() {
+		q.bufMtx.Lock()
+		if q.held[item] != timer {
+			// Canceled or aborted
+			q.bufMtx.Unlock()
+			return
+		}
+		delete(q.held, item)
+		q.bufMtx.Unlock()
+
+		q.push(item)
+	})
+	q.held[item] = timer
+}
+
+// unhold removes item from the held work, reporting whether it was held.
+// q.bufMtx must be held.
+func (q *DefaultWorkQueue) unhold(item *workItem) bool {
+	timer, ok := q.held[item]
+	if !ok {
+		return false
+	}
+
+	timer.Stop()
+	delete(q.held, item)
+	return true
+}
@@ -0,0 +1,254 @@
+package compute
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/benbjohnson/clock"
+	"github.com/golang/mock/gomock"
+	m "github.com/launchdarkly/go-test-helpers/v2/matchers"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zaptest"
+)
+
+func at(hour, minute int) time.Time {
+	return time.Date(2022, 6, 1, hour, minute, 0, 0, time.UTC)
+}
+
+func TestWindow(t *testing.T) {
+	overnight, err := NewWindow("22:00", "06:00", time.UTC)
+	m.For(t, "err").Require(err, m.BeNil())
+	daytime, err := NewWindow("09:00", "17:30", time.UTC)
+	m.For(t, "err").Require(err, m.BeNil())
+
+	tests := []struct {
+		name     string
+		window   *Window
+		t        time.Time
+		contains bool
+		next     time.Time
+	}{
+		{"overnight before", overnight, at(12, 0), false, at(22, 0)},
+		{"overnight start", overnight, at(22, 0), true, at(22, 0)},
+		{"overnight after midnight", overnight, at(3, 0), true, at(3, 0)},
+		{"overnight end", overnight, at(6, 0), false, at(22, 0)},
+		{"daytime before", daytime, at(8, 0), false, at(9, 0)},
+		{"daytime inside", daytime, at(17, 29), true, at(17, 29)},
+		{"daytime after", daytime, at(17, 30), false, at(9, 0).Add(24 * time.Hour)},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			m.For(t, "contains").Assert(test.window.Contains(test.t), m.Equal(test.contains))
+			m.For(t, "next").Assert(test.window.Next(test.t), m.Equal(test.next))
+		})
+	}
+
+	t.Run("daylight saving time", func(t *testing.T) {
+		loc, err := time.LoadLocation("America/Los_Angeles")
+		if err != nil {
+			t.Skip("time zone database not available:", err)
+		}
+		window, err := NewWindow("22:00", "06:00", loc)
+		m.For(t, "err").Require(err, m.BeNil())
+
+		// Clocks go back from 02:00 to 01:00 on 2022-11-06
+		m.For(t, "fall back before end").Assert(window.Contains(time.Date(2022, 11, 6, 5, 30, 0, 0, loc)), m.Equal(true))
+		m.For(t, "fall back after end").Assert(window.Contains(time.Date(2022, 11, 6, 6, 30, 0, 0, loc)), m.Equal(false))
+		m.For(t, "fall back next").Assert(window.Next(time.Date(2022, 11, 6, 12, 0, 0, 0, loc)), m.Equal(time.Date(2022, 11, 6, 22, 0, 0, 0, loc)))
+		// Clocks go forward from 02:00 to 03:00 on 2022-03-13
+		m.For(t, "spring forward before end").Assert(window.Contains(time.Date(2022, 3, 13, 5, 30, 0, 0, loc)), m.Equal(true))
+		m.For(t, "spring forward after end").Assert(window.Contains(time.Date(2022, 3, 13, 6, 30, 0, 0, loc)), m.Equal(false))
+		m.For(t, "spring forward next").Assert(window.Next(time.Date(2022, 3, 12, 12, 0, 0, 0, loc)), m.Equal(time.Date(2022, 3, 12, 22, 0, 0, 0, loc)))
+		m.For(t, "spring forward next day").Assert(window.Next(time.Date(2022, 3, 13, 6, 30, 0, 0, loc)), m.Equal(time.Date(2022, 3, 13, 22, 0, 0, 0, loc)))
+	})
+
+	t.Run("invalid", func(t *testing.T) {
+		_, err := NewWindow("25:00", "06:00", time.UTC)
+		m.For(t, "err").Assert(err, m.Not(m.BeNil()))
+	})
+
+	t.Run("json", func(t *testing.T) {
+		b, err := json.Marshal(overnight)
+		m.For(t, "marshal err").Require(err, m.BeNil())
+
+		var window Window
+		err = json.Unmarshal(b, &window)
+		m.For(t, "unmarshal err").Require(err, m.BeNil())
+		m.For(t, "window").Assert(&window, m.Equal(overnight))
+	})
+}
+
+func TestDefaultWorkQueue_schedule(t *testing.T) {
+	logger := zaptest.NewLogger(t)
+
+	ctrl := gomock.NewController(t)
+	t.Cleanup(func() {
+		ctrl.Finish()
+	})
+
+	mWorker := NewMockWorker(ctrl)
+	mWorker.EXPECT().
+		IsReadyChan(gomock.Any(), gomock.Any()).
+		DoAndReturn(func(ctx context.Context, opts ...func(options *ReadyOptions)) <-chan error {
+			ch := make(chan error, 1)
+			ch <- nil
+			return ch
+		}).
+		AnyTimes()
+	mWorker.EXPECT().
+		Connect(gomock.Any()).
+		Return(nil).
+		AnyTimes()
+	mWorker.EXPECT().
+		Equals(gomock.Any()).
+		Return(true).
+		AnyTimes()
+
+	newPool := func() *MockPool {
+		mPool := NewMockPool(ctrl)
+		mPool.EXPECT().
+			GetWorker(gomock.Any()).
+			Return(mWorker, nil).
+			AnyTimes()
+		mPool.EXPECT().
+			ReturnWorker(gomock.Eq(mWorker)).
+			AnyTimes()
+		return mPool
+	}
+
+	window, err := NewWindow("22:00", "06:00", time.UTC)
+	m.For(t, "err").Require(err, m.BeNil())
+
+	assertPending := func(t *testing.T, work *GenericWorkInfo[string, string]) {
+		t.Helper()
+		select {
+		case <-work.Result:
+			t.Fatal("work ran outside its schedule")
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+	assertRan := func(t *testing.T, work *GenericWorkInfo[string, string]) {
+		t.Helper()
+		select {
+		case res := <-work.Result:
+			m.For(t, "result").Assert(res, m.Equal(work.Request))
+		case <-time.After(time.Second):
+			t.Fatal("work did not run")
+		}
+	}
+	// waitHeld waits until n work items are deferred by q, so that advancing
+	// the clock fires their timers.
+	waitHeld := func(t *testing.T, q WorkQueue, n int) {
+		t.Helper()
+		dq := q.(*DefaultWorkQueue)
+		deadline := time.Now().Add(time.Second)
+		for {
+			dq.bufMtx.Lock()
+			held := len(dq.held)
+			dq.bufMtx.Unlock()
+			if held == n {
+				return
+			}
+			if time.Now().After(deadline) {
+				t.Fatal("work not deferred")
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}
+	newWork := func(req string) *GenericWorkInfo[string, string] {
+		return NewWorkInfo(context.Background(), req,
+			func(ctx context.Context, logger *zap.Logger, req string, worker Worker) (string, error) {
+				return req, nil
+			})
+	}
+
+	t.Run("not before", func(t *testing.T) {
+		mClock := clock.NewMock()
+		mClock.Set(at(12, 0))
+
+		q := NewQueue(logger, newPool(), 1, WithQueueClock(mClock))
+
+		work := newWork("deferred")
+		work.NotBefore = at(13, 0)
+		q.Add(work)
+
+		waitHeld(t, q, 1)
+		assertPending(t, work)
+		m.For(t, "stats").Assert(q.TenantStats()[""], m.Equal(TenantStats{Queued: 1}))
+
+		mClock.Add(time.Hour)
+		assertRan(t, work)
+	})
+
+	t.Run("window opens", func(t *testing.T) {
+		mClock := clock.NewMock()
+		mClock.Set(at(12, 0))
+
+		q := NewQueue(logger, newPool(), 1, WithQueueClock(mClock))
+
+		work := newWork("overnight")
+		work.Window = window
+		q.Add(work)
+
+		waitHeld(t, q, 1)
+		assertPending(t, work)
+
+		mClock.Add(10 * time.Hour)
+		assertRan(t, work)
+	})
+
+	t.Run("window closes while queued", func(t *testing.T) {
+		mClock := clock.NewMock()
+		mClock.Set(at(23, 0))
+
+		q := NewQueue(logger, newPool(), 1, WithQueueClock(mClock))
+
+		// Occupy the only slot
+		started := make(chan struct{})
+		release := make(chan struct{})
+		blocker := NewWorkInfo(context.Background(), "blocker",
+			func(ctx context.Context, logger *zap.Logger, req string, worker Worker) (string, error) {
+				close(started)
+				<-release
+				return req, nil
+			})
+		q.Add(blocker)
+		<-started
+
+		work := newWork("overnight")
+		work.Window = window
+		q.Add(work)
+
+		// The window closes at 06:00
+		mClock.Add(8 * time.Hour)
+		close(release)
+		<-blocker.Result
+
+		waitHeld(t, q, 1)
+		assertPending(t, work)
+
+		mClock.Add(15 * time.Hour)
+		assertRan(t, work)
+	})
+
+	t.Run("cancel deferred", func(t *testing.T) {
+		mClock := clock.NewMock()
+		mClock.Set(at(12, 0))
+
+		q := NewQueue(logger, newPool(), 1, WithQueueClock(mClock))
+
+		work := newWork("canceled")
+		work.Window = window
+		id := q.Add(work)
+		waitHeld(t, q, 1)
+
+		err := q.Cancel(id)
+		m.For(t, "cancel err").Require(err, m.BeNil())
+
+		q.Wait()
+		m.For(t, "err").Assert(<-work.Err, m.Equal(context.Canceled))
+		waitHeld(t, q, 0)
+	})
+}
@@ -0,0 +1,95 @@
+package compute
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"time"
+)
+
+// WorkID identifies work added to a WorkQueue
+type WorkID string
+
+type workIDKey struct{}
+
+// WorkIDFrom returns the ID of the work whose context is ctx. Work runs with
+// its ID so that it can tag what it starts on the worker.
+func WorkIDFrom(ctx context.Context) (WorkID, bool) {
+	id, ok := ctx.Value(workIDKey{}).(WorkID)
+	return id, ok
+}
+
+func newWorkID() WorkID {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return WorkID(hex.EncodeToString(b))
+}
+
+// workItem is work tracked by a WorkQueue
+type workItem struct {
+	id       WorkID
+	info     WorkInfo
+	attempts []error // Errors of previous failed attempts
+
+	ctx    context.Context // Derived from the WorkInfo context, canceled by WorkQueue.Cancel
+	cancel context.CancelFunc
+
+	dispatched bool          // Whether the work holds a slot of the queue
+	queuedAt   time.Time     // When the work was last added to the buffer
+	runtime    time.Duration // How long the last attempt ran
+
+	journaled bool // Whether the work is recorded in the queue's Journal
+}
+
+// workBuffer holds work waiting to be dispatched to a worker.
+// Implementations are not thread-safe.
+type workBuffer interface {
+	// push adds work to the buffer
+	push(item *workItem)
+	// pop removes and returns the next work to dispatch
+	pop() (*workItem, bool)
+	// remove removes item from the buffer, reporting whether it was buffered
+	remove(item *workItem) bool
+	// len returns the number of buffered work items
+	len() int
+}
+
+// fifoBuffer dispatches work in the order it was added
+type fifoBuffer struct {
+	items []*workItem
+}
+
+func newFIFOBuffer() *fifoBuffer {
+	return &fifoBuffer{}
+}
+
+func (b *fifoBuffer) push(item *workItem) {
+	b.items = append(b.items, item)
+}
+
+func (b *fifoBuffer) pop() (*workItem, bool) {
+	if len(b.items) == 0 {
+		return nil, false
+	}
+
+	item := b.items[0]
+	b.items[0] = nil
+	b.items = b.items[1:]
+	return item, true
+}
+
+func (b *fifoBuffer) remove(item *workItem) bool {
+	for i, it := range b.items {
+		if it == item {
+			b.items = remove(b.items, i)
+			return true
+		}
+	}
+	return false
+}
+
+func (b *fifoBuffer) len() int {
+	return len(b.items)
+}
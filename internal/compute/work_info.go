@@ -3,6 +3,7 @@ package compute
 import (
 	"context"
 	"errors"
+	"time"
 
 	"go.uber.org/zap"
 )
@@ -12,6 +13,12 @@ type WorkRunFunc[T, U any] func(ctx context.Context, logger *zap.Logger, req T,
 type WorkInfo interface {
 	getCtx() context.Context
 	getReq() any
+	getPriority() int
+	getTenant() string
+	getNotBefore() time.Time
+	getWindow() *Window
+	getRequirements() Requirements
+	marshal() (kind string, payload []byte, err error)
 	setRes(res any)
 	setErr(err error)
 	run(ctx context.Context, logger *zap.Logger, req any, instance Worker) (any, error)
@@ -23,6 +30,21 @@ type GenericWorkInfo[T, U any] struct {
 	Result  chan U
 	Err     chan error
 	Run     WorkRunFunc[T, U]
+
+	// Priority of the work when the queue uses priority scheduling.
+	// Higher priorities are dispatched first.
+	Priority int
+	// Tenant owning the work when the queue uses fair-share scheduling
+	Tenant string
+	// NotBefore holds the work in the queue until the given time
+	NotBefore time.Time
+	// Window holds the work in the queue while the window is closed. Work
+	// already running when the window closes is not interrupted.
+	Window *Window
+	// Requirements restricts the workers the work runs on
+	Requirements Requirements
+
+	workType *WorkType[T, U] // Set for work created from a registered WorkType
 }
 
 func (w *GenericWorkInfo[T, U]) getCtx() context.Context {
@@ -33,6 +55,37 @@ func (w *GenericWorkInfo[T, U]) getReq() any {
 	return w.Request
 }
 
+func (w *GenericWorkInfo[T, U]) getPriority() int {
+	return w.Priority
+}
+
+func (w *GenericWorkInfo[T, U]) getTenant() string {
+	return w.Tenant
+}
+
+func (w *GenericWorkInfo[T, U]) getNotBefore() time.Time {
+	return w.NotBefore
+}
+
+func (w *GenericWorkInfo[T, U]) getWindow() *Window {
+	return w.Window
+}
+
+func (w *GenericWorkInfo[T, U]) getRequirements() Requirements {
+	return w.Requirements
+}
+
+// marshal serializes the request for a Journal. Work not created from a
+// registered WorkType returns an empty kind.
+func (w *GenericWorkInfo[T, U]) marshal() (string, []byte, error) {
+	if w.workType == nil {
+		return "", nil, nil
+	}
+
+	payload, err := w.workType.serializer.Marshal(w.Request)
+	return w.workType.name, payload, err
+}
+
 func (w *GenericWorkInfo[T, U]) setRes(res any) {
 	w.Result <- res.(U)
 }
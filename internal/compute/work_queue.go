@@ -1,21 +1,84 @@
 package compute
 
 import (
+	"context"
 	"sync"
+	"time"
 
+	"github.com/benbjohnson/clock"
+	"github.com/pkg/errors"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 	"go.uber.org/atomic"
 	"go.uber.org/zap"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/ansg191/remote-worker/api/proto"
+	"github.com/ansg191/remote-worker/internal/tracing"
+)
+
+var (
+	ErrWorkNotFound = errors.New("work not found")
+	ErrQueueClosed  = errors.New("work queue closed")
+)
+
+// ShutdownMode selects what happens to unfinished work on Shutdown
+type ShutdownMode int
+
+const (
+	// ShutdownDrain stops accepting work and waits for all accepted work,
+	// queued or running, to finish. This includes work deferred by its
+	// schedule, so drain with a deadline.
+	ShutdownDrain ShutdownMode = iota
+	// ShutdownAbort cancels running work on the workers and fails queued work
+	// with ErrQueueClosed.
+	ShutdownAbort
 )
 
+// cancelTimeout bounds the JobService.Cancel call made when canceling work
+const cancelTimeout = 10 * time.Second
+
 type WorkQueue interface {
-	// Add new job to the WorkQueue
-	Add(info WorkInfo)
+	// Add new job to the WorkQueue and return its ID
+	Add(info WorkInfo) WorkID
+	// Cancel removes queued work or cancels running work with the given ID
+	Cancel(id WorkID) error
 	// Wait for all jobs to complete
 	Wait()
+	// Shutdown stops accepting work, finishes or aborts unfinished work
+	// according to mode, and closes the Pool. If ctx expires while draining,
+	// the remaining work is aborted and ctx.Err() is returned.
+	Shutdown(ctx context.Context, mode ShutdownMode) error
+	// TenantStats returns the queued and running work of every tenant with
+	// unfinished work
+	TenantStats() map[string]TenantStats
 	// GetMaxSize returns maximum number of allowed concurrent workers
 	GetMaxSize() int
 	// SetMaxSize sets maximum number of allowed concurrent workers
 	SetMaxSize(size int)
+	// Pause holds queued work until Resume is called. Running work is not
+	// affected.
+	Pause()
+	// Resume dispatches queued work again after Pause
+	Resume()
+	// Paused reports whether queued work is held by Pause
+	Paused() bool
+	// SetHeld holds queued work while held is set, e.g. while a budget is
+	// exceeded. It is independent of Pause, which is left to operators.
+	SetHeld(held bool)
+	// Held reports whether queued work is held by SetHeld
+	Held() bool
+}
+
+// TenantStats counts the unfinished work of a tenant
+type TenantStats struct {
+	// Queued is work waiting for a slot, including work waiting for a retry
+	// or for its schedule
+	Queued int
+	// Running is work holding a slot, including work waiting for a worker
+	Running int
 }
 
 type DefaultWorkQueue struct {
@@ -24,20 +87,70 @@ type DefaultWorkQueue struct {
 	wg   sync.WaitGroup // WaitGroup to manage all jobs
 	pool Pool           // InstancePool to get workers from
 
-	workQueue chan WorkInfo // workQueue used as a thread-safe FIFO queue
+	bufMtx  sync.Mutex                 // bufMtx is a mutex for the fields below.
+	cond    *sync.Cond                 // cond wakes run when work is queued or a slot is freed.
+	buffer  workBuffer                 // buffer holds work waiting for a worker.
+	fair    *fairBuffer                // fair is the buffer in fair-share mode, otherwise nil.
+	held    map[*workItem]*clock.Timer // held holds work deferred by its schedule.
+	items   map[WorkID]*workItem       // items holds all unfinished work.
+	active  int                        // active is the number of slots taken by dispatched work.
+	paused  bool                       // paused holds queued work until Resume.
+	onHold  bool                       // onHold holds queued work until SetHeld(false).
+	closed  bool                       // closed is set once Shutdown is called.
+	stopped bool                       // stopped is set to stop run.
+
+	aborted      *atomic.Bool // aborted is set when unfinished work is aborted.
+	shutdownOnce sync.Once
 
 	mtx     sync.Mutex // mtx is a mutex for workers.
 	workers []Worker   // Instances in-use taken from the pool.
 
 	maxSize *atomic.Uint32 // Maximum number of active in-use workers
+
+	tracer  trace.Tracer
+	options QueueOptions
 }
 
-func NewQueue(logger *zap.Logger, pool Pool, maxSize int) WorkQueue {
+func NewQueue(logger *zap.Logger, pool Pool, maxSize int, opts ...QueueOptionsFunc) WorkQueue {
+	options := QueueOptions{
+		Clock:          clock.New(),
+		TracerProvider: otel.GetTracerProvider(),
+	}
+
+	for _, opt := range opts {
+		opt(&options)
+	}
+
+	newBuffer := func() workBuffer {
+		if options.PriorityScheduling {
+			return newPriorityBuffer(options.Clock, options.AgingInterval)
+		}
+		return newFIFOBuffer()
+	}
+
+	var fair *fairBuffer
+	buffer := newBuffer()
+	if options.FairShare {
+		fair = newFairBuffer(newBuffer, options.tenantWeight, options.tenantLimit)
+		buffer = fair
+	}
+
 	wq := &DefaultWorkQueue{
-		logger:    logger,
-		pool:      pool,
-		maxSize:   atomic.NewUint32(uint32(maxSize)),
-		workQueue: make(chan WorkInfo, 1024),
+		logger:  logger,
+		pool:    pool,
+		maxSize: atomic.NewUint32(uint32(maxSize)),
+		buffer:  buffer,
+		fair:    fair,
+		items:   make(map[WorkID]*workItem),
+		held:    make(map[*workItem]*clock.Timer),
+		aborted: atomic.NewBool(false),
+		tracer:  options.TracerProvider.Tracer(tracerName),
+		options: options,
+	}
+	wq.cond = sync.NewCond(&wq.bufMtx)
+
+	if options.Journal != nil {
+		wq.replay(options.Journal.State())
 	}
 
 	go wq.run()
@@ -45,74 +158,495 @@ func NewQueue(logger *zap.Logger, pool Pool, maxSize int) WorkQueue {
 	return wq
 }
 
+// run dispatches queued work whenever a slot below maxSize is free. Getting a
+// worker can take minutes, so every item is dispatched in its own routine and
+// workers are provisioned in parallel.
 func (q *DefaultWorkQueue) run() {
 	for {
-		q.mtx.Lock()
-		workLength := uint32(len(q.workers))
-		q.mtx.Unlock()
+		item, ok := q.next()
+		if !ok {
+			return
+		}
 
-		if workLength < q.maxSize.Load() {
-			// Wait for work
-			work := <-q.workQueue
+		go q.dispatch(item)
+	}
+}
 
-			q.logger.Debug("Work received", zap.Any("req", work.getReq()))
+// next blocks until work is queued and a slot is free, then takes both.
+// It returns false once the queue is stopped.
+func (q *DefaultWorkQueue) next() (*workItem, bool) {
+	q.bufMtx.Lock()
+	defer q.bufMtx.Unlock()
 
-			q.mtx.Lock()
+	for !q.stopped {
+		// In fair-share mode, buffered work may be held back by tenant limits
+		if !q.paused && !q.onHold && uint32(q.active) < q.maxSize.Load() {
+			if item, ok := q.buffer.pop(); ok {
+				now := q.options.Clock.Now()
+				if at := readyAt(item.info, now); at.After(now) {
+					// The window of the work closed while it was buffered
+					if q.fair != nil {
+						q.fair.done(item)
+					}
+					q.hold(item, at)
+					continue
+				}
 
-			worker, err := q.pool.GetWorker(work.getCtx())
-			if err != nil {
-				q.logger.Error("Error getting worker from pool", zap.Error(err))
-				work.setErr(err)
-				q.wg.Done()
-				q.mtx.Unlock()
-				continue
+				item.dispatched = true
+				q.active++
+				return item, true
 			}
+		}
+
+		q.cond.Wait()
+	}
+
+	return nil, false
+}
 
-			q.logger.Debug("Worker retrieved for work", zap.Any("req", work.getReq()))
+// release frees the slot taken by next for item
+func (q *DefaultWorkQueue) release(item *workItem) {
+	q.bufMtx.Lock()
+	q.free(item)
+	q.bufMtx.Unlock()
+}
 
-			q.workers = append(q.workers, worker)
+// free frees the slot taken by next for item.
+// q.bufMtx must be held.
+func (q *DefaultWorkQueue) free(item *workItem) {
+	item.dispatched = false
+	q.active--
+	if q.fair != nil {
+		q.fair.done(item)
+	}
+	q.cond.Broadcast()
+}
 
-			q.mtx.Unlock()
+// requeue frees the slot taken by next for item and queues it again in one
+// step, so that Cancel either finds item queued or has already canceled it.
+// It returns false, without queuing item, if item was canceled.
+func (q *DefaultWorkQueue) requeue(item *workItem) bool {
+	q.bufMtx.Lock()
+	defer q.bufMtx.Unlock()
+
+	q.free(item)
+	if item.ctx.Err() != nil {
+		return false
+	}
+	q.enqueue(item)
+	return true
+}
 
-			go func() {
-				defer func(worker Worker) {
-					q.mtx.Lock()
-					defer q.mtx.Lock()
-					q.workers = removeItem(q.workers, worker)
-					q.pool.ReturnWorker(worker)
-					q.wg.Done()
-				}(worker)
+// dispatch gets a worker for item and runs it
+func (q *DefaultWorkQueue) dispatch(item *workItem) {
+	work := item.info
+	item.runtime = 0
 
-				q.logger.Debug("Waiting for worker ready", zap.Any("req", work.getReq()))
-				err := <-worker.IsReadyChan(work.getCtx())
-				if err != nil {
-					work.setErr(err)
-					return
-				}
+	if err := item.ctx.Err(); err != nil {
+		// Canceled while waiting for a retry
+		q.release(item)
+		q.fail(item, q.abortErr(err))
+		return
+	}
 
-				err = worker.Connect(work.getCtx())
-				if err != nil {
-					work.setErr(err)
-					return
-				}
+	// The span covers a single attempt, from getting a worker to the result
+	ctx, span := q.tracer.Start(item.ctx, "WorkQueue.work", trace.WithAttributes(
+		attribute.String("work.id", string(item.id)),
+		attribute.String("work.tenant", work.getTenant()),
+		attribute.Int("work.attempt", len(item.attempts)+1),
+	))
 
-				q.logger.Info("Starting work", zap.Any("req", work.getReq()))
-				result, err := work.run(work.getCtx(), q.logger, work.getReq(), worker)
-				if err != nil {
-					work.setErr(err)
-				} else {
-					work.setRes(result)
-				}
-				q.logger.Info("Work finished", zap.Any("req", work.getReq()))
-			}()
+	q.logger.Debug("Work received", zap.Any("req", work.getReq()))
+
+	worker, err := q.getWorker(ctx, work)
+	if errors.Is(err, ErrBudgetExceeded) {
+		// Work is held, not failed, until the budget allows new workers
+		q.logger.Warn("Budget exceeded, holding queued work", zap.Error(err))
+		tracing.End(span, err)
+		q.SetHeld(true)
+		if !q.requeue(item) {
+			q.fail(item, q.abortErr(item.ctx.Err()))
 		}
+		return
+	}
+	if err != nil {
+		q.logger.Error("Error getting worker from pool", zap.Error(err))
+		tracing.End(span, err)
+		q.release(item)
+		q.fail(item, q.abortErr(&WorkerError{Err: err}))
+		return
+	}
+
+	q.logger.Debug("Worker retrieved for work", zap.Any("req", work.getReq()))
+
+	q.mtx.Lock()
+	q.workers = append(q.workers, worker)
+	q.mtx.Unlock()
+
+	if item.journaled {
+		q.recordStarted(item, worker)
+	}
+
+	q.runWork(ctx, span, item, worker)
+}
+
+// getWorker gets a worker from the pool satisfying the requirements of work
+func (q *DefaultWorkQueue) getWorker(ctx context.Context, work WorkInfo) (Worker, error) {
+	if req := work.getRequirements(); !req.IsZero() {
+		return q.pool.GetWorkerFor(ctx, req)
+	}
+	return q.pool.GetWorker(ctx)
+}
+
+// runWork runs item on worker and reports the outcome, ending span
+func (q *DefaultWorkQueue) runWork(ctx context.Context, span trace.Span, item *workItem, worker Worker) {
+	result, err := q.execute(ctx, item, worker)
+	tracing.End(span, err)
+
+	if item.ctx.Err() != nil {
+		// Canceling the context of work stops the WorkRunFunc, but the job
+		// may keep running on the worker. It is canceled before the worker is
+		// released, so that the job of other work is never canceled.
+		_ = q.cancelJob(worker, item.id)
+	}
+
+	q.mtx.Lock()
+	q.workers = removeItem(q.workers, worker)
+	q.mtx.Unlock()
+
+	if err != nil && item.ctx.Err() == nil && q.options.Retry.retries(len(item.attempts)+1, err) {
+		// The worker may be the cause of the failure, so the retry runs on a
+		// fresh one
+		q.pool.RemoveWorker(worker)
+	} else {
+		q.pool.ReturnWorker(worker)
+	}
+	q.release(item)
+
+	if err != nil {
+		q.fail(item, err)
+		return
+	}
+
+	item.info.setRes(result)
+	q.finish(item, nil)
+}
+
+func (q *DefaultWorkQueue) execute(ctx context.Context, item *workItem, worker Worker) (any, error) {
+	work := item.info
+
+	q.logger.Debug("Waiting for worker ready", zap.Any("req", work.getReq()))
+	readyCtx, span := q.tracer.Start(ctx, "Worker.IsReadyChan")
+	err := <-worker.IsReadyChan(readyCtx)
+	tracing.End(span, err)
+	if err != nil {
+		return nil, &WorkerError{Err: err}
+	}
+
+	connectCtx, span := q.tracer.Start(ctx, "Worker.Connect")
+	err = worker.Connect(connectCtx)
+	tracing.End(span, err)
+	if err != nil {
+		return nil, &WorkerError{Err: err}
+	}
+
+	start := q.options.Clock.Now()
+	q.emit(QueueEvent{
+		Type:   WorkStarted,
+		WorkID: item.id,
+		Tenant: work.getTenant(),
+		Time:   start,
+		Worker: worker,
+		Wait:   start.Sub(item.queuedAt),
+	})
+
+	q.logger.Info("Starting work", zap.Any("req", work.getReq()), zap.String("id", string(item.id)))
+	result, err := work.run(ctx, q.logger, work.getReq(), worker)
+	item.runtime = q.options.Clock.Since(start)
+	q.logger.Info("Work finished", zap.Any("req", work.getReq()), zap.String("id", string(item.id)))
+	return result, err
+}
+
+// fail retries item if the retry policy allows it, otherwise it reports err
+// as the final result of item.
+func (q *DefaultWorkQueue) fail(item *workItem, err error) {
+	item.attempts = append(item.attempts, err)
+	policy := q.options.Retry
+	attempt := len(item.attempts)
+
+	if policy.retries(attempt, err) && item.ctx.Err() == nil {
+		delay := policy.backoff(attempt)
+		q.logger.Warn("Work failed, retrying",
+			zap.Any("req", item.info.getReq()),
+			zap.Int("attempt", attempt),
+			zap.Duration("backoff", delay),
+			zap.Error(err))
+
+		go func() {
+			select {
+			case <-item.ctx.Done():
+				q.fail(item, q.abortErr(item.ctx.Err()))
+			case <-q.options.Clock.After(delay):
+				q.push(item)
+			}
+		}()
+		return
+	}
+
+	if attempt > 1 {
+		err = &RetryError{Attempts: item.attempts}
+	}
+
+	item.info.setErr(err)
+	q.finish(item, err)
+}
+
+// finish stops tracking item after its result has been reported
+func (q *DefaultWorkQueue) finish(item *workItem, err error) {
+	if item.journaled {
+		q.recordFinished(item.id, err)
 	}
+
+	q.emit(QueueEvent{
+		Type:     WorkFinished,
+		WorkID:   item.id,
+		Tenant:   item.info.getTenant(),
+		Duration: item.runtime,
+		Err:      err,
+	})
+
+	q.bufMtx.Lock()
+	delete(q.items, item.id)
+	q.bufMtx.Unlock()
+
+	item.cancel()
+	q.wg.Done()
 }
 
-func (q *DefaultWorkQueue) Add(info WorkInfo) {
+// emit sends event to the configured QueueEventHandlers
+func (q *DefaultWorkQueue) emit(event QueueEvent) {
+	if event.Time.IsZero() {
+		event.Time = q.options.Clock.Now()
+	}
+
+	for _, handler := range q.options.EventHandlers {
+		handler(event)
+	}
+}
+
+func (q *DefaultWorkQueue) Add(info WorkInfo) WorkID {
 	q.logger.Debug("Adding job to WorkQueue", zap.Any("req", info.getReq()))
+
+	item := q.add(newWorkID(), info, false)
+
+	return item.id
+}
+
+// add starts tracking info under id and queues it. Replayed work is already
+// recorded in the journal.
+func (q *DefaultWorkQueue) add(id WorkID, info WorkInfo, replayed bool) *workItem {
+	ctx, cancel := context.WithCancel(context.WithValue(info.getCtx(), workIDKey{}, id))
+	item := &workItem{
+		id:        id,
+		info:      info,
+		ctx:       ctx,
+		cancel:    cancel,
+		journaled: replayed,
+	}
+
+	// The closed check and wg.Add happen under the lock so that no work is
+	// added after Shutdown started waiting.
+	q.bufMtx.Lock()
+	if q.closed {
+		q.bufMtx.Unlock()
+		q.logger.Warn("Rejecting work, queue closed", zap.String("id", string(id)))
+		cancel()
+		info.setErr(ErrQueueClosed)
+		return item
+	}
 	q.wg.Add(1)
-	q.workQueue <- info
+	q.items[item.id] = item
+	q.bufMtx.Unlock()
+
+	if !replayed && q.options.Journal != nil {
+		q.recordSubmitted(item)
+	}
+
+	q.push(item)
+
+	return item
+}
+
+func (q *DefaultWorkQueue) Cancel(id WorkID) error {
+	q.bufMtx.Lock()
+	item, ok := q.items[id]
+	if !ok {
+		q.bufMtx.Unlock()
+		return ErrWorkNotFound
+	}
+
+	// The context is canceled under the lock, so that work requeued
+	// concurrently is either unqueued here or not queued again
+	queued := q.unqueue(item)
+	item.cancel()
+	q.bufMtx.Unlock()
+
+	q.logger.Info("Canceling work", zap.String("id", string(id)), zap.Bool("queued", queued))
+	// Running work cancels its job on its worker once its context is canceled
+
+	if queued {
+		q.fail(item, context.Canceled)
+	}
+	return nil
+}
+
+// cancelJob cancels the job of work id on worker, if it is still running
+func (q *DefaultWorkQueue) cancelJob(worker Worker, id WorkID) error {
+	if worker.Job() == nil {
+		return nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), cancelTimeout)
+	defer cancel()
+
+	_, err := worker.Job().Cancel(ctx, &proto.JobCancelRequest{Id: string(id)})
+	if err != nil && status.Code(err) != codes.NotFound {
+		q.logger.Error("error canceling job on worker", zap.Error(err))
+		return err
+	}
+
+	return nil
+}
+
+func (q *DefaultWorkQueue) Shutdown(ctx context.Context, mode ShutdownMode) error {
+	q.shutdownOnce.Do(func() {
+		q.bufMtx.Lock()
+		q.closed = true
+		q.bufMtx.Unlock()
+
+		q.logger.Info("Shutting down work queue", zap.Bool("abort", mode == ShutdownAbort))
+	})
+
+	if mode == ShutdownAbort {
+		q.abort()
+	}
+
+	drained := make(chan struct{})
+	go func() {
+		q.wg.Wait()
+		close(drained)
+	}()
+
+	var err error
+	select {
+	case <-drained:
+	case <-ctx.Done():
+		q.logger.Warn("Shutdown deadline exceeded, aborting remaining work")
+		err = ctx.Err()
+		q.abort()
+		<-drained
+	}
+
+	q.stop()
+
+	if closeErr := q.pool.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// abort fails queued work with ErrQueueClosed and cancels running work
+func (q *DefaultWorkQueue) abort() {
+	q.aborted.Store(true)
+
+	q.bufMtx.Lock()
+	// Work requeued concurrently must be dispatched to fail on its canceled
+	// context, so it cannot be held
+	q.paused = false
+	q.onHold = false
+	var queued, running []*workItem
+	for _, item := range q.items {
+		if q.unqueue(item) {
+			queued = append(queued, item)
+		} else {
+			running = append(running, item)
+		}
+	}
+	q.bufMtx.Unlock()
+
+	for _, item := range queued {
+		item.cancel()
+		q.fail(item, ErrQueueClosed)
+	}
+
+	// Work waiting for a retry or a worker is failed by its own routine once
+	// its context is canceled, and running work cancels its job.
+	for _, item := range running {
+		item.cancel()
+	}
+}
+
+// abortErr replaces err with ErrQueueClosed if the work did not start because
+// the queue was aborted.
+func (q *DefaultWorkQueue) abortErr(err error) error {
+	if q.aborted.Load() {
+		return ErrQueueClosed
+	}
+	return err
+}
+
+// stop stops the run routine
+func (q *DefaultWorkQueue) stop() {
+	q.bufMtx.Lock()
+	q.stopped = true
+	q.cond.Broadcast()
+	q.bufMtx.Unlock()
+}
+
+// push adds item to the buffer and wakes run. Work that may not be dispatched
+// yet is held until its schedule allows it.
+func (q *DefaultWorkQueue) push(item *workItem) {
+	q.bufMtx.Lock()
+	q.enqueue(item)
+	q.bufMtx.Unlock()
+}
+
+// enqueue adds item to the buffer, or holds it until it is ready.
+// q.bufMtx must be held.
+func (q *DefaultWorkQueue) enqueue(item *workItem) {
+	now := q.options.Clock.Now()
+	if at := readyAt(item.info, now); at.After(now) {
+		q.hold(item, at)
+		return
+	}
+
+	item.queuedAt = now
+	q.buffer.push(item)
+	q.cond.Broadcast()
+}
+
+// unqueue removes item from the buffer or held work, reporting whether it was
+// queued. q.bufMtx must be held.
+func (q *DefaultWorkQueue) unqueue(item *workItem) bool {
+	return q.buffer.remove(item) || q.unhold(item)
+}
+
+func (q *DefaultWorkQueue) TenantStats() map[string]TenantStats {
+	q.bufMtx.Lock()
+	defer q.bufMtx.Unlock()
+
+	stats := make(map[string]TenantStats)
+	for _, item := range q.items {
+		tenant := item.info.getTenant()
+		s := stats[tenant]
+		if item.dispatched {
+			s.Running++
+		} else {
+			s.Queued++
+		}
+		stats[tenant] = s
+	}
+	return stats
 }
 
 func (q *DefaultWorkQueue) Wait() {
@@ -124,5 +658,40 @@ func (q *DefaultWorkQueue) GetMaxSize() int {
 }
 
 func (q *DefaultWorkQueue) SetMaxSize(size int) {
+	q.bufMtx.Lock()
 	q.maxSize.Store(uint32(size))
+	q.cond.Broadcast()
+	q.bufMtx.Unlock()
+}
+
+func (q *DefaultWorkQueue) Pause() {
+	q.bufMtx.Lock()
+	q.paused = true
+	q.bufMtx.Unlock()
+}
+
+func (q *DefaultWorkQueue) Resume() {
+	q.bufMtx.Lock()
+	q.paused = false
+	q.cond.Broadcast()
+	q.bufMtx.Unlock()
+}
+
+func (q *DefaultWorkQueue) Paused() bool {
+	q.bufMtx.Lock()
+	defer q.bufMtx.Unlock()
+	return q.paused
+}
+
+func (q *DefaultWorkQueue) SetHeld(held bool) {
+	q.bufMtx.Lock()
+	q.onHold = held
+	q.cond.Broadcast()
+	q.bufMtx.Unlock()
+}
+
+func (q *DefaultWorkQueue) Held() bool {
+	q.bufMtx.Lock()
+	defer q.bufMtx.Unlock()
+	return q.onHold
 }
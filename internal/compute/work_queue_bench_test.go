@@ -0,0 +1,103 @@
+//go:build linux || darwin
+
+package compute
+
+import (
+	"context"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/golang/mock/gomock"
+	"go.uber.org/zap"
+)
+
+// cpuTime returns the CPU time used by the process
+func cpuTime(b *testing.B) time.Duration {
+	var usage syscall.Rusage
+	if err := syscall.Getrusage(syscall.RUSAGE_SELF, &usage); err != nil {
+		b.Fatal(err)
+	}
+	return time.Duration(usage.Utime.Nano() + usage.Stime.Nano())
+}
+
+func benchmarkQueue(b *testing.B, maxSize int) *DefaultWorkQueue {
+	ctrl := gomock.NewController(b)
+	b.Cleanup(func() {
+		ctrl.Finish()
+	})
+
+	mWorker := NewMockWorker(ctrl)
+	mWorker.EXPECT().
+		IsReadyChan(gomock.Any(), gomock.Any()).
+		DoAndReturn(func(ctx context.Context, opts ...func(options *ReadyOptions)) <-chan error {
+			ch := make(chan error, 1)
+			ch <- nil
+			return ch
+		}).
+		AnyTimes()
+	mWorker.EXPECT().
+		Connect(gomock.Any()).
+		Return(nil).
+		AnyTimes()
+	mWorker.EXPECT().
+		Equals(gomock.Any()).
+		Return(true).
+		AnyTimes()
+
+	mPool := NewMockPool(ctrl)
+	mPool.EXPECT().
+		GetWorker(gomock.Any()).
+		Return(mWorker, nil).
+		AnyTimes()
+	mPool.EXPECT().
+		ReturnWorker(gomock.Any()).
+		AnyTimes()
+
+	return NewQueue(zap.NewNop(), mPool, maxSize).(*DefaultWorkQueue)
+}
+
+// BenchmarkDefaultWorkQueue_Saturated measures the CPU used by the queue while
+// all slots are busy and more work is waiting. The dispatcher should be idle.
+func BenchmarkDefaultWorkQueue_Saturated(b *testing.B) {
+	const window = 10 * time.Millisecond
+
+	q := benchmarkQueue(b, 4)
+
+	release := make(chan struct{})
+	for i := 0; i < 16; i++ {
+		q.Add(NewWorkInfo(context.Background(), "req",
+			func(ctx context.Context, logger *zap.Logger, req string, worker Worker) (string, error) {
+				<-release
+				return req, nil
+			}))
+	}
+
+	b.ResetTimer()
+	start := cpuTime(b)
+	for i := 0; i < b.N; i++ {
+		time.Sleep(window)
+	}
+	used := cpuTime(b) - start
+	b.StopTimer()
+
+	b.ReportMetric(float64(used)/float64(time.Duration(b.N)*window), "cpu/wall")
+
+	close(release)
+	q.Wait()
+}
+
+// BenchmarkDefaultWorkQueue_Throughput measures dispatching short work
+func BenchmarkDefaultWorkQueue_Throughput(b *testing.B) {
+	q := benchmarkQueue(b, 8)
+
+	run := func(ctx context.Context, logger *zap.Logger, req int, worker Worker) (int, error) {
+		return req, nil
+	}
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		q.Add(NewWorkInfo(context.Background(), i, run))
+	}
+	q.Wait()
+}
@@ -3,13 +3,22 @@ package compute
 import (
 	"context"
 	"errors"
+	"fmt"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/golang/mock/gomock"
 	m "github.com/launchdarkly/go-test-helpers/v2/matchers"
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
 	"go.uber.org/atomic"
 	"go.uber.org/zap"
 	"go.uber.org/zap/zaptest"
+	"google.golang.org/grpc"
+
+	"github.com/ansg191/remote-worker/api/proto"
 )
 
 func TestNewQueue(t *testing.T) {
@@ -115,6 +124,99 @@ func TestDefaultWorkQueue_SetMaxSize(t *testing.T) {
 	}
 }
 
+func TestDefaultWorkQueue_dispatch(t *testing.T) {
+	logger := zaptest.NewLogger(t)
+
+	ctrl := gomock.NewController(t)
+	t.Cleanup(func() {
+		ctrl.Finish()
+	})
+
+	mWorker := NewMockWorker(ctrl)
+	mWorker.EXPECT().
+		IsReadyChan(gomock.Any(), gomock.Any()).
+		DoAndReturn(func(ctx context.Context, opts ...func(options *ReadyOptions)) <-chan error {
+			ch := make(chan error, 1)
+			ch <- nil
+			return ch
+		}).
+		AnyTimes()
+	mWorker.EXPECT().
+		Connect(gomock.Any()).
+		Return(nil).
+		AnyTimes()
+	mWorker.EXPECT().
+		Equals(gomock.Any()).
+		Return(true).
+		AnyTimes()
+
+	newWork := func() *GenericWorkInfo[string, string] {
+		return NewWorkInfo(context.Background(), "req",
+			func(ctx context.Context, logger *zap.Logger, req string, worker Worker) (string, error) {
+				return req, nil
+			})
+	}
+
+	t.Run("SetMaxSize wakes dispatcher", func(t *testing.T) {
+		mPool := NewMockPool(ctrl)
+		mPool.EXPECT().GetWorker(gomock.Any()).Return(mWorker, nil)
+		mPool.EXPECT().ReturnWorker(gomock.Eq(mWorker))
+
+		q := NewQueue(logger, mPool, 0)
+		work := newWork()
+		q.Add(work)
+
+		select {
+		case <-work.Result:
+			t.Fatal("work dispatched with maxSize 0")
+		case <-time.After(10 * time.Millisecond):
+		}
+
+		q.SetMaxSize(1)
+
+		select {
+		case res := <-work.Result:
+			m.For(t, "result").Assert(res, m.Equal("req"))
+		case <-time.After(time.Second):
+			t.Fatal("work not dispatched after SetMaxSize")
+		}
+	})
+
+	t.Run("parallel provisioning", func(t *testing.T) {
+		// Both GetWorker calls must be in flight at once to return
+		var arrived sync.WaitGroup
+		arrived.Add(2)
+
+		mPool := NewMockPool(ctrl)
+		mPool.EXPECT().
+			GetWorker(gomock.Any()).
+			DoAndReturn(func(ctx context.Context) (Worker, error) {
+				arrived.Done()
+				arrived.Wait()
+				return mWorker, nil
+			}).
+			Times(2)
+		mPool.EXPECT().ReturnWorker(gomock.Eq(mWorker)).Times(2)
+
+		q := NewQueue(logger, mPool, 2)
+		work1, work2 := newWork(), newWork()
+		q.Add(work1)
+		q.Add(work2)
+
+		done := make(chan struct{})
+		go func() {
+			q.Wait()
+			close(done)
+		}()
+
+		select {
+		case <-done:
+		case <-time.After(time.Second):
+			t.Fatal("workers not provisioned in parallel")
+		}
+	})
+}
+
 func TestDefaultWorkQueue_Add(t *testing.T) {
 	logger := zaptest.NewLogger(t)
 
@@ -216,3 +318,582 @@ func TestDefaultWorkQueue_Add(t *testing.T) {
 		})
 	}
 }
+
+func TestDefaultWorkQueue_Priority(t *testing.T) {
+	logger := zaptest.NewLogger(t)
+
+	ctrl := gomock.NewController(t)
+	t.Cleanup(func() {
+		ctrl.Finish()
+	})
+
+	mWorker := NewMockWorker(ctrl)
+	mPool := NewMockPool(ctrl)
+
+	// Block the first GetWorker until all work has been queued
+	release := make(chan struct{})
+	first := true
+	mPool.EXPECT().
+		GetWorker(gomock.Any()).
+		DoAndReturn(func(ctx context.Context) (Worker, error) {
+			if first {
+				first = false
+				<-release
+			}
+			return mWorker, nil
+		}).
+		AnyTimes()
+	mPool.EXPECT().
+		ReturnWorker(gomock.Eq(mWorker)).
+		AnyTimes()
+
+	mWorker.EXPECT().
+		IsReadyChan(gomock.Any(), gomock.Any()).
+		DoAndReturn(func(ctx context.Context, opts ...func(options *ReadyOptions)) <-chan error {
+			ch := make(chan error, 1)
+			ch <- nil
+			return ch
+		}).
+		AnyTimes()
+	mWorker.EXPECT().
+		Connect(gomock.Any()).
+		Return(nil).
+		AnyTimes()
+	mWorker.EXPECT().
+		Equals(gomock.Eq(mWorker)).
+		Return(true).
+		AnyTimes()
+
+	var order []string
+	newWork := func(req string, priority int) *GenericWorkInfo[string, string] {
+		work := NewWorkInfo(context.Background(), req,
+			func(ctx context.Context, logger *zap.Logger, req string, worker Worker) (string, error) {
+				order = append(order, req)
+				return req, nil
+			})
+		work.Priority = priority
+		return work
+	}
+
+	q := NewQueue(logger, mPool, 1, WithPriorityScheduling(0))
+
+	q.Add(newWork("first", 0))
+	// Give the dispatcher time to take the first work
+	time.Sleep(10 * time.Millisecond)
+	q.Add(newWork("low", 0))
+	q.Add(newWork("high", 10))
+	q.Add(newWork("mid", 5))
+	close(release)
+
+	q.Wait()
+
+	m.For(t, "order").Assert(order, m.Items(
+		m.Equal("first"), m.Equal("high"), m.Equal("mid"), m.Equal("low"),
+	))
+}
+
+type cancelClient struct {
+	proto.JobServiceClient
+	canceled chan struct{}
+	id       string // ID of the canceled job
+}
+
+func (c *cancelClient) Cancel(_ context.Context, req *proto.JobCancelRequest, _ ...grpc.CallOption) (*proto.JobCancelResponse, error) {
+	c.id = req.Id
+	close(c.canceled)
+	return &proto.JobCancelResponse{}, nil
+}
+
+func TestDefaultWorkQueue_Cancel(t *testing.T) {
+	logger := zaptest.NewLogger(t)
+
+	ctrl := gomock.NewController(t)
+	t.Cleanup(func() {
+		ctrl.Finish()
+	})
+
+	t.Run("not found", func(t *testing.T) {
+		q := NewQueue(logger, NewMockPool(ctrl), 1)
+
+		err := q.Cancel("unknown")
+		m.For(t, "err").Assert(err, m.Equal(ErrWorkNotFound))
+	})
+
+	t.Run("queued", func(t *testing.T) {
+		// maxSize of 0 keeps work queued
+		q := NewQueue(logger, NewMockPool(ctrl), 0)
+
+		work := NewWorkInfo(context.Background(), "req",
+			func(ctx context.Context, logger *zap.Logger, req string, worker Worker) (string, error) {
+				t.Error("canceled work was run")
+				return req, nil
+			})
+
+		id := q.Add(work)
+		m.For(t, "id").Assert(string(id), m.Not(m.Equal("")))
+
+		err := q.Cancel(id)
+		m.For(t, "cancel err").Require(err, m.BeNil())
+
+		q.Wait()
+		m.For(t, "err").Assert(<-work.Err, m.Equal(context.Canceled))
+
+		err = q.Cancel(id)
+		m.For(t, "cancel twice err").Assert(err, m.Equal(ErrWorkNotFound))
+	})
+
+	t.Run("running", func(t *testing.T) {
+		client := &cancelClient{canceled: make(chan struct{})}
+
+		mWorker := NewMockWorker(ctrl)
+		mWorker.EXPECT().
+			IsReadyChan(gomock.Any(), gomock.Any()).
+			DoAndReturn(func(ctx context.Context, opts ...func(options *ReadyOptions)) <-chan error {
+				ch := make(chan error, 1)
+				ch <- nil
+				return ch
+			})
+		mWorker.EXPECT().
+			Connect(gomock.Any()).
+			Return(nil)
+		mWorker.EXPECT().
+			Job().
+			Return(client).
+			AnyTimes()
+		mWorker.EXPECT().
+			Equals(gomock.Any()).
+			Return(true).
+			AnyTimes()
+
+		mPool := NewMockPool(ctrl)
+		mPool.EXPECT().GetWorker(gomock.Any()).Return(mWorker, nil)
+		mPool.EXPECT().ReturnWorker(gomock.Eq(mWorker))
+
+		started := make(chan struct{})
+		var runID WorkID
+		work := NewWorkInfo(context.Background(), "req",
+			func(ctx context.Context, logger *zap.Logger, req string, worker Worker) (string, error) {
+				runID, _ = WorkIDFrom(ctx)
+				close(started)
+				<-ctx.Done()
+				return "", ctx.Err()
+			})
+
+		q := NewQueue(logger, mPool, 1)
+		id := q.Add(work)
+		<-started
+
+		err := q.Cancel(id)
+		m.For(t, "cancel err").Require(err, m.BeNil())
+
+		q.Wait()
+		m.For(t, "err").Assert(<-work.Err, m.Equal(context.Canceled))
+
+		select {
+		case <-client.canceled:
+			m.For(t, "canceled job").Assert(client.id, m.Equal(string(id)))
+		default:
+			t.Error("job not canceled on worker")
+		}
+		m.For(t, "run id").Assert(runID, m.Equal(id))
+	})
+}
+
+func TestDefaultWorkQueue_Pause(t *testing.T) {
+	logger := zaptest.NewLogger(t)
+
+	ctrl := gomock.NewController(t)
+	t.Cleanup(func() {
+		ctrl.Finish()
+	})
+
+	mWorker := NewMockWorker(ctrl)
+	mWorker.EXPECT().
+		IsReadyChan(gomock.Any(), gomock.Any()).
+		DoAndReturn(func(ctx context.Context, opts ...func(options *ReadyOptions)) <-chan error {
+			ch := make(chan error, 1)
+			ch <- nil
+			return ch
+		})
+	mWorker.EXPECT().
+		Connect(gomock.Any()).
+		Return(nil)
+	mWorker.EXPECT().
+		Equals(gomock.Any()).
+		Return(true).
+		AnyTimes()
+
+	refused := make(chan struct{})
+	mPool := NewMockPool(ctrl)
+	gomock.InOrder(
+		mPool.EXPECT().GetWorker(gomock.Any()).DoAndReturn(func(ctx context.Context) (Worker, error) {
+			defer close(refused)
+			return nil, fmt.Errorf("daily budget: %w", ErrBudgetExceeded)
+		}),
+		mPool.EXPECT().GetWorker(gomock.Any()).Return(mWorker, nil),
+	)
+	mPool.EXPECT().ReturnWorker(gomock.Eq(mWorker))
+
+	work := NewWorkInfo(context.Background(), "req",
+		func(ctx context.Context, logger *zap.Logger, req string, worker Worker) (string, error) {
+			return req, nil
+		})
+
+	q := NewQueue(logger, mPool, 1)
+	q.Add(work)
+	<-refused
+
+	// The refused work is held instead of failed
+	deadline := time.Now().Add(time.Second)
+	for !q.Held() || q.TenantStats()[""].Queued != 1 {
+		if time.Now().After(deadline) {
+			t.Fatal("refused work not held")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	m.For(t, "not paused").Assert(q.Paused(), m.Equal(false))
+
+	// Releasing the hold leaves a pause of an operator in place
+	q.Pause()
+	q.SetHeld(false)
+	time.Sleep(10 * time.Millisecond)
+	m.For(t, "still queued").Assert(q.TenantStats()[""].Queued, m.Equal(1))
+
+	q.Resume()
+	m.For(t, "resumed").Assert(q.Paused(), m.Equal(false))
+
+	q.Wait()
+	m.For(t, "result").Assert(<-work.Result, m.Equal("req"))
+}
+
+func TestDefaultWorkQueue_Cancel_refused(t *testing.T) {
+	logger := zaptest.NewLogger(t)
+
+	ctrl := gomock.NewController(t)
+	t.Cleanup(func() {
+		ctrl.Finish()
+	})
+
+	// Work is canceled while the pool refuses a worker for it
+	var q WorkQueue
+	mPool := NewMockPool(ctrl)
+	mPool.EXPECT().GetWorker(gomock.Any()).DoAndReturn(func(ctx context.Context) (Worker, error) {
+		id, _ := WorkIDFrom(ctx)
+		m.For(t, "cancel err").Assert(q.Cancel(id), m.BeNil())
+		return nil, fmt.Errorf("daily budget: %w", ErrBudgetExceeded)
+	})
+
+	work := NewWorkInfo(context.Background(), "req",
+		func(ctx context.Context, logger *zap.Logger, req string, worker Worker) (string, error) {
+			return req, nil
+		})
+
+	q = NewQueue(logger, mPool, 1)
+	q.Add(work)
+
+	// The canceled work fails instead of being held
+	select {
+	case err := <-work.Err:
+		m.For(t, "err").Assert(errors.Is(err, context.Canceled), m.Equal(true))
+	case <-time.After(time.Second):
+		t.Fatal("canceled work held")
+	}
+	q.Wait()
+	m.For(t, "queued").Assert(q.TenantStats(), m.Length().Should(m.Equal(0)))
+}
+
+func TestDefaultWorkQueue_Shutdown(t *testing.T) {
+	logger := zaptest.NewLogger(t)
+
+	ctrl := gomock.NewController(t)
+	t.Cleanup(func() {
+		ctrl.Finish()
+	})
+
+	newWorker := func(client proto.JobServiceClient) *MockWorker {
+		mWorker := NewMockWorker(ctrl)
+		mWorker.EXPECT().
+			IsReadyChan(gomock.Any(), gomock.Any()).
+			DoAndReturn(func(ctx context.Context, opts ...func(options *ReadyOptions)) <-chan error {
+				ch := make(chan error, 1)
+				ch <- nil
+				return ch
+			})
+		mWorker.EXPECT().
+			Connect(gomock.Any()).
+			Return(nil)
+		mWorker.EXPECT().
+			Job().
+			Return(client).
+			AnyTimes()
+		mWorker.EXPECT().
+			Equals(gomock.Any()).
+			Return(true).
+			AnyTimes()
+		return mWorker
+	}
+
+	t.Run("drain", func(t *testing.T) {
+		mWorker := newWorker(nil)
+
+		mPool := NewMockPool(ctrl)
+		mPool.EXPECT().GetWorker(gomock.Any()).Return(mWorker, nil)
+		mPool.EXPECT().ReturnWorker(gomock.Eq(mWorker))
+		mPool.EXPECT().Close().Return(nil)
+
+		started := make(chan struct{})
+		release := make(chan struct{})
+		work := NewWorkInfo(context.Background(), "req",
+			func(ctx context.Context, logger *zap.Logger, req string, worker Worker) (string, error) {
+				close(started)
+				<-release
+				return req, nil
+			})
+
+		q := NewQueue(logger, mPool, 1)
+		q.Add(work)
+		<-started
+
+		shutdownErr := make(chan error)
+		go func() {
+			shutdownErr <- q.Shutdown(context.Background(), ShutdownDrain)
+		}()
+
+		// Wait for Shutdown to stop accepting work
+		dq := q.(*DefaultWorkQueue)
+		for {
+			dq.bufMtx.Lock()
+			closed := dq.closed
+			dq.bufMtx.Unlock()
+			if closed {
+				break
+			}
+			time.Sleep(time.Millisecond)
+		}
+
+		late := NewWorkInfo(context.Background(), "late",
+			func(ctx context.Context, logger *zap.Logger, req string, worker Worker) (string, error) {
+				t.Error("work added after shutdown was run")
+				return req, nil
+			})
+		q.Add(late)
+		m.For(t, "late err").Assert(<-late.Err, m.Equal(ErrQueueClosed))
+
+		select {
+		case <-shutdownErr:
+			t.Fatal("shutdown returned before work finished")
+		default:
+		}
+
+		close(release)
+		m.For(t, "shutdown err").Assert(<-shutdownErr, m.BeNil())
+		m.For(t, "result").Assert(<-work.Result, m.Equal("req"))
+	})
+
+	t.Run("abort", func(t *testing.T) {
+		client := &cancelClient{canceled: make(chan struct{})}
+		mWorker := newWorker(client)
+
+		mPool := NewMockPool(ctrl)
+		mPool.EXPECT().GetWorker(gomock.Any()).Return(mWorker, nil)
+		mPool.EXPECT().ReturnWorker(gomock.Eq(mWorker))
+		mPool.EXPECT().Close().Return(nil)
+
+		started := make(chan struct{})
+		running := NewWorkInfo(context.Background(), "running",
+			func(ctx context.Context, logger *zap.Logger, req string, worker Worker) (string, error) {
+				close(started)
+				<-ctx.Done()
+				return "", ctx.Err()
+			})
+		queued := NewWorkInfo(context.Background(), "queued",
+			func(ctx context.Context, logger *zap.Logger, req string, worker Worker) (string, error) {
+				t.Error("queued work was run")
+				return req, nil
+			})
+
+		q := NewQueue(logger, mPool, 1)
+		q.Add(running)
+		<-started
+		q.Add(queued)
+
+		err := q.Shutdown(context.Background(), ShutdownAbort)
+		m.For(t, "shutdown err").Assert(err, m.BeNil())
+
+		m.For(t, "running err").Assert(<-running.Err, m.Equal(context.Canceled))
+		m.For(t, "queued err").Assert(<-queued.Err, m.Equal(ErrQueueClosed))
+
+		select {
+		case <-client.canceled:
+		default:
+			t.Error("job not canceled on worker")
+		}
+	})
+
+	t.Run("drain deadline", func(t *testing.T) {
+		client := &cancelClient{canceled: make(chan struct{})}
+		mWorker := newWorker(client)
+
+		mPool := NewMockPool(ctrl)
+		mPool.EXPECT().GetWorker(gomock.Any()).Return(mWorker, nil)
+		mPool.EXPECT().ReturnWorker(gomock.Eq(mWorker))
+		mPool.EXPECT().Close().Return(nil)
+
+		started := make(chan struct{})
+		work := NewWorkInfo(context.Background(), "req",
+			func(ctx context.Context, logger *zap.Logger, req string, worker Worker) (string, error) {
+				close(started)
+				<-ctx.Done()
+				return "", ctx.Err()
+			})
+
+		q := NewQueue(logger, mPool, 1)
+		q.Add(work)
+		<-started
+
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+		defer cancel()
+
+		err := q.Shutdown(ctx, ShutdownDrain)
+		m.For(t, "shutdown err").Assert(err, m.Equal(context.DeadlineExceeded))
+		m.For(t, "err").Assert(<-work.Err, m.Equal(context.Canceled))
+	})
+}
+
+func TestDefaultWorkQueue_FairShare(t *testing.T) {
+	logger := zaptest.NewLogger(t)
+
+	ctrl := gomock.NewController(t)
+	t.Cleanup(func() {
+		ctrl.Finish()
+	})
+
+	mWorker := NewMockWorker(ctrl)
+	mWorker.EXPECT().
+		IsReadyChan(gomock.Any(), gomock.Any()).
+		DoAndReturn(func(ctx context.Context, opts ...func(options *ReadyOptions)) <-chan error {
+			ch := make(chan error, 1)
+			ch <- nil
+			return ch
+		}).
+		AnyTimes()
+	mWorker.EXPECT().
+		Connect(gomock.Any()).
+		Return(nil).
+		AnyTimes()
+	mWorker.EXPECT().
+		Equals(gomock.Any()).
+		Return(true).
+		AnyTimes()
+
+	mPool := NewMockPool(ctrl)
+	mPool.EXPECT().
+		GetWorker(gomock.Any()).
+		Return(mWorker, nil).
+		AnyTimes()
+	mPool.EXPECT().
+		ReturnWorker(gomock.Eq(mWorker)).
+		AnyTimes()
+
+	started := make(chan string, 4)
+	release := make(chan struct{})
+	newWork := func(req, tenant string) *GenericWorkInfo[string, string] {
+		work := NewWorkInfo(context.Background(), req,
+			func(ctx context.Context, logger *zap.Logger, req string, worker Worker) (string, error) {
+				started <- req
+				<-release
+				return req, nil
+			})
+		work.Tenant = tenant
+		return work
+	}
+
+	q := NewQueue(logger, mPool, 3, WithTenantLimit("a", 1))
+	q.Add(newWork("a1", "a"))
+	q.Add(newWork("a2", "a"))
+	q.Add(newWork("a3", "a"))
+	q.Add(newWork("b1", "b"))
+
+	// A slot is free, but tenant a is at its limit
+	var running []any
+	for i := 0; i < 2; i++ {
+		running = append(running, <-started)
+	}
+	m.For(t, "running").Assert(running, m.ItemsInAnyOrder(m.Equal("a1"), m.Equal("b1")))
+
+	m.For(t, "stats").Assert(q.TenantStats(), m.Equal(map[string]TenantStats{
+		"a": {Queued: 2, Running: 1},
+		"b": {Running: 1},
+	}))
+
+	close(release)
+	q.Wait()
+
+	m.For(t, "stats").Assert(q.TenantStats(), m.Length().Should(m.Equal(0)))
+}
+
+func TestDefaultWorkQueue_tracing(t *testing.T) {
+	logger := zaptest.NewLogger(t)
+
+	ctrl := gomock.NewController(t)
+	t.Cleanup(func() {
+		ctrl.Finish()
+	})
+
+	exporter := tracetest.NewInMemoryExporter()
+	tp := sdktrace.NewTracerProvider(sdktrace.WithSyncer(exporter))
+
+	mWorker := NewMockWorker(ctrl)
+	mWorker.EXPECT().
+		IsReadyChan(gomock.Any(), gomock.Any()).
+		DoAndReturn(func(ctx context.Context, opts ...func(options *ReadyOptions)) <-chan error {
+			ch := make(chan error, 1)
+			ch <- nil
+			return ch
+		})
+	mWorker.EXPECT().
+		Connect(gomock.Any()).
+		Return(errors.New("connection refused"))
+	mWorker.EXPECT().
+		Equals(gomock.Any()).
+		Return(true).
+		AnyTimes()
+	mWorker.EXPECT().
+		Close().
+		Return(nil)
+
+	mFactory := NewMockWorkerFactory(ctrl)
+	mFactory.EXPECT().
+		Create(gomock.Any()).
+		Return(mWorker, nil)
+
+	pool := NewPool(logger, mFactory, WithPoolTracerProvider(tp))
+	q := NewQueue(logger, pool, 1, WithQueueTracerProvider(tp))
+
+	work := NewWorkInfo(context.Background(), "req",
+		func(ctx context.Context, logger *zap.Logger, req string, worker Worker) (string, error) {
+			return req, nil
+		})
+	q.Add(work)
+	q.Wait()
+
+	err := <-work.Err
+	m.For(t, "err").Assert(err, m.Not(m.BeNil()))
+
+	spans := exporter.GetSpans()
+	byName := make(map[string]tracetest.SpanStub)
+	for _, span := range spans {
+		byName[span.Name] = span
+	}
+	m.For(t, "spans").Assert(spans, m.Length().Should(m.Equal(4)))
+
+	root := byName["WorkQueue.work"]
+	m.For(t, "root status").Assert(root.Status.Code, m.Equal(codes.Error))
+	for _, name := range []string{"WorkerFactory.Create", "Worker.IsReadyChan", "Worker.Connect"} {
+		m.For(t, name+" parent").Assert(byName[name].Parent.SpanID(), m.Equal(root.SpanContext.SpanID()))
+	}
+	m.For(t, "connect status").Assert(byName["Worker.Connect"].Status.Code, m.Equal(codes.Error))
+	m.For(t, "ready status").Assert(byName["Worker.IsReadyChan"].Status.Code, m.Equal(codes.Unset))
+
+	m.For(t, "close err").Assert(q.Shutdown(context.Background(), ShutdownDrain), m.BeNil())
+}
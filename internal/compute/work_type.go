@@ -0,0 +1,112 @@
+package compute
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+var (
+	ErrUnknownWorkType = errors.New("unknown work type")
+)
+
+// Serializer converts work requests to and from bytes so they can be journaled
+type Serializer[T any] interface {
+	Marshal(req T) ([]byte, error)
+	Unmarshal(data []byte) (T, error)
+}
+
+// JSONSerializer serializes requests with encoding/json
+type JSONSerializer[T any] struct{}
+
+func (JSONSerializer[T]) Marshal(req T) ([]byte, error) {
+	return json.Marshal(req)
+}
+
+func (JSONSerializer[T]) Unmarshal(data []byte) (T, error) {
+	var req T
+	err := json.Unmarshal(data, &req)
+	return req, err
+}
+
+// WorkType is a named kind of work whose requests can be persisted in a
+// Journal and replayed after a restart.
+type WorkType[T, U any] struct {
+	name       string
+	run        WorkRunFunc[T, U]
+	serializer Serializer[T]
+}
+
+// workRestorer recreates journaled work
+type workRestorer interface {
+	restore(ctx context.Context, entry JournalEntry) (WorkInfo, error)
+}
+
+var (
+	workTypesMtx sync.RWMutex
+	workTypes    = make(map[string]workRestorer)
+)
+
+// RegisterWorkType registers a kind of work under name. If serializer is nil,
+// requests are serialized as JSON. It panics if name is already registered.
+func RegisterWorkType[T, U any](name string, run WorkRunFunc[T, U], serializer Serializer[T]) *WorkType[T, U] {
+	if serializer == nil {
+		serializer = JSONSerializer[T]{}
+	}
+
+	t := &WorkType[T, U]{
+		name:       name,
+		run:        run,
+		serializer: serializer,
+	}
+
+	workTypesMtx.Lock()
+	defer workTypesMtx.Unlock()
+
+	if _, ok := workTypes[name]; ok {
+		panic(fmt.Sprintf("compute: work type %q registered twice", name))
+	}
+	workTypes[name] = t
+
+	return t
+}
+
+func lookupWorkType(name string) (workRestorer, bool) {
+	workTypesMtx.RLock()
+	defer workTypesMtx.RUnlock()
+
+	t, ok := workTypes[name]
+	return t, ok
+}
+
+// Name returns the registered name of the work type
+func (t *WorkType[T, U]) Name() string {
+	return t.name
+}
+
+// NewWorkInfo creates work of this type
+func (t *WorkType[T, U]) NewWorkInfo(ctx context.Context, request T) *GenericWorkInfo[T, U] {
+	work := NewWorkInfo(ctx, request, t.run)
+	work.workType = t
+	return work
+}
+
+func (t *WorkType[T, U]) restore(ctx context.Context, entry JournalEntry) (WorkInfo, error) {
+	req, err := t.serializer.Unmarshal(entry.Payload)
+	if err != nil {
+		return nil, err
+	}
+
+	work := t.NewWorkInfo(ctx, req)
+	work.Priority = entry.Priority
+	work.Tenant = entry.Tenant
+	work.NotBefore = entry.NotBefore
+	work.Window = entry.Window
+	if entry.Requirements != nil {
+		work.Requirements = *entry.Requirements
+	}
+	return work, nil
+}
@@ -3,6 +3,7 @@ package compute
 import (
 	"context"
 	"io"
+	"time"
 
 	"github.com/pkg/errors"
 
@@ -11,6 +12,14 @@ import (
 
 var (
 	ErrClosed = errors.New("worker closed")
+	// ErrBudgetExceeded is wrapped by the errors of WorkerFactory.Create when
+	// a spending limit forbids new workers. Work queues hold their work until
+	// they are resumed instead of failing it.
+	ErrBudgetExceeded = errors.New("budget exceeded")
+	// ErrInsufficientCapacity is wrapped by the errors of WorkerFactory.Create
+	// when the provider has no capacity for the worker, e.g. no spot
+	// instances of its type. Pools fall back to their next factory.
+	ErrInsufficientCapacity = errors.New("insufficient capacity")
 )
 
 type Worker interface {
@@ -30,3 +39,64 @@ type Worker interface {
 type WorkerFactory interface {
 	Create(ctx context.Context) (Worker, error)
 }
+
+// FactoryWrapper is implemented by factories wrapping another factory, e.g. to
+// refuse to create workers. Pools look up the optional interfaces of factories,
+// such as CapableFactory and WorkerAttacher, on the wrapped factories too.
+type FactoryWrapper interface {
+	Unwrap() WorkerFactory
+}
+
+// factoryAs returns the first of factory and the factories it wraps that
+// implements T
+func factoryAs[T any](factory WorkerFactory) (T, bool) {
+	for {
+		if v, ok := factory.(T); ok {
+			return v, true
+		}
+		wrapper, ok := factory.(FactoryWrapper)
+		if !ok {
+			var zero T
+			return zero, false
+		}
+		factory = wrapper.Unwrap()
+	}
+}
+
+// Identifier is implemented by workers backed by an identifiable instance,
+// such as an EC2 instance.
+type Identifier interface {
+	ID() string
+}
+
+// Markets of instances
+const (
+	MarketSpot     = "spot"
+	MarketOnDemand = "on-demand"
+)
+
+// Instance is implemented by workers backed by a cloud instance billed for its
+// runtime.
+type Instance interface {
+	// InstanceType is the provider's type of the instance, e.g. g4dn.xlarge
+	InstanceType() string
+	// Market is MarketSpot or MarketOnDemand
+	Market() string
+	// LaunchTime is when the instance was launched
+	LaunchTime() time.Time
+}
+
+// Addresser is implemented by workers reachable at a network address. The
+// address is known once the worker is connected.
+type Addresser interface {
+	Address() string
+}
+
+// WorkerAttacher is implemented by factories that can recreate a Worker for an
+// existing instance, e.g. after a manager restart.
+type WorkerAttacher interface {
+	Attach(ctx context.Context, id string) (Worker, error)
+	// Terminate terminates an existing instance that can't be reattached.
+	// Instances that no longer exist are not an error.
+	Terminate(ctx context.Context, id string) error
+}
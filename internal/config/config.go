@@ -0,0 +1,789 @@
+package config
+
+import (
+	"encoding/base64"
+	"fmt"
+	"net/url"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ec2"
+	"github.com/aws/aws-sdk-go-v2/service/ec2/types"
+	"go.uber.org/zap"
+	"gopkg.in/yaml.v2"
+
+	"github.com/ansg191/remote-worker/internal/autoscale"
+	"github.com/ansg191/remote-worker/internal/budget"
+	"github.com/ansg191/remote-worker/internal/compute"
+	"github.com/ansg191/remote-worker/internal/cost"
+	"github.com/ansg191/remote-worker/internal/tracing"
+	"github.com/ansg191/remote-worker/internal/webhook"
+	awsworker "github.com/ansg191/remote-worker/internal/worker/aws"
+	"github.com/ansg191/remote-worker/internal/worker/local"
+)
+
+// EnvPrefix prefixes the environment variables overriding the configuration
+const EnvPrefix = "RW"
+
+// labelPattern matches the keys and values of worker labels, which are passed
+// to the worker on its command line
+var labelPattern = regexp.MustCompile(`^[A-Za-z0-9._/-]+$`)
+
+// Instance markets
+const (
+	MarketSpot     = compute.MarketSpot
+	MarketOnDemand = compute.MarketOnDemand
+)
+
+// Config is the configuration of the manager. Fields holding a value, or a list
+// or map of values, can be overridden with an environment variable named after
+// their path, e.g. RW_POOL_MAX_WORKERS for pool.max_workers. Lists are comma
+// separated and maps are written as key=value pairs, e.g.
+// RW_QUEUE_TENANT_WEIGHTS=studio=3,archive=1. Lists and maps of objects, e.g.
+// factories and routes, can only be set in the configuration file.
+type Config struct {
+	// Region of the EC2 instances. Defaults to the region of the AWS
+	// configuration.
+	Region string `yaml:"region"`
+
+	Manager  ManagerConfig  `yaml:"manager"`
+	Worker   WorkerConfig   `yaml:"worker"`
+	Instance InstanceConfig `yaml:"instance"`
+	Pool     PoolConfig     `yaml:"pool"`
+	// Factories provision the workers of the pool. If empty, a single factory
+	// creates instances of the instance section.
+	Factories []FactoryConfig `yaml:"factories"`
+	// Routes choose the factories of jobs by their requirements. The first
+	// matching route applies. Jobs matching no route may use any factory.
+	Routes    []RouteConfig   `yaml:"routes"`
+	Queue     QueueConfig     `yaml:"queue"`
+	Webhooks  WebhooksConfig  `yaml:"webhooks"`
+	Costs     CostsConfig     `yaml:"costs"`
+	Budgets   BudgetsConfig   `yaml:"budgets"`
+	Autoscale AutoscaleConfig `yaml:"autoscale"`
+}
+
+type ManagerConfig struct {
+	// Addr is the address the ManagerService API is served on
+	Addr string `yaml:"addr"`
+	// MetricsAddr is the address Prometheus metrics are served on. Disabled
+	// if empty.
+	MetricsAddr string `yaml:"metrics_addr"`
+	// DashboardAddr is the address the web dashboard is served on. Disabled
+	// if empty.
+	DashboardAddr string `yaml:"dashboard_addr"`
+	// DataDir is the directory of the work journal. Disabled if empty.
+	DataDir string `yaml:"data_dir"`
+	// TraceExporter is the exporter of traces: stdout or otlp. Disabled if
+	// empty.
+	TraceExporter string `yaml:"trace_exporter"`
+	// ShutdownTimeout bounds how long running jobs are drained on shutdown
+	// before they are aborted
+	ShutdownTimeout Duration `yaml:"shutdown_timeout"`
+}
+
+type WorkerConfig struct {
+	// Port the worker serves its gRPC API on
+	Port uint16 `yaml:"port"`
+	// Labels advertised by the workers, matched against the labels required
+	// by jobs. Ignored with instance.user_data_file.
+	Labels map[string]string `yaml:"labels"`
+}
+
+type InstanceConfig struct {
+	ImageID            string   `yaml:"image_id"`
+	InstanceType       string   `yaml:"instance_type"`
+	Market             string   `yaml:"market"`
+	KeyName            string   `yaml:"key_name"`
+	SecurityGroupIDs   []string `yaml:"security_group_ids"`
+	SubnetID           string   `yaml:"subnet_id"`
+	IAMInstanceProfile string   `yaml:"iam_instance_profile"`
+	// UserDataFile replaces the built-in user data installing the worker
+	UserDataFile string `yaml:"user_data_file"`
+}
+
+type FactoryConfig struct {
+	Name string `yaml:"name"`
+	// Local is the path of the worker binary. If set, workers are processes
+	// of it on the machine of the manager instead of instances, e.g. for
+	// development.
+	Local string `yaml:"local"`
+	// InstanceType and Market override those of the instance section
+	InstanceType string `yaml:"instance_type"`
+	Market       string `yaml:"market"`
+	// MaxWorkers limits the workers of the factory. Unlimited if zero.
+	MaxWorkers int `yaml:"max_workers"`
+	// Priority orders the factories, lowest first, e.g. by cost
+	Priority int `yaml:"priority"`
+	// Labels are advertised by the workers in addition to worker.labels
+	Labels map[string]string `yaml:"labels"`
+	// Capabilities declares the capabilities of the workers, so that jobs
+	// are routed to the factory without connecting to its workers first
+	Capabilities *CapabilitiesConfig `yaml:"capabilities"`
+}
+
+type CapabilitiesConfig struct {
+	// GPU is the vendor of the GPU of the workers, e.g. NVIDIA. No GPU if
+	// empty.
+	GPU        string `yaml:"gpu"`
+	Threads    uint32 `yaml:"threads"`
+	ScratchGiB uint64 `yaml:"scratch_gib"`
+}
+
+type RouteConfig struct {
+	// Requirements of the jobs the route matches. Jobs match if they require
+	// at least as much.
+	GPU        bool              `yaml:"gpu"`
+	GPUVendor  string            `yaml:"gpu_vendor"`
+	ScratchGiB uint64            `yaml:"min_scratch_gib"`
+	Threads    uint32            `yaml:"min_threads"`
+	Labels     map[string]string `yaml:"labels"`
+	// Factories that may create workers for the jobs
+	Factories []string `yaml:"factories"`
+}
+
+type PoolConfig struct {
+	MaxWorkers           int      `yaml:"max_workers"`
+	MinWarm              int      `yaml:"min_warm"`
+	FailWhenExhausted    bool     `yaml:"fail_when_exhausted"`
+	IdleTimeout          Duration `yaml:"idle_timeout"`
+	ReapInterval         Duration `yaml:"reap_interval"`
+	HealthCheckInterval  Duration `yaml:"health_check_interval"`
+	HealthCheckTimeout   Duration `yaml:"health_check_timeout"`
+	HealthCheckThreshold int      `yaml:"health_check_threshold"`
+}
+
+type QueueConfig struct {
+	// MaxSize is the number of jobs running at once
+	MaxSize            int            `yaml:"max_size"`
+	PriorityScheduling bool           `yaml:"priority_scheduling"`
+	AgingInterval      Duration       `yaml:"aging_interval"`
+	FairShare          bool           `yaml:"fair_share"`
+	TenantWeights      map[string]int `yaml:"tenant_weights"`
+	TenantLimits       map[string]int `yaml:"tenant_limits"`
+	DefaultTenantLimit int            `yaml:"default_tenant_limit"`
+	Retry              RetryConfig    `yaml:"retry"`
+}
+
+type RetryConfig struct {
+	MaxAttempts    int      `yaml:"max_attempts"`
+	InitialBackoff Duration `yaml:"initial_backoff"`
+	MaxBackoff     Duration `yaml:"max_backoff"`
+	Multiplier     float64  `yaml:"multiplier"`
+	Jitter         float64  `yaml:"jitter"`
+}
+
+type WebhooksConfig struct {
+	Timeout        Duration `yaml:"timeout"`
+	MaxAttempts    int      `yaml:"max_attempts"`
+	InitialBackoff Duration `yaml:"initial_backoff"`
+	MaxBackoff     Duration `yaml:"max_backoff"`
+	// DeadLetterFile records failed deliveries as lines of JSON. Failed
+	// deliveries are only logged if empty.
+	DeadLetterFile string          `yaml:"dead_letter_file"`
+	Endpoints      []WebhookConfig `yaml:"endpoints"`
+}
+
+type WebhookConfig struct {
+	URL    string `yaml:"url"`
+	Secret string `yaml:"secret"`
+	// Events are job events sent to the endpoint: queued, started,
+	// succeeded, failed or canceled. All events are sent if empty.
+	Events []string `yaml:"events"`
+}
+
+type CostsConfig struct {
+	// Prices are the hourly prices of instance types. Job costs are zero for
+	// instance types without a price.
+	Prices map[string]PriceConfig `yaml:"prices"`
+}
+
+type PriceConfig struct {
+	Spot     float64 `yaml:"spot"`
+	OnDemand float64 `yaml:"on_demand"`
+}
+
+type BudgetsConfig struct {
+	// CheckInterval is how often budgets are evaluated in the background
+	CheckInterval Duration `yaml:"check_interval"`
+	// Timezone of the days and months of budgets, e.g. America/Los_Angeles.
+	// Defaults to UTC.
+	Timezone string         `yaml:"timezone"`
+	Limits   []BudgetConfig `yaml:"limits"`
+}
+
+type BudgetConfig struct {
+	Name string `yaml:"name"`
+	// Period is daily, monthly or batch
+	Period string `yaml:"period"`
+	// Soft and Hard are limits in USD. Zero disables a limit.
+	Soft float64 `yaml:"soft"`
+	Hard float64 `yaml:"hard"`
+}
+
+type AutoscaleConfig struct {
+	// TargetWait is the expected wait of queued jobs the autoscaler keeps
+	// the queue under. Disabled if zero, queue.max_size is then fixed.
+	TargetWait Duration `yaml:"target_wait"`
+	// Interval is how often the autoscaler is evaluated
+	Interval          Duration `yaml:"interval"`
+	MinSize           int      `yaml:"min_size"`
+	MaxSize           int      `yaml:"max_size"`
+	MinWarm           int      `yaml:"min_warm"`
+	ScaleUpCooldown   Duration `yaml:"scale_up_cooldown"`
+	ScaleDownCooldown Duration `yaml:"scale_down_cooldown"`
+}
+
+// Duration is a time.Duration written as a string in YAML, e.g. 1m30s
+type Duration time.Duration
+
+func (d *Duration) UnmarshalYAML(unmarshal func(any) error) error {
+	var s string
+	if err := unmarshal(&s); err != nil {
+		return err
+	}
+
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = Duration(v)
+	return nil
+}
+
+func (d Duration) MarshalYAML() (any, error) {
+	return time.Duration(d).String(), nil
+}
+
+// Default returns the configuration used for fields not set in a file
+func Default() *Config {
+	return &Config{
+		Manager: ManagerConfig{
+			Addr:            ":8080",
+			MetricsAddr:     ":9090",
+			DashboardAddr:   ":8081",
+			ShutdownTimeout: Duration(5 * time.Minute),
+		},
+		Worker: WorkerConfig{
+			Port: 443,
+		},
+		Instance: InstanceConfig{
+			InstanceType: string(types.InstanceTypeG4dnXlarge),
+			Market:       MarketSpot,
+		},
+		Queue: QueueConfig{
+			MaxSize: 2,
+		},
+		Webhooks: WebhooksConfig{
+			Timeout:        Duration(10 * time.Second),
+			MaxAttempts:    5,
+			InitialBackoff: Duration(time.Second),
+			MaxBackoff:     Duration(time.Minute),
+		},
+		Budgets: BudgetsConfig{
+			CheckInterval: Duration(time.Minute),
+		},
+		Autoscale: AutoscaleConfig{
+			Interval:          Duration(30 * time.Second),
+			MinSize:           1,
+			ScaleUpCooldown:   Duration(time.Minute),
+			ScaleDownCooldown: Duration(5 * time.Minute),
+		},
+	}
+}
+
+// Load reads the configuration from the YAML file at path on top of the
+// defaults, applies environment overrides and validates the result. If path
+// is empty, only the defaults and environment are used. Unknown fields are
+// errors.
+func Load(path string) (*Config, error) {
+	c := Default()
+
+	if path != "" {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		if err = yaml.UnmarshalStrict(data, c); err != nil {
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+	}
+
+	if err := applyEnv(c, EnvPrefix, os.LookupEnv); err != nil {
+		return nil, err
+	}
+
+	if err := c.Validate(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// ValidationError lists every problem found in a configuration
+type ValidationError struct {
+	Problems []string
+}
+
+func (e *ValidationError) Error() string {
+	return "invalid configuration:\n  - " + strings.Join(e.Problems, "\n  - ")
+}
+
+// Validate checks that the configuration is complete and consistent
+func (c *Config) Validate() error {
+	var problems []string
+	check := func(ok bool, format string, args ...any) {
+		if !ok {
+			problems = append(problems, fmt.Sprintf(format, args...))
+		}
+	}
+
+	check(c.Manager.Addr != "", "manager.addr is required")
+	switch c.Manager.TraceExporter {
+	case tracing.ExporterNone, tracing.ExporterStdout, tracing.ExporterOTLP:
+	default:
+		problems = append(problems, fmt.Sprintf("manager.trace_exporter %q must be %q or %q",
+			c.Manager.TraceExporter, tracing.ExporterStdout, tracing.ExporterOTLP))
+	}
+	check(c.Manager.ShutdownTimeout > 0, "manager.shutdown_timeout must be positive")
+
+	check(c.Worker.Port > 0, "worker.port is required")
+	for key, value := range c.Worker.Labels {
+		check(labelPattern.MatchString(key) && (value == "" || labelPattern.MatchString(value)),
+			"worker.labels %s=%s may only contain letters, digits and ._/-", key, value)
+	}
+
+	check(c.Instance.ImageID != "" || !c.launchesInstances(), "instance.image_id is required")
+	check(c.Instance.InstanceType != "", "instance.instance_type is required")
+	check(c.Instance.Market == MarketSpot || c.Instance.Market == MarketOnDemand,
+		"instance.market %q must be %q or %q", c.Instance.Market, MarketSpot, MarketOnDemand)
+	if c.Instance.UserDataFile != "" {
+		_, err := os.Stat(c.Instance.UserDataFile)
+		check(err == nil, "instance.user_data_file: %v", err)
+	}
+
+	check(c.Pool.MaxWorkers >= 0, "pool.max_workers must not be negative")
+	check(c.Pool.MinWarm >= 0, "pool.min_warm must not be negative")
+	check(c.Pool.MaxWorkers == 0 || c.Pool.MinWarm <= c.Pool.MaxWorkers,
+		"pool.min_warm (%d) exceeds pool.max_workers (%d)", c.Pool.MinWarm, c.Pool.MaxWorkers)
+	check(c.Pool.IdleTimeout >= 0, "pool.idle_timeout must not be negative")
+	check(c.Pool.ReapInterval >= 0, "pool.reap_interval must not be negative")
+	check(c.Pool.HealthCheckInterval >= 0, "pool.health_check_interval must not be negative")
+	check(c.Pool.HealthCheckTimeout >= 0, "pool.health_check_timeout must not be negative")
+	check(c.Pool.HealthCheckThreshold >= 0, "pool.health_check_threshold must not be negative")
+
+	factories := map[string]bool{}
+	if len(c.Factories) == 0 {
+		factories[compute.DefaultFactoryName] = true
+	}
+	for i, factory := range c.Factories {
+		check(factory.Name != "", "factories[%d].name is required", i)
+		check(!factories[factory.Name], "factories[%d].name %q is not unique", i, factory.Name)
+		factories[factory.Name] = true
+		check(factory.Market == "" || factory.Market == MarketSpot || factory.Market == MarketOnDemand,
+			"factories[%d].market %q must be %q or %q", i, factory.Market, MarketSpot, MarketOnDemand)
+		check(factory.MaxWorkers >= 0, "factories[%d].max_workers must not be negative", i)
+		for key, value := range factory.Labels {
+			check(labelPattern.MatchString(key) && (value == "" || labelPattern.MatchString(value)),
+				"factories[%d].labels %s=%s may only contain letters, digits and ._/-", i, key, value)
+		}
+	}
+	for i, route := range c.Routes {
+		check(len(route.Factories) > 0, "routes[%d].factories is required", i)
+		for _, name := range route.Factories {
+			check(factories[name], "routes[%d].factories: unknown factory %q", i, name)
+		}
+	}
+
+	check(c.Queue.MaxSize > 0, "queue.max_size must be positive")
+	check(c.Queue.AgingInterval >= 0, "queue.aging_interval must not be negative")
+	check(c.Queue.AgingInterval == 0 || c.Queue.PriorityScheduling,
+		"queue.aging_interval requires queue.priority_scheduling")
+	check(len(c.Queue.TenantWeights) == 0 || c.Queue.FairShare,
+		"queue.tenant_weights requires queue.fair_share")
+	for tenant, weight := range c.Queue.TenantWeights {
+		check(weight > 0, "queue.tenant_weights.%s must be positive", tenant)
+	}
+	for tenant, limit := range c.Queue.TenantLimits {
+		check(limit > 0, "queue.tenant_limits.%s must be positive", tenant)
+	}
+	check(c.Queue.DefaultTenantLimit >= 0, "queue.default_tenant_limit must not be negative")
+
+	retry := c.Queue.Retry
+	check(retry.MaxAttempts >= 0, "queue.retry.max_attempts must not be negative")
+	check(retry.MaxAttempts < 2 || retry.InitialBackoff > 0,
+		"queue.retry.initial_backoff is required when retrying")
+	check(retry.MaxBackoff >= 0, "queue.retry.max_backoff must not be negative")
+	check(retry.Multiplier == 0 || retry.Multiplier >= 1, "queue.retry.multiplier must be at least 1")
+	check(retry.Jitter >= 0 && retry.Jitter <= 1, "queue.retry.jitter must be between 0 and 1")
+
+	hooks := c.Webhooks
+	check(hooks.Timeout > 0, "webhooks.timeout must be positive")
+	check(hooks.MaxAttempts > 0, "webhooks.max_attempts must be positive")
+	check(hooks.InitialBackoff >= 0, "webhooks.initial_backoff must not be negative")
+	check(hooks.MaxBackoff >= 0, "webhooks.max_backoff must not be negative")
+	for i, hook := range hooks.Endpoints {
+		u, err := url.Parse(hook.URL)
+		check(err == nil && (u.Scheme == "http" || u.Scheme == "https") && u.Host != "",
+			"webhooks.endpoints[%d].url %q must be an http or https URL", i, hook.URL)
+		for _, event := range hook.Events {
+			_, err := webhook.ParseEvent(event)
+			check(err == nil, "webhooks.endpoints[%d].events: %v", i, err)
+		}
+	}
+
+	if len(c.Costs.Prices) > 0 {
+		_, ok := c.Costs.Prices[c.Instance.InstanceType]
+		check(ok, "costs.prices has no price for instance.instance_type %q", c.Instance.InstanceType)
+		for i, factory := range c.Factories {
+			if factory.InstanceType == "" || factory.Local != "" {
+				continue
+			}
+			_, ok := c.Costs.Prices[factory.InstanceType]
+			check(ok, "costs.prices has no price for factories[%d].instance_type %q", i, factory.InstanceType)
+		}
+	}
+	for instanceType, price := range c.Costs.Prices {
+		check(price.Spot >= 0 && price.OnDemand >= 0, "costs.prices.%s must not be negative", instanceType)
+	}
+
+	budgets := c.Budgets
+	check(budgets.CheckInterval > 0, "budgets.check_interval must be positive")
+	_, err := time.LoadLocation(budgets.Timezone)
+	check(err == nil, "budgets.timezone %q is not a known time zone", budgets.Timezone)
+	check(len(budgets.Limits) == 0 || len(c.Costs.Prices) > 0, "budgets.limits require costs.prices")
+	names := make(map[string]bool, len(budgets.Limits))
+	for i, limit := range budgets.Limits {
+		check(limit.Name != "", "budgets.limits[%d].name is required", i)
+		check(!names[limit.Name], "budgets.limits[%d].name %q is not unique", i, limit.Name)
+		names[limit.Name] = true
+
+		switch budget.Period(limit.Period) {
+		case budget.Daily, budget.Monthly, budget.Batch:
+		default:
+			check(false, "budgets.limits[%d].period %q must be daily, monthly or batch", i, limit.Period)
+		}
+		check(limit.Soft >= 0 && limit.Hard >= 0, "budgets.limits[%d] must not be negative", i)
+		check(limit.Soft > 0 || limit.Hard > 0, "budgets.limits[%d] requires a soft or hard limit", i)
+		check(limit.Hard == 0 || limit.Soft <= limit.Hard, "budgets.limits[%d].soft exceeds its hard limit", i)
+	}
+
+	scale := c.Autoscale
+	check(scale.TargetWait >= 0, "autoscale.target_wait must not be negative")
+	if scale.TargetWait > 0 {
+		check(scale.Interval > 0, "autoscale.interval must be positive")
+		check(scale.MinSize >= 0, "autoscale.min_size must not be negative")
+		check(scale.MaxSize == 0 || scale.MaxSize >= scale.MinSize,
+			"autoscale.min_size (%d) exceeds autoscale.max_size (%d)", scale.MinSize, scale.MaxSize)
+		check(scale.MinWarm >= 0, "autoscale.min_warm must not be negative")
+		check(scale.ScaleUpCooldown >= 0 && scale.ScaleDownCooldown >= 0, "autoscale cooldowns must not be negative")
+	}
+
+	if len(problems) > 0 {
+		return &ValidationError{Problems: problems}
+	}
+	return nil
+}
+
+// InstanceParams returns the parameters of worker instances
+func (c *Config) InstanceParams() (*ec2.RunInstancesInput, error) {
+	return c.instanceParams(FactoryConfig{})
+}
+
+// instanceParams returns the parameters of the instances of factory
+func (c *Config) instanceParams(factory FactoryConfig) (*ec2.RunInstancesInput, error) {
+	instanceType := c.Instance.InstanceType
+	if factory.InstanceType != "" {
+		instanceType = factory.InstanceType
+	}
+	market := c.Instance.Market
+	if factory.Market != "" {
+		market = factory.Market
+	}
+
+	var userData string
+	if c.Instance.UserDataFile != "" {
+		data, err := os.ReadFile(c.Instance.UserDataFile)
+		if err != nil {
+			return nil, err
+		}
+		userData = base64.StdEncoding.EncodeToString(data)
+	} else {
+		var err error
+		userData, err = awsworker.NewUserData(c.Worker.Port, c.labels(factory))
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	params := &ec2.RunInstancesInput{
+		MinCount:         aws.Int32(1),
+		MaxCount:         aws.Int32(1),
+		ImageId:          aws.String(c.Instance.ImageID),
+		InstanceType:     types.InstanceType(instanceType),
+		SecurityGroupIds: c.Instance.SecurityGroupIDs,
+		UserData:         aws.String(userData),
+	}
+	if market == MarketSpot {
+		params.InstanceMarketOptions = &types.InstanceMarketOptionsRequest{
+			MarketType: types.MarketTypeSpot,
+		}
+	}
+	if c.Instance.KeyName != "" {
+		params.KeyName = aws.String(c.Instance.KeyName)
+	}
+	if c.Instance.SubnetID != "" {
+		params.SubnetId = aws.String(c.Instance.SubnetID)
+	}
+	if c.Instance.IAMInstanceProfile != "" {
+		params.IamInstanceProfile = &types.IamInstanceProfileSpecification{
+			Name: aws.String(c.Instance.IAMInstanceProfile),
+		}
+	}
+	return params, nil
+}
+
+// launchesInstances reports whether a factory launches instances
+func (c *Config) launchesInstances() bool {
+	if len(c.Factories) == 0 {
+		return true
+	}
+	for _, factory := range c.Factories {
+		if factory.Local == "" {
+			return true
+		}
+	}
+	return false
+}
+
+// labels returns the labels advertised by the workers of factory
+func (c *Config) labels(factory FactoryConfig) map[string]string {
+	if len(factory.Labels) == 0 {
+		return c.Worker.Labels
+	}
+
+	labels := make(map[string]string, len(c.Worker.Labels)+len(factory.Labels))
+	for key, value := range c.Worker.Labels {
+		labels[key] = value
+	}
+	for key, value := range factory.Labels {
+		labels[key] = value
+	}
+	return labels
+}
+
+// NamedFactories returns the factories of the worker pool. create creates the
+// WorkerFactory of instances launched with params. Local factories log to
+// logger.
+func (c *Config) NamedFactories(logger *zap.Logger, create func(params *ec2.RunInstancesInput) compute.WorkerFactory) ([]compute.NamedFactory, error) {
+	if len(c.Factories) == 0 {
+		params, err := c.InstanceParams()
+		if err != nil {
+			return nil, err
+		}
+		return []compute.NamedFactory{{Name: compute.DefaultFactoryName, Factory: create(params)}}, nil
+	}
+
+	factories := make([]compute.NamedFactory, len(c.Factories))
+	for i, factory := range c.Factories {
+		var workerFactory compute.WorkerFactory
+		if factory.Local != "" {
+			workerFactory = c.localFactory(logger, factory)
+		} else {
+			params, err := c.instanceParams(factory)
+			if err != nil {
+				return nil, err
+			}
+			workerFactory = create(params)
+		}
+
+		factories[i] = compute.NamedFactory{
+			Name:       factory.Name,
+			Factory:    workerFactory,
+			MaxWorkers: factory.MaxWorkers,
+			Priority:   factory.Priority,
+		}
+		if caps := factory.Capabilities; caps != nil {
+			factories[i].Capabilities = &compute.Capabilities{
+				Scratch: caps.ScratchGiB * compute.GiB,
+				Threads: caps.Threads,
+				Labels:  c.labels(factory),
+			}
+			if caps.GPU != "" {
+				factories[i].Capabilities.GPUs = []string{caps.GPU}
+			}
+		}
+	}
+	return factories, nil
+}
+
+// localFactory returns the factory of the local workers of factory
+func (c *Config) localFactory(logger *zap.Logger, factory FactoryConfig) compute.WorkerFactory {
+	labels := c.labels(factory)
+	keys := make([]string, 0, len(labels))
+	for key := range labels {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	var args []string
+	for _, key := range keys {
+		args = append(args, "-label", key+"="+labels[key])
+	}
+
+	return local.NewWorkerFactory(logger.With(zap.String("factory", factory.Name)), factory.Local,
+		local.WithArgs(args...),
+		local.WithOutput(os.Stderr))
+}
+
+// Router returns the router of the worker pool, or nil if no routes are
+// configured
+func (c *Config) Router() compute.Router {
+	if len(c.Routes) == 0 {
+		return nil
+	}
+
+	rules := make([]compute.RouteRule, len(c.Routes))
+	for i, route := range c.Routes {
+		rules[i] = compute.RouteRule{
+			Match: compute.Requirements{
+				GPU:        route.GPU,
+				GPUVendor:  route.GPUVendor,
+				MinScratch: route.ScratchGiB * compute.GiB,
+				MinThreads: route.Threads,
+				Labels:     route.Labels,
+			},
+			Factories: route.Factories,
+		}
+	}
+	return compute.RouteRules(rules...)
+}
+
+// PoolOptions returns the options of the worker pool
+func (c *Config) PoolOptions() []compute.PoolOptionsFunc {
+	opts := []compute.PoolOptionsFunc{
+		compute.WithMaxWorkers(c.Pool.MaxWorkers),
+		compute.WithMinWarm(c.Pool.MinWarm),
+		compute.WithIdleTimeout(time.Duration(c.Pool.IdleTimeout)),
+		compute.WithReapInterval(time.Duration(c.Pool.ReapInterval)),
+		compute.WithHealthCheckInterval(time.Duration(c.Pool.HealthCheckInterval)),
+		compute.WithHealthCheckTimeout(time.Duration(c.Pool.HealthCheckTimeout)),
+		compute.WithHealthCheckThreshold(c.Pool.HealthCheckThreshold),
+	}
+	if c.Pool.FailWhenExhausted {
+		opts = append(opts, compute.WithFailWhenExhausted())
+	}
+	if router := c.Router(); router != nil {
+		opts = append(opts, compute.WithRouter(router))
+	}
+	return opts
+}
+
+// QueueOptions returns the options of the work queue
+func (c *Config) QueueOptions() []compute.QueueOptionsFunc {
+	var opts []compute.QueueOptionsFunc
+	if c.Queue.PriorityScheduling {
+		opts = append(opts, compute.WithPriorityScheduling(time.Duration(c.Queue.AgingInterval)))
+	}
+	if c.Queue.FairShare {
+		opts = append(opts, compute.WithFairShare(c.Queue.TenantWeights))
+	}
+	for tenant, limit := range c.Queue.TenantLimits {
+		opts = append(opts, compute.WithTenantLimit(tenant, limit))
+	}
+	if c.Queue.DefaultTenantLimit > 0 {
+		opts = append(opts, compute.WithDefaultTenantLimit(c.Queue.DefaultTenantLimit))
+	}
+	if c.Queue.Retry.MaxAttempts > 1 {
+		opts = append(opts, compute.WithRetryPolicy(compute.RetryPolicy{
+			MaxAttempts:    c.Queue.Retry.MaxAttempts,
+			InitialBackoff: time.Duration(c.Queue.Retry.InitialBackoff),
+			MaxBackoff:     time.Duration(c.Queue.Retry.MaxBackoff),
+			Multiplier:     c.Queue.Retry.Multiplier,
+			Jitter:         c.Queue.Retry.Jitter,
+		}))
+	}
+	return opts
+}
+
+// WebhookEndpoints returns the endpoints notified of job events
+func (c *Config) WebhookEndpoints() []webhook.Endpoint {
+	endpoints := make([]webhook.Endpoint, 0, len(c.Webhooks.Endpoints))
+	for _, hook := range c.Webhooks.Endpoints {
+		endpoint := webhook.Endpoint{URL: hook.URL, Secret: hook.Secret}
+		for _, name := range hook.Events {
+			// Events are checked by Validate
+			event, _ := webhook.ParseEvent(name)
+			endpoint.Events = append(endpoint.Events, event)
+		}
+		endpoints = append(endpoints, endpoint)
+	}
+	return endpoints
+}
+
+// WebhookOptions returns the options of the webhook notifier
+func (c *Config) WebhookOptions() []webhook.OptionsFunc {
+	return []webhook.OptionsFunc{
+		webhook.WithTimeout(time.Duration(c.Webhooks.Timeout)),
+		webhook.WithRetry(c.Webhooks.MaxAttempts,
+			time.Duration(c.Webhooks.InitialBackoff),
+			time.Duration(c.Webhooks.MaxBackoff)),
+	}
+}
+
+// Prices returns the price table of instance types
+func (c *Config) Prices() cost.Prices {
+	prices := make(cost.Prices, len(c.Costs.Prices))
+	for instanceType, price := range c.Costs.Prices {
+		prices[instanceType] = cost.Price{Spot: price.Spot, OnDemand: price.OnDemand}
+	}
+	return prices
+}
+
+// BudgetLimits returns the spend limits of workers
+func (c *Config) BudgetLimits() []budget.Budget {
+	budgets := make([]budget.Budget, 0, len(c.Budgets.Limits))
+	for _, limit := range c.Budgets.Limits {
+		budgets = append(budgets, budget.Budget{
+			Name:   limit.Name,
+			Period: budget.Period(limit.Period),
+			Soft:   limit.Soft,
+			Hard:   limit.Hard,
+		})
+	}
+	return budgets
+}
+
+// BudgetOptions returns the options of the budget guard
+func (c *Config) BudgetOptions() []budget.OptionsFunc {
+	opts := []budget.OptionsFunc{
+		budget.WithCheckInterval(time.Duration(c.Budgets.CheckInterval)),
+	}
+	// The time zone is checked by Validate
+	if loc, err := time.LoadLocation(c.Budgets.Timezone); err == nil {
+		opts = append(opts, budget.WithLocation(loc))
+	}
+	return opts
+}
+
+// Autoscaler returns the autoscaler of the queue, or nil if autoscaling is
+// disabled
+func (c *Config) Autoscaler() autoscale.Autoscaler {
+	if c.Autoscale.TargetWait <= 0 {
+		return nil
+	}
+	return autoscale.NewTargetTracking(time.Duration(c.Autoscale.TargetWait),
+		autoscale.WithSizeRange(c.Autoscale.MinSize, c.Autoscale.MaxSize),
+		autoscale.WithMinWarm(c.Autoscale.MinWarm),
+		autoscale.WithCooldowns(time.Duration(c.Autoscale.ScaleUpCooldown), time.Duration(c.Autoscale.ScaleDownCooldown)))
+}
+
+// AutoscaleOptions returns the options of the autoscaling controller
+func (c *Config) AutoscaleOptions() []autoscale.OptionsFunc {
+	return []autoscale.OptionsFunc{
+		autoscale.WithInterval(time.Duration(c.Autoscale.Interval)),
+	}
+}
@@ -0,0 +1,258 @@
+package config
+
+import (
+	"encoding/base64"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/service/ec2"
+	"github.com/aws/aws-sdk-go-v2/service/ec2/types"
+	m "github.com/launchdarkly/go-test-helpers/v2/matchers"
+	"go.uber.org/zap/zaptest"
+
+	"github.com/ansg191/remote-worker/internal/budget"
+	"github.com/ansg191/remote-worker/internal/compute"
+	"github.com/ansg191/remote-worker/internal/manager"
+	"github.com/ansg191/remote-worker/internal/worker/local"
+)
+
+func writeConfig(t *testing.T, content string) string {
+	t.Helper()
+
+	path := filepath.Join(t.TempDir(), "manager.yaml")
+	err := os.WriteFile(path, []byte(content), 0o600)
+	m.For(t, "write err").Require(err, m.BeNil())
+	return path
+}
+
+func TestLoad_example(t *testing.T) {
+	c, err := Load("../../cmd/manager/manager.example.yaml")
+	m.For(t, "load err").Require(err, m.BeNil())
+
+	m.For(t, "region").Assert(c.Region, m.Equal("us-west-2"))
+	m.For(t, "shutdown timeout").Assert(c.Manager.ShutdownTimeout, m.Equal(Duration(5*time.Minute)))
+	m.For(t, "security groups").Assert(c.Instance.SecurityGroupIDs, m.Length().Should(m.Equal(1)))
+	m.For(t, "tenant weights").Assert(c.Queue.TenantWeights["studio"], m.Equal(3))
+	m.For(t, "retry jitter").Assert(c.Queue.Retry.Jitter, m.Equal(0.2))
+
+	endpoints := c.WebhookEndpoints()
+	m.For(t, "webhooks").Require(endpoints, m.Length().Should(m.Equal(1)))
+	m.For(t, "webhook events").Assert(endpoints[0].Events, m.Equal([]manager.JobEventType{manager.JobSucceeded, manager.JobFailed}))
+
+	m.For(t, "spot price").Assert(c.Prices()["g4dn.xlarge"].Spot, m.Equal(0.1578))
+
+	budgets := c.BudgetLimits()
+	m.For(t, "budgets").Require(budgets, m.Length().Should(m.Equal(3)))
+	m.For(t, "budget period").Assert(budgets[2].Period, m.Equal(budget.Batch))
+	m.For(t, "budget options").Assert(c.BudgetOptions(), m.Length().Should(m.Equal(2)))
+	m.For(t, "autoscaler").Assert(c.Autoscaler(), m.Not(m.BeNil()))
+
+	m.For(t, "factories").Assert(c.Factories, m.Length().Should(m.Equal(2)))
+	m.For(t, "pool options").Assert(c.PoolOptions(), m.Length().Should(m.Equal(8)))
+	m.For(t, "queue options").Assert(c.QueueOptions(), m.Length().Should(m.Equal(4)))
+}
+
+func TestLoad_defaults(t *testing.T) {
+	c, err := Load(writeConfig(t, "instance:\n  image_id: ami-test\n"))
+	m.For(t, "load err").Require(err, m.BeNil())
+
+	m.For(t, "addr").Assert(c.Manager.Addr, m.Equal(":8080"))
+	m.For(t, "port").Assert(c.Worker.Port, m.Equal(uint16(443)))
+	m.For(t, "market").Assert(c.Instance.Market, m.Equal(MarketSpot))
+	m.For(t, "max size").Assert(c.Queue.MaxSize, m.Equal(2))
+	m.For(t, "queue options").Assert(c.QueueOptions(), m.Length().Should(m.Equal(0)))
+	m.For(t, "autoscaler").Assert(c.Autoscaler(), m.BeNil())
+}
+
+func TestLoad_unknownField(t *testing.T) {
+	_, err := Load(writeConfig(t, "instance:\n  image_id: ami-test\n  imageid: typo\n"))
+	m.For(t, "load err").Require(err, m.Not(m.BeNil()))
+	m.For(t, "message").Assert(strings.Contains(err.Error(), "imageid"), m.Equal(true))
+}
+
+func TestLoad_env(t *testing.T) {
+	t.Setenv("RW_INSTANCE_IMAGE_ID", "ami-env")
+	t.Setenv("RW_POOL_MAX_WORKERS", "8")
+	t.Setenv("RW_POOL_IDLE_TIMEOUT", "90s")
+	t.Setenv("RW_WORKER_PORT", "8443")
+	t.Setenv("RW_INSTANCE_SECURITY_GROUP_IDS", "sg-1, sg-2")
+	t.Setenv("RW_QUEUE_FAIR_SHARE", "true")
+	t.Setenv("RW_QUEUE_TENANT_WEIGHTS", "a=2,b=1")
+
+	c, err := Load(writeConfig(t, "instance:\n  image_id: ami-file\npool:\n  max_workers: 2\n"))
+	m.For(t, "load err").Require(err, m.BeNil())
+
+	m.For(t, "image id").Assert(c.Instance.ImageID, m.Equal("ami-env"))
+	m.For(t, "max workers").Assert(c.Pool.MaxWorkers, m.Equal(8))
+	m.For(t, "idle timeout").Assert(c.Pool.IdleTimeout, m.Equal(Duration(90*time.Second)))
+	m.For(t, "port").Assert(c.Worker.Port, m.Equal(uint16(8443)))
+	m.For(t, "security groups").Assert(c.Instance.SecurityGroupIDs, m.Equal([]string{"sg-1", "sg-2"}))
+	m.For(t, "tenant weights").Assert(c.Queue.TenantWeights, m.Equal(map[string]int{"a": 2, "b": 1}))
+
+	t.Setenv("RW_FACTORIES", "spot")
+	_, err = Load("")
+	m.For(t, "object list err").Require(err, m.Not(m.BeNil()))
+	m.For(t, "object list message").Assert(strings.Contains(err.Error(), "configuration file"), m.Equal(true))
+	os.Unsetenv("RW_FACTORIES")
+
+	t.Setenv("RW_POOL_MAX_WORKERS", "many")
+	_, err = Load("")
+	m.For(t, "invalid env err").Require(err, m.Not(m.BeNil()))
+	m.For(t, "invalid env message").Assert(strings.Contains(err.Error(), "pool.max_workers"), m.Equal(true))
+}
+
+func TestConfig_Validate(t *testing.T) {
+	c := Default()
+	c.Instance.Market = "reserved"
+	c.Worker.Labels = map[string]string{"tier": "very fast"}
+	c.Pool.MaxWorkers = 1
+	c.Pool.MinWarm = 2
+	c.Queue.MaxSize = 0
+	c.Queue.TenantWeights = map[string]int{"a": 1}
+	c.Webhooks.Endpoints = []WebhookConfig{{URL: "cms.example.com", Events: []string{"done"}}}
+	c.Factories = []FactoryConfig{
+		{Name: "gpu", InstanceType: "p3.2xlarge", MaxWorkers: -1},
+		{Name: "gpu", Market: "reserved", InstanceType: "c6i.large"},
+	}
+	c.Routes = []RouteConfig{{GPU: true}, {Factories: []string{"cpu"}}}
+	c.Costs.Prices = map[string]PriceConfig{"p3.2xlarge": {Spot: 1}}
+	c.Budgets.Limits = []BudgetConfig{
+		{Name: "daily", Period: "weekly", Hard: 10},
+		{Name: "daily", Period: "daily", Soft: 20, Hard: 10},
+	}
+	c.Autoscale.TargetWait = Duration(10 * time.Minute)
+	c.Autoscale.MinSize = 4
+	c.Autoscale.MaxSize = 2
+
+	err := c.Validate()
+	var verr *ValidationError
+	m.For(t, "error type").Require(errors.As(err, &verr), m.Equal(true))
+	m.For(t, "problems").Assert(verr.Problems, m.Equal([]string{
+		`worker.labels tier=very fast may only contain letters, digits and ._/-`,
+		`instance.image_id is required`,
+		`instance.market "reserved" must be "spot" or "on-demand"`,
+		`pool.min_warm (2) exceeds pool.max_workers (1)`,
+		`factories[0].max_workers must not be negative`,
+		`factories[1].name "gpu" is not unique`,
+		`factories[1].market "reserved" must be "spot" or "on-demand"`,
+		`routes[0].factories is required`,
+		`routes[1].factories: unknown factory "cpu"`,
+		`queue.max_size must be positive`,
+		`queue.tenant_weights requires queue.fair_share`,
+		`webhooks.endpoints[0].url "cms.example.com" must be an http or https URL`,
+		`webhooks.endpoints[0].events: unknown job event "done"`,
+		`costs.prices has no price for instance.instance_type "g4dn.xlarge"`,
+		`costs.prices has no price for factories[1].instance_type "c6i.large"`,
+		`budgets.limits[0].period "weekly" must be daily, monthly or batch`,
+		`budgets.limits[1].name "daily" is not unique`,
+		`budgets.limits[1].soft exceeds its hard limit`,
+		`autoscale.min_size (4) exceeds autoscale.max_size (2)`,
+	}))
+}
+
+func TestConfig_InstanceParams(t *testing.T) {
+	c := Default()
+	c.Instance.ImageID = "ami-test"
+	c.Instance.Market = MarketOnDemand
+	c.Instance.IAMInstanceProfile = "worker"
+	c.Worker.Port = 8443
+	c.Worker.Labels = map[string]string{"tier": "fast"}
+
+	params, err := c.InstanceParams()
+	m.For(t, "params err").Require(err, m.BeNil())
+	m.For(t, "image id").Assert(*params.ImageId, m.Equal("ami-test"))
+	m.For(t, "instance type").Assert(params.InstanceType, m.Equal(types.InstanceTypeG4dnXlarge))
+	m.For(t, "market").Assert(params.InstanceMarketOptions, m.BeNil())
+	m.For(t, "profile").Assert(*params.IamInstanceProfile.Name, m.Equal("worker"))
+
+	userData, err := base64.StdEncoding.DecodeString(*params.UserData)
+	m.For(t, "decode err").Require(err, m.BeNil())
+	m.For(t, "user data port").Assert(strings.Contains(string(userData), "-p 8443"), m.Equal(true))
+	m.For(t, "user data labels").Assert(strings.Contains(string(userData), "-label tier=fast"), m.Equal(true))
+
+	c.Instance.UserDataFile = writeConfig(t, "#!/bin/sh\n")
+	params, err = c.InstanceParams()
+	m.For(t, "file params err").Require(err, m.BeNil())
+	m.For(t, "file user data").Assert(*params.UserData, m.Equal(base64.StdEncoding.EncodeToString([]byte("#!/bin/sh\n"))))
+}
+
+func TestConfig_NamedFactories(t *testing.T) {
+	c := Default()
+	c.Instance.ImageID = "ami-test"
+	c.Worker.Labels = map[string]string{"region": "us-west-2"}
+
+	var params []*ec2.RunInstancesInput
+	create := func(p *ec2.RunInstancesInput) compute.WorkerFactory {
+		params = append(params, p)
+		return nil
+	}
+
+	factories, err := c.NamedFactories(zaptest.NewLogger(t), create)
+	m.For(t, "default err").Require(err, m.BeNil())
+	m.For(t, "default factories").Require(factories, m.Length().Should(m.Equal(1)))
+	m.For(t, "default name").Assert(factories[0].Name, m.Equal(compute.DefaultFactoryName))
+	m.For(t, "no router").Assert(c.Router() == nil, m.Equal(true))
+
+	c.Factories = []FactoryConfig{
+		{Name: "cpu", InstanceType: "c6i.2xlarge", Market: MarketOnDemand, MaxWorkers: 2, Labels: map[string]string{"class": "cpu"}},
+		{Name: "gpu", Priority: 1, Capabilities: &CapabilitiesConfig{GPU: "NVIDIA", ScratchGiB: 100}},
+	}
+	c.Routes = []RouteConfig{{GPU: true, Factories: []string{"gpu"}}}
+
+	params = nil
+	factories, err = c.NamedFactories(zaptest.NewLogger(t), create)
+	m.For(t, "err").Require(err, m.BeNil())
+	m.For(t, "factories").Require(factories, m.Length().Should(m.Equal(2)))
+	m.For(t, "params").Require(params, m.Length().Should(m.Equal(2)))
+
+	m.For(t, "cpu max workers").Assert(factories[0].MaxWorkers, m.Equal(2))
+	m.For(t, "cpu capabilities").Assert(factories[0].Capabilities, m.BeNil())
+	m.For(t, "cpu instance type").Assert(params[0].InstanceType, m.Equal(types.InstanceTypeC6i2xlarge))
+	m.For(t, "cpu market").Assert(params[0].InstanceMarketOptions, m.BeNil())
+	userData, err := base64.StdEncoding.DecodeString(*params[0].UserData)
+	m.For(t, "decode err").Require(err, m.BeNil())
+	m.For(t, "cpu labels").Assert(strings.Contains(string(userData), "-label class=cpu"), m.Equal(true))
+	m.For(t, "worker labels").Assert(strings.Contains(string(userData), "-label region=us-west-2"), m.Equal(true))
+
+	m.For(t, "gpu priority").Assert(factories[1].Priority, m.Equal(1))
+	m.For(t, "gpu instance type").Assert(params[1].InstanceType, m.Equal(types.InstanceTypeG4dnXlarge))
+	m.For(t, "gpu market").Assert(params[1].InstanceMarketOptions, m.Not(m.BeNil()))
+	m.For(t, "gpu capabilities").Assert(*factories[1].Capabilities, m.Equal(compute.Capabilities{
+		GPUs:    []string{"NVIDIA"},
+		Scratch: 100 * compute.GiB,
+		Labels:  map[string]string{"region": "us-west-2"},
+	}))
+
+	router := c.Router()
+	m.For(t, "router").Require(router, m.Not(m.BeNil()))
+	m.For(t, "gpu route").Assert(router(compute.Requirements{GPU: true}), m.Equal([]string{"gpu"}))
+	m.For(t, "no route").Assert(router(compute.Requirements{}), m.BeNil())
+}
+
+func TestConfig_NamedFactories_local(t *testing.T) {
+	c := Default()
+	c.Factories = []FactoryConfig{{Name: "laptop", Local: "/usr/local/bin/worker", MaxWorkers: 2}}
+
+	// Local workers need no image
+	m.For(t, "validate err").Require(c.Validate(), m.BeNil())
+
+	factories, err := c.NamedFactories(zaptest.NewLogger(t), func(*ec2.RunInstancesInput) compute.WorkerFactory {
+		t.Fatal("instance factory created")
+		return nil
+	})
+	m.For(t, "err").Require(err, m.BeNil())
+	m.For(t, "factories").Require(factories, m.Length().Should(m.Equal(1)))
+	_, ok := factories[0].Factory.(*local.WorkerFactory)
+	m.For(t, "local factory").Assert(ok, m.Equal(true))
+	m.For(t, "max workers").Assert(factories[0].MaxWorkers, m.Equal(2))
+
+	c.Factories = append(c.Factories, FactoryConfig{Name: "ec2"})
+	err = c.Validate()
+	var verr *ValidationError
+	m.For(t, "error type").Require(errors.As(err, &verr), m.Equal(true))
+	m.For(t, "problems").Assert(verr.Problems, m.Equal([]string{`instance.image_id is required`}))
+}
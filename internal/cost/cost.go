@@ -0,0 +1,440 @@
+package cost
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/ansg191/remote-worker/internal/compute"
+)
+
+// Price is the hourly price of an instance type in each market
+type Price struct {
+	Spot     float64
+	OnDemand float64
+}
+
+// Prices maps instance types to their Price
+type Prices map[string]Price
+
+// Hourly returns the hourly price of instanceType in market
+func (p Prices) Hourly(instanceType, market string) (float64, bool) {
+	price, ok := p[instanceType]
+	if !ok {
+		return 0, false
+	}
+
+	switch market {
+	case compute.MarketSpot:
+		return price.Spot, true
+	case compute.MarketOnDemand:
+		return price.OnDemand, true
+	default:
+		return 0, false
+	}
+}
+
+// JobCost is the cost of a job
+type JobCost struct {
+	Tenant string
+	// Busy is how long the job ran on workers, over all attempts
+	Busy time.Duration
+	// Idle is the job's share of the idle time of the workers it ran on. It
+	// is settled when a worker is terminated.
+	Idle time.Duration
+	// BusyCost and IdleCost are the prices of Busy and Idle
+	BusyCost float64
+	IdleCost float64
+}
+
+// Total returns the total cost of the job
+func (c JobCost) Total() float64 {
+	return c.BusyCost + c.IdleCost
+}
+
+// TenantCost is the total cost of the jobs of a tenant
+type TenantCost struct {
+	Tenant string
+	Jobs   int
+	Cost   float64
+}
+
+// Accountant attributes the runtime of workers, from launch until removal, to
+// the work that ran on them. Work is charged for the time it ran at the price
+// of its worker. The idle time of a worker is shared by the work that ran on
+// it, in proportion to how long it ran. Idle time of workers that ran no work
+// is unattributed.
+//
+// Workers are fed with HandlePoolEvent and HandleQueueEvent. Workers
+// implementing compute.Instance are priced from Prices; others are free.
+//
+// Only the last Options.MaxJobs finished jobs are kept, and runtimes of
+// terminated workers are dropped once they are older than the longest window
+// asked for by Spend.
+type Accountant struct {
+	logger  *zap.Logger
+	prices  Prices
+	options Options
+
+	mtx          sync.Mutex // Mutex for below fields
+	instances    map[compute.Worker]*instance
+	running      map[compute.WorkID]*instance // Instance running work
+	jobs         map[compute.WorkID]*job
+	settled      []compute.WorkID       // Settled jobs, oldest first
+	evicted      map[string]*TenantCost // Costs of evicted jobs by tenant
+	unattributed float64
+	total        float64
+	terminated   []runtime     // Runtimes of terminated priced workers
+	window       time.Duration // Longest window asked for by Spend
+	latest       time.Time     // Latest time seen
+}
+
+// job is the cost of a job and what it is still waiting for to be settled
+type job struct {
+	JobCost
+	finished bool
+	workers  int  // Live instances the job ran on
+	queued   bool // Whether the job is in settled
+}
+
+// runtime is the billed runtime of a worker
+type runtime struct {
+	launched time.Time
+	removed  time.Time
+	hourly   float64
+}
+
+type instance struct {
+	launched time.Time
+	hourly   float64
+
+	work    compute.WorkID // Work running on the instance, if any
+	started time.Time      // Start of work
+	busy    map[compute.WorkID]time.Duration
+}
+
+func New(logger *zap.Logger, prices Prices, opts ...OptionsFunc) *Accountant {
+	options := Options{
+		Retention: 24 * time.Hour,
+		MaxJobs:   10000,
+	}
+
+	for _, opt := range opts {
+		opt(&options)
+	}
+
+	return &Accountant{
+		logger:    logger,
+		prices:    prices,
+		options:   options,
+		instances: make(map[compute.Worker]*instance),
+		running:   make(map[compute.WorkID]*instance),
+		jobs:      make(map[compute.WorkID]*job),
+		evicted:   make(map[string]*TenantCost),
+	}
+}
+
+func (a *Accountant) HandlePoolEvent(event compute.PoolEvent) {
+	a.mtx.Lock()
+	defer a.mtx.Unlock()
+
+	switch event.Type {
+	case compute.WorkerCreated:
+		a.instance(event.Worker, event.Time.Add(-event.Duration))
+	case compute.WorkerRemoved:
+		// Reattached workers are only known once removed
+		inst := a.instance(event.Worker, event.Time)
+		a.stop(inst, event.Time)
+		a.settle(inst, event.Time)
+		if inst.hourly > 0 {
+			a.terminated = append(a.terminated, runtime{
+				launched: inst.launched,
+				removed:  event.Time,
+				hourly:   inst.hourly,
+			})
+		}
+		delete(a.instances, event.Worker)
+
+		for id := range inst.busy {
+			a.jobs[id].workers--
+			a.release(id)
+		}
+		a.prune(event.Time)
+	}
+}
+
+func (a *Accountant) HandleQueueEvent(event compute.QueueEvent) {
+	a.mtx.Lock()
+	defer a.mtx.Unlock()
+
+	// A retried attempt may start on another worker without a finished event
+	if inst, ok := a.running[event.WorkID]; ok && inst.work == event.WorkID {
+		a.stop(inst, event.Time)
+	}
+
+	switch event.Type {
+	case compute.WorkStarted:
+		j, ok := a.jobs[event.WorkID]
+		if !ok {
+			j = &job{JobCost: JobCost{Tenant: event.Tenant}}
+			a.jobs[event.WorkID] = j
+		}
+		j.finished = false
+
+		inst := a.instance(event.Worker, event.Time)
+		inst.work = event.WorkID
+		inst.started = event.Time
+		a.running[event.WorkID] = inst
+	case compute.WorkFinished:
+		delete(a.running, event.WorkID)
+		if j, ok := a.jobs[event.WorkID]; ok {
+			j.finished = true
+			a.release(event.WorkID)
+		}
+	}
+}
+
+// instance returns the instance of worker, tracking it from launched if it is
+// not known.
+// a.mtx must be held.
+func (a *Accountant) instance(worker compute.Worker, launched time.Time) *instance {
+	if inst, ok := a.instances[worker]; ok {
+		return inst
+	}
+
+	inst := &instance{
+		launched: launched,
+		busy:     make(map[compute.WorkID]time.Duration),
+	}
+	if priced, ok := worker.(compute.Instance); ok {
+		if t := priced.LaunchTime(); !t.IsZero() {
+			inst.launched = t
+		}
+
+		hourly, ok := a.prices.Hourly(priced.InstanceType(), priced.Market())
+		if !ok {
+			a.logger.Warn("No price for instance type, its cost is not accounted",
+				zap.String("type", priced.InstanceType()),
+				zap.String("market", priced.Market()))
+		}
+		inst.hourly = hourly
+	}
+
+	a.instances[worker] = inst
+	return inst
+}
+
+// stop charges the work running on inst until t.
+// a.mtx must be held.
+func (a *Accountant) stop(inst *instance, t time.Time) {
+	if inst.work == "" {
+		return
+	}
+
+	d := t.Sub(inst.started)
+	if d < 0 {
+		d = 0
+	}
+	job := a.jobs[inst.work]
+	if _, ok := inst.busy[inst.work]; !ok {
+		job.workers++
+	}
+	inst.busy[inst.work] += d
+	job.Busy += d
+	job.BusyCost += a.price(inst, d)
+
+	delete(a.running, inst.work)
+	inst.work = ""
+}
+
+// settle shares the idle time of the removed inst among the work that ran on
+// it.
+// a.mtx must be held.
+func (a *Accountant) settle(inst *instance, removed time.Time) {
+	runtime := removed.Sub(inst.launched)
+	if runtime < 0 {
+		runtime = 0
+	}
+	a.total += a.price(inst, runtime)
+
+	var busy time.Duration
+	for _, d := range inst.busy {
+		busy += d
+	}
+	idle := runtime - busy
+	if idle <= 0 {
+		return
+	}
+
+	if busy == 0 {
+		a.unattributed += a.price(inst, idle)
+		return
+	}
+	for id, d := range inst.busy {
+		share := time.Duration(float64(idle) * float64(d) / float64(busy))
+		job := a.jobs[id]
+		job.Idle += share
+		job.IdleCost += a.price(inst, share)
+	}
+}
+
+func (a *Accountant) price(inst *instance, d time.Duration) float64 {
+	return inst.hourly * d.Hours()
+}
+
+// release queues the job id for eviction once it is settled, i.e. it finished
+// and all the workers it ran on were removed. The oldest settled jobs are
+// evicted beyond Options.MaxJobs, keeping their costs in their tenant's.
+// a.mtx must be held.
+func (a *Accountant) release(id compute.WorkID) {
+	j := a.jobs[id]
+	if !j.finished || j.workers > 0 || j.queued {
+		return
+	}
+	j.queued = true
+	a.settled = append(a.settled, id)
+
+	for len(a.settled) > a.options.MaxJobs {
+		id := a.settled[0]
+		a.settled = a.settled[1:]
+
+		j := a.jobs[id]
+		j.queued = false
+		// Retried since, queued again once settled
+		if !j.finished || j.workers > 0 {
+			continue
+		}
+
+		tenant, ok := a.evicted[j.Tenant]
+		if !ok {
+			tenant = &TenantCost{Tenant: j.Tenant}
+			a.evicted[j.Tenant] = tenant
+		}
+		tenant.Jobs++
+		tenant.Cost += j.Total()
+		delete(a.jobs, id)
+	}
+}
+
+// prune drops the runtimes of terminated workers that were removed before
+// the longest window asked for by Spend, or Options.Retention, ending at the
+// latest time seen.
+// a.mtx must be held.
+func (a *Accountant) prune(now time.Time) {
+	if now.After(a.latest) {
+		a.latest = now
+	}
+	keep := a.window
+	if keep < a.options.Retention {
+		keep = a.options.Retention
+	}
+	cutoff := a.latest.Add(-keep)
+
+	terminated := a.terminated[:0]
+	for _, r := range a.terminated {
+		if !r.removed.Before(cutoff) {
+			terminated = append(terminated, r)
+		}
+	}
+	for i := len(terminated); i < len(a.terminated); i++ {
+		a.terminated[i] = runtime{}
+	}
+	a.terminated = terminated
+}
+
+// Job returns the cost of work so far. Finished jobs may be evicted, see
+// Options.MaxJobs.
+func (a *Accountant) Job(id compute.WorkID) (JobCost, bool) {
+	a.mtx.Lock()
+	defer a.mtx.Unlock()
+
+	j, ok := a.jobs[id]
+	if !ok {
+		return JobCost{}, false
+	}
+	return j.JobCost, true
+}
+
+// Tenants returns the cost of the jobs of every tenant, ordered by tenant
+func (a *Accountant) Tenants() []TenantCost {
+	a.mtx.Lock()
+	defer a.mtx.Unlock()
+
+	byTenant := make(map[string]*TenantCost)
+	for _, evicted := range a.evicted {
+		tenant := *evicted
+		byTenant[tenant.Tenant] = &tenant
+	}
+	for _, job := range a.jobs {
+		tenant, ok := byTenant[job.Tenant]
+		if !ok {
+			tenant = &TenantCost{Tenant: job.Tenant}
+			byTenant[job.Tenant] = tenant
+		}
+		tenant.Jobs++
+		tenant.Cost += job.Total()
+	}
+
+	tenants := make([]TenantCost, 0, len(byTenant))
+	for _, tenant := range byTenant {
+		tenants = append(tenants, *tenant)
+	}
+	sort.Slice(tenants, func(i, j int) bool {
+		return tenants[i].Tenant < tenants[j].Tenant
+	})
+	return tenants
+}
+
+// Unattributed returns the cost of idle time of terminated workers that ran
+// no work
+func (a *Accountant) Unattributed() float64 {
+	a.mtx.Lock()
+	defer a.mtx.Unlock()
+	return a.unattributed
+}
+
+// Total returns the cost of all terminated workers
+func (a *Accountant) Total() float64 {
+	a.mtx.Lock()
+	defer a.mtx.Unlock()
+	return a.total
+}
+
+// Spend returns the cost of the runtime of all workers, running or
+// terminated, between since and until. Runtimes are kept for the longest
+// window asked for so far, see Options.Retention.
+func (a *Accountant) Spend(since, until time.Time) float64 {
+	a.mtx.Lock()
+	defer a.mtx.Unlock()
+
+	if window := until.Sub(since); window > a.window {
+		a.window = window
+	}
+	a.prune(until)
+
+	var spend float64
+	for _, inst := range a.instances {
+		spend += inst.hourly * overlap(inst.launched, until, since, until).Hours()
+	}
+	for _, r := range a.terminated {
+		spend += r.hourly * overlap(r.launched, r.removed, since, until).Hours()
+	}
+	return spend
+}
+
+// overlap returns how long the intervals [start, end) and [since, until)
+// overlap
+func overlap(start, end, since, until time.Time) time.Duration {
+	if start.Before(since) {
+		start = since
+	}
+	if end.After(until) {
+		end = until
+	}
+	if !end.After(start) {
+		return 0
+	}
+	return end.Sub(start)
+}
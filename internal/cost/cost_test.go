@@ -0,0 +1,203 @@
+package cost
+
+import (
+	"math"
+	"testing"
+	"time"
+
+	m "github.com/launchdarkly/go-test-helpers/v2/matchers"
+	"go.uber.org/zap/zaptest"
+
+	"github.com/ansg191/remote-worker/internal/compute"
+)
+
+// testInstance is a priced worker. Its Worker methods are never called.
+type testInstance struct {
+	*compute.MockWorker
+	instanceType string
+	market       string
+	launched     time.Time
+}
+
+func (w *testInstance) InstanceType() string {
+	return w.instanceType
+}
+
+func (w *testInstance) Market() string {
+	return w.market
+}
+
+func (w *testInstance) LaunchTime() time.Time {
+	return w.launched
+}
+
+// testPrices price a g4dn.xlarge spot instance at 0.001 per second
+var testPrices = Prices{
+	"g4dn.xlarge": {Spot: 3.6, OnDemand: 7.2},
+}
+
+var t0 = time.Date(2022, 9, 1, 12, 0, 0, 0, time.UTC)
+
+func at(secs int) time.Time {
+	return t0.Add(time.Duration(secs) * time.Second)
+}
+
+func assertCost(t *testing.T, name string, got, want float64) {
+	t.Helper()
+	if math.Abs(got-want) > 1e-9 {
+		t.Errorf("%s: got %v, want %v", name, got, want)
+	}
+}
+
+func TestPrices_Hourly(t *testing.T) {
+	price, ok := testPrices.Hourly("g4dn.xlarge", compute.MarketOnDemand)
+	m.For(t, "on-demand ok").Assert(ok, m.Equal(true))
+	m.For(t, "on-demand").Assert(price, m.Equal(7.2))
+
+	_, ok = testPrices.Hourly("p3.2xlarge", compute.MarketSpot)
+	m.For(t, "unknown type").Assert(ok, m.Equal(false))
+	_, ok = testPrices.Hourly("g4dn.xlarge", "reserved")
+	m.For(t, "unknown market").Assert(ok, m.Equal(false))
+}
+
+func TestAccountant(t *testing.T) {
+	a := New(zaptest.NewLogger(t), testPrices)
+	busy := &testInstance{instanceType: "g4dn.xlarge", market: compute.MarketSpot, launched: t0}
+	idle := &testInstance{instanceType: "g4dn.xlarge", market: compute.MarketSpot}
+
+	a.HandlePoolEvent(compute.PoolEvent{Type: compute.WorkerCreated, Worker: busy, Time: at(5), Duration: 5 * time.Second})
+	a.HandlePoolEvent(compute.PoolEvent{Type: compute.WorkerCreated, Worker: idle, Time: at(10), Duration: 10 * time.Second})
+
+	a.HandleQueueEvent(compute.QueueEvent{Type: compute.WorkStarted, WorkID: "1", Tenant: "a", Worker: busy, Time: at(10)})
+	a.HandleQueueEvent(compute.QueueEvent{Type: compute.WorkFinished, WorkID: "1", Tenant: "a", Time: at(40)})
+	a.HandleQueueEvent(compute.QueueEvent{Type: compute.WorkStarted, WorkID: "2", Tenant: "b", Worker: busy, Time: at(50)})
+	a.HandleQueueEvent(compute.QueueEvent{Type: compute.WorkFinished, WorkID: "2", Tenant: "b", Time: at(60)})
+
+	job, ok := a.Job("1")
+	m.For(t, "job ok").Require(ok, m.Equal(true))
+	m.For(t, "busy").Assert(job.Busy, m.Equal(30*time.Second))
+	assertCost(t, "busy cost", job.BusyCost, 0.03)
+	m.For(t, "idle before termination").Assert(job.Idle, m.Equal(time.Duration(0)))
+
+	a.HandlePoolEvent(compute.PoolEvent{Type: compute.WorkerRemoved, Worker: busy, Time: at(100)})
+	a.HandlePoolEvent(compute.PoolEvent{Type: compute.WorkerRemoved, Worker: idle, Time: at(20)})
+
+	// 60s of idle time are shared 3:1 by the jobs
+	job, _ = a.Job("1")
+	m.For(t, "idle").Assert(job.Idle, m.Equal(45*time.Second))
+	assertCost(t, "job 1", job.Total(), 0.075)
+	job, _ = a.Job("2")
+	m.For(t, "tenant").Assert(job.Tenant, m.Equal("b"))
+	assertCost(t, "job 2", job.Total(), 0.025)
+
+	tenants := a.Tenants()
+	m.For(t, "tenants").Require(tenants, m.Length().Should(m.Equal(2)))
+	m.For(t, "tenant a").Assert(tenants[0].Tenant, m.Equal("a"))
+	m.For(t, "tenant a jobs").Assert(tenants[0].Jobs, m.Equal(1))
+	assertCost(t, "tenant a", tenants[0].Cost, 0.075)
+
+	// The idle worker ran from its RunInstances call for 20s
+	assertCost(t, "unattributed", a.Unattributed(), 0.02)
+	assertCost(t, "total", a.Total(), 0.12)
+
+	_, ok = a.Job("unknown")
+	m.For(t, "unknown job").Assert(ok, m.Equal(false))
+}
+
+func TestAccountant_retries(t *testing.T) {
+	a := New(zaptest.NewLogger(t), testPrices)
+	first := &testInstance{instanceType: "g4dn.xlarge", market: compute.MarketOnDemand, launched: t0}
+	second := &testInstance{instanceType: "g4dn.xlarge", market: compute.MarketSpot, launched: t0}
+
+	a.HandlePoolEvent(compute.PoolEvent{Type: compute.WorkerCreated, Worker: first, Time: t0})
+	a.HandlePoolEvent(compute.PoolEvent{Type: compute.WorkerCreated, Worker: second, Time: t0})
+
+	// The failed first attempt ends when its worker is removed
+	a.HandleQueueEvent(compute.QueueEvent{Type: compute.WorkStarted, WorkID: "1", Worker: first, Time: at(0)})
+	a.HandlePoolEvent(compute.PoolEvent{Type: compute.WorkerRemoved, Worker: first, Time: at(10)})
+
+	// The second attempt is superseded without a finished event
+	a.HandleQueueEvent(compute.QueueEvent{Type: compute.WorkStarted, WorkID: "1", Worker: second, Time: at(20)})
+	a.HandleQueueEvent(compute.QueueEvent{Type: compute.WorkStarted, WorkID: "1", Worker: second, Time: at(30)})
+	a.HandleQueueEvent(compute.QueueEvent{Type: compute.WorkFinished, WorkID: "1", Time: at(40)})
+
+	job, _ := a.Job("1")
+	m.For(t, "busy").Assert(job.Busy, m.Equal(30*time.Second))
+	assertCost(t, "busy cost", job.BusyCost, 0.02+0.02)
+
+	// Reattached workers without a created event are still accounted
+	reattached := &testInstance{instanceType: "p3.2xlarge", market: compute.MarketSpot, launched: t0}
+	a.HandleQueueEvent(compute.QueueEvent{Type: compute.WorkStarted, WorkID: "2", Worker: reattached, Time: at(0)})
+	a.HandlePoolEvent(compute.PoolEvent{Type: compute.WorkerRemoved, Worker: reattached, Time: at(10)})
+	job, _ = a.Job("2")
+	m.For(t, "unpriced busy").Assert(job.Busy, m.Equal(10*time.Second))
+	m.For(t, "unpriced cost").Assert(job.Total(), m.Equal(0.0))
+}
+
+func TestAccountant_Spend(t *testing.T) {
+	a := New(zaptest.NewLogger(t), testPrices)
+	terminated := &testInstance{instanceType: "g4dn.xlarge", market: compute.MarketSpot, launched: t0}
+	running := &testInstance{instanceType: "g4dn.xlarge", market: compute.MarketOnDemand, launched: at(50)}
+
+	a.HandlePoolEvent(compute.PoolEvent{Type: compute.WorkerCreated, Worker: terminated, Time: at(5)})
+	a.HandlePoolEvent(compute.PoolEvent{Type: compute.WorkerCreated, Worker: running, Time: at(55)})
+	a.HandlePoolEvent(compute.PoolEvent{Type: compute.WorkerRemoved, Worker: terminated, Time: at(100)})
+
+	// 100s of spot and 50s of on-demand runtime
+	assertCost(t, "all", a.Spend(t0, at(100)), 0.1+0.1)
+	// 40s of spot and 20s of on-demand runtime
+	assertCost(t, "window", a.Spend(at(30), at(70)), 0.04+0.04)
+	// The running worker is charged until the end of the window
+	assertCost(t, "running", a.Spend(at(100), at(200)), 0.2)
+	assertCost(t, "before", a.Spend(t0.Add(-time.Hour), t0), 0)
+}
+
+func TestAccountant_maxJobs(t *testing.T) {
+	a := New(zaptest.NewLogger(t), testPrices, WithMaxJobs(1))
+	first := &testInstance{instanceType: "g4dn.xlarge", market: compute.MarketSpot, launched: t0}
+	second := &testInstance{instanceType: "g4dn.xlarge", market: compute.MarketSpot, launched: t0}
+
+	a.HandleQueueEvent(compute.QueueEvent{Type: compute.WorkStarted, WorkID: "1", Tenant: "a", Worker: first, Time: at(0)})
+	a.HandleQueueEvent(compute.QueueEvent{Type: compute.WorkFinished, WorkID: "1", Tenant: "a", Time: at(10)})
+	a.HandleQueueEvent(compute.QueueEvent{Type: compute.WorkStarted, WorkID: "2", Tenant: "a", Worker: second, Time: at(0)})
+	a.HandleQueueEvent(compute.QueueEvent{Type: compute.WorkFinished, WorkID: "2", Tenant: "a", Time: at(10)})
+
+	// Jobs are kept until their idle time is settled
+	a.HandlePoolEvent(compute.PoolEvent{Type: compute.WorkerRemoved, Worker: second, Time: at(20)})
+	_, ok := a.Job("1")
+	m.For(t, "unsettled job").Assert(ok, m.Equal(true))
+	_, ok = a.Job("2")
+	m.For(t, "settled job").Assert(ok, m.Equal(true))
+
+	a.HandlePoolEvent(compute.PoolEvent{Type: compute.WorkerRemoved, Worker: first, Time: at(40)})
+	_, ok = a.Job("2")
+	m.For(t, "evicted job").Assert(ok, m.Equal(false))
+	job, ok := a.Job("1")
+	m.For(t, "kept job").Require(ok, m.Equal(true))
+	assertCost(t, "kept job", job.Total(), 0.04)
+
+	tenants := a.Tenants()
+	m.For(t, "tenants").Require(tenants, m.Length().Should(m.Equal(1)))
+	m.For(t, "tenant jobs").Assert(tenants[0].Jobs, m.Equal(2))
+	assertCost(t, "tenant cost", tenants[0].Cost, 0.02+0.04)
+}
+
+func TestAccountant_retention(t *testing.T) {
+	a := New(zaptest.NewLogger(t), testPrices, WithRetention(time.Minute))
+	old := &testInstance{instanceType: "g4dn.xlarge", market: compute.MarketSpot, launched: t0}
+	recent := &testInstance{instanceType: "g4dn.xlarge", market: compute.MarketSpot, launched: at(3600)}
+
+	a.HandlePoolEvent(compute.PoolEvent{Type: compute.WorkerRemoved, Worker: old, Time: at(100)})
+	assertCost(t, "long window", a.Spend(t0, at(7200)), 0.1)
+
+	// Runtimes are kept for the longest window asked for
+	a.HandlePoolEvent(compute.PoolEvent{Type: compute.WorkerRemoved, Worker: recent, Time: at(3700)})
+	assertCost(t, "short window", a.Spend(at(7170), at(7200)), 0)
+	assertCost(t, "kept", a.Spend(t0, at(7200)), 0.2)
+
+	// Runtimes removed before the longest window are dropped
+	later := &testInstance{instanceType: "g4dn.xlarge", market: compute.MarketSpot, launched: at(7400)}
+	a.HandlePoolEvent(compute.PoolEvent{Type: compute.WorkerRemoved, Worker: later, Time: at(7400)})
+	m.For(t, "terminated").Assert(a.terminated, m.Length().Should(m.Equal(2)))
+	assertCost(t, "pruned", a.Spend(t0, at(7200)), 0.1)
+}
@@ -0,0 +1,27 @@
+package cost
+
+import "time"
+
+type Options struct {
+	// Retention is how long the runtimes of terminated workers are kept at
+	// least. They are kept longer if Spend is asked for longer windows.
+	// Defaults to 24 hours.
+	Retention time.Duration
+	// MaxJobs is how many finished jobs are kept for Job. The costs of older
+	// jobs are still counted by Tenants. Defaults to 10000.
+	MaxJobs int
+}
+
+type OptionsFunc func(options *Options)
+
+func WithRetention(retention time.Duration) OptionsFunc {
+	return func(opts *Options) {
+		opts.Retention = retention
+	}
+}
+
+func WithMaxJobs(n int) OptionsFunc {
+	return func(opts *Options) {
+		opts.MaxJobs = n
+	}
+}
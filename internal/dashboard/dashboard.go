@@ -0,0 +1,215 @@
+package dashboard
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/ansg191/remote-worker/api/proto"
+	"github.com/ansg191/remote-worker/internal/compute"
+)
+
+// Worker states
+const (
+	StateIdle = "idle"
+	StateBusy = "busy"
+)
+
+// infoTimeout bounds a single WorkerService.Info call
+const infoTimeout = 10 * time.Second
+
+// Dashboard tracks the workers of a compute.Pool and serves a web UI showing
+// them together with the jobs of a manager. Workers are fed with
+// HandlePoolEvent and HandleQueueEvent.
+type Dashboard struct {
+	logger *zap.Logger
+
+	mtx     sync.Mutex // Mutex for below fields
+	workers map[compute.Worker]*worker
+	changed chan struct{} // Closed and replaced whenever a worker changes
+}
+
+type worker struct {
+	id      string
+	addr    string
+	created time.Time
+	job     compute.WorkID // Work running on the worker, if any
+	info    *proto.WorkerInfoResponse
+	loading bool // Set while WorkerService.Info is called
+}
+
+// WorkerStatus is the state of a worker shown on the dashboard
+type WorkerStatus struct {
+	ID       string    `json:"id"`
+	Address  string    `json:"address"`
+	State    string    `json:"state"`
+	Job      string    `json:"job,omitempty"`
+	Created  time.Time `json:"created"`
+	Uptime   string    `json:"uptime"`
+	Hardware string    `json:"hardware,omitempty"`
+}
+
+func New(logger *zap.Logger) *Dashboard {
+	return &Dashboard{
+		logger:  logger,
+		workers: make(map[compute.Worker]*worker),
+		changed: make(chan struct{}),
+	}
+}
+
+func (d *Dashboard) HandlePoolEvent(event compute.PoolEvent) {
+	d.mtx.Lock()
+	defer d.mtx.Unlock()
+
+	switch event.Type {
+	case compute.WorkerCreated:
+		w := &worker{created: event.Time}
+		if identifier, ok := event.Worker.(compute.Identifier); ok {
+			w.id = identifier.ID()
+		}
+		d.workers[event.Worker] = w
+	case compute.WorkerRemoved:
+		delete(d.workers, event.Worker)
+	}
+	d.signal()
+}
+
+func (d *Dashboard) HandleQueueEvent(event compute.QueueEvent) {
+	d.mtx.Lock()
+	defer d.mtx.Unlock()
+
+	// Work is only running on one worker. A retried attempt may start on
+	// another worker without a finished event.
+	for _, w := range d.workers {
+		if w.job == event.WorkID {
+			w.job = ""
+		}
+	}
+
+	if event.Type == compute.WorkStarted {
+		w, ok := d.workers[event.Worker]
+		if !ok {
+			return
+		}
+		w.job = event.WorkID
+
+		// Started work runs on a connected worker, so its address and
+		// client are current. Both are read here since the queue may
+		// reconnect the worker concurrently to later calls.
+		if addresser, ok := event.Worker.(compute.Addresser); ok {
+			w.addr = addresser.Address()
+		}
+		if w.info == nil && !w.loading {
+			w.loading = true
+			go d.loadInfo(event.Worker, event.Worker.Worker())
+		}
+	}
+	d.signal()
+}
+
+// loadInfo caches the hardware information of worker
+func (d *Dashboard) loadInfo(key compute.Worker, client proto.WorkerServiceClient) {
+	ctx, cancel := context.WithTimeout(context.Background(), infoTimeout)
+	defer cancel()
+
+	info, err := client.Info(ctx, &proto.WorkerInfoRequest{})
+	if err != nil {
+		d.logger.Warn("error getting worker info", zap.Error(err))
+	}
+
+	d.mtx.Lock()
+	defer d.mtx.Unlock()
+
+	w, ok := d.workers[key]
+	if !ok {
+		return
+	}
+	w.loading = false
+	w.info = info
+	d.signal()
+}
+
+// Workers returns the workers in the pool, oldest first
+func (d *Dashboard) Workers() []WorkerStatus {
+	d.mtx.Lock()
+	defer d.mtx.Unlock()
+
+	now := time.Now()
+	workers := make([]WorkerStatus, 0, len(d.workers))
+	for _, w := range d.workers {
+		status := WorkerStatus{
+			ID:       w.id,
+			Address:  w.addr,
+			State:    StateIdle,
+			Job:      string(w.job),
+			Created:  w.created,
+			Uptime:   now.Sub(w.created).Round(time.Second).String(),
+			Hardware: Hardware(w.info),
+		}
+		if w.job != "" {
+			status.State = StateBusy
+		}
+		workers = append(workers, status)
+	}
+
+	sort.Slice(workers, func(i, j int) bool {
+		return workers[i].Created.Before(workers[j].Created)
+	})
+	return workers
+}
+
+// Changed returns a channel closed the next time a worker changes
+func (d *Dashboard) Changed() <-chan struct{} {
+	d.mtx.Lock()
+	defer d.mtx.Unlock()
+	return d.changed
+}
+
+// signal wakes all routines waiting for changes.
+// d.mtx must be held.
+func (d *Dashboard) signal() {
+	close(d.changed)
+	d.changed = make(chan struct{})
+}
+
+// Hardware summarizes the CPU, memory, storage and GPUs of a worker, e.g.
+// "4 cores / 8 threads, 16.0 GiB RAM, 125.0 GiB disk, GPU: TU104GL [Tesla T4]"
+func Hardware(info *proto.WorkerInfoResponse) string {
+	if info == nil {
+		return ""
+	}
+
+	var parts []string
+	if cpu := info.Cpu; cpu != nil && cpu.Cores > 0 {
+		parts = append(parts, fmt.Sprintf("%d cores / %d threads", cpu.Cores, cpu.Threads))
+	}
+	if mem := info.Memory; mem != nil && mem.Physical > 0 {
+		parts = append(parts, gibibytes(mem.Physical)+" RAM")
+	}
+	if storage := info.Storage; storage != nil && storage.TotalBytes > 0 {
+		parts = append(parts, gibibytes(storage.TotalBytes)+" disk")
+	}
+	if gpu := info.Gpu; gpu != nil {
+		var cards []string
+		for _, card := range gpu.Card {
+			name := "unknown"
+			if product := card.GetDevice().GetProduct(); product.GetName() != "" {
+				name = product.GetName()
+			}
+			cards = append(cards, name)
+		}
+		if len(cards) > 0 {
+			parts = append(parts, "GPU: "+strings.Join(cards, ", "))
+		}
+	}
+	return strings.Join(parts, ", ")
+}
+
+func gibibytes(b uint64) string {
+	return fmt.Sprintf("%.1f GiB", float64(b)/(1<<30))
+}
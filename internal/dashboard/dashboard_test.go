@@ -0,0 +1,228 @@
+package dashboard
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/golang/mock/gomock"
+	m "github.com/launchdarkly/go-test-helpers/v2/matchers"
+	"go.uber.org/zap/zaptest"
+	"google.golang.org/grpc"
+
+	"github.com/ansg191/remote-worker/api/proto"
+	"github.com/ansg191/remote-worker/internal/compute"
+)
+
+// infoClient is a WorkerServiceClient returning info
+type infoClient struct {
+	proto.WorkerServiceClient
+	info *proto.WorkerInfoResponse
+}
+
+func (c *infoClient) Info(context.Context, *proto.WorkerInfoRequest, ...grpc.CallOption) (*proto.WorkerInfoResponse, error) {
+	return c.info, nil
+}
+
+// testWorker is an identifiable, addressable worker
+type testWorker struct {
+	*compute.MockWorker
+	id string
+}
+
+func (w *testWorker) ID() string {
+	return w.id
+}
+
+func (w *testWorker) Address() string {
+	return "10.0.0.1:443"
+}
+
+var testInfo = &proto.WorkerInfoResponse{
+	Cpu:     &proto.CPUInfo{Cores: 4, Threads: 8},
+	Memory:  &proto.MemoryInfo{Physical: 16 << 30},
+	Storage: &proto.StorageInfo{TotalBytes: 125 << 30},
+	Gpu: &proto.GPUInfo{Card: []*proto.GPUInfo_Card{{
+		Device: &proto.PCIInfo_Device{Product: &proto.PCIInfo_Vendor_Product{Name: "TU104GL [Tesla T4]"}},
+	}}},
+}
+
+func newWorker(t *testing.T, id string) *testWorker {
+	t.Helper()
+
+	ctrl := gomock.NewController(t)
+	t.Cleanup(func() {
+		ctrl.Finish()
+	})
+
+	mWorker := compute.NewMockWorker(ctrl)
+	mWorker.EXPECT().
+		Worker().
+		Return(&infoClient{info: testInfo}).
+		AnyTimes()
+	return &testWorker{MockWorker: mWorker, id: id}
+}
+
+func waitWorkers(t *testing.T, d *Dashboard, ready func([]WorkerStatus) bool) []WorkerStatus {
+	t.Helper()
+
+	timeout := time.After(time.Second)
+	for {
+		changed := d.Changed()
+		if workers := d.Workers(); ready(workers) {
+			return workers
+		}
+		select {
+		case <-changed:
+		case <-timeout:
+			t.Fatalf("workers not updated: %+v", d.Workers())
+		}
+	}
+}
+
+func TestDashboard_workers(t *testing.T) {
+	d := New(zaptest.NewLogger(t))
+	w1, w2 := newWorker(t, "i-1"), newWorker(t, "i-2")
+	now := time.Now()
+
+	d.HandlePoolEvent(compute.PoolEvent{Type: compute.WorkerCreated, Worker: w1, Time: now.Add(-time.Minute)})
+	d.HandlePoolEvent(compute.PoolEvent{Type: compute.WorkerCreated, Worker: w2, Time: now})
+
+	workers := d.Workers()
+	m.For(t, "workers").Require(workers, m.Length().Should(m.Equal(2)))
+	m.For(t, "oldest first").Assert(workers[0].ID, m.Equal("i-1"))
+	m.For(t, "state").Assert(workers[0].State, m.Equal(StateIdle))
+	m.For(t, "address before start").Assert(workers[0].Address, m.Equal(""))
+
+	d.HandleQueueEvent(compute.QueueEvent{Type: compute.WorkStarted, WorkID: "job", Worker: w1, Time: now})
+	workers = waitWorkers(t, d, func(workers []WorkerStatus) bool {
+		return workers[0].Hardware != ""
+	})
+	m.For(t, "busy").Assert(workers[0].State, m.Equal(StateBusy))
+	m.For(t, "job").Assert(workers[0].Job, m.Equal("job"))
+	m.For(t, "address").Assert(workers[0].Address, m.Equal("10.0.0.1:443"))
+	m.For(t, "hardware").Assert(workers[0].Hardware,
+		m.Equal("4 cores / 8 threads, 16.0 GiB RAM, 125.0 GiB disk, GPU: TU104GL [Tesla T4]"))
+
+	// A retry on another worker moves the work
+	d.HandleQueueEvent(compute.QueueEvent{Type: compute.WorkStarted, WorkID: "job", Worker: w2, Time: now})
+	workers = d.Workers()
+	m.For(t, "retried from").Assert(workers[0].State, m.Equal(StateIdle))
+	m.For(t, "retried to").Assert(workers[1].Job, m.Equal("job"))
+
+	d.HandleQueueEvent(compute.QueueEvent{Type: compute.WorkFinished, WorkID: "job", Time: now})
+	m.For(t, "finished").Assert(d.Workers()[1].State, m.Equal(StateIdle))
+
+	d.HandlePoolEvent(compute.PoolEvent{Type: compute.WorkerRemoved, Worker: w1, Time: now})
+	workers = d.Workers()
+	m.For(t, "removed").Require(workers, m.Length().Should(m.Equal(1)))
+	m.For(t, "remaining").Assert(workers[0].ID, m.Equal("i-2"))
+}
+
+func TestHardware(t *testing.T) {
+	m.For(t, "nil").Assert(Hardware(nil), m.Equal(""))
+	m.For(t, "partial").Assert(Hardware(&proto.WorkerInfoResponse{
+		Cpu: &proto.CPUInfo{Cores: 2, Threads: 4},
+		Gpu: &proto.GPUInfo{Card: []*proto.GPUInfo_Card{{}}},
+	}), m.Equal("2 cores / 4 threads, GPU: unknown"))
+}
+
+// testJobs is a Jobs listing jobs
+type testJobs struct {
+	mtx     sync.Mutex
+	jobs    []*proto.JobInfo
+	changed chan struct{}
+}
+
+func (j *testJobs) ListJobs(context.Context, *proto.ListJobsRequest) (*proto.ListJobsResponse, error) {
+	j.mtx.Lock()
+	defer j.mtx.Unlock()
+	return &proto.ListJobsResponse{Jobs: j.jobs}, nil
+}
+
+func (j *testJobs) Changed() <-chan struct{} {
+	j.mtx.Lock()
+	defer j.mtx.Unlock()
+	return j.changed
+}
+
+func (j *testJobs) add(job *proto.JobInfo) {
+	j.mtx.Lock()
+	defer j.mtx.Unlock()
+	j.jobs = append(j.jobs, job)
+	close(j.changed)
+	j.changed = make(chan struct{})
+}
+
+func TestDashboard_Handler(t *testing.T) {
+	d := New(zaptest.NewLogger(t))
+	jobs := &testJobs{changed: make(chan struct{})}
+	jobs.add(&proto.JobInfo{Id: "1", State: proto.JobInfo_RUNNING, Status: &proto.JobStatus{
+		EncodeStatus: &proto.EncodeStatus{Progress: 42},
+	}})
+
+	srv := httptest.NewServer(d.Handler(jobs))
+	t.Cleanup(srv.Close)
+
+	res, err := http.Get(srv.URL + "/")
+	m.For(t, "index err").Require(err, m.BeNil())
+	body, _ := io.ReadAll(res.Body)
+	_ = res.Body.Close()
+	m.For(t, "index").Assert(strings.Contains(string(body), "app.js"), m.Equal(true))
+
+	res, err = http.Get(srv.URL + "/api/state")
+	m.For(t, "state err").Require(err, m.BeNil())
+	var state struct {
+		Jobs []*struct {
+			ID     string `json:"id"`
+			State  string `json:"state"`
+			Status struct {
+				EncodeStatus struct {
+					Progress float64 `json:"progress"`
+				} `json:"encodeStatus"`
+			} `json:"status"`
+		} `json:"jobs"`
+		Workers []WorkerStatus `json:"workers"`
+	}
+	err = json.NewDecoder(res.Body).Decode(&state)
+	_ = res.Body.Close()
+	m.For(t, "decode err").Require(err, m.BeNil())
+	m.For(t, "jobs").Require(state.Jobs, m.Length().Should(m.Equal(1)))
+	m.For(t, "job state").Assert(state.Jobs[0].State, m.Equal("RUNNING"))
+	m.For(t, "job progress").Assert(state.Jobs[0].Status.EncodeStatus.Progress, m.Equal(42.0))
+	m.For(t, "workers").Assert(state.Workers, m.Length().Should(m.Equal(0)))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	req, _ := http.NewRequestWithContext(ctx, http.MethodGet, srv.URL+"/api/events", nil)
+	res, err = http.DefaultClient.Do(req)
+	m.For(t, "events err").Require(err, m.BeNil())
+	defer res.Body.Close()
+	m.For(t, "content type").Assert(res.Header.Get("Content-Type"), m.Equal("text/event-stream"))
+
+	events := bufio.NewScanner(res.Body)
+	next := func() string {
+		for events.Scan() {
+			if line := events.Text(); strings.HasPrefix(line, "data: ") {
+				return strings.TrimPrefix(line, "data: ")
+			}
+		}
+		t.Fatalf("stream ended: %v", events.Err())
+		return ""
+	}
+
+	m.For(t, "first event").Assert(strings.Contains(next(), `"id":"1"`), m.Equal(true))
+
+	d.HandlePoolEvent(compute.PoolEvent{Type: compute.WorkerCreated, Worker: newWorker(t, "i-1"), Time: time.Now()})
+	m.For(t, "worker event").Assert(strings.Contains(next(), `"id":"i-1"`), m.Equal(true))
+
+	jobs.add(&proto.JobInfo{Id: "2"})
+	m.For(t, "job event").Assert(strings.Contains(next(), `"id":"2"`), m.Equal(true))
+}
@@ -0,0 +1,135 @@
+package dashboard
+
+import (
+	"context"
+	"embed"
+	"encoding/json"
+	"fmt"
+	"io/fs"
+	"net/http"
+	"time"
+
+	"go.uber.org/zap"
+	"google.golang.org/protobuf/encoding/protojson"
+
+	"github.com/ansg191/remote-worker/api/proto"
+)
+
+//go:embed static
+var static embed.FS
+
+const (
+	// updateInterval is the minimum time between two events of a stream
+	updateInterval = 500 * time.Millisecond
+	// refreshInterval is how often a stream is sent an event without changes,
+	// keeping uptimes current
+	refreshInterval = 5 * time.Second
+)
+
+// Jobs lists the jobs shown on the dashboard. It is implemented by
+// manager.Manager.
+type Jobs interface {
+	ListJobs(ctx context.Context, req *proto.ListJobsRequest) (*proto.ListJobsResponse, error)
+	// Changed returns a channel closed the next time any job changes
+	Changed() <-chan struct{}
+}
+
+// State is a snapshot of the jobs and workers sent to the UI
+type State struct {
+	Jobs    []json.RawMessage `json:"jobs"`
+	Workers []WorkerStatus    `json:"workers"`
+}
+
+// Handler returns the http.Handler serving the UI with jobs. The UI is
+// updated live from the /api/events server-sent event stream.
+func (d *Dashboard) Handler(jobs Jobs) http.Handler {
+	assets, err := fs.Sub(static, "static")
+	if err != nil {
+		panic(err)
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle("/", http.FileServer(http.FS(assets)))
+	mux.HandleFunc("/api/state", func(w http.ResponseWriter, r *http.Request) {
+		state, err := d.state(r.Context(), jobs)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write(state)
+	})
+	mux.HandleFunc("/api/events", func(w http.ResponseWriter, r *http.Request) {
+		d.stream(w, r, jobs)
+	})
+	return mux
+}
+
+// stream sends the state as server-sent events whenever jobs or workers change
+func (d *Dashboard) stream(w http.ResponseWriter, r *http.Request, jobs Jobs) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+
+	ctx := r.Context()
+	ticker := time.NewTicker(refreshInterval)
+	defer ticker.Stop()
+
+	for {
+		// Channels are taken before the state so that no change is missed
+		jobsChanged, workersChanged := jobs.Changed(), d.Changed()
+
+		state, err := d.state(ctx, jobs)
+		if err != nil {
+			d.logger.Error("error getting dashboard state", zap.Error(err))
+			return
+		}
+		if _, err = fmt.Fprintf(w, "data: %s\n\n", state); err != nil {
+			return
+		}
+		flusher.Flush()
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-jobsChanged:
+		case <-workersChanged:
+		case <-ticker.C:
+		}
+
+		// Bursts of changes, such as progress reports, are coalesced
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(updateInterval):
+		}
+	}
+}
+
+// state returns the JSON encoded State
+func (d *Dashboard) state(ctx context.Context, jobs Jobs) ([]byte, error) {
+	res, err := jobs.ListJobs(ctx, &proto.ListJobsRequest{})
+	if err != nil {
+		return nil, err
+	}
+
+	state := State{
+		Jobs:    make([]json.RawMessage, 0, len(res.Jobs)),
+		Workers: d.Workers(),
+	}
+	for _, job := range res.Jobs {
+		data, err := protojson.Marshal(job)
+		if err != nil {
+			return nil, err
+		}
+		state.Jobs = append(state.Jobs, data)
+	}
+	return json.Marshal(state)
+}
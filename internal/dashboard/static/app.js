@@ -0,0 +1,135 @@
+"use strict";
+
+// Renders the state streamed from /api/events. Enum fields left out of the
+// JSON have their zero value, e.g. QUEUED jobs have no state.
+
+function text(value) {
+  const span = document.createElement("span");
+  span.textContent = value === undefined || value === "" ? "-" : String(value);
+  return span;
+}
+
+function cell(content, className) {
+  const td = document.createElement("td");
+  td.appendChild(content instanceof Node ? content : text(content));
+  if (className) {
+    td.className = className;
+  }
+  return td;
+}
+
+function render(id, rows, columns) {
+  const body = document.getElementById(id);
+  body.replaceChildren();
+  document.getElementById(id + "-count").textContent = rows.length;
+
+  if (rows.length === 0) {
+    const td = cell("none", "empty");
+    td.colSpan = columns;
+    const tr = document.createElement("tr");
+    tr.appendChild(td);
+    body.appendChild(tr);
+    return;
+  }
+  for (const cells of rows) {
+    const tr = document.createElement("tr");
+    cells.forEach((c) => tr.appendChild(c));
+    body.appendChild(tr);
+  }
+}
+
+function time(ts) {
+  return ts ? new Date(ts).toLocaleTimeString() : "-";
+}
+
+function duration(from, to) {
+  if (!from || !to) {
+    return "-";
+  }
+  let secs = Math.round((new Date(to) - new Date(from)) / 1000);
+  const hours = Math.floor(secs / 3600);
+  secs %= 3600;
+  const mins = Math.floor(secs / 60);
+  secs %= 60;
+  return (hours ? hours + "h" : "") + (hours || mins ? mins + "m" : "") + secs + "s";
+}
+
+function progress(job) {
+  const status = job.status || {};
+  const encode = status.encodeStatus || {};
+  const pct = Math.max(0, Math.min(100, encode.progress || 0));
+
+  const bar = document.createElement("div");
+  bar.className = "progress";
+  const fill = document.createElement("div");
+  fill.style.width = pct + "%";
+  const label = document.createElement("span");
+  label.textContent = pct.toFixed(1) + "%" + (encode.speed ? " @ " + encode.speed.toFixed(2) + "x" : "");
+  bar.append(fill, label);
+  return bar;
+}
+
+function update(state) {
+  const jobs = state.jobs.map((job) => Object.assign({ state: "QUEUED", job: {} }, job));
+  const workers = {};
+  for (const w of state.workers) {
+    workers[w.id] = w;
+  }
+
+  render("running", jobs.filter((j) => j.state === "RUNNING").map((j) => [
+    cell(j.id, "mono"),
+    cell(j.job.sourcePath),
+    cell(j.tenant),
+    cell(j.workerId, "mono"),
+    cell(j.status ? j.status.status || "ENCODING" : "STARTING"),
+    cell(progress(j)),
+    cell(time(j.started)),
+  ]), 7);
+
+  render("queued", jobs.filter((j) => j.state === "QUEUED").map((j) => [
+    cell(j.id, "mono"),
+    cell(j.job.sourcePath),
+    cell(j.tenant),
+    cell(j.priority || 0),
+    cell(time(j.submitted)),
+  ]), 5);
+
+  render("workers", state.workers.map((w) => [
+    cell(w.id, "mono"),
+    cell(w.address, "mono"),
+    cell(w.state, "state-" + w.state),
+    cell(w.job, "mono"),
+    cell(w.uptime),
+    cell(w.hardware),
+  ]), 6);
+
+  const finished = jobs.filter((j) => j.state !== "RUNNING" && j.state !== "QUEUED").reverse();
+  render("finished", finished.map((j) => [
+    cell(j.id, "mono"),
+    cell(j.job.sourcePath),
+    cell(j.tenant),
+    cell(j.state, "state-" + j.state),
+    cell(duration(j.started, j.finished)),
+    cell(time(j.finished)),
+    cell(j.cost ? "$" + (j.cost.total || 0).toFixed(4) : "-"),
+    cell(j.error),
+  ]), 8);
+}
+
+function connect() {
+  const status = document.getElementById("connection");
+  const events = new EventSource("api/events");
+
+  events.onopen = () => {
+    status.textContent = "live";
+    status.className = "connected";
+  };
+  events.onmessage = (e) => update(JSON.parse(e.data));
+  // EventSource reconnects by itself
+  events.onerror = () => {
+    status.textContent = "reconnecting";
+    status.className = "disconnected";
+  };
+}
+
+connect();
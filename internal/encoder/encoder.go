@@ -15,11 +15,17 @@ import (
 	"github.com/aws/aws-sdk-go-v2/service/s3"
 	"github.com/xfrr/goffmpeg/models"
 	"github.com/xfrr/goffmpeg/transcoder"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 	"go.uber.org/zap"
 
 	"github.com/ansg191/remote-worker/api/proto"
+	"github.com/ansg191/remote-worker/internal/tracing"
 )
 
+var tracer = otel.Tracer("github.com/ansg191/remote-worker/internal/encoder")
+
 type EncodeJob interface {
 	SetSourcePath(path string) EncodeJob
 	SetDestPath(path string) EncodeJob
@@ -27,7 +33,8 @@ type EncodeJob interface {
 	SetBitrate(bitrate string) EncodeJob
 
 	GetStatus() <-chan *proto.JobStatus
-	Start()
+	// Start runs the job. ctx carries the trace of the job's spans.
+	Start(ctx context.Context)
 	Wait()
 	Cancel()
 }
@@ -86,13 +93,22 @@ func (d *DefaultEncodeJob) GetStatus() <-chan *proto.JobStatus {
 	return d.status
 }
 
-func (d *DefaultEncodeJob) Start() {
+func (d *DefaultEncodeJob) Start(ctx context.Context) {
+	ctx, span := tracer.Start(ctx, "EncodeJob", trace.WithAttributes(
+		attribute.String("job.source", d.sourcePath),
+		attribute.String("job.dest", d.destPath),
+		attribute.String("job.codec", d.codec),
+		attribute.String("job.bitrate", d.bitrate),
+	))
+
+	var err error
 	defer func() {
+		tracing.End(span, err)
 		d.done <- true
 		close(d.status)
 	}()
 
-	err := d.setup()
+	err = d.setup(ctx)
 	if err != nil {
 		d.status <- &proto.JobStatus{
 			Status: proto.JobStatus_ERROR,
@@ -101,7 +117,7 @@ func (d *DefaultEncodeJob) Start() {
 		return
 	}
 
-	err = d.transcode()
+	err = d.transcode(ctx)
 	if err != nil {
 		d.status <- &proto.JobStatus{
 			Status: proto.JobStatus_ERROR,
@@ -109,8 +125,8 @@ func (d *DefaultEncodeJob) Start() {
 		}
 	}
 
-	err = d.cleanup(err)
-	if err != nil {
+	if cleanupErr := d.cleanup(ctx, err); cleanupErr != nil {
+		err = cleanupErr
 		d.status <- &proto.JobStatus{
 			Status: proto.JobStatus_ERROR,
 			Error:  err.Error(),
@@ -119,7 +135,12 @@ func (d *DefaultEncodeJob) Start() {
 	}
 }
 
-func (d *DefaultEncodeJob) setup() error {
+func (d *DefaultEncodeJob) setup(ctx context.Context) (err error) {
+	ctx, span := tracer.Start(ctx, "EncodeJob.setup")
+	defer func() {
+		tracing.End(span, err)
+	}()
+
 	if strings.HasPrefix(d.sourcePath, "s3://") {
 		// Download file
 		d.status <- &proto.JobStatus{
@@ -148,7 +169,7 @@ func (d *DefaultEncodeJob) setup() error {
 
 		downloader := manager.NewDownloader(s3.NewFromConfig(d.cfg))
 
-		_, err = downloader.Download(context.Background(), file, &s3.GetObjectInput{
+		_, err = downloader.Download(ctx, file, &s3.GetObjectInput{
 			Bucket: aws.String(u.Host),
 			Key:    aws.String(u.Path[1:]),
 		})
@@ -181,10 +202,15 @@ func (d *DefaultEncodeJob) setup() error {
 	return nil
 }
 
-func (d *DefaultEncodeJob) transcode() error {
+func (d *DefaultEncodeJob) transcode(ctx context.Context) (err error) {
+	_, span := tracer.Start(ctx, "EncodeJob.transcode")
+	defer func() {
+		tracing.End(span, err)
+	}()
+
 	trans := new(transcoder.Transcoder)
 
-	err := trans.Initialize(d.sourceFilePath, d.destFilePath)
+	err = trans.Initialize(d.sourceFilePath, d.destFilePath)
 	if err != nil {
 		return err
 	}
@@ -224,7 +250,12 @@ func (d *DefaultEncodeJob) transcode() error {
 	return <-done
 }
 
-func (d *DefaultEncodeJob) cleanup(err error) error {
+func (d *DefaultEncodeJob) cleanup(ctx context.Context, jobErr error) (err error) {
+	ctx, span := tracer.Start(ctx, "EncodeJob.cleanup")
+	defer func() {
+		tracing.End(span, err)
+	}()
+
 	if d.sourcePath != d.sourceFilePath {
 		defer func(name string) {
 			err := os.Remove(name)
@@ -242,7 +273,7 @@ func (d *DefaultEncodeJob) cleanup(err error) error {
 		}(d.destFilePath)
 	}
 
-	if err != nil {
+	if jobErr != nil {
 		return nil
 	}
 
@@ -273,7 +304,7 @@ func (d *DefaultEncodeJob) cleanup(err error) error {
 			zap.String("key", u.Path[1:]))
 
 		uploader := manager.NewUploader(s3.NewFromConfig(d.cfg))
-		_, err = uploader.Upload(context.Background(), &s3.PutObjectInput{
+		_, err = uploader.Upload(ctx, &s3.PutObjectInput{
 			Bucket: aws.String(u.Host),
 			Key:    aws.String(u.Path[1:]),
 			Body:   file,
@@ -0,0 +1,74 @@
+package manager
+
+import (
+	"context"
+	"io"
+
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
+
+	"github.com/ansg191/remote-worker/api/proto"
+	"github.com/ansg191/remote-worker/internal/compute"
+)
+
+// encodeRequest is the request of encode work
+type encodeRequest struct {
+	Job *proto.Job `json:"job"`
+}
+
+// encodeWork runs an encode job on a worker with JobService. It is registered
+// so that submitted jobs are replayed from the journal after a restart.
+var encodeWork = compute.RegisterWorkType("encode", runEncode, nil)
+
+// reportFunc receives the statuses of a running job
+type reportFunc func(status *proto.JobStatus)
+
+type reportKey struct{}
+
+func withReporter(ctx context.Context, report reportFunc) context.Context {
+	return context.WithValue(ctx, reportKey{}, report)
+}
+
+func reporterFrom(ctx context.Context) reportFunc {
+	if report, ok := ctx.Value(reportKey{}).(reportFunc); ok {
+		return report
+	}
+	return func(*proto.JobStatus) {}
+}
+
+// runEncode starts req on worker and relays the job's statuses until it
+// finished. The job failed if its last status is an error.
+func runEncode(ctx context.Context, logger *zap.Logger, req encodeRequest, worker compute.Worker) (struct{}, error) {
+	report := reporterFrom(ctx)
+
+	id, _ := compute.WorkIDFrom(ctx)
+	_, err := worker.Job().Start(ctx, &proto.JobStartRequest{Job: req.Job, Id: string(id)})
+	if err != nil {
+		return struct{}{}, err
+	}
+
+	stream, err := worker.Job().Status(ctx, &proto.JobStatusRequest{})
+	if err != nil {
+		return struct{}{}, err
+	}
+
+	var last *proto.JobStatus
+	for {
+		status, err := stream.Recv()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return struct{}{}, err
+		}
+
+		last = status
+		report(status)
+	}
+
+	if last != nil && last.Status == proto.JobStatus_ERROR {
+		logger.Warn("Job failed", zap.String("error", last.Error))
+		return struct{}{}, errors.Errorf("job failed: %s", last.Error)
+	}
+	return struct{}{}, nil
+}
@@ -0,0 +1,51 @@
+package manager
+
+import (
+	"time"
+
+	"github.com/ansg191/remote-worker/api/proto"
+)
+
+type JobEventType int
+
+const (
+	// JobQueued is emitted when a job is submitted
+	JobQueued JobEventType = iota
+	// JobStarted is emitted when an attempt of a job starts running on a
+	// worker. Retried jobs start again.
+	JobStarted
+	// JobSucceeded is emitted when a job finished successfully
+	JobSucceeded
+	// JobFailed is emitted when a job finally failed
+	JobFailed
+	// JobCanceled is emitted when a canceled job finished
+	JobCanceled
+)
+
+func (t JobEventType) String() string {
+	switch t {
+	case JobQueued:
+		return "queued"
+	case JobStarted:
+		return "started"
+	case JobSucceeded:
+		return "succeeded"
+	case JobFailed:
+		return "failed"
+	case JobCanceled:
+		return "canceled"
+	default:
+		return "unknown"
+	}
+}
+
+type JobEvent struct {
+	Type JobEventType
+	Time time.Time
+	// Job is the state of the job after the event
+	Job *proto.JobInfo
+}
+
+// JobEventHandler receives the events of all jobs in order. Handlers are
+// called with the manager locked, so they must not block or call the manager.
+type JobEventHandler func(event JobEvent)
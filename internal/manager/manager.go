@@ -0,0 +1,582 @@
+package manager
+
+import (
+	"context"
+	"encoding/json"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/timestamppb"
+
+	"github.com/ansg191/remote-worker/api/proto"
+	"github.com/ansg191/remote-worker/internal/budget"
+	"github.com/ansg191/remote-worker/internal/compute"
+	"github.com/ansg191/remote-worker/internal/cost"
+)
+
+// Manager runs encode jobs submitted through the ManagerService API on a
+// compute.WorkQueue and tracks their state. Jobs are kept in memory for the
+// lifetime of the manager.
+type Manager struct {
+	proto.UnimplementedManagerServiceServer
+
+	logger     *zap.Logger
+	queue      compute.WorkQueue
+	handlers   []JobEventHandler
+	accountant *cost.Accountant
+	guard      *budget.Guard
+
+	mtx     sync.Mutex // Mutex for below fields
+	jobs    map[compute.WorkID]*job
+	order   []*job        // Jobs in submission order
+	changed chan struct{} // Closed and replaced whenever any job changes
+	closed  bool
+}
+
+type job struct {
+	id       compute.WorkID
+	spec     *proto.Job
+	priority int32
+	tenant   string
+	require  compute.Requirements
+
+	state    proto.JobInfo_State
+	status   *proto.JobStatus // Latest status reported by the worker
+	err      string
+	workerID string
+	canceled bool // Set by CancelJob
+
+	submitted time.Time
+	started   time.Time
+	finished  time.Time
+
+	changed chan struct{} // Closed and replaced whenever the job changes
+}
+
+// New creates a Manager running at most maxSize jobs at once on workers from
+// pool
+func New(logger *zap.Logger, pool compute.Pool, maxSize int, opts ...OptionsFunc) *Manager {
+	var options Options
+	for _, opt := range opts {
+		opt(&options)
+	}
+
+	m := &Manager{
+		logger:     logger,
+		handlers:   options.EventHandlers,
+		accountant: options.Accountant,
+		guard:      options.Guard,
+		jobs:       make(map[compute.WorkID]*job),
+		changed:    make(chan struct{}),
+	}
+
+	var queueOpts []compute.QueueOptionsFunc
+	if m.accountant != nil {
+		// Work is charged before its job events are emitted, so that they
+		// include its cost
+		queueOpts = append(queueOpts, compute.WithQueueEventHandler(m.accountant.HandleQueueEvent))
+	}
+	queueOpts = append(queueOpts, compute.WithQueueEventHandler(m.handleQueueEvent))
+	queueOpts = append(queueOpts, options.QueueOptions...)
+
+	if options.Journal != nil {
+		// Jobs are restored before the queue replays them, so that their
+		// events are tracked and their statuses reported
+		m.restore(options.Journal.State())
+		queueOpts = append(queueOpts,
+			compute.WithJournal(options.Journal),
+			compute.WithReplayContext(m.replayContext))
+	}
+
+	m.queue = compute.NewQueue(logger, pool, maxSize, queueOpts...)
+	if m.guard != nil {
+		m.guard.Watch(m.queue)
+	}
+
+	return m
+}
+
+// Queue returns the WorkQueue running the jobs
+func (m *Manager) Queue() compute.WorkQueue {
+	return m.queue
+}
+
+// Changed returns a channel closed the next time any job is submitted or
+// changes
+func (m *Manager) Changed() <-chan struct{} {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	return m.changed
+}
+
+// Shutdown stops accepting jobs and shuts down the queue
+func (m *Manager) Shutdown(ctx context.Context, mode compute.ShutdownMode) error {
+	m.mtx.Lock()
+	m.closed = true
+	m.mtx.Unlock()
+
+	return m.queue.Shutdown(ctx, mode)
+}
+
+// restore lists unfinished jobs from the journal
+func (m *Manager) restore(state *compute.JournalState) {
+	if state == nil {
+		return
+	}
+
+	for _, entry := range state.Pending {
+		if entry.Kind != encodeWork.Name() {
+			continue
+		}
+
+		var req encodeRequest
+		if err := json.Unmarshal(entry.Payload, &req); err != nil {
+			// The queue fails the work as well
+			continue
+		}
+
+		j := &job{
+			id:        entry.WorkID,
+			spec:      req.Job,
+			priority:  int32(entry.Priority),
+			tenant:    entry.Tenant,
+			submitted: entry.Time,
+			changed:   make(chan struct{}),
+		}
+		if entry.Requirements != nil {
+			j.require = *entry.Requirements
+		}
+		m.jobs[j.id] = j
+		m.order = append(m.order, j)
+	}
+
+	if len(m.order) > 0 {
+		m.logger.Info("Restored jobs from journal", zap.Int("count", len(m.order)))
+	}
+}
+
+// replayContext returns the context of the replayed work of entry, reporting
+// the statuses of its restored job
+func (m *Manager) replayContext(entry compute.JournalEntry) context.Context {
+	m.mtx.Lock()
+	j, ok := m.jobs[entry.WorkID]
+	m.mtx.Unlock()
+
+	if !ok {
+		return context.Background()
+	}
+	return m.reporter(j)
+}
+
+// reporter returns the context of the work of j, reporting its statuses
+func (m *Manager) reporter(j *job) context.Context {
+	return withReporter(context.Background(), func(status *proto.JobStatus) {
+		m.report(j, status)
+	})
+}
+
+func (m *Manager) handleQueueEvent(event compute.QueueEvent) {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+
+	j, ok := m.jobs[event.WorkID]
+	if !ok {
+		return
+	}
+
+	jobEvent := JobEvent{Time: event.Time}
+	switch event.Type {
+	case compute.WorkStarted:
+		j.state = proto.JobInfo_RUNNING
+		j.started = event.Time
+		j.workerID = ""
+		if identifier, ok := event.Worker.(compute.Identifier); ok {
+			j.workerID = identifier.ID()
+		}
+		jobEvent.Type = JobStarted
+	case compute.WorkFinished:
+		j.finished = event.Time
+		switch {
+		case event.Err == nil:
+			j.state = proto.JobInfo_SUCCEEDED
+			jobEvent.Type = JobSucceeded
+		case j.canceled:
+			// Running work may fail with any error once canceled
+			j.state = proto.JobInfo_CANCELED
+			jobEvent.Type = JobCanceled
+		default:
+			j.state = proto.JobInfo_FAILED
+			j.err = event.Err.Error()
+			jobEvent.Type = JobFailed
+		}
+	default:
+		return
+	}
+	m.signal(j)
+	m.emit(jobEvent, j)
+}
+
+// emit sends event of j to the configured JobEventHandlers.
+// m.mtx must be held, so that events are handled in order.
+func (m *Manager) emit(event JobEvent, j *job) {
+	if len(m.handlers) == 0 {
+		return
+	}
+
+	event.Job = m.info(j)
+	for _, handler := range m.handlers {
+		handler(event)
+	}
+}
+
+// report records the latest status of j
+func (m *Manager) report(j *job, status *proto.JobStatus) {
+	m.mtx.Lock()
+	j.status = status
+	m.signal(j)
+	m.mtx.Unlock()
+}
+
+func (m *Manager) SubmitJob(_ context.Context, req *proto.SubmitJobRequest) (*proto.SubmitJobResponse, error) {
+	if req.Job == nil {
+		return nil, status.Error(codes.InvalidArgument, "job not provided")
+	}
+	if req.Job.SourcePath == "" || req.Job.DestPath == "" {
+		return nil, status.Error(codes.InvalidArgument, "job source and destination paths are required")
+	}
+
+	j := &job{
+		spec:      req.Job,
+		priority:  req.Priority,
+		tenant:    req.Tenant,
+		require:   requirements(req.Requirements),
+		submitted: time.Now(),
+		changed:   make(chan struct{}),
+	}
+
+	work := encodeWork.NewWorkInfo(m.reporter(j), encodeRequest{Job: req.Job})
+	work.Priority = int(req.Priority)
+	work.Tenant = req.Tenant
+	work.Requirements = j.require
+
+	// The lock is held while adding so that the job is tracked before any of
+	// its events. Adding never emits events itself.
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+
+	if m.closed {
+		return nil, status.Error(codes.Unavailable, "manager shutting down")
+	}
+
+	j.id = m.queue.Add(work)
+	m.jobs[j.id] = j
+	m.order = append(m.order, j)
+	m.signal(j)
+	m.emit(JobEvent{Type: JobQueued, Time: j.submitted}, j)
+
+	m.logger.Info("Job submitted",
+		zap.String("id", string(j.id)),
+		zap.String("source", req.Job.SourcePath),
+		zap.String("dest", req.Job.DestPath))
+
+	return &proto.SubmitJobResponse{Id: string(j.id)}, nil
+}
+
+func (m *Manager) GetJob(_ context.Context, req *proto.GetJobRequest) (*proto.JobInfo, error) {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+
+	j, ok := m.jobs[compute.WorkID(req.Id)]
+	if !ok {
+		return nil, status.Errorf(codes.NotFound, "job %s not found", req.Id)
+	}
+	return m.info(j), nil
+}
+
+func (m *Manager) ListJobs(_ context.Context, req *proto.ListJobsRequest) (*proto.ListJobsResponse, error) {
+	states := make(map[proto.JobInfo_State]bool)
+	for _, state := range req.States {
+		states[state] = true
+	}
+
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+
+	res := &proto.ListJobsResponse{}
+	for _, j := range m.order {
+		if len(states) > 0 && !states[j.state] {
+			continue
+		}
+		if req.Tenant != "" && j.tenant != req.Tenant {
+			continue
+		}
+		res.Jobs = append(res.Jobs, m.info(j))
+	}
+	return res, nil
+}
+
+func (m *Manager) CancelJob(_ context.Context, req *proto.CancelJobRequest) (*proto.CancelJobResponse, error) {
+	m.mtx.Lock()
+	j, ok := m.jobs[compute.WorkID(req.Id)]
+	if !ok {
+		m.mtx.Unlock()
+		return nil, status.Errorf(codes.NotFound, "job %s not found", req.Id)
+	}
+	if j.done() {
+		m.mtx.Unlock()
+		return nil, status.Errorf(codes.FailedPrecondition, "job %s already finished", req.Id)
+	}
+	j.canceled = true
+	m.mtx.Unlock()
+
+	// Canceling queued work finishes it immediately, emitting an event, so
+	// the lock must not be held
+	err := m.queue.Cancel(j.id)
+	if err == compute.ErrWorkNotFound {
+		return nil, status.Errorf(codes.FailedPrecondition, "job %s already finished", req.Id)
+	}
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "error canceling job on worker: %v", err)
+	}
+
+	m.logger.Info("Job canceled", zap.String("id", req.Id))
+	return &proto.CancelJobResponse{}, nil
+}
+
+// WatchJob streams the statuses of a job until it finished. Statuses reported
+// faster than they can be sent are skipped. A job that failed without an
+// error status from its worker ends with an error status.
+func (m *Manager) WatchJob(req *proto.WatchJobRequest, stream proto.ManagerService_WatchJobServer) error {
+	var sent *proto.JobStatus
+	for {
+		m.mtx.Lock()
+		j, ok := m.jobs[compute.WorkID(req.Id)]
+		if !ok {
+			m.mtx.Unlock()
+			return status.Errorf(codes.NotFound, "job %s not found", req.Id)
+		}
+		latest, state, errMsg, changed := j.status, j.state, j.err, j.changed
+		m.mtx.Unlock()
+
+		if latest != nil && latest != sent {
+			if err := stream.Send(latest); err != nil {
+				return err
+			}
+			sent = latest
+		}
+
+		switch state {
+		case proto.JobInfo_SUCCEEDED, proto.JobInfo_CANCELED:
+			return nil
+		case proto.JobInfo_FAILED:
+			if sent == nil || sent.Status != proto.JobStatus_ERROR {
+				return stream.Send(&proto.JobStatus{
+					Status: proto.JobStatus_ERROR,
+					Error:  errMsg,
+				})
+			}
+			return nil
+		}
+
+		select {
+		case <-stream.Context().Done():
+			return stream.Context().Err()
+		case <-changed:
+		}
+	}
+}
+
+func (m *Manager) GetCosts(_ context.Context, req *proto.GetCostsRequest) (*proto.GetCostsResponse, error) {
+	if m.accountant == nil {
+		return nil, status.Error(codes.FailedPrecondition, "cost accounting disabled")
+	}
+
+	res := &proto.GetCostsResponse{
+		Unattributed: m.accountant.Unattributed(),
+		Total:        m.accountant.Total(),
+	}
+	for _, tenant := range m.accountant.Tenants() {
+		if req.Tenant != "" && tenant.Tenant != req.Tenant {
+			continue
+		}
+		res.Tenants = append(res.Tenants, &proto.GetCostsResponse_Tenant{
+			Tenant: tenant.Tenant,
+			Jobs:   int32(tenant.Jobs),
+			Cost:   tenant.Cost,
+		})
+	}
+	return res, nil
+}
+
+func (m *Manager) ListBudgets(context.Context, *proto.ListBudgetsRequest) (*proto.ListBudgetsResponse, error) {
+	if m.guard == nil {
+		return nil, status.Error(codes.FailedPrecondition, "budgets disabled")
+	}
+
+	var res proto.ListBudgetsResponse
+	for _, s := range m.guard.Status() {
+		res.Budgets = append(res.Budgets, budgetInfo(s))
+	}
+	return &res, nil
+}
+
+func (m *Manager) OverrideBudget(_ context.Context, req *proto.OverrideBudgetRequest) (*proto.Budget, error) {
+	if m.guard == nil {
+		return nil, status.Error(codes.FailedPrecondition, "budgets disabled")
+	}
+	if req.Seconds < 0 {
+		return nil, status.Error(codes.InvalidArgument, "seconds must not be negative")
+	}
+
+	err := m.guard.Override(req.Name, time.Duration(req.Seconds)*time.Second)
+	if err != nil {
+		return nil, budgetError(err)
+	}
+	return m.budget(req.Name)
+}
+
+func (m *Manager) ResetBudget(_ context.Context, req *proto.ResetBudgetRequest) (*proto.Budget, error) {
+	if m.guard == nil {
+		return nil, status.Error(codes.FailedPrecondition, "budgets disabled")
+	}
+
+	if err := m.guard.Reset(req.Name); err != nil {
+		return nil, budgetError(err)
+	}
+	return m.budget(req.Name)
+}
+
+// budget returns the API representation of the budget called name
+func (m *Manager) budget(name string) (*proto.Budget, error) {
+	for _, s := range m.guard.Status() {
+		if s.Budget.Name == name {
+			return budgetInfo(s), nil
+		}
+	}
+	return nil, status.Errorf(codes.NotFound, "budget %q not found", name)
+}
+
+func budgetInfo(s budget.Status) *proto.Budget {
+	return &proto.Budget{
+		Name:          s.Budget.Name,
+		Period:        string(s.Budget.Period),
+		Soft:          s.Budget.Soft,
+		Hard:          s.Budget.Hard,
+		Since:         timestamp(s.Since),
+		Spend:         s.Spend,
+		Exceeded:      s.Exceeded,
+		OverrideUntil: timestamp(s.Override),
+	}
+}
+
+// budgetError converts an error of budget.Guard to a status error
+func budgetError(err error) error {
+	switch {
+	case errors.Is(err, budget.ErrUnknownBudget):
+		return status.Error(codes.NotFound, err.Error())
+	case errors.Is(err, budget.ErrNotBatch):
+		return status.Error(codes.FailedPrecondition, err.Error())
+	default:
+		return status.Error(codes.Internal, err.Error())
+	}
+}
+
+// signal wakes all routines watching j or any job.
+// m.mtx must be held.
+func (m *Manager) signal(j *job) {
+	close(j.changed)
+	j.changed = make(chan struct{})
+	close(m.changed)
+	m.changed = make(chan struct{})
+}
+
+// done reports whether j finished.
+// Manager.mtx must be held.
+func (j *job) done() bool {
+	switch j.state {
+	case proto.JobInfo_SUCCEEDED, proto.JobInfo_FAILED, proto.JobInfo_CANCELED:
+		return true
+	default:
+		return false
+	}
+}
+
+// info returns the API representation of j with its cost.
+// m.mtx must be held.
+func (m *Manager) info(j *job) *proto.JobInfo {
+	info := j.info()
+	if m.accountant == nil {
+		return info
+	}
+
+	// Jobs that did not run yet cost nothing
+	c, _ := m.accountant.Job(j.id)
+	info.Cost = &proto.JobCost{
+		Total:       c.Total(),
+		Busy:        c.BusyCost,
+		Idle:        c.IdleCost,
+		BusySeconds: c.Busy.Seconds(),
+		IdleSeconds: c.Idle.Seconds(),
+	}
+	return info
+}
+
+// info returns the API representation of j.
+// Manager.mtx must be held.
+func (j *job) info() *proto.JobInfo {
+	return &proto.JobInfo{
+		Id:        string(j.id),
+		Job:       j.spec,
+		State:     j.state,
+		Status:    j.status,
+		Error:     j.err,
+		Priority:  j.priority,
+		Tenant:    j.tenant,
+		WorkerId:  j.workerID,
+		Submitted: timestamp(j.submitted),
+		Started:   timestamp(j.started),
+		Finished:  timestamp(j.finished),
+
+		Requirements: requirementsProto(j.require),
+	}
+}
+
+// requirements converts the requirements of a job from the API
+func requirements(req *proto.Requirements) compute.Requirements {
+	if req == nil {
+		return compute.Requirements{}
+	}
+	return compute.Requirements{
+		GPU:        req.Gpu,
+		GPUVendor:  req.GpuVendor,
+		MinScratch: req.MinScratchGib * compute.GiB,
+		MinThreads: req.MinThreads,
+		Labels:     req.Labels,
+	}
+}
+
+// requirementsProto returns the API representation of req, nil if any worker
+// satisfies it
+func requirementsProto(req compute.Requirements) *proto.Requirements {
+	if req.IsZero() {
+		return nil
+	}
+	return &proto.Requirements{
+		Gpu:           req.GPU,
+		GpuVendor:     req.GPUVendor,
+		MinScratchGib: req.MinScratch / compute.GiB,
+		MinThreads:    req.MinThreads,
+		Labels:        req.Labels,
+	}
+}
+
+func timestamp(t time.Time) *timestamppb.Timestamp {
+	if t.IsZero() {
+		return nil
+	}
+	return timestamppb.New(t)
+}
@@ -0,0 +1,467 @@
+package manager
+
+import (
+	"context"
+	"io"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/golang/mock/gomock"
+	m "github.com/launchdarkly/go-test-helpers/v2/matchers"
+	"go.uber.org/zap/zaptest"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/ansg191/remote-worker/api/proto"
+	"github.com/ansg191/remote-worker/internal/budget"
+	"github.com/ansg191/remote-worker/internal/compute"
+	"github.com/ansg191/remote-worker/internal/cost"
+)
+
+// jobClient is a JobServiceClient replaying statuses. Status blocks until
+// release is closed.
+type jobClient struct {
+	proto.JobServiceClient
+	statuses []*proto.JobStatus
+	release  chan struct{}
+}
+
+func (c *jobClient) Start(context.Context, *proto.JobStartRequest, ...grpc.CallOption) (*proto.JobStartResponse, error) {
+	return &proto.JobStartResponse{}, nil
+}
+
+func (c *jobClient) Status(ctx context.Context, _ *proto.JobStatusRequest, _ ...grpc.CallOption) (proto.JobService_StatusClient, error) {
+	return &statusStream{ctx: ctx, client: c}, nil
+}
+
+func (c *jobClient) Cancel(context.Context, *proto.JobCancelRequest, ...grpc.CallOption) (*proto.JobCancelResponse, error) {
+	return &proto.JobCancelResponse{}, nil
+}
+
+type statusStream struct {
+	grpc.ClientStream
+	ctx    context.Context
+	client *jobClient
+	sent   int
+}
+
+func (s *statusStream) Recv() (*proto.JobStatus, error) {
+	if s.sent == len(s.client.statuses) {
+		select {
+		case <-s.ctx.Done():
+			return nil, status.FromContextError(s.ctx.Err()).Err()
+		case <-s.client.release:
+			return nil, io.EOF
+		}
+	}
+
+	s.sent++
+	return s.client.statuses[s.sent-1], nil
+}
+
+// watchStream is a ManagerService_WatchJobServer collecting sent statuses
+type watchStream struct {
+	grpc.ServerStream
+	ctx context.Context
+
+	mtx      sync.Mutex
+	statuses []*proto.JobStatus
+}
+
+func (s *watchStream) Context() context.Context {
+	return s.ctx
+}
+
+func (s *watchStream) Send(status *proto.JobStatus) error {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	s.statuses = append(s.statuses, status)
+	return nil
+}
+
+func newManager(t *testing.T, client proto.JobServiceClient, maxSize int, opts ...OptionsFunc) *Manager {
+	t.Helper()
+
+	ctrl := gomock.NewController(t)
+	t.Cleanup(func() {
+		ctrl.Finish()
+	})
+
+	mWorker := compute.NewMockWorker(ctrl)
+	mWorker.EXPECT().
+		IsReadyChan(gomock.Any(), gomock.Any()).
+		DoAndReturn(func(ctx context.Context, opts ...func(options *compute.ReadyOptions)) <-chan error {
+			ch := make(chan error, 1)
+			ch <- nil
+			return ch
+		}).
+		AnyTimes()
+	mWorker.EXPECT().
+		Connect(gomock.Any()).
+		Return(nil).
+		AnyTimes()
+	mWorker.EXPECT().
+		Equals(gomock.Any()).
+		Return(true).
+		AnyTimes()
+	mWorker.EXPECT().
+		Job().
+		Return(client).
+		AnyTimes()
+
+	mPool := compute.NewMockPool(ctrl)
+	mPool.EXPECT().
+		GetWorker(gomock.Any()).
+		Return(mWorker, nil).
+		AnyTimes()
+	mPool.EXPECT().
+		GetWorkerFor(gomock.Any(), gomock.Any()).
+		Return(mWorker, nil).
+		AnyTimes()
+	mPool.EXPECT().
+		ReturnWorker(gomock.Any()).
+		AnyTimes()
+	mPool.EXPECT().
+		RemoveWorker(gomock.Any()).
+		AnyTimes()
+	mPool.EXPECT().
+		Close().
+		Return(nil).
+		AnyTimes()
+
+	return New(zaptest.NewLogger(t), mPool, maxSize, opts...)
+}
+
+func waitState(t *testing.T, mgr *Manager, id string, state proto.JobInfo_State) *proto.JobInfo {
+	t.Helper()
+
+	deadline := time.Now().Add(time.Second)
+	for {
+		info, err := mgr.GetJob(context.Background(), &proto.GetJobRequest{Id: id})
+		m.For(t, "get err").Require(err, m.BeNil())
+		if info.State == state {
+			return info
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("job in state %s, expected %s", info.State, state)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+var testJob = &proto.Job{
+	SourcePath: "s3://bucket/in.mkv",
+	DestPath:   "s3://bucket/out.mp4",
+	Codec:      "hevc",
+	Bitrate:    "8M",
+}
+
+func TestManager_SubmitJob(t *testing.T) {
+	client := &jobClient{
+		statuses: []*proto.JobStatus{
+			{Status: proto.JobStatus_DOWNLOADING},
+			{Status: proto.JobStatus_ENCODING, EncodeStatus: &proto.EncodeStatus{Progress: 50}},
+		},
+		release: make(chan struct{}),
+	}
+	mgr := newManager(t, client, 1)
+	ctx := context.Background()
+
+	_, err := mgr.SubmitJob(ctx, &proto.SubmitJobRequest{Job: &proto.Job{SourcePath: "in.mkv"}})
+	m.For(t, "invalid code").Assert(status.Code(err), m.Equal(codes.InvalidArgument))
+
+	changed := mgr.Changed()
+	res, err := mgr.SubmitJob(ctx, &proto.SubmitJobRequest{
+		Job:          testJob,
+		Priority:     2,
+		Tenant:       "studio",
+		Requirements: &proto.Requirements{Gpu: true, MinScratchGib: 100},
+	})
+	m.For(t, "submit err").Require(err, m.BeNil())
+	select {
+	case <-changed:
+	default:
+		t.Error("submitting did not signal a change")
+	}
+
+	watch := &watchStream{ctx: ctx}
+	watched := make(chan error, 1)
+	go func() {
+		watched <- mgr.WatchJob(&proto.WatchJobRequest{Id: res.Id}, watch)
+	}()
+
+	info := waitState(t, mgr, res.Id, proto.JobInfo_RUNNING)
+	m.For(t, "tenant").Assert(info.Tenant, m.Equal("studio"))
+	m.For(t, "priority").Assert(info.Priority, m.Equal(int32(2)))
+	m.For(t, "scratch").Assert(info.Requirements.GetMinScratchGib(), m.Equal(uint64(100)))
+	m.For(t, "started").Assert(info.Started, m.Not(m.BeNil()))
+
+	close(client.release)
+	info = waitState(t, mgr, res.Id, proto.JobInfo_SUCCEEDED)
+	m.For(t, "progress").Assert(info.Status.EncodeStatus.Progress, m.Equal(50.0))
+	m.For(t, "finished").Assert(info.Finished, m.Not(m.BeNil()))
+
+	m.For(t, "watch err").Assert(<-watched, m.BeNil())
+	watch.mtx.Lock()
+	last := watch.statuses[len(watch.statuses)-1]
+	watch.mtx.Unlock()
+	m.For(t, "last watched").Assert(last.Status, m.Equal(proto.JobStatus_ENCODING))
+
+	_, err = mgr.CancelJob(ctx, &proto.CancelJobRequest{Id: res.Id})
+	m.For(t, "cancel finished code").Assert(status.Code(err), m.Equal(codes.FailedPrecondition))
+
+	err = mgr.Shutdown(ctx, compute.ShutdownDrain)
+	m.For(t, "shutdown err").Assert(err, m.BeNil())
+
+	_, err = mgr.SubmitJob(ctx, &proto.SubmitJobRequest{Job: testJob})
+	m.For(t, "closed code").Assert(status.Code(err), m.Equal(codes.Unavailable))
+}
+
+func TestManager_failedJob(t *testing.T) {
+	release := make(chan struct{})
+	close(release)
+	client := &jobClient{
+		statuses: []*proto.JobStatus{
+			{Status: proto.JobStatus_ERROR, Error: "ffmpeg exited"},
+		},
+		release: release,
+	}
+	mgr := newManager(t, client, 1)
+	ctx := context.Background()
+
+	res, err := mgr.SubmitJob(ctx, &proto.SubmitJobRequest{Job: testJob})
+	m.For(t, "submit err").Require(err, m.BeNil())
+
+	info := waitState(t, mgr, res.Id, proto.JobInfo_FAILED)
+	m.For(t, "error").Assert(info.Error, m.Equal("job failed: ffmpeg exited"))
+
+	watch := &watchStream{ctx: ctx}
+	err = mgr.WatchJob(&proto.WatchJobRequest{Id: res.Id}, watch)
+	m.For(t, "watch err").Assert(err, m.BeNil())
+	m.For(t, "watched").Assert(watch.statuses, m.Length().Should(m.Equal(1)))
+	m.For(t, "watched error").Assert(watch.statuses[0].Error, m.Equal("ffmpeg exited"))
+}
+
+func TestManager_CancelJob(t *testing.T) {
+	client := &jobClient{release: make(chan struct{})}
+	mgr := newManager(t, client, 1)
+	ctx := context.Background()
+
+	_, err := mgr.CancelJob(ctx, &proto.CancelJobRequest{Id: "unknown"})
+	m.For(t, "not found code").Assert(status.Code(err), m.Equal(codes.NotFound))
+
+	running, err := mgr.SubmitJob(ctx, &proto.SubmitJobRequest{Job: testJob, Tenant: "a"})
+	m.For(t, "submit err").Require(err, m.BeNil())
+	waitState(t, mgr, running.Id, proto.JobInfo_RUNNING)
+
+	// maxSize of 1 keeps the second job queued
+	queued, err := mgr.SubmitJob(ctx, &proto.SubmitJobRequest{Job: testJob, Tenant: "b"})
+	m.For(t, "submit err").Require(err, m.BeNil())
+
+	list, err := mgr.ListJobs(ctx, &proto.ListJobsRequest{States: []proto.JobInfo_State{proto.JobInfo_QUEUED}})
+	m.For(t, "list err").Require(err, m.BeNil())
+	m.For(t, "queued jobs").Assert(list.Jobs, m.Length().Should(m.Equal(1)))
+	m.For(t, "queued id").Assert(list.Jobs[0].Id, m.Equal(queued.Id))
+
+	_, err = mgr.CancelJob(ctx, &proto.CancelJobRequest{Id: queued.Id})
+	m.For(t, "cancel queued err").Assert(err, m.BeNil())
+	waitState(t, mgr, queued.Id, proto.JobInfo_CANCELED)
+
+	_, err = mgr.CancelJob(ctx, &proto.CancelJobRequest{Id: running.Id})
+	m.For(t, "cancel running err").Assert(err, m.BeNil())
+	waitState(t, mgr, running.Id, proto.JobInfo_CANCELED)
+
+	list, err = mgr.ListJobs(ctx, &proto.ListJobsRequest{Tenant: "a"})
+	m.For(t, "list err").Require(err, m.BeNil())
+	m.For(t, "tenant jobs").Assert(list.Jobs, m.Length().Should(m.Equal(1)))
+	m.For(t, "tenant id").Assert(list.Jobs[0].Id, m.Equal(running.Id))
+}
+
+// memJournal is an in-memory Journal
+type memJournal struct {
+	mtx     sync.Mutex
+	state   *compute.JournalState
+	entries []compute.JournalEntry
+}
+
+func (j *memJournal) Record(entry compute.JournalEntry) error {
+	j.mtx.Lock()
+	defer j.mtx.Unlock()
+	j.entries = append(j.entries, entry)
+	return nil
+}
+
+func (j *memJournal) State() *compute.JournalState {
+	return j.state
+}
+
+func (j *memJournal) Close() error {
+	return nil
+}
+
+func TestManager_restore(t *testing.T) {
+	client := &jobClient{
+		statuses: []*proto.JobStatus{
+			{Status: proto.JobStatus_ENCODING, EncodeStatus: &proto.EncodeStatus{Progress: 30}},
+		},
+		release: make(chan struct{}),
+	}
+
+	journal := &memJournal{
+		state: &compute.JournalState{
+			Pending: []compute.JournalEntry{{
+				Type:     compute.JournalWorkSubmitted,
+				WorkID:   "restored",
+				Kind:     encodeWork.Name(),
+				Payload:  []byte(`{"job":{"sourcePath":"in.mkv","destPath":"out.mp4"}}`),
+				Priority: 4,
+
+				Requirements: &compute.Requirements{Labels: map[string]string{"region": "eu"}},
+			}},
+		},
+	}
+	mgr := newManager(t, client, 1, WithJournal(journal))
+	ctx := context.Background()
+
+	// Statuses of replayed jobs are reported
+	watch := &watchStream{ctx: ctx}
+	watched := make(chan error, 1)
+	go func() {
+		watched <- mgr.WatchJob(&proto.WatchJobRequest{Id: "restored"}, watch)
+	}()
+
+	deadline := time.Now().Add(time.Second)
+	for {
+		info, err := mgr.GetJob(ctx, &proto.GetJobRequest{Id: "restored"})
+		m.For(t, "get err").Require(err, m.BeNil())
+		if info.Status.GetEncodeStatus().GetProgress() == 30 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("status of replayed job not reported")
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	close(client.release)
+	info := waitState(t, mgr, "restored", proto.JobInfo_SUCCEEDED)
+	m.For(t, "watch err").Assert(<-watched, m.BeNil())
+	watch.mtx.Lock()
+	m.For(t, "watched").Assert(watch.statuses, m.Not(m.Length().Should(m.Equal(0))))
+	m.For(t, "watched progress").Assert(watch.statuses[len(watch.statuses)-1].GetEncodeStatus().GetProgress(), m.Equal(30.0))
+	watch.mtx.Unlock()
+
+	m.For(t, "source").Assert(info.Job.SourcePath, m.Equal("in.mkv"))
+	m.For(t, "priority").Assert(info.Priority, m.Equal(int32(4)))
+	m.For(t, "labels").Assert(info.Requirements.GetLabels(), m.Equal(map[string]string{"region": "eu"}))
+}
+
+func TestManager_events(t *testing.T) {
+	release := make(chan struct{})
+	close(release)
+	client := &jobClient{release: release}
+
+	var mtx sync.Mutex
+	var events []JobEvent
+	mgr := newManager(t, client, 1, WithJobEventHandler(func(event JobEvent) {
+		mtx.Lock()
+		defer mtx.Unlock()
+		events = append(events, event)
+	}))
+
+	res, err := mgr.SubmitJob(context.Background(), &proto.SubmitJobRequest{Job: testJob, Tenant: "studio"})
+	m.For(t, "submit err").Require(err, m.BeNil())
+	waitState(t, mgr, res.Id, proto.JobInfo_SUCCEEDED)
+
+	mtx.Lock()
+	defer mtx.Unlock()
+	m.For(t, "events").Require(events, m.Length().Should(m.Equal(3)))
+	m.For(t, "queued").Assert(events[0].Type, m.Equal(JobQueued))
+	m.For(t, "queued state").Assert(events[0].Job.State, m.Equal(proto.JobInfo_QUEUED))
+	m.For(t, "started").Assert(events[1].Type, m.Equal(JobStarted))
+	m.For(t, "succeeded").Assert(events[2].Type, m.Equal(JobSucceeded))
+	m.For(t, "succeeded id").Assert(events[2].Job.Id, m.Equal(res.Id))
+	m.For(t, "succeeded finished").Assert(events[2].Job.Finished, m.Not(m.BeNil()))
+}
+
+func TestManager_GetCosts(t *testing.T) {
+	release := make(chan struct{})
+	close(release)
+	client := &jobClient{release: release}
+	ctx := context.Background()
+
+	mgr := newManager(t, client, 1)
+	_, err := mgr.GetCosts(ctx, &proto.GetCostsRequest{})
+	m.For(t, "disabled code").Assert(status.Code(err), m.Equal(codes.FailedPrecondition))
+
+	mgr = newManager(t, client, 1, WithAccountant(cost.New(zaptest.NewLogger(t), nil)))
+	res, err := mgr.SubmitJob(ctx, &proto.SubmitJobRequest{Job: testJob, Tenant: "studio"})
+	m.For(t, "submit err").Require(err, m.BeNil())
+
+	info := waitState(t, mgr, res.Id, proto.JobInfo_SUCCEEDED)
+	m.For(t, "job cost").Assert(info.Cost, m.Not(m.BeNil()))
+
+	costs, err := mgr.GetCosts(ctx, &proto.GetCostsRequest{Tenant: "studio"})
+	m.For(t, "costs err").Require(err, m.BeNil())
+	m.For(t, "tenants").Require(costs.Tenants, m.Length().Should(m.Equal(1)))
+	m.For(t, "tenant jobs").Assert(costs.Tenants[0].Jobs, m.Equal(int32(1)))
+
+	costs, err = mgr.GetCosts(ctx, &proto.GetCostsRequest{Tenant: "archive"})
+	m.For(t, "other tenant err").Require(err, m.BeNil())
+	m.For(t, "other tenant").Assert(costs.Tenants, m.Length().Should(m.Equal(0)))
+}
+
+// fixedSpend is a budget.Spender reporting the same spend for any window
+type fixedSpend float64
+
+func (s fixedSpend) Spend(time.Time, time.Time) float64 {
+	return float64(s)
+}
+
+func TestManager_budgets(t *testing.T) {
+	release := make(chan struct{})
+	close(release)
+	client := &jobClient{release: release}
+	ctx := context.Background()
+
+	mgr := newManager(t, client, 1)
+	_, err := mgr.ListBudgets(ctx, &proto.ListBudgetsRequest{})
+	m.For(t, "disabled code").Assert(status.Code(err), m.Equal(codes.FailedPrecondition))
+
+	guard := budget.New(zaptest.NewLogger(t), fixedSpend(20), []budget.Budget{
+		{Name: "daily", Period: budget.Daily, Soft: 5, Hard: 10},
+	})
+	t.Cleanup(func() {
+		_ = guard.Close()
+	})
+	mgr = newManager(t, client, 1, WithGuard(guard))
+
+	budgets, err := mgr.ListBudgets(ctx, &proto.ListBudgetsRequest{})
+	m.For(t, "list err").Require(err, m.BeNil())
+	m.For(t, "budgets").Require(budgets.Budgets, m.Length().Should(m.Equal(1)))
+	m.For(t, "exceeded").Assert(budgets.Budgets[0].Exceeded, m.Equal(true))
+	m.For(t, "spend").Assert(budgets.Budgets[0].Spend, m.Equal(20.0))
+
+	// Jobs are held while the hard limit is exceeded
+	res, err := mgr.SubmitJob(ctx, &proto.SubmitJobRequest{Job: testJob})
+	m.For(t, "submit err").Require(err, m.BeNil())
+	m.For(t, "held").Assert(mgr.Queue().Held(), m.Equal(true))
+	m.For(t, "not paused").Assert(mgr.Queue().Paused(), m.Equal(false))
+
+	_, err = mgr.OverrideBudget(ctx, &proto.OverrideBudgetRequest{Name: "daily", Seconds: -1})
+	m.For(t, "negative code").Assert(status.Code(err), m.Equal(codes.InvalidArgument))
+	_, err = mgr.OverrideBudget(ctx, &proto.OverrideBudgetRequest{Name: "weekly", Seconds: 60})
+	m.For(t, "unknown code").Assert(status.Code(err), m.Equal(codes.NotFound))
+
+	overridden, err := mgr.OverrideBudget(ctx, &proto.OverrideBudgetRequest{Name: "daily", Seconds: 3600})
+	m.For(t, "override err").Require(err, m.BeNil())
+	m.For(t, "overridden").Assert(overridden.Exceeded, m.Equal(false))
+	m.For(t, "override until").Assert(overridden.OverrideUntil, m.Not(m.BeNil()))
+
+	waitState(t, mgr, res.Id, proto.JobInfo_SUCCEEDED)
+
+	_, err = mgr.ResetBudget(ctx, &proto.ResetBudgetRequest{Name: "daily"})
+	m.For(t, "reset code").Assert(status.Code(err), m.Equal(codes.FailedPrecondition))
+}
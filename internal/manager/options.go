@@ -0,0 +1,57 @@
+package manager
+
+import (
+	"github.com/ansg191/remote-worker/internal/budget"
+	"github.com/ansg191/remote-worker/internal/compute"
+	"github.com/ansg191/remote-worker/internal/cost"
+)
+
+type Options struct {
+	// Journal records submitted jobs. Unfinished jobs in the journal are
+	// listed again and replayed when the manager is created.
+	Journal compute.Journal
+	// QueueOptions are passed to compute.NewQueue
+	QueueOptions []compute.QueueOptionsFunc
+	// EventHandlers are called with every JobEvent.
+	EventHandlers []JobEventHandler
+	// Accountant reports the costs of jobs. It is fed the events of the
+	// queue, but must be fed the events of the pool. Cost accounting is
+	// disabled if nil.
+	Accountant *cost.Accountant
+	// Guard enforces budgets. It watches the queue, holding queued jobs while
+	// a hard limit is exceeded, but must also wrap the factory of the pool.
+	// Budgets are disabled if nil.
+	Guard *budget.Guard
+}
+
+type OptionsFunc func(options *Options)
+
+func WithJournal(journal compute.Journal) OptionsFunc {
+	return func(opts *Options) {
+		opts.Journal = journal
+	}
+}
+
+func WithQueueOptions(queueOpts ...compute.QueueOptionsFunc) OptionsFunc {
+	return func(opts *Options) {
+		opts.QueueOptions = append(opts.QueueOptions, queueOpts...)
+	}
+}
+
+func WithJobEventHandler(handler JobEventHandler) OptionsFunc {
+	return func(opts *Options) {
+		opts.EventHandlers = append(opts.EventHandlers, handler)
+	}
+}
+
+func WithAccountant(accountant *cost.Accountant) OptionsFunc {
+	return func(opts *Options) {
+		opts.Accountant = accountant
+	}
+}
+
+func WithGuard(guard *budget.Guard) OptionsFunc {
+	return func(opts *Options) {
+		opts.Guard = guard
+	}
+}
@@ -0,0 +1,205 @@
+package metrics
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/ansg191/remote-worker/internal/compute"
+)
+
+const namespace = "remote_worker"
+
+// Failure reasons of work
+const (
+	ReasonCanceled    = "canceled"
+	ReasonDeadline    = "deadline_exceeded"
+	ReasonQueueClosed = "queue_closed"
+	ReasonWorker      = "worker"
+	ReasonJob         = "job"
+)
+
+// Metrics collects Prometheus metrics from a compute.Pool and a
+// compute.WorkQueue. Events are fed with HandlePoolEvent and HandleQueueEvent,
+// and gauges are read from the pool and queue registered with Observe.
+type Metrics struct {
+	registry *prometheus.Registry
+
+	provisioning prometheus.Histogram
+	jobDuration  prometheus.Histogram
+	queueWait    prometheus.Histogram
+	failures     *prometheus.CounterVec
+	terminated   *prometheus.CounterVec
+
+	mtx      sync.Mutex
+	creating map[compute.Worker]time.Time // Create start of workers not yet started
+}
+
+func New() *Metrics {
+	m := &Metrics{
+		registry: prometheus.NewRegistry(),
+		provisioning: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Namespace: namespace,
+			Name:      "provisioning_seconds",
+			Help:      "Time from creating a worker until it is ready, for workers created on demand.",
+			Buckets:   []float64{5, 10, 20, 30, 45, 60, 90, 120, 180, 300, 600},
+		}),
+		jobDuration: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Namespace: namespace,
+			Name:      "job_duration_seconds",
+			Help:      "Time work ran on a worker.",
+			Buckets:   prometheus.ExponentialBuckets(1, 2, 16),
+		}),
+		queueWait: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Namespace: namespace,
+			Name:      "queue_wait_seconds",
+			Help:      "Time work was queued before it started running.",
+			Buckets:   prometheus.ExponentialBuckets(0.1, 2, 16),
+		}),
+		failures: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "work_failures_total",
+			Help:      "Work that finally failed, by reason.",
+		}, []string{"reason"}),
+		terminated: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "instances_terminated_total",
+			Help:      "Workers removed from the pool, by reason.",
+		}, []string{"reason"}),
+		creating: make(map[compute.Worker]time.Time),
+	}
+
+	m.registry.MustRegister(
+		m.provisioning,
+		m.jobDuration,
+		m.queueWait,
+		m.failures,
+		m.terminated,
+		prometheus.NewGoCollector(),
+		prometheus.NewProcessCollector(prometheus.ProcessCollectorOpts{}),
+	)
+
+	return m
+}
+
+// Observe registers gauges reading the state of pool and queue
+func (m *Metrics) Observe(pool compute.Pool, queue compute.WorkQueue) {
+	poolGauge := func(name, help string, value func(stats compute.PoolStats) int) prometheus.Collector {
+		return prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      name,
+			Help:      help,
+		}, func() float64 {
+			return float64(value(pool.Stats()))
+		})
+	}
+	queueGauge := func(name, help string, value func(stats compute.TenantStats) int) prometheus.Collector {
+		return prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      name,
+			Help:      help,
+		}, func() float64 {
+			total := 0
+			for _, stats := range queue.TenantStats() {
+				total += value(stats)
+			}
+			return float64(total)
+		})
+	}
+
+	m.registry.MustRegister(
+		poolGauge("workers_live", "Workers in the pool, available or in use.",
+			func(stats compute.PoolStats) int { return stats.Live }),
+		poolGauge("workers_available", "Idle workers in the pool.",
+			func(stats compute.PoolStats) int { return stats.Available }),
+		poolGauge("workers_in_use", "Workers taken from the pool.",
+			func(stats compute.PoolStats) int { return stats.Live - stats.Available }),
+		poolGauge("workers_pending", "Workers being created.",
+			func(stats compute.PoolStats) int { return stats.Pending }),
+		queueGauge("queue_depth", "Work waiting in the queue.",
+			func(stats compute.TenantStats) int { return stats.Queued }),
+		queueGauge("queue_running", "Work dispatched to workers.",
+			func(stats compute.TenantStats) int { return stats.Running }),
+	)
+}
+
+// HandlePoolEvent is a compute.PoolEventHandler
+func (m *Metrics) HandlePoolEvent(event compute.PoolEvent) {
+	switch event.Type {
+	case compute.WorkerCreated:
+		if event.Warm {
+			// Warm workers may sit idle before their first work, which would
+			// skew provisioning times
+			return
+		}
+		m.mtx.Lock()
+		m.creating[event.Worker] = event.Time.Add(-event.Duration)
+		m.mtx.Unlock()
+	case compute.WorkerRemoved:
+		m.mtx.Lock()
+		delete(m.creating, event.Worker)
+		m.mtx.Unlock()
+		m.terminated.WithLabelValues(string(event.Reason)).Inc()
+	}
+}
+
+// HandleQueueEvent is a compute.QueueEventHandler
+func (m *Metrics) HandleQueueEvent(event compute.QueueEvent) {
+	switch event.Type {
+	case compute.WorkStarted:
+		m.queueWait.Observe(event.Wait.Seconds())
+
+		m.mtx.Lock()
+		created, ok := m.creating[event.Worker]
+		delete(m.creating, event.Worker)
+		m.mtx.Unlock()
+
+		if ok {
+			m.provisioning.Observe(event.Time.Sub(created).Seconds())
+		}
+	case compute.WorkFinished:
+		if event.Duration > 0 {
+			m.jobDuration.Observe(event.Duration.Seconds())
+		}
+		if event.Err != nil {
+			m.failures.WithLabelValues(FailureReason(event.Err)).Inc()
+		}
+	}
+}
+
+// FailureReason classifies the error of failed work
+func FailureReason(err error) string {
+	var workerErr *compute.WorkerError
+	switch {
+	case errors.Is(err, compute.ErrQueueClosed):
+		return ReasonQueueClosed
+	case errors.Is(err, context.Canceled):
+		return ReasonCanceled
+	case errors.Is(err, context.DeadlineExceeded):
+		return ReasonDeadline
+	case errors.As(err, &workerErr) || errors.Is(err, compute.ErrClosed):
+		return ReasonWorker
+	}
+
+	var retryErr *compute.RetryError
+	if errors.As(err, &retryErr) {
+		err = retryErr.Unwrap()
+	}
+	if s, ok := status.FromError(err); ok && s.Code() != codes.OK {
+		return "grpc_" + strings.ToLower(s.Code().String())
+	}
+	return ReasonJob
+}
+
+// Handler returns an HTTP handler serving the metrics
+func (m *Metrics) Handler() http.Handler {
+	return promhttp.HandlerFor(m.registry, promhttp.HandlerOpts{})
+}
@@ -0,0 +1,134 @@
+package metrics
+
+import (
+	"context"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/golang/mock/gomock"
+	m "github.com/launchdarkly/go-test-helpers/v2/matchers"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"go.uber.org/zap"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/ansg191/remote-worker/internal/compute"
+)
+
+func TestFailureReason(t *testing.T) {
+	tests := []struct {
+		name   string
+		err    error
+		reason string
+	}{
+		{"canceled", context.Canceled, ReasonCanceled},
+		{"deadline", context.DeadlineExceeded, ReasonDeadline},
+		{"queue closed", compute.ErrQueueClosed, ReasonQueueClosed},
+		{"worker", &compute.WorkerError{Err: compute.ErrClosed}, ReasonWorker},
+		{"grpc", status.Error(codes.Unavailable, "down"), "grpc_unavailable"},
+		{"retries", &compute.RetryError{Attempts: []error{status.Error(codes.Internal, "")}}, "grpc_internal"},
+		{"job", context.TODO().Err(), ReasonJob},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			m.For(t, "reason").Assert(FailureReason(test.err), m.Equal(test.reason))
+		})
+	}
+}
+
+func TestMetrics(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	t.Cleanup(func() {
+		ctrl.Finish()
+	})
+
+	mWorker := compute.NewMockWorker(ctrl)
+	warmWorker := compute.NewMockWorker(ctrl)
+
+	mPool := compute.NewMockPool(ctrl)
+	mPool.EXPECT().
+		Stats().
+		Return(compute.PoolStats{Live: 3, Available: 1, Pending: 2}).
+		AnyTimes()
+
+	metrics := New()
+	metrics.Observe(mPool, compute.NewQueue(zap.NewNop(), mPool, 0))
+
+	now := time.Now()
+	metrics.HandlePoolEvent(compute.PoolEvent{
+		Type:     compute.WorkerCreated,
+		Worker:   mWorker,
+		Time:     now,
+		Duration: 5 * time.Second,
+	})
+	metrics.HandlePoolEvent(compute.PoolEvent{
+		Type:   compute.WorkerCreated,
+		Worker: warmWorker,
+		Time:   now,
+		Warm:   true,
+	})
+	metrics.HandleQueueEvent(compute.QueueEvent{
+		Type:   compute.WorkStarted,
+		Worker: mWorker,
+		Time:   now.Add(25 * time.Second),
+		Wait:   time.Second,
+	})
+	metrics.HandleQueueEvent(compute.QueueEvent{
+		Type:   compute.WorkStarted,
+		Worker: warmWorker,
+		Time:   now.Add(time.Hour),
+	})
+	metrics.HandleQueueEvent(compute.QueueEvent{
+		Type:     compute.WorkFinished,
+		Duration: time.Minute,
+		Err:      context.Canceled,
+	})
+	metrics.HandlePoolEvent(compute.PoolEvent{
+		Type:   compute.WorkerRemoved,
+		Worker: mWorker,
+		Reason: compute.ReasonIdle,
+	})
+
+	m.For(t, "failures").Assert(
+		testutil.ToFloat64(metrics.failures.WithLabelValues(ReasonCanceled)), m.Equal(1.0))
+	m.For(t, "terminated").Assert(
+		testutil.ToFloat64(metrics.terminated.WithLabelValues(string(compute.ReasonIdle))), m.Equal(1.0))
+
+	err := testutil.CollectAndCompare(metrics.provisioning, strings.NewReader(`
+# HELP remote_worker_provisioning_seconds Time from creating a worker until it is ready, for workers created on demand.
+# TYPE remote_worker_provisioning_seconds histogram
+remote_worker_provisioning_seconds_bucket{le="5"} 0
+remote_worker_provisioning_seconds_bucket{le="10"} 0
+remote_worker_provisioning_seconds_bucket{le="20"} 0
+remote_worker_provisioning_seconds_bucket{le="30"} 1
+remote_worker_provisioning_seconds_bucket{le="45"} 1
+remote_worker_provisioning_seconds_bucket{le="60"} 1
+remote_worker_provisioning_seconds_bucket{le="90"} 1
+remote_worker_provisioning_seconds_bucket{le="120"} 1
+remote_worker_provisioning_seconds_bucket{le="180"} 1
+remote_worker_provisioning_seconds_bucket{le="300"} 1
+remote_worker_provisioning_seconds_bucket{le="600"} 1
+remote_worker_provisioning_seconds_bucket{le="+Inf"} 1
+remote_worker_provisioning_seconds_sum 30
+remote_worker_provisioning_seconds_count 1
+`))
+	m.For(t, "provisioning").Assert(err, m.BeNil())
+
+	rec := httptest.NewRecorder()
+	metrics.Handler().ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	body := rec.Body.String()
+
+	for _, line := range []string{
+		"remote_worker_workers_live 3",
+		"remote_worker_workers_available 1",
+		"remote_worker_workers_in_use 2",
+		"remote_worker_workers_pending 2",
+		"remote_worker_queue_depth 0",
+		"remote_worker_queue_wait_seconds_count 2",
+		"remote_worker_job_duration_seconds_count 1",
+	} {
+		m.For(t, "body").Assert(strings.Contains(body, line+"\n"), m.Equal(true))
+	}
+}
@@ -0,0 +1,87 @@
+package tracing
+
+import (
+	"context"
+	"net"
+	"testing"
+
+	m "github.com/launchdarkly/go-test-helpers/v2/matchers"
+	"go.opentelemetry.io/contrib/instrumentation/google.golang.org/grpc/otelgrpc"
+	"go.opentelemetry.io/otel/propagation"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/test/bufconn"
+
+	"github.com/ansg191/remote-worker/api/proto"
+)
+
+type workerServer struct {
+	proto.UnimplementedWorkerServiceServer
+	spanContext chan trace.SpanContext
+}
+
+func (s *workerServer) Status(ctx context.Context, _ *proto.WorkerStatusRequest) (*proto.WorkerStatusResponse, error) {
+	s.spanContext <- trace.SpanContextFromContext(ctx)
+	return &proto.WorkerStatusResponse{Msg: "OK"}, nil
+}
+
+func TestSetup(t *testing.T) {
+	shutdown, err := Setup(context.Background(), "test", ExporterNone)
+	m.For(t, "none err").Require(err, m.BeNil())
+	m.For(t, "shutdown err").Assert(shutdown(context.Background()), m.BeNil())
+
+	_, err = Setup(context.Background(), "test", "zipkin")
+	m.For(t, "unknown err").Assert(err, m.Not(m.BeNil()))
+}
+
+func TestPropagation(t *testing.T) {
+	exporter := tracetest.NewInMemoryExporter()
+	tp := sdktrace.NewTracerProvider(sdktrace.WithSyncer(exporter))
+	opts := []otelgrpc.Option{
+		otelgrpc.WithTracerProvider(tp),
+		otelgrpc.WithPropagators(propagation.TraceContext{}),
+	}
+
+	lis := bufconn.Listen(1 << 20)
+	server := grpc.NewServer(ServerOptions(opts...)...)
+	worker := &workerServer{spanContext: make(chan trace.SpanContext, 1)}
+	proto.RegisterWorkerServiceServer(server, worker)
+	go func() {
+		_ = server.Serve(lis)
+	}()
+	t.Cleanup(server.Stop)
+
+	dialOpts := append([]grpc.DialOption{
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) {
+			return lis.DialContext(ctx)
+		}),
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+	}, DialOptions(opts...)...)
+	conn, err := grpc.Dial("bufnet", dialOpts...)
+	m.For(t, "dial err").Require(err, m.BeNil())
+	t.Cleanup(func() {
+		_ = conn.Close()
+	})
+
+	ctx, span := tp.Tracer("test").Start(context.Background(), "parent")
+	_, err = proto.NewWorkerServiceClient(conn).Status(ctx, &proto.WorkerStatusRequest{})
+	span.End()
+	m.For(t, "status err").Require(err, m.BeNil())
+
+	remote := <-worker.spanContext
+	m.For(t, "trace id").Assert(remote.TraceID(), m.Equal(span.SpanContext().TraceID()))
+
+	var names []any
+	for _, stub := range exporter.GetSpans() {
+		names = append(names, stub.Name)
+		m.For(t, stub.Name+" trace id").Assert(stub.SpanContext.TraceID(), m.Equal(span.SpanContext().TraceID()))
+	}
+	m.For(t, "spans").Assert(names, m.ItemsInAnyOrder(
+		m.Equal("parent"),
+		m.Equal("encoder_worker.WorkerService/Status"),
+		m.Equal("encoder_worker.WorkerService/Status"),
+	))
+}
@@ -0,0 +1,52 @@
+package webhook
+
+import (
+	"io"
+	"net/http"
+	"time"
+)
+
+type Options struct {
+	// Client sends deliveries. Defaults to http.DefaultClient.
+	Client *http.Client
+	// Timeout bounds a single delivery attempt. Defaults to 10 seconds.
+	Timeout time.Duration
+	// MaxAttempts is the total number of attempts of a delivery, including
+	// the first. Defaults to 5.
+	MaxAttempts int
+	// InitialBackoff is the delay before the first retry, doubled after
+	// every attempt. Defaults to 1 second.
+	InitialBackoff time.Duration
+	// MaxBackoff caps the delay between attempts. Defaults to 1 minute.
+	MaxBackoff time.Duration
+	// DeadLetterLog receives every DeadLetter as a line of JSON
+	DeadLetterLog io.Writer
+}
+
+type OptionsFunc func(options *Options)
+
+func WithClient(client *http.Client) OptionsFunc {
+	return func(opts *Options) {
+		opts.Client = client
+	}
+}
+
+func WithTimeout(timeout time.Duration) OptionsFunc {
+	return func(opts *Options) {
+		opts.Timeout = timeout
+	}
+}
+
+func WithRetry(maxAttempts int, initialBackoff, maxBackoff time.Duration) OptionsFunc {
+	return func(opts *Options) {
+		opts.MaxAttempts = maxAttempts
+		opts.InitialBackoff = initialBackoff
+		opts.MaxBackoff = maxBackoff
+	}
+}
+
+func WithDeadLetterLog(w io.Writer) OptionsFunc {
+	return func(opts *Options) {
+		opts.DeadLetterLog = w
+	}
+}
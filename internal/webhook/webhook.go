@@ -0,0 +1,413 @@
+package webhook
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
+	"google.golang.org/protobuf/encoding/protojson"
+
+	"github.com/ansg191/remote-worker/internal/manager"
+)
+
+// Headers of deliveries
+const (
+	// HeaderSignature is the hex encoded HMAC-SHA256 of the body keyed with
+	// the endpoint's secret, prefixed with "sha256="
+	HeaderSignature = "X-Remote-Worker-Signature"
+	HeaderEvent     = "X-Remote-Worker-Event"
+	HeaderDelivery  = "X-Remote-Worker-Delivery"
+)
+
+// queueSize is the number of deliveries buffered per endpoint. Events
+// arriving at a full queue are dead-lettered.
+const queueSize = 1024
+
+var ErrQueueFull = errors.New("delivery queue full")
+
+// Endpoint receives job events
+type Endpoint struct {
+	URL string
+	// Secret signs deliveries. Deliveries are unsigned if empty.
+	Secret string
+	// Events are the job events sent to the endpoint. All events are sent if
+	// empty.
+	Events []manager.JobEventType
+}
+
+// Payload is the JSON body of a delivery
+type Payload struct {
+	ID    string    `json:"id"`
+	Event string    `json:"event"` // e.g. job.succeeded
+	Time  time.Time `json:"time"`
+	Job   Job       `json:"job"`
+}
+
+type Job struct {
+	ID string `json:"id"`
+	// Spec is the submitted api/proto Job
+	Spec     json.RawMessage `json:"spec"`
+	Output   string          `json:"output"`
+	State    string          `json:"state"`
+	Tenant   string          `json:"tenant,omitempty"`
+	Priority int32           `json:"priority,omitempty"`
+	WorkerID string          `json:"workerId,omitempty"`
+	// Duration is how long the last attempt ran, set for finished jobs
+	Duration float64 `json:"durationSeconds,omitempty"`
+	Error    string  `json:"error,omitempty"`
+	// Cost is the cost of the job so far in USD, if accounted
+	Cost float64 `json:"cost,omitempty"`
+}
+
+// DeadLetter is a delivery that could not be delivered
+type DeadLetter struct {
+	ID       string          `json:"id"`
+	URL      string          `json:"url"`
+	Event    string          `json:"event"`
+	Payload  json.RawMessage `json:"payload"`
+	Attempts int             `json:"attempts"`
+	Error    string          `json:"error"`
+	Time     time.Time       `json:"time"`
+}
+
+// Notifier delivers manager.JobEvent to webhook endpoints. Events are fed with
+// HandleJobEvent. Every endpoint receives its events in order from a
+// background routine. Failed deliveries are retried with exponential backoff
+// and dead-lettered once attempts run out.
+type Notifier struct {
+	logger  *zap.Logger
+	options Options
+
+	ctx    context.Context
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+
+	endpoints []*endpoint
+
+	mtx         sync.Mutex // Mutex for below fields
+	deadLetters []DeadLetter
+	closed      bool
+}
+
+type endpoint struct {
+	Endpoint
+	events map[manager.JobEventType]bool
+	queue  chan delivery
+}
+
+type delivery struct {
+	id    string
+	event string
+	body  []byte
+}
+
+func New(logger *zap.Logger, endpoints []Endpoint, opts ...OptionsFunc) *Notifier {
+	options := Options{
+		Client:         http.DefaultClient,
+		Timeout:        10 * time.Second,
+		MaxAttempts:    5,
+		InitialBackoff: time.Second,
+		MaxBackoff:     time.Minute,
+	}
+	for _, opt := range opts {
+		opt(&options)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	n := &Notifier{
+		logger:  logger,
+		options: options,
+		ctx:     ctx,
+		cancel:  cancel,
+	}
+
+	for _, e := range endpoints {
+		ep := &endpoint{
+			Endpoint: e,
+			events:   make(map[manager.JobEventType]bool),
+			queue:    make(chan delivery, queueSize),
+		}
+		for _, t := range e.Events {
+			ep.events[t] = true
+		}
+		n.endpoints = append(n.endpoints, ep)
+
+		n.wg.Add(1)
+		go n.run(ep)
+	}
+
+	return n
+}
+
+// HandleJobEvent queues event for delivery to the endpoints subscribed to it
+func (n *Notifier) HandleJobEvent(event manager.JobEvent) {
+	d, err := newDelivery(event)
+	if err != nil {
+		n.logger.Error("error encoding webhook payload", zap.Error(err))
+		return
+	}
+
+	n.mtx.Lock()
+	defer n.mtx.Unlock()
+
+	if n.closed {
+		return
+	}
+
+	for _, ep := range n.endpoints {
+		if len(ep.events) > 0 && !ep.events[event.Type] {
+			continue
+		}
+
+		select {
+		case ep.queue <- d:
+		default:
+			n.deadLetter(ep, d, 0, ErrQueueFull)
+		}
+	}
+}
+
+// DeadLetters returns the deliveries that failed since the Notifier was
+// created
+func (n *Notifier) DeadLetters() []DeadLetter {
+	n.mtx.Lock()
+	defer n.mtx.Unlock()
+	return append([]DeadLetter(nil), n.deadLetters...)
+}
+
+// Close stops accepting events and waits for queued deliveries. Deliveries
+// still pending when ctx is done are aborted and dead-lettered.
+func (n *Notifier) Close(ctx context.Context) error {
+	n.mtx.Lock()
+	if !n.closed {
+		n.closed = true
+		for _, ep := range n.endpoints {
+			close(ep.queue)
+		}
+	}
+	n.mtx.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		n.wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		n.cancel()
+		return nil
+	case <-ctx.Done():
+		n.cancel()
+		<-done
+		return ctx.Err()
+	}
+}
+
+// run delivers the queued deliveries of ep in order
+func (n *Notifier) run(ep *endpoint) {
+	defer n.wg.Done()
+
+	for d := range ep.queue {
+		n.deliver(ep, d)
+	}
+}
+
+// deliver posts d to ep until it succeeds, fails permanently or attempts run
+// out
+func (n *Notifier) deliver(ep *endpoint, d delivery) {
+	backoff := n.options.InitialBackoff
+	for attempt := 1; ; attempt++ {
+		err := n.post(ep, d)
+		if err == nil {
+			return
+		}
+
+		var permanent *permanentError
+		if errors.As(err, &permanent) || attempt >= n.options.MaxAttempts || n.ctx.Err() != nil {
+			n.mtx.Lock()
+			n.deadLetter(ep, d, attempt, err)
+			n.mtx.Unlock()
+			return
+		}
+
+		n.logger.Warn("webhook delivery failed, retrying",
+			zap.String("url", ep.URL),
+			zap.String("delivery", d.id),
+			zap.Int("attempt", attempt),
+			zap.Duration("backoff", backoff),
+			zap.Error(err))
+
+		timer := time.NewTimer(backoff)
+		select {
+		case <-n.ctx.Done():
+			timer.Stop()
+			n.mtx.Lock()
+			n.deadLetter(ep, d, attempt, n.ctx.Err())
+			n.mtx.Unlock()
+			return
+		case <-timer.C:
+		}
+
+		backoff *= 2
+		if n.options.MaxBackoff > 0 && backoff > n.options.MaxBackoff {
+			backoff = n.options.MaxBackoff
+		}
+	}
+}
+
+// permanentError is returned by post for failures that are not retried
+type permanentError struct {
+	err error
+}
+
+func (e *permanentError) Error() string {
+	return e.err.Error()
+}
+
+func (n *Notifier) post(ep *endpoint, d delivery) error {
+	ctx, cancel := context.WithTimeout(n.ctx, n.options.Timeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, ep.URL, bytes.NewReader(d.body))
+	if err != nil {
+		return &permanentError{err: err}
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(HeaderEvent, d.event)
+	req.Header.Set(HeaderDelivery, d.id)
+	if ep.Secret != "" {
+		req.Header.Set(HeaderSignature, Sign(ep.Secret, d.body))
+	}
+
+	res, err := n.options.Client.Do(req)
+	if err != nil {
+		return err
+	}
+	_, _ = io.Copy(io.Discard, res.Body)
+	_ = res.Body.Close()
+
+	if res.StatusCode >= 200 && res.StatusCode < 300 {
+		return nil
+	}
+
+	err = errors.Errorf("endpoint responded %s", res.Status)
+	if res.StatusCode == http.StatusTooManyRequests || res.StatusCode >= 500 {
+		return err
+	}
+	return &permanentError{err: err}
+}
+
+// deadLetter records the failed delivery d.
+// n.mtx must be held.
+func (n *Notifier) deadLetter(ep *endpoint, d delivery, attempts int, err error) {
+	letter := DeadLetter{
+		ID:       d.id,
+		URL:      ep.URL,
+		Event:    d.event,
+		Payload:  d.body,
+		Attempts: attempts,
+		Error:    err.Error(),
+		Time:     time.Now(),
+	}
+	n.deadLetters = append(n.deadLetters, letter)
+
+	n.logger.Error("webhook delivery failed",
+		zap.String("url", ep.URL),
+		zap.String("delivery", d.id),
+		zap.String("event", d.event),
+		zap.Int("attempts", attempts),
+		zap.Error(err))
+
+	if n.options.DeadLetterLog != nil {
+		data, _ := json.Marshal(letter)
+		if _, err := n.options.DeadLetterLog.Write(append(data, '\n')); err != nil {
+			n.logger.Error("error writing dead letter", zap.Error(err))
+		}
+	}
+}
+
+// Sign returns the HeaderSignature of body
+func Sign(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// Verify reports whether signature is the HeaderSignature of body
+func Verify(secret string, body []byte, signature string) bool {
+	return hmac.Equal([]byte(Sign(secret, body)), []byte(signature))
+}
+
+// EventName returns the name of t in payloads, e.g. job.succeeded
+func EventName(t manager.JobEventType) string {
+	return "job." + t.String()
+}
+
+// ParseEvent returns the JobEventType named name, with or without the "job."
+// prefix
+func ParseEvent(name string) (manager.JobEventType, error) {
+	for t := manager.JobQueued; t <= manager.JobCanceled; t++ {
+		if name == t.String() || name == EventName(t) {
+			return t, nil
+		}
+	}
+	return 0, errors.Errorf("unknown job event %q", name)
+}
+
+func newDelivery(event manager.JobEvent) (delivery, error) {
+	id := newDeliveryID()
+
+	info := event.Job
+	spec, err := protojson.Marshal(info.Job)
+	if err != nil {
+		return delivery{}, err
+	}
+	if len(spec) == 0 {
+		spec = []byte("null")
+	}
+
+	payload := Payload{
+		ID:    id,
+		Event: EventName(event.Type),
+		Time:  event.Time,
+		Job: Job{
+			ID:       info.Id,
+			Spec:     spec,
+			Output:   info.Job.GetDestPath(),
+			State:    info.State.String(),
+			Tenant:   info.Tenant,
+			Priority: info.Priority,
+			WorkerID: info.WorkerId,
+			Error:    info.Error,
+			Cost:     info.Cost.GetTotal(),
+		},
+	}
+	if info.Started != nil && info.Finished != nil {
+		payload.Job.Duration = info.Finished.AsTime().Sub(info.Started.AsTime()).Seconds()
+	}
+
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return delivery{}, err
+	}
+	return delivery{id: id, event: payload.Event, body: body}, nil
+}
+
+func newDeliveryID() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(b)
+}
@@ -0,0 +1,216 @@
+package webhook
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	m "github.com/launchdarkly/go-test-helpers/v2/matchers"
+	"go.uber.org/zap/zaptest"
+	"google.golang.org/protobuf/types/known/timestamppb"
+
+	"github.com/ansg191/remote-worker/api/proto"
+	"github.com/ansg191/remote-worker/internal/manager"
+)
+
+const testSecret = "secret"
+
+// receiver is a webhook endpoint recording deliveries. It responds with the
+// queued status codes, then 200.
+type receiver struct {
+	t *testing.T
+
+	mtx      sync.Mutex
+	statuses []int
+	payloads []Payload
+	attempts int
+	received chan struct{}
+}
+
+func newReceiver(t *testing.T, statuses ...int) (*receiver, *httptest.Server) {
+	r := &receiver{t: t, statuses: statuses, received: make(chan struct{}, 16)}
+	srv := httptest.NewServer(r)
+	t.Cleanup(srv.Close)
+	return r, srv
+}
+
+func (r *receiver) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	body, err := io.ReadAll(req.Body)
+	m.For(r.t, "read err").Assert(err, m.BeNil())
+	m.For(r.t, "signature").Assert(Verify(testSecret, body, req.Header.Get(HeaderSignature)), m.Equal(true))
+
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+
+	r.attempts++
+	if len(r.statuses) > 0 {
+		status := r.statuses[0]
+		r.statuses = r.statuses[1:]
+		w.WriteHeader(status)
+		return
+	}
+
+	var payload Payload
+	m.For(r.t, "decode err").Assert(json.Unmarshal(body, &payload), m.BeNil())
+	m.For(r.t, "event header").Assert(req.Header.Get(HeaderEvent), m.Equal(payload.Event))
+	r.payloads = append(r.payloads, payload)
+	r.received <- struct{}{}
+}
+
+func (r *receiver) wait(t *testing.T, n int) []Payload {
+	t.Helper()
+
+	timeout := time.After(time.Second)
+	for i := 0; i < n; i++ {
+		select {
+		case <-r.received:
+		case <-timeout:
+			t.Fatalf("received %d of %d deliveries", i, n)
+		}
+	}
+
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	return append([]Payload(nil), r.payloads...)
+}
+
+func jobEvent(t manager.JobEventType, state proto.JobInfo_State) manager.JobEvent {
+	started := time.Date(2022, 9, 1, 12, 0, 0, 0, time.UTC)
+	info := &proto.JobInfo{
+		Id:       "job",
+		Job:      &proto.Job{SourcePath: "s3://bucket/in.mkv", DestPath: "s3://bucket/out.mp4", Codec: "hevc"},
+		State:    state,
+		Tenant:   "studio",
+		WorkerId: "i-1",
+	}
+	if t != manager.JobQueued {
+		info.Started = timestamppb.New(started)
+	}
+	if state == proto.JobInfo_SUCCEEDED || state == proto.JobInfo_FAILED {
+		info.Finished = timestamppb.New(started.Add(90 * time.Second))
+	}
+	if state == proto.JobInfo_FAILED {
+		info.Error = "job failed: ffmpeg exited"
+	}
+	return manager.JobEvent{Type: t, Time: started, Job: info}
+}
+
+func TestNotifier_deliver(t *testing.T) {
+	all, allSrv := newReceiver(t)
+	finished, finishedSrv := newReceiver(t)
+
+	n := New(zaptest.NewLogger(t), []Endpoint{
+		{URL: allSrv.URL, Secret: testSecret},
+		{URL: finishedSrv.URL, Secret: testSecret, Events: []manager.JobEventType{manager.JobSucceeded, manager.JobFailed}},
+	})
+
+	n.HandleJobEvent(jobEvent(manager.JobQueued, proto.JobInfo_QUEUED))
+	n.HandleJobEvent(jobEvent(manager.JobStarted, proto.JobInfo_RUNNING))
+	n.HandleJobEvent(jobEvent(manager.JobFailed, proto.JobInfo_FAILED))
+
+	payloads := all.wait(t, 3)
+	m.For(t, "ordered").Assert(payloads[0].Event, m.Equal("job.queued"))
+	m.For(t, "started").Assert(payloads[1].Event, m.Equal("job.started"))
+
+	payloads = finished.wait(t, 1)
+	failed := payloads[0]
+	m.For(t, "event").Assert(failed.Event, m.Equal("job.failed"))
+	m.For(t, "output").Assert(failed.Job.Output, m.Equal("s3://bucket/out.mp4"))
+	m.For(t, "spec").Assert(string(failed.Job.Spec), m.Equal(`{"sourcePath":"s3://bucket/in.mkv","destPath":"s3://bucket/out.mp4","codec":"hevc"}`))
+	m.For(t, "duration").Assert(failed.Job.Duration, m.Equal(90.0))
+	m.For(t, "error").Assert(failed.Job.Error, m.Equal("job failed: ffmpeg exited"))
+	m.For(t, "worker").Assert(failed.Job.WorkerID, m.Equal("i-1"))
+	m.For(t, "state").Assert(failed.Job.State, m.Equal("FAILED"))
+
+	err := n.Close(context.Background())
+	m.For(t, "close err").Assert(err, m.BeNil())
+	m.For(t, "dead letters").Assert(n.DeadLetters(), m.Length().Should(m.Equal(0)))
+}
+
+func TestNotifier_retry(t *testing.T) {
+	r, srv := newReceiver(t, http.StatusServiceUnavailable, http.StatusTooManyRequests)
+	n := New(zaptest.NewLogger(t), []Endpoint{{URL: srv.URL, Secret: testSecret}},
+		WithRetry(3, time.Millisecond, time.Millisecond))
+
+	n.HandleJobEvent(jobEvent(manager.JobSucceeded, proto.JobInfo_SUCCEEDED))
+	payloads := r.wait(t, 1)
+	m.For(t, "event").Assert(payloads[0].Event, m.Equal("job.succeeded"))
+
+	err := n.Close(context.Background())
+	m.For(t, "close err").Assert(err, m.BeNil())
+	m.For(t, "attempts").Assert(r.attempts, m.Equal(3))
+	m.For(t, "dead letters").Assert(n.DeadLetters(), m.Length().Should(m.Equal(0)))
+}
+
+func TestNotifier_deadLetter(t *testing.T) {
+	var log bytes.Buffer
+	_, failing := newReceiver(t, http.StatusInternalServerError, http.StatusBadGateway)
+	_, rejecting := newReceiver(t, http.StatusBadRequest)
+	n := New(zaptest.NewLogger(t), []Endpoint{
+		{URL: failing.URL, Secret: testSecret},
+		{URL: rejecting.URL, Secret: testSecret},
+	}, WithRetry(2, time.Millisecond, time.Millisecond), WithDeadLetterLog(&log))
+
+	n.HandleJobEvent(jobEvent(manager.JobCanceled, proto.JobInfo_CANCELED))
+
+	err := n.Close(context.Background())
+	m.For(t, "close err").Assert(err, m.BeNil())
+
+	letters := n.DeadLetters()
+	m.For(t, "dead letters").Require(letters, m.Length().Should(m.Equal(2)))
+	byURL := map[string]DeadLetter{letters[0].URL: letters[0], letters[1].URL: letters[1]}
+
+	m.For(t, "retried attempts").Assert(byURL[failing.URL].Attempts, m.Equal(2))
+	m.For(t, "retried error").Assert(byURL[failing.URL].Error, m.Equal("endpoint responded 502 Bad Gateway"))
+	m.For(t, "rejected attempts").Assert(byURL[rejecting.URL].Attempts, m.Equal(1))
+	m.For(t, "event").Assert(byURL[rejecting.URL].Event, m.Equal("job.canceled"))
+	m.For(t, "log lines").Assert(strings.Count(log.String(), "\n"), m.Equal(2))
+}
+
+func TestNotifier_Close(t *testing.T) {
+	block := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		select {
+		case <-block:
+		case <-req.Context().Done():
+		}
+	}))
+	t.Cleanup(func() {
+		close(block)
+		srv.Close()
+	})
+
+	n := New(zaptest.NewLogger(t), []Endpoint{{URL: srv.URL}})
+	n.HandleJobEvent(jobEvent(manager.JobQueued, proto.JobInfo_QUEUED))
+	n.HandleJobEvent(jobEvent(manager.JobStarted, proto.JobInfo_RUNNING))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	err := n.Close(ctx)
+	m.For(t, "close err").Assert(err, m.Equal(context.DeadlineExceeded))
+	m.For(t, "aborted deliveries").Assert(n.DeadLetters(), m.Length().Should(m.Equal(2)))
+
+	// Events after closing are dropped
+	n.HandleJobEvent(jobEvent(manager.JobQueued, proto.JobInfo_QUEUED))
+	m.For(t, "dropped").Assert(n.DeadLetters(), m.Length().Should(m.Equal(2)))
+}
+
+func TestParseEvent(t *testing.T) {
+	event, err := ParseEvent("succeeded")
+	m.For(t, "short err").Require(err, m.BeNil())
+	m.For(t, "short").Assert(event, m.Equal(manager.JobSucceeded))
+
+	event, err = ParseEvent("job.canceled")
+	m.For(t, "prefixed err").Require(err, m.BeNil())
+	m.For(t, "prefixed").Assert(event, m.Equal(manager.JobCanceled))
+
+	_, err = ParseEvent("cancelled")
+	m.For(t, "unknown err").Assert(err, m.Not(m.BeNil()))
+}
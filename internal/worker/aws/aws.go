@@ -1,40 +1,59 @@
 package aws
 
 import (
+	"bytes"
 	"context"
 	_ "embed"
 	"encoding/base64"
 	"errors"
+	"fmt"
 	"net/netip"
+	"regexp"
+	"sync"
+	"text/template"
 	"time"
 
 	"github.com/aws/aws-sdk-go-v2/aws"
 	"github.com/aws/aws-sdk-go-v2/service/ec2"
 	"github.com/aws/aws-sdk-go-v2/service/ec2/types"
+	"github.com/aws/smithy-go"
 	"go.uber.org/zap"
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/credentials/insecure"
 
 	"github.com/ansg191/remote-worker/api/proto"
 	"github.com/ansg191/remote-worker/internal/compute"
+	"github.com/ansg191/remote-worker/internal/tracing"
 )
 
 //go:embed userdata.sh
-var userData []byte
-
-var DefaultInstanceParams = &ec2.RunInstancesInput{
-	MinCount:           aws.Int32(1),
-	MaxCount:           aws.Int32(1),
-	IamInstanceProfile: nil,
-	ImageId:            aws.String("ami-0892d3c7ee96c0bf7"),
-	InstanceMarketOptions: &types.InstanceMarketOptionsRequest{
-		MarketType:  types.MarketTypeSpot,
-		SpotOptions: nil,
-	},
-	InstanceType:     "g4dn.xlarge",
-	KeyName:          aws.String("us-west-ec2-keys"),
-	SecurityGroupIds: []string{"sg-09b52430796d9b9c5"},
-	UserData:         aws.String(base64.StdEncoding.EncodeToString(userData)),
+var userData string
+
+var userDataTemplate = template.Must(template.New("userdata").Parse(userData))
+
+// labelPattern matches the label keys and values that can be written unquoted
+// to the command line of the worker service
+var labelPattern = regexp.MustCompile(`^[A-Za-z0-9._/-]+$`)
+
+// NewUserData returns the base64 encoded user data of worker instances,
+// installing and starting the worker on port and advertising labels. Label
+// keys and values may only contain letters, digits and ._/-
+func NewUserData(port uint16, labels map[string]string) (string, error) {
+	for key, value := range labels {
+		if !labelPattern.MatchString(key) || (value != "" && !labelPattern.MatchString(value)) {
+			return "", fmt.Errorf("label %q may only contain letters, digits and ._/-", key+"="+value)
+		}
+	}
+
+	var buf bytes.Buffer
+	err := userDataTemplate.Execute(&buf, struct {
+		Port   uint16
+		Labels map[string]string
+	}{Port: port, Labels: labels})
+	if err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(buf.Bytes()), nil
 }
 
 type WorkerEC2Client interface {
@@ -48,20 +67,24 @@ type Worker struct {
 	logger *zap.Logger
 	client WorkerEC2Client
 
-	id   string
-	port uint16
-
-	addr netip.AddrPort
+	id           string
+	port         uint16
+	instanceType string
+	market       string
+	launched     time.Time
 
+	mtx    sync.Mutex // Mutex for below fields
+	addr   netip.AddrPort
 	conn   *grpc.ClientConn
 	worker proto.WorkerServiceClient
 	job    proto.JobServiceClient
-
 	closed bool
 }
 
 func (w *Worker) Close() error {
+	w.mtx.Lock()
 	if w.closed {
+		w.mtx.Unlock()
 		return compute.ErrClosed
 	}
 
@@ -74,6 +97,7 @@ func (w *Worker) Close() error {
 			w.logger.Error("error closing grpc connection")
 		}
 	}
+	w.mtx.Unlock()
 
 	_, err := w.client.TerminateInstances(context.Background(), &ec2.TerminateInstancesInput{
 		InstanceIds: []string{w.id},
@@ -90,6 +114,38 @@ func (w *Worker) Equals(other compute.Worker) bool {
 	}
 }
 
+// ID returns the EC2 instance ID of the worker
+func (w *Worker) ID() string {
+	return w.id
+}
+
+// InstanceType returns the EC2 instance type of the worker
+func (w *Worker) InstanceType() string {
+	return w.instanceType
+}
+
+// Market returns whether the worker is a spot or on-demand instance
+func (w *Worker) Market() string {
+	return w.market
+}
+
+// LaunchTime returns when the instance of the worker was launched
+func (w *Worker) LaunchTime() time.Time {
+	return w.launched
+}
+
+// Address returns the address the worker is connected to, or an empty string
+// if it has not been connected
+func (w *Worker) Address() string {
+	w.mtx.Lock()
+	defer w.mtx.Unlock()
+
+	if !w.addr.IsValid() {
+		return ""
+	}
+	return w.addr.String()
+}
+
 func (w *Worker) getIP(ctx context.Context) (netip.Addr, error) {
 	instances, err := w.client.DescribeInstances(ctx, &ec2.DescribeInstancesInput{
 		InstanceIds: []string{w.id},
@@ -110,46 +166,72 @@ func (w *Worker) getIP(ctx context.Context) (netip.Addr, error) {
 	return netip.ParseAddr(aws.ToString(instance.PublicIpAddress))
 }
 
-func (w *Worker) Connect(ctx context.Context) (err error) {
-	if w.closed {
+func (w *Worker) Connect(ctx context.Context) error {
+	if w.isClosed() {
 		return compute.ErrClosed
 	}
-	if w.conn != nil {
-		_ = w.conn.Close()
-	}
 
 	ip, err := w.getIP(ctx)
 	if err != nil {
 		return err
 	}
 
-	w.addr = netip.AddrPortFrom(ip, w.port)
+	addr := netip.AddrPortFrom(ip, w.port)
 
-	w.conn, err = grpc.DialContext(ctx, w.addr.String(),
+	dialOpts := append([]grpc.DialOption{
 		grpc.WithBlock(),
 		grpc.WithTransportCredentials(insecure.NewCredentials()),
-	)
+	}, tracing.DialOptions()...)
+
+	// The worker is not locked while dialing so that Close and the clients
+	// of the current connection aren't delayed
+	conn, err := grpc.DialContext(ctx, addr.String(), dialOpts...)
 	if err != nil {
 		return err
 	}
 
-	w.worker = proto.NewWorkerServiceClient(w.conn)
-	w.job = proto.NewJobServiceClient(w.conn)
+	w.mtx.Lock()
+	defer w.mtx.Unlock()
+	if w.closed {
+		_ = conn.Close()
+		return compute.ErrClosed
+	}
+	if w.conn != nil {
+		_ = w.conn.Close()
+	}
+
+	w.addr = addr
+	w.conn = conn
+	w.worker = proto.NewWorkerServiceClient(conn)
+	w.job = proto.NewJobServiceClient(conn)
 
 	return nil
 }
 
+func (w *Worker) isClosed() bool {
+	w.mtx.Lock()
+	defer w.mtx.Unlock()
+	return w.closed
+}
+
 func (w *Worker) Worker() proto.WorkerServiceClient {
+	w.mtx.Lock()
+	defer w.mtx.Unlock()
 	return w.worker
 }
 
 func (w *Worker) Job() proto.JobServiceClient {
+	w.mtx.Lock()
+	defer w.mtx.Unlock()
 	return w.job
 }
 
 func (w *Worker) getInstanceStatus(ctx context.Context) (types.InstanceStateName, error) {
+	// Stopped and terminated instances are only described with
+	// IncludeAllInstances, e.g. reclaimed spot instances
 	statuses, err := w.client.DescribeInstanceStatus(ctx, &ec2.DescribeInstanceStatusInput{
-		InstanceIds: []string{w.id},
+		InstanceIds:         []string{w.id},
+		IncludeAllInstances: aws.Bool(true),
 	})
 	if err != nil {
 		return types.InstanceStateNamePending, err
@@ -168,7 +250,7 @@ func (w *Worker) getInstanceStatus(ctx context.Context) (types.InstanceStateName
 }
 
 func (w *Worker) IsReady(ctx context.Context, opts ...compute.ReadyOptionsFunc) (bool, error) {
-	if w.closed {
+	if w.isClosed() {
 		return false, compute.ErrClosed
 	}
 
@@ -177,8 +259,13 @@ func (w *Worker) IsReady(ctx context.Context, opts ...compute.ReadyOptionsFunc)
 		return false, err
 	}
 
-	if status != types.InstanceStateNameRunning {
+	switch status {
+	case types.InstanceStateNameRunning:
+	case types.InstanceStateNamePending:
 		return false, nil
+	default:
+		// The instance will never be ready
+		return false, errors.New("instance " + string(status))
 	}
 
 	options := &compute.ReadyOptions{
@@ -263,8 +350,40 @@ func NewWorkerFactory(logger *zap.Logger, client WorkerEC2Client, input *ec2.Run
 	}
 }
 
+// capacityErrorCodes are the codes of EC2 errors caused by a lack of capacity
+// for the instance. Account quotas, e.g. VcpuLimitExceeded, aren't included so
+// that they surface instead of being masked by a fallback factory.
+var capacityErrorCodes = map[string]bool{
+	"InsufficientInstanceCapacity": true,
+	"InsufficientHostCapacity":     true,
+	"MaxSpotInstanceCountExceeded": true,
+	"SpotMaxPriceTooLow":           true,
+}
+
+// CapacityError is returned by WorkerFactory.Create when EC2 has no capacity
+// for the instance. It wraps the EC2 error and is compute.ErrInsufficientCapacity.
+type CapacityError struct {
+	Err error
+}
+
+func (e *CapacityError) Error() string {
+	return "insufficient capacity: " + e.Err.Error()
+}
+
+func (e *CapacityError) Unwrap() error {
+	return e.Err
+}
+
+func (e *CapacityError) Is(target error) bool {
+	return target == compute.ErrInsufficientCapacity
+}
+
 func (f *WorkerFactory) Create(ctx context.Context) (compute.Worker, error) {
 	instances, err := f.client.RunInstances(ctx, f.params)
+	var apiErr smithy.APIError
+	if errors.As(err, &apiErr) && capacityErrorCodes[apiErr.ErrorCode()] {
+		return nil, &CapacityError{Err: err}
+	}
 	if err != nil {
 		return nil, err
 	}
@@ -273,12 +392,76 @@ func (f *WorkerFactory) Create(ctx context.Context) (compute.Worker, error) {
 		return nil, errors.New("no instances found")
 	}
 
-	instance := instances.Instances[0]
+	return f.newWorker(instances.Instances[0]), nil
+}
+
+// newWorker returns the Worker of instance
+func (f *WorkerFactory) newWorker(instance types.Instance) *Worker {
+	market := compute.MarketOnDemand
+	if instance.InstanceLifecycle == types.InstanceLifecycleTypeSpot {
+		market = compute.MarketSpot
+	}
+
+	launched := time.Now()
+	if instance.LaunchTime != nil {
+		launched = *instance.LaunchTime
+	}
 
 	return &Worker{
-		logger: f.logger,
-		client: f.client,
-		id:     aws.ToString(instance.InstanceId),
-		port:   f.port,
-	}, nil
+		logger:       f.logger,
+		client:       f.client,
+		id:           aws.ToString(instance.InstanceId),
+		port:         f.port,
+		instanceType: string(instance.InstanceType),
+		market:       market,
+		launched:     launched,
+	}
+}
+
+// Attach creates a Worker for an existing instance, e.g. one left over from a
+// previous manager run. Stopped instances are terminated, as they can't be
+// used without being started again.
+func (f *WorkerFactory) Attach(ctx context.Context, id string) (compute.Worker, error) {
+	instances, err := f.client.DescribeInstances(ctx, &ec2.DescribeInstancesInput{
+		InstanceIds: []string{id},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if len(instances.Reservations) < 1 || len(instances.Reservations[0].Instances) < 1 {
+		return nil, errors.New("instance not found")
+	}
+
+	instance := instances.Reservations[0].Instances[0]
+
+	var state types.InstanceStateName
+	if instance.State != nil {
+		state = instance.State.Name
+	}
+
+	switch state {
+	case types.InstanceStateNamePending, types.InstanceStateNameRunning:
+		return f.newWorker(instance), nil
+	case types.InstanceStateNameStopping, types.InstanceStateNameStopped:
+		if err = f.Terminate(ctx, id); err != nil {
+			return nil, err
+		}
+		return nil, errors.New("instance stopped")
+	default:
+		return nil, errors.New("instance terminated")
+	}
+}
+
+// Terminate terminates instance id. Instances that don't exist anymore are
+// not an error.
+func (f *WorkerFactory) Terminate(ctx context.Context, id string) error {
+	_, err := f.client.TerminateInstances(ctx, &ec2.TerminateInstancesInput{
+		InstanceIds: []string{id},
+	})
+	var apiErr smithy.APIError
+	if errors.As(err, &apiErr) && apiErr.ErrorCode() == "InvalidInstanceID.NotFound" {
+		return nil
+	}
+	return err
 }
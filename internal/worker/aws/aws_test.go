@@ -2,14 +2,17 @@ package aws
 
 import (
 	"context"
+	"encoding/base64"
 	"errors"
 	"net"
+	"strings"
 	"testing"
 	"time"
 
 	"github.com/aws/aws-sdk-go-v2/aws"
 	"github.com/aws/aws-sdk-go-v2/service/ec2"
 	"github.com/aws/aws-sdk-go-v2/service/ec2/types"
+	"github.com/aws/smithy-go"
 	"github.com/golang/mock/gomock"
 	m "github.com/launchdarkly/go-test-helpers/v2/matchers"
 	"go.uber.org/zap/zaptest"
@@ -19,6 +22,13 @@ import (
 	"github.com/ansg191/remote-worker/internal/compute"
 )
 
+var testParams = &ec2.RunInstancesInput{
+	MinCount:     aws.Int32(1),
+	MaxCount:     aws.Int32(1),
+	ImageId:      aws.String("ami-test"),
+	InstanceType: types.InstanceTypeG4dnXlarge,
+}
+
 func grpcServer(t *testing.T) (*net.TCPAddr, *grpc.Server) {
 	t.Helper()
 
@@ -37,6 +47,20 @@ func grpcServer(t *testing.T) (*net.TCPAddr, *grpc.Server) {
 	return l.Addr().(*net.TCPAddr), gsrv
 }
 
+func TestNewUserData(t *testing.T) {
+	encoded, err := NewUserData(8443, map[string]string{"tier": "gpu", "spot": ""})
+	m.For(t, "err").Require(err, m.BeNil())
+	data, err := base64.StdEncoding.DecodeString(encoded)
+	m.For(t, "decode err").Require(err, m.BeNil())
+	m.For(t, "command line").Assert(strings.Contains(string(data),
+		"ExecStart=/go_encoder_worker -p 8443 -tmp /data -label spot= -label tier=gpu\n"), m.Equal(true))
+
+	_, err = NewUserData(8443, map[string]string{"tier": "gpu; reboot"})
+	m.For(t, "invalid value").Assert(err, m.Not(m.BeNil()))
+	_, err = NewUserData(8443, map[string]string{"$(reboot)": ""})
+	m.For(t, "invalid key").Assert(err, m.Not(m.BeNil()))
+}
+
 func TestNewWorkerFactory(t *testing.T) {
 	logger := zaptest.NewLogger(t)
 
@@ -47,12 +71,12 @@ func TestNewWorkerFactory(t *testing.T) {
 
 	mClient := NewMockWorkerEC2Client(ctrl)
 
-	factoryI := NewWorkerFactory(logger, mClient, DefaultInstanceParams, 443)
+	factoryI := NewWorkerFactory(logger, mClient, testParams, 443)
 
 	factory := factoryI.(*WorkerFactory)
 
 	m.For(t, "factory").For("input").
-		Assert(factory.params, m.Equal(DefaultInstanceParams))
+		Assert(factory.params, m.Equal(testParams))
 	m.For(t, "factory").For("port").Assert(factory.port, m.Equal(uint16(443)))
 }
 
@@ -69,10 +93,15 @@ func TestWorkerFactory_Create(t *testing.T) {
 		mClient.EXPECT().
 			RunInstances(gomock.Any(), gomock.Any(), gomock.Any()).
 			Return(&ec2.RunInstancesOutput{
-				Instances: []types.Instance{{InstanceId: aws.String("i-123456")}},
+				Instances: []types.Instance{{
+					InstanceId:        aws.String("i-123456"),
+					InstanceType:      types.InstanceTypeG4dnXlarge,
+					InstanceLifecycle: types.InstanceLifecycleTypeSpot,
+					LaunchTime:        aws.Time(time.Date(2022, 9, 1, 12, 0, 0, 0, time.UTC)),
+				}},
 			}, nil)
 
-		factory := NewWorkerFactory(logger, mClient, DefaultInstanceParams, 443)
+		factory := NewWorkerFactory(logger, mClient, testParams, 443)
 
 		workerI, err := factory.Create(context.Background())
 
@@ -83,6 +112,9 @@ func TestWorkerFactory_Create(t *testing.T) {
 		m.For(t, "worker").For("client").Assert(worker.client, m.Equal(mClient))
 		m.For(t, "worker").For("id").Assert(worker.id, m.Equal("i-123456"))
 		m.For(t, "worker").For("port").Assert(worker.port, m.Equal(uint16(443)))
+		m.For(t, "worker").For("instance type").Assert(worker.InstanceType(), m.Equal("g4dn.xlarge"))
+		m.For(t, "worker").For("market").Assert(worker.Market(), m.Equal(compute.MarketSpot))
+		m.For(t, "worker").For("launched").Assert(worker.LaunchTime(), m.Equal(time.Date(2022, 9, 1, 12, 0, 0, 0, time.UTC)))
 	})
 
 	t.Run("error", func(t *testing.T) {
@@ -93,7 +125,7 @@ func TestWorkerFactory_Create(t *testing.T) {
 			RunInstances(gomock.Any(), gomock.Any(), gomock.Any()).
 			Return(nil, expectedErr)
 
-		factory := NewWorkerFactory(logger, mClient, DefaultInstanceParams, 443)
+		factory := NewWorkerFactory(logger, mClient, testParams, 443)
 
 		workerI, err := factory.Create(context.Background())
 
@@ -101,6 +133,35 @@ func TestWorkerFactory_Create(t *testing.T) {
 		m.For(t, "worker").Assert(workerI, m.BeNil())
 	})
 
+	t.Run("insufficient capacity", func(t *testing.T) {
+		mClient := NewMockWorkerEC2Client(ctrl)
+		mClient.EXPECT().
+			RunInstances(gomock.Any(), gomock.Any(), gomock.Any()).
+			Return(nil, &smithy.GenericAPIError{Code: "InsufficientInstanceCapacity"})
+
+		factory := NewWorkerFactory(logger, mClient, testParams, 443)
+
+		_, err := factory.Create(context.Background())
+
+		m.For(t, "capacity err").Assert(errors.Is(err, compute.ErrInsufficientCapacity), m.Equal(true))
+		var apiErr smithy.APIError
+		m.For(t, "api err").Require(errors.As(err, &apiErr), m.Equal(true))
+		m.For(t, "api err code").Assert(apiErr.ErrorCode(), m.Equal("InsufficientInstanceCapacity"))
+	})
+
+	t.Run("quota exceeded", func(t *testing.T) {
+		mClient := NewMockWorkerEC2Client(ctrl)
+		mClient.EXPECT().
+			RunInstances(gomock.Any(), gomock.Any(), gomock.Any()).
+			Return(nil, &smithy.GenericAPIError{Code: "VcpuLimitExceeded"})
+
+		factory := NewWorkerFactory(logger, mClient, testParams, 443)
+
+		_, err := factory.Create(context.Background())
+
+		m.For(t, "quota err").Assert(errors.Is(err, compute.ErrInsufficientCapacity), m.Equal(false))
+	})
+
 	t.Run("no instance returned", func(t *testing.T) {
 		mClient := NewMockWorkerEC2Client(ctrl)
 		mClient.EXPECT().
@@ -109,7 +170,7 @@ func TestWorkerFactory_Create(t *testing.T) {
 				Instances: []types.Instance{},
 			}, nil)
 
-		factory := NewWorkerFactory(logger, mClient, DefaultInstanceParams, 443)
+		factory := NewWorkerFactory(logger, mClient, testParams, 443)
 
 		workerI, err := factory.Create(context.Background())
 
@@ -118,6 +179,100 @@ func TestWorkerFactory_Create(t *testing.T) {
 	})
 }
 
+func TestWorkerFactory_Attach(t *testing.T) {
+	logger := zaptest.NewLogger(t)
+
+	ctrl := gomock.NewController(t)
+	t.Cleanup(func() {
+		ctrl.Finish()
+	})
+
+	describe := func(state types.InstanceStateName) *ec2.DescribeInstancesOutput {
+		return &ec2.DescribeInstancesOutput{
+			Reservations: []types.Reservation{
+				{Instances: []types.Instance{{
+					InstanceId: aws.String("i-123456"),
+					State:      &types.InstanceState{Name: state},
+				}}},
+			},
+		}
+	}
+
+	t.Run("running instance", func(t *testing.T) {
+		mClient := NewMockWorkerEC2Client(ctrl)
+		mClient.EXPECT().
+			DescribeInstances(gomock.Any(), gomock.Any(), gomock.Any()).
+			Return(describe(types.InstanceStateNameRunning), nil)
+
+		factory := NewWorkerFactory(logger, mClient, testParams, 443).(*WorkerFactory)
+
+		workerI, err := factory.Attach(context.Background(), "i-123456")
+		m.For(t, "attach err").Require(err, m.BeNil())
+
+		worker := workerI.(*Worker)
+		m.For(t, "worker").For("id").Assert(worker.ID(), m.Equal("i-123456"))
+		m.For(t, "worker").For("port").Assert(worker.port, m.Equal(uint16(443)))
+		m.For(t, "worker").For("market").Assert(worker.Market(), m.Equal(compute.MarketOnDemand))
+	})
+
+	t.Run("stopped instance", func(t *testing.T) {
+		mClient := NewMockWorkerEC2Client(ctrl)
+		mClient.EXPECT().
+			DescribeInstances(gomock.Any(), gomock.Any(), gomock.Any()).
+			Return(describe(types.InstanceStateNameStopped), nil)
+		mClient.EXPECT().
+			TerminateInstances(gomock.Any(), gomock.Any(), gomock.Any()).
+			Return(nil, nil)
+
+		factory := NewWorkerFactory(logger, mClient, testParams, 443).(*WorkerFactory)
+
+		workerI, err := factory.Attach(context.Background(), "i-123456")
+		m.For(t, "attach err").Assert(err, m.Not(m.BeNil()))
+		m.For(t, "worker").Assert(workerI, m.BeNil())
+	})
+
+	t.Run("terminated instance", func(t *testing.T) {
+		mClient := NewMockWorkerEC2Client(ctrl)
+		mClient.EXPECT().
+			DescribeInstances(gomock.Any(), gomock.Any(), gomock.Any()).
+			Return(describe(types.InstanceStateNameTerminated), nil)
+
+		factory := NewWorkerFactory(logger, mClient, testParams, 443).(*WorkerFactory)
+
+		workerI, err := factory.Attach(context.Background(), "i-123456")
+		m.For(t, "attach err").Assert(err, m.Not(m.BeNil()))
+		m.For(t, "worker").Assert(workerI, m.BeNil())
+	})
+}
+
+func TestWorkerFactory_Terminate(t *testing.T) {
+	logger := zaptest.NewLogger(t)
+
+	ctrl := gomock.NewController(t)
+	t.Cleanup(func() {
+		ctrl.Finish()
+	})
+
+	mClient := NewMockWorkerEC2Client(ctrl)
+	gomock.InOrder(
+		mClient.EXPECT().
+			TerminateInstances(gomock.Any(), gomock.Eq(&ec2.TerminateInstancesInput{InstanceIds: []string{"i-123456"}}), gomock.Any()).
+			Return(&ec2.TerminateInstancesOutput{}, nil),
+		mClient.EXPECT().
+			TerminateInstances(gomock.Any(), gomock.Any(), gomock.Any()).
+			Return(nil, &smithy.GenericAPIError{Code: "InvalidInstanceID.NotFound"}),
+		mClient.EXPECT().
+			TerminateInstances(gomock.Any(), gomock.Any(), gomock.Any()).
+			Return(nil, &smithy.GenericAPIError{Code: "RequestLimitExceeded"}),
+	)
+
+	factory := NewWorkerFactory(logger, mClient, testParams, 443).(*WorkerFactory)
+
+	m.For(t, "terminated").Assert(factory.Terminate(context.Background(), "i-123456"), m.BeNil())
+	m.For(t, "not found").Assert(factory.Terminate(context.Background(), "i-123456"), m.BeNil())
+	m.For(t, "failed").Assert(factory.Terminate(context.Background(), "i-123456"), m.Not(m.BeNil()))
+}
+
 func TestWorker_Close(t *testing.T) {
 	logger := zaptest.NewLogger(t)
 
@@ -292,8 +447,11 @@ func TestWorker_Connect(t *testing.T) {
 			port:   port,
 		}
 
+		m.For(t, "address before connect").Assert(worker.Address(), m.Equal(""))
+
 		err := worker.Connect(context.Background())
 		m.For(t, "err").Assert(err, m.BeNil())
+		m.For(t, "address").Assert(worker.Address(), m.Equal(addr.String()))
 	})
 
 	t.Run("double connect", func(t *testing.T) {
@@ -323,6 +481,39 @@ func TestWorker_Connect(t *testing.T) {
 		m.For(t, "err").Assert(err, m.BeNil())
 	})
 
+	t.Run("concurrent address", func(t *testing.T) {
+		mClient := NewMockWorkerEC2Client(ctrl)
+		mClient.EXPECT().
+			DescribeInstances(gomock.Any(), gomock.Any(), gomock.Any()).
+			Return(&ec2.DescribeInstancesOutput{
+				Reservations: []types.Reservation{
+					{Instances: []types.Instance{{
+						PublicIpAddress: aws.String(ip.String()),
+					}}},
+				},
+			}, nil)
+
+		worker := &Worker{
+			logger: logger,
+			client: mClient,
+			id:     "id",
+			port:   port,
+		}
+
+		// Addresses are read, e.g. by the dashboard, while the worker is
+		// connected by the queue
+		connected := make(chan error, 1)
+		go func() {
+			connected <- worker.Connect(context.Background())
+		}()
+		for len(connected) == 0 {
+			_ = worker.Address()
+			_ = worker.Worker()
+		}
+		m.For(t, "err").Assert(<-connected, m.BeNil())
+		m.For(t, "address").Assert(worker.Address(), m.Equal(addr.String()))
+	})
+
 	t.Run("connect to closed", func(t *testing.T) {
 		mClient := NewMockWorkerEC2Client(ctrl)
 		mClient.EXPECT().
@@ -483,6 +674,33 @@ func TestWorker_IsReady(t *testing.T) {
 		m.For(t, "ready").Assert(ready, m.Equal(false))
 	})
 
+	t.Run("terminated status", func(t *testing.T) {
+		mClient := NewMockWorkerEC2Client(ctrl)
+		mClient.EXPECT().
+			DescribeInstanceStatus(gomock.Any(), gomock.Any(), gomock.Any()).
+			DoAndReturn(func(ctx context.Context, params *ec2.DescribeInstanceStatusInput, optFns ...func(*ec2.Options)) (*ec2.DescribeInstanceStatusOutput, error) {
+				m.For(t, "include all").Assert(aws.ToBool(params.IncludeAllInstances), m.Equal(true))
+				return &ec2.DescribeInstanceStatusOutput{
+					InstanceStatuses: []types.InstanceStatus{{
+						InstanceState: &types.InstanceState{
+							Name: types.InstanceStateNameTerminated,
+						},
+					}},
+				}, nil
+			})
+
+		worker := &Worker{
+			logger: logger,
+			client: mClient,
+			id:     "id",
+			port:   port,
+		}
+
+		ready, err := worker.IsReady(context.Background())
+		m.For(t, "err").Assert(err, m.Not(m.BeNil()))
+		m.For(t, "ready").Assert(ready, m.Equal(false))
+	})
+
 	t.Run("status error", func(t *testing.T) {
 		expectedErr := errors.New("something bad happened")
 
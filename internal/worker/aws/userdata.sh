@@ -21,7 +21,7 @@ After=syslog.target network.target
 User=root
 Type=simple
 
-ExecStart=/go_encoder_worker -p 443 -tmp /data
+ExecStart=/go_encoder_worker -p {{ .Port }} -tmp /data{{ range $key, $value := .Labels }} -label {{ $key }}={{ $value }}{{ end }}
 TimeoutStopSec=20
 KillMode=process
 Restart=on-failure
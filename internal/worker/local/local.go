@@ -0,0 +1,350 @@
+// Package local runs workers on the local machine, listening on a free
+// localhost port with their own temporary directory. Workers are either
+// processes of the worker binary or in-process gRPC servers, so that the
+// manager can be run and tested without EC2.
+package local
+
+import (
+	"context"
+	"net"
+	"os"
+	"os/exec"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+
+	"github.com/ansg191/remote-worker/api/proto"
+	"github.com/ansg191/remote-worker/internal/compute"
+	"github.com/ansg191/remote-worker/internal/tracing"
+)
+
+// ErrExited is returned by Worker.IsReady once the worker stopped serving
+// without being closed
+var ErrExited = errors.New("worker exited")
+
+// RegisterFunc registers the services of an in-process worker on server.
+// dir is the temporary directory of the worker.
+type RegisterFunc func(server *grpc.Server, dir string)
+
+type Worker struct {
+	logger *zap.Logger
+
+	addr string
+	dir  string
+
+	// stop stops serving. It is called once, by Close.
+	stop func()
+	done chan struct{} // Closed once the worker stopped serving
+	err  error         // Why the worker stopped serving, set before done is closed
+
+	mtx    sync.Mutex // Mutex for below fields
+	conn   *grpc.ClientConn
+	worker proto.WorkerServiceClient
+	job    proto.JobServiceClient
+	closed bool
+}
+
+func (w *Worker) Close() error {
+	w.mtx.Lock()
+	if w.closed {
+		w.mtx.Unlock()
+		return compute.ErrClosed
+	}
+	w.closed = true
+
+	if w.conn != nil {
+		err := w.conn.Close()
+		w.conn = nil
+		if err != nil {
+			w.logger.Error("error closing grpc connection", zap.Error(err))
+		}
+	}
+	w.mtx.Unlock()
+
+	w.stop()
+	<-w.done
+
+	return os.RemoveAll(w.dir)
+}
+
+func (w *Worker) Equals(other compute.Worker) bool {
+	switch v := other.(type) {
+	case *Worker:
+		return w == v
+	default:
+		return false
+	}
+}
+
+// Address returns the localhost address the worker listens on
+func (w *Worker) Address() string {
+	return w.addr
+}
+
+// Dir returns the temporary directory of the worker
+func (w *Worker) Dir() string {
+	return w.dir
+}
+
+// exited returns an error if the worker stopped serving
+func (w *Worker) exited() error {
+	select {
+	case <-w.done:
+		if w.err != nil {
+			return errors.Wrap(ErrExited, w.err.Error())
+		}
+		return ErrExited
+	default:
+		return nil
+	}
+}
+
+func (w *Worker) Connect(ctx context.Context) error {
+	w.mtx.Lock()
+	closed := w.closed
+	w.mtx.Unlock()
+	if closed {
+		return compute.ErrClosed
+	}
+
+	dialOpts := append([]grpc.DialOption{
+		grpc.WithBlock(),
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+	}, tracing.DialOptions()...)
+
+	// The worker is not locked while dialing so that Close isn't delayed
+	conn, err := grpc.DialContext(ctx, w.addr, dialOpts...)
+	if err != nil {
+		return err
+	}
+
+	w.mtx.Lock()
+	defer w.mtx.Unlock()
+	if w.closed {
+		_ = conn.Close()
+		return compute.ErrClosed
+	}
+	if w.conn != nil {
+		_ = w.conn.Close()
+	}
+
+	w.conn = conn
+	w.worker = proto.NewWorkerServiceClient(conn)
+	w.job = proto.NewJobServiceClient(conn)
+
+	return nil
+}
+
+func (w *Worker) Worker() proto.WorkerServiceClient {
+	w.mtx.Lock()
+	defer w.mtx.Unlock()
+	return w.worker
+}
+
+func (w *Worker) Job() proto.JobServiceClient {
+	w.mtx.Lock()
+	defer w.mtx.Unlock()
+	return w.job
+}
+
+// IsReady dials the worker. It returns ErrExited if the worker stopped
+// serving.
+func (w *Worker) IsReady(ctx context.Context, opts ...compute.ReadyOptionsFunc) (bool, error) {
+	w.mtx.Lock()
+	closed := w.closed
+	w.mtx.Unlock()
+	if closed {
+		return false, compute.ErrClosed
+	}
+	if err := w.exited(); err != nil {
+		return false, err
+	}
+
+	options := &compute.ReadyOptions{
+		ConnTimeout: time.Second,
+	}
+
+	for _, opt := range opts {
+		opt(options)
+	}
+
+	connCtx, cancel := context.WithTimeout(ctx, options.ConnTimeout)
+	defer cancel()
+
+	err := w.Connect(connCtx)
+
+	if err == context.DeadlineExceeded {
+		// The worker may have exited while being dialed
+		return false, w.exited()
+	}
+	if err != nil {
+		return false, err
+	}
+
+	return true, nil
+}
+
+func (w *Worker) IsReadyChan(ctx context.Context, opts ...compute.ReadyOptionsFunc) <-chan error {
+	ch := make(chan error, 1)
+
+	options := &compute.ReadyOptions{
+		TickerInterval: 100 * time.Millisecond,
+		ConnTimeout:    time.Second,
+	}
+
+	for _, opt := range opts {
+		opt(options)
+	}
+
+	ticker := time.NewTicker(options.TickerInterval)
+	go func() {
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				ch <- ctx.Err()
+				return
+			case <-ticker.C:
+				isReady, err := w.IsReady(ctx, opts...)
+				if err != nil {
+					ch <- err
+					return
+				}
+
+				if isReady {
+					ch <- nil
+					return
+				}
+			}
+		}
+	}()
+
+	return ch
+}
+
+// WorkerFactory creates workers on the local machine
+type WorkerFactory struct {
+	logger  *zap.Logger
+	options Options
+
+	// start starts serving on a listener of a free localhost port, with dir
+	// as the temporary directory. It returns the function stopping the
+	// worker and waiting for it.
+	start func(lis net.Listener, dir string) (stop func(), wait func() error, err error)
+}
+
+// NewWorkerFactory returns a factory starting a process of the worker binary
+// at path for every worker. Workers are killed with the processes they started
+// when closed.
+func NewWorkerFactory(logger *zap.Logger, path string, opts ...OptionsFunc) compute.WorkerFactory {
+	f := newWorkerFactory(logger, opts)
+	f.start = func(lis net.Listener, dir string) (func(), func() error, error) {
+		host, port, err := net.SplitHostPort(lis.Addr().String())
+		if err != nil {
+			return nil, nil, err
+		}
+		// The worker binary listens itself, so the port is released right
+		// before it starts
+		if err = lis.Close(); err != nil {
+			return nil, nil, err
+		}
+
+		args := append([]string{"-host", host, "-p", port, "-tmp", dir}, f.options.Args...)
+		cmd := exec.Command(path, args...)
+		cmd.Stdout = f.options.Output
+		cmd.Stderr = f.options.Output
+		setProcessGroup(cmd)
+		if err = cmd.Start(); err != nil {
+			return nil, nil, err
+		}
+
+		f.logger.Debug("Started worker process",
+			zap.Int("pid", cmd.Process.Pid),
+			zap.String("addr", lis.Addr().String()))
+
+		stop := func() {
+			_ = killProcessGroup(cmd)
+		}
+		return stop, cmd.Wait, nil
+	}
+	return f
+}
+
+// NewServerFactory returns a factory serving the services registered by
+// register on an in-process gRPC server for every worker. Servers are stopped
+// when their worker is closed.
+func NewServerFactory(logger *zap.Logger, register RegisterFunc, opts ...OptionsFunc) compute.WorkerFactory {
+	f := newWorkerFactory(logger, opts)
+	f.start = func(lis net.Listener, dir string) (func(), func() error, error) {
+		server := grpc.NewServer(tracing.ServerOptions()...)
+		register(server, dir)
+
+		served := make(chan error, 1)
+		go func() {
+			served <- server.Serve(lis)
+		}()
+
+		wait := func() error {
+			return <-served
+		}
+		return server.Stop, wait, nil
+	}
+	return f
+}
+
+func newWorkerFactory(logger *zap.Logger, opts []OptionsFunc) *WorkerFactory {
+	options := Options{}
+
+	for _, opt := range opts {
+		opt(&options)
+	}
+
+	return &WorkerFactory{
+		logger:  logger,
+		options: options,
+	}
+}
+
+// Create starts a worker unless ctx is done. The worker isn't bound to ctx, it
+// runs until closed.
+func (f *WorkerFactory) Create(ctx context.Context) (compute.Worker, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	dir, err := os.MkdirTemp(f.options.TempDir, "remote-worker-")
+	if err != nil {
+		return nil, err
+	}
+
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		_ = os.RemoveAll(dir)
+		return nil, err
+	}
+
+	stop, wait, err := f.start(lis, dir)
+	if err != nil {
+		_ = lis.Close()
+		_ = os.RemoveAll(dir)
+		return nil, err
+	}
+
+	w := &Worker{
+		logger: f.logger,
+		addr:   lis.Addr().String(),
+		dir:    dir,
+		stop:   stop,
+		done:   make(chan struct{}),
+	}
+	go func() {
+		w.err = wait()
+		close(w.done)
+	}()
+
+	return w, nil
+}
@@ -0,0 +1,214 @@
+package local
+
+import (
+	"context"
+	"flag"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+	"time"
+
+	m "github.com/launchdarkly/go-test-helpers/v2/matchers"
+	"github.com/pkg/errors"
+	"go.uber.org/zap/zaptest"
+	"google.golang.org/grpc"
+
+	"github.com/ansg191/remote-worker/api/proto"
+	"github.com/ansg191/remote-worker/internal/compute"
+)
+
+// helperEnv makes the test binary act as a worker binary: it serves
+// statusServer if set to "serve", also starting a child process sleeping if set
+// to "spawn", and exits with an error if set to "exit"
+const helperEnv = "LOCAL_WORKER_HELPER"
+
+func TestMain(main *testing.M) {
+	switch os.Getenv(helperEnv) {
+	case "serve":
+		serveHelper()
+		return
+	case "spawn":
+		child := exec.Command(os.Args[0])
+		child.Env = append(os.Environ(), helperEnv+"=sleep")
+		child.Stdout = os.Stdout
+		child.Stderr = os.Stderr
+		if err := child.Start(); err != nil {
+			os.Exit(1)
+		}
+		serveHelper()
+		return
+	case "sleep":
+		time.Sleep(time.Minute)
+		return
+	case "exit":
+		os.Exit(3)
+	}
+	os.Exit(main.Run())
+}
+
+// serveHelper serves statusServer with the flags of the worker binary
+func serveHelper() {
+	flags := flag.NewFlagSet("worker", flag.ExitOnError)
+	host := flags.String("host", "0.0.0.0", "")
+	port := flags.String("p", "8000", "")
+	tempPath := flags.String("tmp", "/tmp", "")
+	label := flags.String("label", "", "")
+	_ = flags.Parse(os.Args[1:])
+
+	lis, err := net.Listen("tcp", net.JoinHostPort(*host, *port))
+	if err != nil {
+		os.Exit(1)
+	}
+
+	server := grpc.NewServer()
+	proto.RegisterWorkerServiceServer(server, &statusServer{msg: *tempPath + " " + *label})
+	_ = server.Serve(lis)
+}
+
+// statusServer replies msg to WorkerService.Status
+type statusServer struct {
+	proto.UnimplementedWorkerServiceServer
+	msg string
+}
+
+func (s *statusServer) Status(context.Context, *proto.WorkerStatusRequest) (*proto.WorkerStatusResponse, error) {
+	return &proto.WorkerStatusResponse{Msg: s.msg}, nil
+}
+
+// waitReady waits for worker to be ready
+func waitReady(t *testing.T, worker compute.Worker) error {
+	t.Helper()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	return <-worker.IsReadyChan(ctx, compute.WithTickerInterval(10*time.Millisecond))
+}
+
+func TestNewServerFactory(t *testing.T) {
+	tempDir := t.TempDir()
+	factory := NewServerFactory(zaptest.NewLogger(t), func(server *grpc.Server, dir string) {
+		proto.RegisterWorkerServiceServer(server, &statusServer{msg: dir})
+	}, WithTempDir(tempDir))
+
+	worker, err := factory.Create(context.Background())
+	m.For(t, "create err").Require(err, m.BeNil())
+	m.For(t, "ready").Require(waitReady(t, worker), m.BeNil())
+
+	w := worker.(*Worker)
+	m.For(t, "dir").Assert(filepath.Dir(w.Dir()), m.Equal(tempDir))
+	host, _, err := net.SplitHostPort(w.Address())
+	m.For(t, "address err").Require(err, m.BeNil())
+	m.For(t, "host").Assert(host, m.Equal("127.0.0.1"))
+
+	res, err := worker.Worker().Status(context.Background(), &proto.WorkerStatusRequest{})
+	m.For(t, "status err").Require(err, m.BeNil())
+	m.For(t, "status").Assert(res.GetMsg(), m.Equal(w.Dir()))
+
+	other, err := factory.Create(context.Background())
+	m.For(t, "other err").Require(err, m.BeNil())
+	m.For(t, "equals").Assert(worker.Equals(worker), m.Equal(true))
+	m.For(t, "not equals").Assert(worker.Equals(other), m.Equal(false))
+	m.For(t, "other address").Assert(other.(*Worker).Address(), m.Not(m.Equal(w.Address())))
+	m.For(t, "other close").Require(other.Close(), m.BeNil())
+
+	m.For(t, "close").Require(worker.Close(), m.BeNil())
+	_, err = os.Stat(w.Dir())
+	m.For(t, "dir removed").Assert(os.IsNotExist(err), m.Equal(true))
+
+	m.For(t, "close again").Assert(worker.Close(), m.Equal(compute.ErrClosed))
+	_, err = worker.IsReady(context.Background())
+	m.For(t, "ready after close").Assert(err, m.Equal(compute.ErrClosed))
+	m.For(t, "connect after close").Assert(worker.Connect(context.Background()), m.Equal(compute.ErrClosed))
+}
+
+func TestNewWorkerFactory(t *testing.T) {
+	t.Setenv(helperEnv, "serve")
+
+	tempDir := t.TempDir()
+	factory := NewWorkerFactory(zaptest.NewLogger(t), os.Args[0],
+		WithTempDir(tempDir),
+		WithArgs("-label", "tier=local"))
+
+	worker, err := factory.Create(context.Background())
+	m.For(t, "create err").Require(err, m.BeNil())
+	m.For(t, "ready").Require(waitReady(t, worker), m.BeNil())
+
+	w := worker.(*Worker)
+	res, err := worker.Worker().Status(context.Background(), &proto.WorkerStatusRequest{})
+	m.For(t, "status err").Require(err, m.BeNil())
+	m.For(t, "args").Assert(res.GetMsg(), m.Equal(w.Dir()+" tier=local"))
+
+	m.For(t, "close").Require(worker.Close(), m.BeNil())
+	_, err = os.Stat(w.Dir())
+	m.For(t, "dir removed").Assert(os.IsNotExist(err), m.Equal(true))
+
+	// The process is killed
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	_, err = worker.Worker().Status(ctx, &proto.WorkerStatusRequest{})
+	m.For(t, "killed").Assert(err, m.Not(m.BeNil()))
+}
+
+func TestNewWorkerFactory_exited(t *testing.T) {
+	t.Setenv(helperEnv, "exit")
+
+	factory := NewWorkerFactory(zaptest.NewLogger(t), os.Args[0], WithTempDir(t.TempDir()))
+
+	worker, err := factory.Create(context.Background())
+	m.For(t, "create err").Require(err, m.BeNil())
+
+	err = waitReady(t, worker)
+	m.For(t, "exited").Assert(errors.Is(err, ErrExited), m.Equal(true))
+	m.For(t, "close").Assert(worker.Close(), m.BeNil())
+}
+
+func TestNewWorkerFactory_missingBinary(t *testing.T) {
+	tempDir := t.TempDir()
+	factory := NewWorkerFactory(zaptest.NewLogger(t), filepath.Join(tempDir, "worker"), WithTempDir(tempDir))
+
+	_, err := factory.Create(context.Background())
+	m.For(t, "create err").Assert(err, m.Not(m.BeNil()))
+
+	entries, err := os.ReadDir(tempDir)
+	m.For(t, "read err").Require(err, m.BeNil())
+	m.For(t, "dir removed").Assert(entries, m.Length().Should(m.Equal(0)))
+}
+
+func TestWorkerFactory_Create_canceled(t *testing.T) {
+	tempDir := t.TempDir()
+	factory := NewServerFactory(zaptest.NewLogger(t), func(*grpc.Server, string) {}, WithTempDir(tempDir))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err := factory.Create(ctx)
+	m.For(t, "create err").Assert(err, m.Equal(context.Canceled))
+
+	entries, err := os.ReadDir(tempDir)
+	m.For(t, "read err").Require(err, m.BeNil())
+	m.For(t, "no dir").Assert(entries, m.Length().Should(m.Equal(0)))
+}
+
+func TestWorkerFactory_pool(t *testing.T) {
+	factory := NewServerFactory(zaptest.NewLogger(t), func(server *grpc.Server, dir string) {
+		proto.RegisterWorkerServiceServer(server, &statusServer{msg: "OK"})
+	})
+	pool := compute.NewPool(zaptest.NewLogger(t), factory)
+	t.Cleanup(func() {
+		_ = pool.Close()
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	worker, err := pool.GetWorker(ctx)
+	m.For(t, "get err").Require(err, m.BeNil())
+	// Work queues wait for workers to be ready
+	m.For(t, "ready").Require(waitReady(t, worker), m.BeNil())
+	res, err := worker.Worker().Status(ctx, &proto.WorkerStatusRequest{})
+	m.For(t, "status err").Require(err, m.BeNil())
+	m.For(t, "status").Assert(res.GetMsg(), m.Equal("OK"))
+	pool.ReturnWorker(worker)
+}
@@ -0,0 +1,37 @@
+package local
+
+import (
+	"io"
+)
+
+type Options struct {
+	// Args are passed to the worker binary in addition to its address and
+	// temporary directory, e.g. -label flags
+	Args []string
+	// TempDir is the directory the temporary directories of workers are
+	// created in. Defaults to os.TempDir.
+	TempDir string
+	// Output receives the stdout and stderr of worker processes. Discarded if
+	// nil.
+	Output io.Writer
+}
+
+type OptionsFunc func(options *Options)
+
+func WithArgs(args ...string) OptionsFunc {
+	return func(opts *Options) {
+		opts.Args = append(opts.Args, args...)
+	}
+}
+
+func WithTempDir(dir string) OptionsFunc {
+	return func(opts *Options) {
+		opts.TempDir = dir
+	}
+}
+
+func WithOutput(w io.Writer) OptionsFunc {
+	return func(opts *Options) {
+		opts.Output = w
+	}
+}
@@ -0,0 +1,16 @@
+//go:build !linux && !darwin
+
+package local
+
+import (
+	"os/exec"
+)
+
+// setProcessGroup is a no-op, process groups are not supported
+func setProcessGroup(*exec.Cmd) {}
+
+// killProcessGroup kills the process of cmd only, process groups are not
+// supported
+func killProcessGroup(cmd *exec.Cmd) error {
+	return cmd.Process.Kill()
+}
@@ -0,0 +1,40 @@
+//go:build linux || darwin
+
+package local
+
+import (
+	"context"
+	"io"
+	"os"
+	"testing"
+	"time"
+
+	m "github.com/launchdarkly/go-test-helpers/v2/matchers"
+	"go.uber.org/zap/zaptest"
+)
+
+func TestNewWorkerFactory_processGroup(t *testing.T) {
+	t.Setenv(helperEnv, "spawn")
+
+	// The output of the worker is copied until the child process sharing it
+	// exited too
+	factory := NewWorkerFactory(zaptest.NewLogger(t), os.Args[0],
+		WithTempDir(t.TempDir()),
+		WithOutput(io.Discard))
+
+	worker, err := factory.Create(context.Background())
+	m.For(t, "create err").Require(err, m.BeNil())
+	m.For(t, "ready").Require(waitReady(t, worker), m.BeNil())
+
+	closed := make(chan error, 1)
+	go func() {
+		closed <- worker.Close()
+	}()
+
+	select {
+	case err = <-closed:
+		m.For(t, "close").Assert(err, m.BeNil())
+	case <-time.After(10 * time.Second):
+		t.Fatal("child process of the worker not killed")
+	}
+}
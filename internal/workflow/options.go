@@ -0,0 +1,33 @@
+package workflow
+
+type StepOptions struct {
+	// Priority of the step's work in the WorkQueue
+	Priority int
+	// Tenant of the step's work in the WorkQueue
+	Tenant string
+	// SkipOnDependencyFailure skips the step instead of failing it when a
+	// dependency fails or is skipped.
+	SkipOnDependencyFailure bool
+}
+
+type StepOptionsFunc func(options *StepOptions)
+
+func WithPriority(priority int) StepOptionsFunc {
+	return func(opts *StepOptions) {
+		opts.Priority = priority
+	}
+}
+
+func WithTenant(tenant string) StepOptionsFunc {
+	return func(opts *StepOptions) {
+		opts.Tenant = tenant
+	}
+}
+
+// SkipOnDependencyFailure skips the step when a dependency fails or is
+// skipped. By default the step fails with a DependencyError.
+func SkipOnDependencyFailure() StepOptionsFunc {
+	return func(opts *StepOptions) {
+		opts.SkipOnDependencyFailure = true
+	}
+}
@@ -0,0 +1,341 @@
+package workflow
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
+
+	"github.com/ansg191/remote-worker/internal/compute"
+)
+
+var (
+	// ErrSkipped is the error of a step skipped because a dependency did not
+	// succeed.
+	ErrSkipped = errors.New("step skipped")
+)
+
+// State of a step in a Workflow
+type State int
+
+const (
+	Pending State = iota
+	Running
+	Succeeded
+	Failed
+	Skipped
+)
+
+func (s State) String() string {
+	switch s {
+	case Pending:
+		return "pending"
+	case Running:
+		return "running"
+	case Succeeded:
+		return "succeeded"
+	case Failed:
+		return "failed"
+	case Skipped:
+		return "skipped"
+	default:
+		return "unknown"
+	}
+}
+
+// StepError is the error of a failed step
+type StepError struct {
+	Step string
+	Err  error
+}
+
+func (e *StepError) Error() string {
+	return fmt.Sprintf("step %s: %v", e.Step, e.Err)
+}
+
+func (e *StepError) Unwrap() error {
+	return e.Err
+}
+
+// DependencyError is the error of a step that failed because one of its
+// dependencies did not succeed.
+type DependencyError struct {
+	Dependency string
+	Err        error
+}
+
+func (e *DependencyError) Error() string {
+	return fmt.Sprintf("dependency %s: %v", e.Dependency, e.Err)
+}
+
+func (e *DependencyError) Unwrap() error {
+	return e.Err
+}
+
+// RequestFunc builds the request of a step once all of its dependencies have
+// succeeded. It typically reads the results of the dependencies.
+type RequestFunc[T any] func(ctx context.Context) (T, error)
+
+// Dependency is a step other steps can depend on
+type Dependency interface {
+	step() *node
+}
+
+// Workflow runs work on a compute.WorkQueue in dependency order. Steps are
+// added with Add and start as soon as all of their dependencies succeeded.
+// Since dependencies must be added before their dependents, a Workflow can't
+// contain cycles.
+type Workflow struct {
+	logger *zap.Logger
+	queue  compute.WorkQueue
+
+	mtx     sync.Mutex
+	nodes   []*node
+	names   map[string]bool
+	started bool
+}
+
+type node struct {
+	wf      *Workflow // Workflow the step was added to
+	name    string
+	deps    []*node
+	options StepOptions
+
+	// submit builds the request and adds the work to the queue. It returns
+	// once the work finished, or cancels it once ctx is done.
+	submit func(ctx context.Context) (any, error)
+
+	mtx    sync.Mutex
+	state  State
+	result any
+	err    error
+	done   chan struct{} // Closed once the step finished
+}
+
+func New(logger *zap.Logger, queue compute.WorkQueue) *Workflow {
+	return &Workflow{
+		logger: logger,
+		queue:  queue,
+		names:  make(map[string]bool),
+	}
+}
+
+// Step is a step of a Workflow producing a result of type U
+type Step[U any] struct {
+	node *node
+}
+
+// Add adds a step named name to wf. Once all deps succeeded, req builds its
+// request and run is queued with it. Add panics if name is already used, a
+// dependency was added to another Workflow or wf was already run.
+func Add[T, U any](wf *Workflow, name string, deps []Dependency, req RequestFunc[T], run compute.WorkRunFunc[T, U], opts ...StepOptionsFunc) *Step[U] {
+	var options StepOptions
+	for _, opt := range opts {
+		opt(&options)
+	}
+
+	n := &node{
+		wf:      wf,
+		name:    name,
+		options: options,
+		done:    make(chan struct{}),
+	}
+	for _, dep := range deps {
+		n.deps = append(n.deps, dep.step())
+	}
+
+	n.submit = func(ctx context.Context) (any, error) {
+		request, err := req(ctx)
+		if err != nil {
+			return nil, err
+		}
+
+		work := compute.NewWorkInfo(ctx, request, run)
+		work.Priority = options.Priority
+		work.Tenant = options.Tenant
+
+		id := wf.queue.Add(work)
+
+		select {
+		case res := <-work.Result:
+			return res, nil
+		case err := <-work.Err:
+			return nil, err
+		case <-ctx.Done():
+			if err := wf.queue.Cancel(id); err != nil && err != compute.ErrWorkNotFound {
+				wf.logger.Warn("error canceling step", zap.String("step", name), zap.Error(err))
+			}
+			return nil, ctx.Err()
+		}
+	}
+
+	wf.mtx.Lock()
+	defer wf.mtx.Unlock()
+
+	if wf.started {
+		panic("workflow: step added after Run")
+	}
+	if wf.names[name] {
+		panic(fmt.Sprintf("workflow: step %q added twice", name))
+	}
+	for _, dep := range n.deps {
+		if dep.wf != wf {
+			panic(fmt.Sprintf("workflow: step %q depends on step %q of another workflow", name, dep.name))
+		}
+	}
+	wf.names[name] = true
+	wf.nodes = append(wf.nodes, n)
+
+	return &Step[U]{node: n}
+}
+
+// Run runs all steps and waits for them to finish. It returns the StepError of
+// the first failed step in the order steps were added, or nil if no step
+// failed. Skipped steps are not failures. Once ctx is done, the work of running
+// steps is canceled and the steps fail. A Workflow can only be run once.
+func (wf *Workflow) Run(ctx context.Context) error {
+	wf.mtx.Lock()
+	if wf.started {
+		wf.mtx.Unlock()
+		return errors.New("workflow already run")
+	}
+	wf.started = true
+	nodes := wf.nodes
+	wf.mtx.Unlock()
+
+	var wg sync.WaitGroup
+	for _, n := range nodes {
+		wg.Add(1)
+		go func(n *node) {
+			defer wg.Done()
+			wf.runNode(ctx, n)
+		}(n)
+	}
+	wg.Wait()
+
+	for _, n := range nodes {
+		if state, err := n.status(); state == Failed {
+			return &StepError{Step: n.name, Err: err}
+		}
+	}
+	return nil
+}
+
+func (wf *Workflow) runNode(ctx context.Context, n *node) {
+	defer close(n.done)
+
+	for _, dep := range n.deps {
+		<-dep.done
+	}
+
+	for _, dep := range n.deps {
+		state, err := dep.status()
+		if state == Succeeded {
+			continue
+		}
+
+		if n.options.SkipOnDependencyFailure {
+			wf.logger.Info("Skipping step", zap.String("step", n.name), zap.String("dependency", dep.name))
+			n.finish(Skipped, nil, ErrSkipped)
+			return
+		}
+
+		wf.logger.Info("Failing step after dependency failure", zap.String("step", n.name), zap.String("dependency", dep.name))
+		n.finish(Failed, nil, &DependencyError{Dependency: dep.name, Err: err})
+		return
+	}
+
+	if err := ctx.Err(); err != nil {
+		n.finish(Failed, nil, err)
+		return
+	}
+
+	wf.logger.Debug("Starting step", zap.String("step", n.name))
+	n.setState(Running)
+
+	result, err := n.submit(ctx)
+	if err != nil {
+		wf.logger.Warn("Step failed", zap.String("step", n.name), zap.Error(err))
+		n.finish(Failed, nil, err)
+		return
+	}
+
+	wf.logger.Debug("Step succeeded", zap.String("step", n.name))
+	n.finish(Succeeded, result, nil)
+}
+
+func (n *node) setState(state State) {
+	n.mtx.Lock()
+	n.state = state
+	n.mtx.Unlock()
+}
+
+func (n *node) finish(state State, result any, err error) {
+	n.mtx.Lock()
+	n.state = state
+	n.result = result
+	n.err = err
+	n.mtx.Unlock()
+}
+
+func (n *node) status() (State, error) {
+	n.mtx.Lock()
+	defer n.mtx.Unlock()
+	return n.state, n.err
+}
+
+func (s *Step[U]) step() *node {
+	return s.node
+}
+
+// Name returns the name of the step
+func (s *Step[U]) Name() string {
+	return s.node.name
+}
+
+// State returns the current state of the step
+func (s *Step[U]) State() State {
+	state, _ := s.node.status()
+	return state
+}
+
+// Err returns the error of a failed or skipped step
+func (s *Step[U]) Err() error {
+	_, err := s.node.status()
+	return err
+}
+
+// Result returns the result of a succeeded step, or the zero value otherwise.
+// It is safe to call from the RequestFunc of a dependent step.
+func (s *Step[U]) Result() U {
+	s.node.mtx.Lock()
+	defer s.node.mtx.Unlock()
+
+	result, _ := s.node.result.(U)
+	return result
+}
+
+// Done returns a channel that is closed once the step finished
+func (s *Step[U]) Done() <-chan struct{} {
+	return s.node.done
+}
+
+// All returns steps as dependencies, e.g. to fan in a fan-out
+func All[U any](steps []*Step[U]) []Dependency {
+	deps := make([]Dependency, len(steps))
+	for i, s := range steps {
+		deps[i] = s
+	}
+	return deps
+}
+
+// Results returns the results of steps in order
+func Results[U any](steps []*Step[U]) []U {
+	results := make([]U, len(steps))
+	for i, s := range steps {
+		results[i] = s.Result()
+	}
+	return results
+}
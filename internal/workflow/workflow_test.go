@@ -0,0 +1,213 @@
+package workflow
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/golang/mock/gomock"
+	m "github.com/launchdarkly/go-test-helpers/v2/matchers"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zaptest"
+
+	"github.com/ansg191/remote-worker/internal/compute"
+)
+
+func newQueue(t *testing.T) compute.WorkQueue {
+	t.Helper()
+
+	ctrl := gomock.NewController(t)
+	t.Cleanup(func() {
+		ctrl.Finish()
+	})
+
+	mWorker := compute.NewMockWorker(ctrl)
+	mWorker.EXPECT().
+		IsReadyChan(gomock.Any(), gomock.Any()).
+		DoAndReturn(func(ctx context.Context, opts ...func(options *compute.ReadyOptions)) <-chan error {
+			ch := make(chan error, 1)
+			ch <- nil
+			return ch
+		}).
+		AnyTimes()
+	mWorker.EXPECT().
+		Connect(gomock.Any()).
+		Return(nil).
+		AnyTimes()
+	mWorker.EXPECT().
+		Equals(gomock.Any()).
+		Return(true).
+		AnyTimes()
+
+	mPool := compute.NewMockPool(ctrl)
+	mPool.EXPECT().
+		GetWorker(gomock.Any()).
+		Return(mWorker, nil).
+		AnyTimes()
+	mPool.EXPECT().
+		ReturnWorker(gomock.Any()).
+		AnyTimes()
+
+	return compute.NewQueue(zaptest.NewLogger(t), mPool, 4)
+}
+
+func TestWorkflow_FanOutFanIn(t *testing.T) {
+	wf := New(zaptest.NewLogger(t), newQueue(t))
+
+	probe := Add(wf, "probe", nil,
+		func(ctx context.Context) (string, error) {
+			return "input.mkv", nil
+		},
+		func(ctx context.Context, logger *zap.Logger, req string, worker compute.Worker) (int, error) {
+			return 3, nil // Number of audio tracks
+		})
+
+	var encodes []*Step[string]
+	for _, rendition := range []string{"1080p", "720p", "480p"} {
+		rendition := rendition
+		encodes = append(encodes, Add(wf, "encode-"+rendition, []Dependency{probe},
+			func(ctx context.Context) (string, error) {
+				return fmt.Sprintf("%s:%d", rendition, probe.Result()), nil
+			},
+			func(ctx context.Context, logger *zap.Logger, req string, worker compute.Worker) (string, error) {
+				return req + ".mp4", nil
+			}))
+	}
+
+	pkg := Add(wf, "package", All(encodes),
+		func(ctx context.Context) ([]string, error) {
+			return Results(encodes), nil
+		},
+		func(ctx context.Context, logger *zap.Logger, req []string, worker compute.Worker) (string, error) {
+			return strings.Join(req, ","), nil
+		})
+
+	err := wf.Run(context.Background())
+	m.For(t, "run err").Require(err, m.BeNil())
+
+	m.For(t, "state").Assert(pkg.State(), m.Equal(Succeeded))
+	m.For(t, "result").Assert(pkg.Result(), m.Equal("1080p:3.mp4,720p:3.mp4,480p:3.mp4"))
+
+	err = wf.Run(context.Background())
+	m.For(t, "run twice err").Assert(err, m.Not(m.BeNil()))
+}
+
+func TestWorkflow_DependencyFailure(t *testing.T) {
+	wf := New(zaptest.NewLogger(t), newQueue(t))
+
+	expectedErr := errors.New("encode failed")
+
+	noop := func(ctx context.Context) (string, error) {
+		return "", nil
+	}
+	succeed := func(ctx context.Context, logger *zap.Logger, req string, worker compute.Worker) (string, error) {
+		return "ok", nil
+	}
+
+	encode := Add(wf, "encode", nil, noop,
+		func(ctx context.Context, logger *zap.Logger, req string, worker compute.Worker) (string, error) {
+			return "", expectedErr
+		})
+	verify := Add(wf, "verify", []Dependency{encode}, noop, succeed)
+	publish := Add(wf, "publish", []Dependency{verify}, noop, succeed)
+	thumbnail := Add(wf, "thumbnail", []Dependency{encode}, noop, succeed, SkipOnDependencyFailure())
+	unrelated := Add(wf, "unrelated", nil, noop, succeed)
+
+	err := wf.Run(context.Background())
+
+	var stepErr *StepError
+	m.For(t, "run err").Require(errors.As(err, &stepErr), m.Equal(true))
+	m.For(t, "failed step").Assert(stepErr.Step, m.Equal("encode"))
+	m.For(t, "cause").Assert(errors.Is(err, expectedErr), m.Equal(true))
+
+	m.For(t, "encode").Assert(encode.State(), m.Equal(Failed))
+
+	m.For(t, "verify").Assert(verify.State(), m.Equal(Failed))
+	var depErr *DependencyError
+	m.For(t, "verify err").Require(errors.As(verify.Err(), &depErr), m.Equal(true))
+	m.For(t, "verify dependency").Assert(depErr.Dependency, m.Equal("encode"))
+
+	m.For(t, "publish").Assert(publish.State(), m.Equal(Failed))
+	m.For(t, "publish cause").Assert(errors.Is(publish.Err(), expectedErr), m.Equal(true))
+
+	m.For(t, "thumbnail").Assert(thumbnail.State(), m.Equal(Skipped))
+	m.For(t, "thumbnail err").Assert(thumbnail.Err(), m.Equal(ErrSkipped))
+
+	m.For(t, "unrelated").Assert(unrelated.State(), m.Equal(Succeeded))
+}
+
+func TestWorkflow_Run_canceled(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	t.Cleanup(func() {
+		ctrl.Finish()
+	})
+
+	// The queue is paused, so the work stays queued
+	queue := compute.NewQueue(zaptest.NewLogger(t), compute.NewMockPool(ctrl), 4)
+	queue.Pause()
+	wf := New(zaptest.NewLogger(t), queue)
+
+	noop := func(ctx context.Context) (string, error) { return "", nil }
+	succeed := func(ctx context.Context, logger *zap.Logger, req string, worker compute.Worker) (string, error) {
+		return "ok", nil
+	}
+	encode := Add(wf, "encode", nil, noop, succeed)
+	publish := Add(wf, "publish", []Dependency{encode}, noop, succeed)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() {
+		done <- wf.Run(ctx)
+	}()
+	deadline := time.Now().Add(time.Second)
+	for len(queue.TenantStats()) == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("step not queued")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	cancel()
+
+	var err error
+	select {
+	case err = <-done:
+	case <-time.After(time.Second):
+		t.Fatal("canceled workflow still running")
+	}
+
+	var stepErr *StepError
+	m.For(t, "run err").Require(errors.As(err, &stepErr), m.Equal(true))
+	m.For(t, "failed step").Assert(stepErr.Step, m.Equal("encode"))
+	m.For(t, "cause").Assert(errors.Is(err, context.Canceled), m.Equal(true))
+	m.For(t, "publish").Assert(publish.State(), m.Equal(Failed))
+	m.For(t, "queued work").Assert(queue.TenantStats(), m.Length().Should(m.Equal(0)))
+}
+
+func TestAdd_duplicate(t *testing.T) {
+	wf := New(zap.NewNop(), nil)
+
+	noop := func(ctx context.Context) (string, error) { return "", nil }
+	Add[string, string](wf, "step", nil, noop, nil)
+
+	defer func() {
+		m.For(t, "panic").Assert(recover(), m.Not(m.BeNil()))
+	}()
+	Add[string, string](wf, "step", nil, noop, nil)
+}
+
+func TestAdd_foreignDependency(t *testing.T) {
+	wf := New(zap.NewNop(), nil)
+	other := New(zap.NewNop(), nil)
+
+	noop := func(ctx context.Context) (string, error) { return "", nil }
+	dep := Add[string, string](other, "dep", nil, noop, nil)
+
+	defer func() {
+		m.For(t, "panic").Assert(recover(), m.Not(m.BeNil()))
+		m.For(t, "steps").Assert(wf.nodes, m.Length().Should(m.Equal(0)))
+	}()
+	Add[string, string](wf, "step", []Dependency{dep}, noop, nil)
+}